@@ -110,6 +110,13 @@ func (txn *Txn) DebugName() string {
 	return txn.Proto.Name
 }
 
+// Priority returns the transaction's current priority. It is zero until the
+// transaction's first request has been sent, and may be raised when the
+// transaction restarts after losing a conflict.
+func (txn *Txn) Priority() int32 {
+	return txn.Proto.Priority
+}
+
 // SetIsolation sets the transaction's isolation type. Transactions default to
 // serializable isolation. The isolation must be set before any operations are
 // performed on the transaction.
@@ -65,6 +65,11 @@ type ZoneConfig struct {
 	// If GC policy is not set, uses the next highest, non-null policy
 	// in the zone config hierarchy, up to the default policy if necessary.
 	GC *GCPolicy `protobuf:"bytes,4,opt,name=gc" json:"gc,omitempty" yaml:"gc,omitempty"`
+	// MinDistinctNodes is the minimum number of distinct nodes the replicas of
+	// each range in the zone must span. A range spanning fewer nodes is
+	// considered under-replicated. Zero imposes no constraint beyond the
+	// replica count.
+	MinDistinctNodes int32 `protobuf:"varint,5,opt,name=min_distinct_nodes" json:"min_distinct_nodes" yaml:"min_distinct_nodes,omitempty"`
 }
 
 func (m *ZoneConfig) Reset()         { *m = ZoneConfig{} }
@@ -99,6 +104,13 @@ func (m *ZoneConfig) GetGC() *GCPolicy {
 	return nil
 }
 
+func (m *ZoneConfig) GetMinDistinctNodes() int32 {
+	if m != nil {
+		return m.MinDistinctNodes
+	}
+	return 0
+}
+
 type SystemConfig struct {
 	Values []cockroach_proto1.KeyValue `protobuf:"bytes,1,rep,name=values" json:"values"`
 }
@@ -178,6 +190,9 @@ func (m *ZoneConfig) MarshalTo(data []byte) (int, error) {
 		}
 		i += n1
 	}
+	data[i] = 0x28
+	i++
+	i = encodeVarintConfig(data, i, uint64(m.MinDistinctNodes))
 	return i, nil
 }
 
@@ -260,6 +275,7 @@ func (m *ZoneConfig) Size() (n int) {
 		l = m.GC.Size()
 		n += 1 + l + sovConfig(uint64(l))
 	}
+	n += 1 + sovConfig(uint64(m.MinDistinctNodes))
 	return n
 }
 
@@ -488,6 +504,25 @@ func (m *ZoneConfig) Unmarshal(data []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinDistinctNodes", wireType)
+			}
+			m.MinDistinctNodes = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowConfig
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.MinDistinctNodes |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipConfig(data[iNdEx:])
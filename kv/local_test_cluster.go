@@ -19,6 +19,7 @@ package kv
 
 import (
 	"net"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -48,6 +49,11 @@ import (
 // in that it doesn't use a distributed sender and doesn't start a
 // server node. There is no RPC traffic.
 type LocalTestCluster struct {
+	// MaxOffset is the maximum clock offset configured on the cluster's
+	// clock. It defaults to zero, under which transactions never encounter
+	// uncertainty restarts. Set it before calling Start to simulate clock
+	// skew between nodes.
+	MaxOffset   time.Duration
 	Manual      *hlc.ManualClock
 	Clock       *hlc.Clock
 	Gossip      *gossip.Gossip
@@ -72,6 +78,7 @@ func (ltc *LocalTestCluster) Start(t util.Tester) {
 	ltc.tester = t
 	ltc.Manual = hlc.NewManualClock(0)
 	ltc.Clock = hlc.NewClock(ltc.Manual.UnixNano)
+	ltc.Clock.SetMaxOffset(ltc.MaxOffset)
 	ltc.Stopper = stop.NewStopper()
 	rpcContext := rpc.NewContext(testutils.NewNodeTestBaseContext(), ltc.Clock, ltc.Stopper)
 	ltc.Gossip = gossip.New(rpcContext, gossip.TestInterval, gossip.TestBootstrap)
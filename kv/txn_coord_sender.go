@@ -566,7 +566,7 @@ func (tc *TxnCoordSender) heartbeatLoop(id string) {
 		tc.Lock()
 		txnMeta := tc.txns[id] // do not leak to outer scope
 		closer = txnMeta.txnEnd
-		trace = tc.tracer.NewTrace(&txnMeta.txn)
+		trace = tc.tracer.NewTrace(proto.NamedTransaction{Transaction: &txnMeta.txn})
 		tc.Unlock()
 	}
 	if closer == nil {
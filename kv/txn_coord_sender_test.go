@@ -59,7 +59,14 @@ func teardownHeartbeats(tc *TxnCoordSender) {
 // createTestDB creates a local test server and starts it. The caller
 // is responsible for stopping the test server.
 func createTestDB(t testing.TB) *LocalTestCluster {
-	s := &LocalTestCluster{}
+	return createTestDBWithMaxOffset(t, 0)
+}
+
+// createTestDBWithMaxOffset creates a test DB whose clock is configured
+// with the specified maximum offset, widening the uncertainty interval
+// of all transactions.
+func createTestDBWithMaxOffset(t testing.TB, maxOffset time.Duration) *LocalTestCluster {
+	s := &LocalTestCluster{MaxOffset: maxOffset}
 	s.Start(t)
 	return s
 }
@@ -19,37 +19,107 @@ package kv
 
 import (
 	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"math"
+	"os"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/keys"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/testutils"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/leaktest"
 	"github.com/cockroachdb/cockroach/util/log"
 	"github.com/cockroachdb/cockroach/util/retry"
+	"golang.org/x/net/context"
 )
 
+var correctnessJSON = flag.String("txn-correctness-json", "",
+	"if set, a JSON summary of each anomaly run is appended to this file")
+
+var correctnessPlan = flag.Bool("txn-correctness-plan", false,
+	"if set, the anomaly tests print every (priority, isolation, history) tuple they would verify instead of running them")
+
+var correctnessFailFast = flag.Bool("txn-correctness-fail-fast", false,
+	"if set, the anomaly tests stop at the first failing (priority, isolation, history) tuple; "+
+		"may also be enabled by setting COCKROACH_TXN_CORRECTNESS_FAIL_FAST=1")
+
+// failFastEnabled returns whether the anomaly tests should stop at the
+// first failure, as requested by flag or environment variable.
+func failFastEnabled() bool {
+	return *correctnessFailFast || os.Getenv("COCKROACH_TXN_CORRECTNESS_FAIL_FAST") == "1"
+}
+
+var correctnessStrictPriority = flag.Bool("txn-correctness-strict-priority", false,
+	"if set, the lost update and write skew tests also verify that write/write conflicts are resolved "+
+		"in favor of the higher priority txn")
+
+var correctnessAnomaly = flag.String("txn-correctness-anomaly", "",
+	"if set, TestTxnDBAnomaly runs only the named anomaly, e.g. \"lost update\"; see anomalies")
+
+var correctnessIso = flag.String("txn-correctness-iso", "",
+	"if set, the anomaly tests only verify tuples with these comma separated isolations, "+
+		"one per txn, e.g. SERIALIZABLE,SNAPSHOT")
+
+var correctnessPri = flag.String("txn-correctness-pri", "",
+	"if set, the anomaly tests only verify tuples with these comma separated priorities, "+
+		"one per txn, e.g. 2,1")
+
+var correctnessCheckAborted = flag.Bool("txn-correctness-check-aborted", false,
+	"if set, the anomaly tests also verify that no value written by a txn which didn't commit "+
+		"is visible once each history completes")
+
+var correctnessTxnBudget = flag.Duration("txn-correctness-txn-budget", 0,
+	"if set, the anomaly tests flag, without failing, every txn which takes longer than this to run; "+
+		"the number of such txns is included in each anomaly's summary")
+
+var correctnessCheckSerializable = flag.Bool("txn-correctness-check-serializable", false,
+	"if set, the anomaly tests also verify that the dependency graph of every history run entirely "+
+		"at SERIALIZABLE isolation is acyclic; see checkSerializable")
+
+var correctnessRepeat = flag.Int("txn-correctness-repeat", 1,
+	"number of times checkConcurrency verifies each anomaly, each time against a fresh database, "+
+		"to shake out failures which only occur under rare interleavings")
+
+var correctnessCmdTimes = flag.Bool("txn-correctness-cmd-times", false,
+	"if set, the anomaly tests print the total time spent executing each type of command "+
+		"once each anomaly has been verified")
+
+var correctnessMaxOffset = flag.Duration("txn-correctness-max-offset", 0,
+	"simulated maximum clock offset of the test server used by the anomaly tests")
+
+var correctnessMaxRetries = flag.Int("txn-correctness-max-retries", 2,
+	"maximum number of times a txn of the anomaly tests is retried after backing off; a txn which "+
+		"exhausts its retries is counted separately from incorrect histories in each anomaly's summary, "+
+		"but still fails the anomaly")
+
 // setCorrectnessRetryOptions sets client for aggressive retries with a
 // limit on number of attempts so we don't get stuck behind indefinite
 // backoff/retry loops. If MaxAttempts is reached, transaction will
-// return retry error.
-func setCorrectnessRetryOptions(lSender *LocalSender) {
+// return retry error, which runTxn reports as a retryExhaustedError.
+func setCorrectnessRetryOptions(s *LocalTestCluster) {
 	client.DefaultTxnRetryOptions = retry.Options{
 		InitialBackoff: 1 * time.Millisecond,
 		MaxBackoff:     50 * time.Millisecond,
 		Multiplier:     10,
-		MaxRetries:     2,
+		MaxRetries:     *correctnessMaxRetries,
 	}
+	// The DB copies the txn retry options when it's created.
+	s.DB = client.NewDB(s.Sender)
 
-	if err := lSender.VisitStores(func(s *storage.Store) error {
+	if err := s.localSender.VisitStores(func(s *storage.Store) error {
 		s.SetRangeRetryOptions(client.DefaultTxnRetryOptions)
 		return nil
 	}); err != nil {
@@ -69,16 +139,183 @@ func setCorrectnessRetryOptions(lSender *LocalSender) {
 // enforce an ordering. If a previous wait channel is set, the
 // command waits on it before execution.
 type cmd struct {
-	name        string // name of the cmd for debug output
-	key, endKey string // key and optional endKey
-	debug       string // optional debug string
-	txnIdx      int    // transaction index in the history
-	historyIdx  int    // this suffixes key so tests get unique keys
+	name        string     // name of the cmd for debug output
+	key, endKey string     // key and optional endKey
+	spans       []span     // optional additional spans for multi-span commands
+	toKey       string     // optional destination key for transfers and counts
+	amount      int64      // optional amount for transfers, expected value for conditional deletes or limit
+	value       *int64     // optional value written by W, given as "x=n"
+	debug       string     // optional debug string
+	txnIdx      int        // transaction index in the history
+	priority    int32      // planned priority of the transaction
+	attempt     int        // attempt of the transaction, starting at 1
+	historyIdx  int        // this suffixes key so tests get unique keys
+	db          *client.DB // for commands issued outside the txn
 	fn          func(
 		c *cmd, txn *client.Txn, t *testing.T) error // execution function
-	ch   chan struct{}    // channel for other commands to wait
-	prev <-chan struct{}  // channel this command must wait on before executing
-	env  map[string]int64 // contains all previously read values
+	// nonTxnFn, if set, executes the command directly against c.db
+	// instead of within a txn.
+	nonTxnFn func(c *cmd, db *client.DB, t *testing.T) error
+	// eng, if set, is the engine underlying c.db, which is inspected
+	// directly by commands which examine intents.
+	eng engine.Engine
+	// cluster, if set, is the test cluster underlying c.db, whose clock
+	// and senders are used by commands which manage txn records.
+	cluster *LocalTestCluster
+	// txnOwner, if set, returns the index of the history's txn with the
+	// given ID, or -1 if no txn of the history has that ID.
+	txnOwner func(id []byte) int
+	// expRetry is set if the command's txn is expected to retry whenever
+	// it overlaps another such txn. See retryPrefix.
+	expRetry bool
+	ch       chan struct{}    // channel for other commands to wait
+	prev     <-chan struct{}  // channel this command must wait on before executing
+	env      map[string]int64 // contains all previously read values
+	// conflictTag, if set, names the command's expected conflict with
+	// the one other command of the history carrying the same tag. See
+	// conflictSep.
+	conflictTag string
+	// savepoints tracks the savepoints of the command's transaction.
+	savepoints *savepoints
+	// scanned holds the rows returned by the first RSC command of the
+	// command's transaction attempt on each span, for comparison with
+	// later RSC commands on the span.
+	scanned map[span]map[string]int64
+	// written holds the keys, as stored in the db, written by the
+	// command's transaction attempt.
+	written map[string]struct{}
+	// recordCommit, if set, is invoked with the commit timestamp of the
+	// command's transaction by commitCmd.
+	recordCommit func(txnIdx int, ts proto.Timestamp)
+	// recordWrite, if set, is invoked with each value written by the
+	// command's transaction.
+	recordWrite func(txnIdx int, key string, value int64)
+	// recordRead, if set, is invoked with each value read by the
+	// command's transaction and the value's MVCC timestamp.
+	recordRead func(txnIdx int, key string, value int64, ts proto.Timestamp)
+	// recordScan, if set, is invoked with each span [key, endKey) scanned
+	// by the command's transaction. A read of an absent key is recorded
+	// as a scan of just that key.
+	recordScan func(txnIdx int, key, endKey string)
+	// recordDuration, if set, is invoked with the time taken to execute
+	// the command.
+	recordDuration func(name string, d time.Duration)
+	// fault, if set, is returned in place of executing the command the
+	// first time the command is reached in each history.
+	fault      error
+	faultFired bool
+	// plannedIdx is the position of the command in the planned history.
+	plannedIdx int
+	// restarted is set if the command is planned to run on its txn's
+	// second attempt, and reached if it was already reached on the
+	// first, so that its fault doesn't fire again. See restartHistories.
+	restarted, reached bool
+}
+
+// injectedError is a transient error injected into a command to
+// simulate e.g. an RPC timeout. It requests an immediate restart of
+// the transaction.
+type injectedError struct {
+	msg string
+}
+
+func (e *injectedError) Error() string {
+	return e.msg
+}
+
+// CanRestartTransaction implements the proto.TransactionRestartError
+// interface.
+func (e *injectedError) CanRestartTransaction() proto.TransactionRestart {
+	return proto.TransactionRestart_IMMEDIATE
+}
+
+// Transaction implements the proto.TransactionRestartError interface.
+func (e *injectedError) Transaction() *proto.Transaction {
+	return nil
+}
+
+// retryExhaustedError is returned by runTxn when a txn gave up after
+// exhausting its retries. Under heavy contention this is expected, and
+// unlike a history which produced an incorrect result, it doesn't
+// indicate a bug.
+type retryExhaustedError struct {
+	txnIdx   int
+	attempts int
+	cause    error
+}
+
+func (e *retryExhaustedError) Error() string {
+	return fmt.Sprintf("txn%d exhausted its retries after %d attempt(s): %s", e.txnIdx, e.attempts, e.cause)
+}
+
+// isRetryExhausted returns whether err, returned by a txn's closure,
+// requested a restart which the client declined to make.
+func isRetryExhausted(err error) bool {
+	restartErr, ok := err.(proto.TransactionRestartError)
+	return ok && restartErr.CanRestartTransaction() != proto.TransactionRestart_ABORT
+}
+
+// The client does not support savepoints, so the harness emulates
+// them: once a savepoint is created, the prior value of every key
+// written within the transaction is recorded before it is first
+// overwritten, and rolling back to the savepoint writes those values
+// back (or deletes keys which did not previously exist).
+
+// undoEntry is the value of a key as of the creation of a savepoint.
+type undoEntry struct {
+	value  int64
+	exists bool
+}
+
+// savepoint is a named point within a transaction which may be rolled
+// back to.
+type savepoint struct {
+	name string
+	env  map[string]int64     // copy of the env at the savepoint
+	undo map[string]undoEntry // prior values of keys written since
+}
+
+// savepoints is the ordered set of savepoints of a single transaction
+// attempt.
+type savepoints struct {
+	active []*savepoint
+}
+
+// create creates a new savepoint with the given name, replacing any
+// existing savepoint with the same name.
+func (sps *savepoints) create(name string, env map[string]int64) {
+	sps.release(name)
+	envCopy := map[string]int64{}
+	for k, v := range env {
+		envCopy[k] = v
+	}
+	sps.active = append(sps.active, &savepoint{
+		name: name,
+		env:  envCopy,
+		undo: map[string]undoEntry{},
+	})
+}
+
+// release removes the named savepoint and all savepoints created
+// after it, returning the named savepoint or nil if it doesn't exist.
+func (sps *savepoints) release(name string) *savepoint {
+	for i, sp := range sps.active {
+		if sp.name == name {
+			sps.active = sps.active[:i]
+			return sp
+		}
+	}
+	return nil
+}
+
+// span is an additional [key, endKey) span argument to a command.
+type span struct {
+	key, endKey string
+}
+
+// contains returns whether the key is within the span.
+func (s span) contains(key string) bool {
+	return s.key <= key && key < s.endKey
 }
 
 func (c *cmd) init(prevCmd *cmd) {
@@ -89,6 +326,7 @@ func (c *cmd) init(prevCmd *cmd) {
 	}
 	c.ch = make(chan struct{}, 1)
 	c.debug = ""
+	c.faultFired = false
 }
 
 func (c *cmd) execute(txn *client.Txn, t *testing.T) (string, error) {
@@ -98,15 +336,24 @@ func (c *cmd) execute(txn *client.Txn, t *testing.T) (string, error) {
 	if log.V(1) {
 		log.Infof("executing %s", c)
 	}
-	err := c.fn(c, txn, t)
+	var err error
+	start := time.Now()
+	if c.fault != nil && !c.faultFired && !c.reached {
+		c.faultFired = true
+		err = c.fault
+	} else if c.nonTxnFn != nil {
+		err = c.nonTxnFn(c, c.db, t)
+	} else {
+		err = c.fn(c, txn, t)
+	}
+	if c.recordDuration != nil {
+		c.recordDuration(c.name, time.Since(start))
+	}
 	if c.ch != nil {
 		c.ch <- struct{}{}
 	}
-	if len(c.key) > 0 && len(c.endKey) > 0 {
-		return fmt.Sprintf("%s%%d.%%d(%s-%s)%s", c.name, c.key, c.endKey, c.debug), err
-	}
-	if len(c.key) > 0 {
-		return fmt.Sprintf("%s%%d.%%d(%s)%s", c.name, c.key, c.debug), err
+	if args := c.args(); len(args) > 0 {
+		return fmt.Sprintf("%s%%d.%%d(%s)%s", c.name, args, c.debug), err
 	}
 	return fmt.Sprintf("%s%%d.%%d%s", c.name, c.debug), err
 }
@@ -118,27 +365,92 @@ func (c *cmd) done() {
 	c.debug = ""
 }
 
+func (c *cmd) makeKey(key string) []byte {
+	return []byte(fmt.Sprintf("%d.%s", c.historyIdx, key))
+}
+
 func (c *cmd) getKey() []byte {
-	return []byte(fmt.Sprintf("%d.%s", c.historyIdx, c.key))
+	return c.makeKey(c.key)
 }
 
 func (c *cmd) getEndKey() []byte {
 	if len(c.endKey) == 0 {
 		return nil
 	}
-	return []byte(fmt.Sprintf("%d.%s", c.historyIdx, c.endKey))
+	return c.makeKey(c.endKey)
 }
 
-func (c *cmd) String() string {
-	if len(c.key) > 0 && len(c.endKey) > 0 {
-		return fmt.Sprintf("%s%d(%s-%s)", c.name, c.txnIdx, c.key, c.endKey)
+// args returns the command's key arguments formatted as they appear in
+// a history, e.g. "A", "A-C" or "A-C,D-F".
+func (c *cmd) args() string {
+	if len(c.key) == 0 {
+		return ""
+	}
+	args := c.key
+	if c.value != nil {
+		args += fmt.Sprintf("=%d", *c.value)
+	}
+	if len(c.endKey) > 0 {
+		args += "-" + c.endKey
 	}
-	if len(c.key) > 0 {
-		return fmt.Sprintf("%s%d(%s)", c.name, c.txnIdx, c.key)
+	for _, s := range c.spans {
+		args += fmt.Sprintf(",%s-%s", s.key, s.endKey)
+	}
+	if len(c.toKey) > 0 {
+		args += "," + c.toKey
+	}
+	if c.amount != 0 {
+		args += fmt.Sprintf(",%d", c.amount)
+	}
+	return args
+}
+
+func (c *cmd) String() string {
+	if args := c.args(); len(args) > 0 {
+		return fmt.Sprintf("%s%d(%s)", c.name, c.txnIdx, args)
 	}
 	return fmt.Sprintf("%s%d", c.name, c.txnIdx)
 }
 
+// nonTxnReadCmd reads a value from the db without a txn and stores it
+// in the env.
+func nonTxnReadCmd(c *cmd, db *client.DB, t *testing.T) error {
+	r, err := db.Get(c.getKey())
+	if err != nil {
+		return err
+	}
+	if r.Value != nil {
+		c.env[c.key] = r.ValueInt()
+		c.debug = fmt.Sprintf("[%d ts=%d]", r.ValueInt(), r.Timestamp())
+		if c.recordRead != nil {
+			c.recordRead(c.txnIdx, c.key, r.ValueInt(), valueTimestamp(r))
+		}
+	} else if c.recordScan != nil {
+		c.recordScan(c.txnIdx, c.key, c.key+"\x00")
+	}
+	return nil
+}
+
+// nonTxnIncCmd increments the value for c.key without a txn.
+func nonTxnIncCmd(c *cmd, db *client.DB, t *testing.T) error {
+	r, err := db.Inc(c.getKey(), 1)
+	if err != nil {
+		return err
+	}
+	c.env[c.key] = r.ValueInt()
+	c.debug = fmt.Sprintf("[%d]", r.ValueInt())
+	return nil
+}
+
+// valueTimestamp returns the full MVCC timestamp of the value, which
+// unlike kv.Timestamp() includes the logical component.
+func valueTimestamp(kv client.KeyValue) proto.Timestamp {
+	if kv.Value == nil || kv.Value.Timestamp == nil {
+		return proto.Timestamp{}
+	}
+	return *kv.Value.Timestamp
+}
+
 // readCmd reads a value from the db and stores it in the env.
 func readCmd(c *cmd, txn *client.Txn, t *testing.T) error {
 	r, err := txn.Get(c.getKey())
@@ -148,41 +460,414 @@ func readCmd(c *cmd, txn *client.Txn, t *testing.T) error {
 	if r.Value != nil {
 		c.env[c.key] = r.ValueInt()
 		c.debug = fmt.Sprintf("[%d ts=%d]", r.ValueInt(), r.Timestamp())
+		if c.recordRead != nil {
+			c.recordRead(c.txnIdx, c.key, r.ValueInt(), valueTimestamp(r))
+		}
+	} else if c.recordScan != nil {
+		c.recordScan(c.txnIdx, c.key, c.key+"\x00")
+	}
+	return nil
+}
+
+// readForUpdateCmd reads a value from the db, stores it in the env and
+// writes it back unchanged. The write lays down an intent, so that, as
+// with a locking read, a concurrent txn writing the key conflicts with
+// this one. An absent key is written as zero.
+func readForUpdateCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	r, err := txn.Get(c.getKey())
+	if err != nil {
+		return err
+	}
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
+	value := r.ValueInt()
+	if err := txn.Put(c.getKey(), value); err != nil {
+		return err
+	}
+	c.env[c.key] = value
+	c.debug = fmt.Sprintf("[%d locked]", value)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, value)
+	}
+	return nil
+}
+
+// notReadCmd reads a value from the db and fails if it is present.
+func notReadCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	r, err := txn.Get(c.getKey())
+	if err != nil {
+		return err
+	}
+	if r.Value != nil {
+		c.debug = fmt.Sprintf("[%d ts=%d]", r.ValueInt(), r.Timestamp())
+		return util.Errorf("expected %s to be absent; found %d", c.key, r.ValueInt())
+	}
+	c.debug = "[absent]"
+	return nil
+}
+
+// recordUndo records the current value of key in each active
+// savepoint which has not yet recorded it, and that the txn attempt
+// writes key. It must be called before key is written.
+func (c *cmd) recordUndo(key string, txn *client.Txn) error {
+	if c.written != nil {
+		c.written[string(c.makeKey(key))] = struct{}{}
+	}
+	if c.savepoints == nil {
+		return nil
+	}
+	var missing []*savepoint
+	for _, sp := range c.savepoints.active {
+		if _, ok := sp.undo[key]; !ok {
+			missing = append(missing, sp)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	r, err := txn.Get(c.makeKey(key))
+	if err != nil {
+		return err
+	}
+	entry := undoEntry{exists: r.Value != nil}
+	if entry.exists {
+		entry.value = r.ValueInt()
+	}
+	for _, sp := range missing {
+		sp.undo[key] = entry
 	}
 	return nil
 }
 
 // deleteRngCmd deletes the range of values from the db from [key, endKey).
 func deleteRngCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if c.savepoints != nil && len(c.savepoints.active) > 0 {
+		return util.Errorf("DR is not supported within a savepoint")
+	}
 	return txn.DelRange(c.getKey(), c.getEndKey())
 }
 
-// scanCmd reads the values from the db from [key, endKey).
+// conditionalDeleteCmd deletes c.key if its current value equals
+// c.amount, and leaves it untouched otherwise. The client has no
+// conditional delete, so the value is read and then deleted within the
+// txn; the condition is thus evaluated against the txn's snapshot, and
+// a concurrent write to the key between the two must cause a restart.
+// The value of c.key, zero if deleted, is stored in the env, and the
+// deletion is recorded as a write of zero.
+func conditionalDeleteCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	r, err := txn.Get(c.getKey())
+	if err != nil {
+		return err
+	}
+	if r.Value == nil || r.ValueInt() != c.amount {
+		if r.Value != nil {
+			c.env[c.key] = r.ValueInt()
+			c.debug = fmt.Sprintf("[kept %d]", r.ValueInt())
+		} else {
+			c.debug = "[absent]"
+		}
+		return nil
+	}
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
+	if err := txn.Del(c.getKey()); err != nil {
+		return err
+	}
+	c.env[c.key] = 0
+	c.debug = fmt.Sprintf("[deleted %d]", c.amount)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, 0)
+	}
+	return nil
+}
+
+// conditionalPutCmd writes one more than the value of c.key in the env
+// to c.key, on condition that the db still holds that value, or that
+// the key is absent if the txn hasn't read or written it. If the
+// condition fails the key is left untouched and the command fails with
+// the condition failed error, showing the actual value in the history.
+func conditionalPutCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	var expValue interface{}
+	exp, ok := c.env[c.key]
+	if ok {
+		expValue = exp
+	}
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
+	if err := txn.CPut(c.getKey(), exp+1, expValue); err != nil {
+		cErr, ok := err.(*proto.ConditionFailedError)
+		if !ok {
+			return err
+		}
+		if cErr.ActualValue == nil {
+			c.debug = "[failed absent]"
+			return err
+		}
+		actual, vErr := cErr.ActualValue.GetInt()
+		if vErr != nil {
+			return vErr
+		}
+		c.debug = fmt.Sprintf("[failed %d]", actual)
+		return err
+	}
+	c.env[c.key] = exp + 1
+	c.debug = fmt.Sprintf("[ok %d]", exp+1)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, exp+1)
+	}
+	return nil
+}
+
+// scanCmd reads the values from the db from [key, endKey), failing if
+// any of them was written after the txn's snapshot.
 func scanCmd(c *cmd, txn *client.Txn, t *testing.T) error {
 	rows, err := txn.Scan(c.getKey(), c.getEndKey(), 0)
 	if err != nil {
 		return err
 	}
+	snapshot := txn.Proto.OrigTimestamp
+	if err := checkSnapshot(rows, snapshot, c.written); err != nil {
+		return err
+	}
+	c.recordRows(rows, snapshot)
+	return nil
+}
+
+// scanOrderedCmd reads the values from the db from [key, endKey) like
+// scanCmd, but fails if the keys aren't returned in strictly increasing
+// order.
+func scanOrderedCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	rows, err := txn.Scan(c.getKey(), c.getEndKey(), 0)
+	if err != nil {
+		return err
+	}
+	if err := checkKeyOrder(rows); err != nil {
+		return err
+	}
+	snapshot := txn.Proto.OrigTimestamp
+	if err := checkSnapshot(rows, snapshot, c.written); err != nil {
+		return err
+	}
+	c.recordRows(rows, snapshot)
+	return nil
+}
+
+// rescanCmd scans [key, endKey) like scanCmd. The first time the span is
+// scanned by a txn attempt, the rows are remembered; every later scan
+// of the span by the attempt must return exactly the same set of keys
+// and values, failing with the first key which differs otherwise. Unlike
+// comparing aggregates of the rows, this can't miss a phantom which
+// happens to preserve the aggregate. Writes of the txn itself to the
+// span between scans are reported as well.
+func rescanCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	rows, err := txn.Scan(c.getKey(), c.getEndKey(), 0)
+	if err != nil {
+		return err
+	}
+	snapshot := txn.Proto.OrigTimestamp
+	if err := checkSnapshot(rows, snapshot, c.written); err != nil {
+		return err
+	}
+	c.recordRows(rows, snapshot)
+	keyPrefix := []byte(fmt.Sprintf("%d.", c.historyIdx))
+	scan := map[string]int64{}
+	for _, kv := range rows {
+		scan[string(bytes.TrimPrefix(kv.Key, keyPrefix))] = kv.ValueInt()
+	}
+	sp := span{c.key, c.endKey}
+	first, ok := c.scanned[sp]
+	if !ok {
+		c.scanned[sp] = scan
+		return nil
+	}
+	return checkSameRows(sp, first, scan)
+}
+
+// checkSameRows verifies that two scans of the span returned the same
+// rows, reporting the first key, in key order, whose presence or value
+// differs.
+func checkSameRows(sp span, first, second map[string]int64) error {
+	var keys []string
+	for key := range first {
+		keys = append(keys, key)
+	}
+	for key := range second {
+		if _, ok := first[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v1, ok1 := first[key]
+		v2, ok2 := second[key]
+		switch {
+		case !ok1:
+			return util.Errorf("phantom row %s=%d appeared in rescan of %s-%s", key, v2, sp.key, sp.endKey)
+		case !ok2:
+			return util.Errorf("row %s=%d disappeared from rescan of %s-%s", key, v1, sp.key, sp.endKey)
+		case v1 != v2:
+			return util.Errorf("row %s changed from %d to %d in rescan of %s-%s", key, v1, v2, sp.key, sp.endKey)
+		}
+	}
+	return nil
+}
+
+// checkKeyOrder verifies that the keys of the rows are strictly
+// increasing.
+func checkKeyOrder(rows []client.KeyValue) error {
+	for i := 1; i < len(rows); i++ {
+		if bytes.Compare(rows[i-1].Key, rows[i].Key) >= 0 {
+			return util.Errorf("scan returned key %q after %q", rows[i].Key, rows[i-1].Key)
+		}
+	}
+	return nil
+}
+
+// checkSnapshot verifies that the rows returned by a scan are consistent
+// with a single snapshot of the db, taken at the given timestamp: no row
+// may have been written after it. Read-only requests of a txn are served
+// at its original timestamp, which is therefore the snapshot. The rows
+// of the keys in own, which the txn wrote itself, are exempt; its
+// intents are written at its current timestamp at the time, which may
+// be past the snapshot.
+func checkSnapshot(rows []client.KeyValue, snapshot proto.Timestamp, own map[string]struct{}) error {
+	for _, kv := range rows {
+		if _, ok := own[string(kv.Key)]; ok {
+			continue
+		}
+		if ts := valueTimestamp(kv); snapshot.Less(ts) {
+			return util.Errorf("scan at snapshot %s returned key %q written at %s", snapshot, kv.Key, ts)
+		}
+	}
+	return nil
+}
+
+// recordRows records the rows returned by a scan of [key, endKey), read
+// at the given snapshot timestamp, in the environment.
+func (c *cmd) recordRows(rows []client.KeyValue, snapshot proto.Timestamp) {
+	if c.recordScan != nil {
+		c.recordScan(c.txnIdx, c.key, c.endKey)
+	}
 	var vals []string
 	keyPrefix := []byte(fmt.Sprintf("%d.", c.historyIdx))
 	for _, kv := range rows {
 		key := bytes.TrimPrefix(kv.Key, keyPrefix)
 		c.env[string(key)] = kv.ValueInt()
 		vals = append(vals, fmt.Sprintf("%d", kv.ValueInt()))
+		if c.recordRead != nil {
+			c.recordRead(c.txnIdx, string(key), kv.ValueInt(), valueTimestamp(kv))
+		}
+	}
+	c.debug = fmt.Sprintf("[%s snapshot=%s]", strings.Join(vals, " "), snapshot)
+}
+
+// batchScanCmd reads the values from the db from [key, endKey) and
+// from each additional span using a single batch, so that all spans
+// are read at the same point in the transaction.
+func batchScanCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	b := &client.Batch{}
+	b.Scan(c.getKey(), c.getEndKey(), 0)
+	for _, s := range c.spans {
+		b.Scan(c.makeKey(s.key), c.makeKey(s.endKey), 0)
+	}
+	if err := txn.Run(b); err != nil {
+		return err
+	}
+	snapshot := txn.Proto.OrigTimestamp
+	for _, result := range b.Results {
+		if err := checkSnapshot(result.Rows, snapshot, c.written); err != nil {
+			return err
+		}
+	}
+	if c.recordScan != nil {
+		c.recordScan(c.txnIdx, c.key, c.endKey)
+		for _, s := range c.spans {
+			c.recordScan(c.txnIdx, s.key, s.endKey)
+		}
+	}
+	var vals []string
+	keyPrefix := []byte(fmt.Sprintf("%d.", c.historyIdx))
+	for _, result := range b.Results {
+		for _, kv := range result.Rows {
+			key := bytes.TrimPrefix(kv.Key, keyPrefix)
+			c.env[string(key)] = kv.ValueInt()
+			vals = append(vals, fmt.Sprintf("%d", kv.ValueInt()))
+			if c.recordRead != nil {
+				c.recordRead(c.txnIdx, string(key), kv.ValueInt(), valueTimestamp(kv))
+			}
+		}
 	}
-	c.debug = fmt.Sprintf("[%s]", strings.Join(vals, " "))
+	c.debug = fmt.Sprintf("[%s snapshot=%s]", strings.Join(vals, " "), snapshot)
 	return nil
 }
 
 // incCmd adds one to the value of c.key in the env and writes
 // it to the db. If c.key isn't in the db, writes 1.
 func incCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
 	r, err := txn.Inc(c.getKey(), 1)
 	if err != nil {
 		return err
 	}
 	c.env[c.key] = r.ValueInt()
 	c.debug = fmt.Sprintf("[%d]", r.ValueInt())
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, r.ValueInt())
+	}
+	return nil
+}
+
+// writeCmd writes c.value to c.key, regardless of the key's previous
+// value, and records it in the env.
+func writeCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
+	if err := txn.Put(c.getKey(), *c.value); err != nil {
+		return err
+	}
+	c.env[c.key] = *c.value
+	c.debug = fmt.Sprintf("[%d]", *c.value)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, *c.value)
+	}
+	return nil
+}
+
+// incLessThanCmd increments the value of c.key by 1 if it is below the
+// limit c.amount, and leaves it untouched otherwise, as a txn enforcing
+// a quota would. The value of c.key, after any increment, is stored in
+// the env.
+func incLessThanCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	r, err := txn.Get(c.getKey())
+	if err != nil {
+		return err
+	}
+	if r.Value != nil && c.recordRead != nil {
+		c.recordRead(c.txnIdx, c.key, r.ValueInt(), valueTimestamp(r))
+	}
+	if value := r.ValueInt(); value >= c.amount {
+		c.env[c.key] = value
+		c.debug = fmt.Sprintf("[%d at limit]", value)
+		return nil
+	}
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
+	r, err = txn.Inc(c.getKey(), 1)
+	if err != nil {
+		return err
+	}
+	c.env[c.key] = r.ValueInt()
+	c.debug = fmt.Sprintf("[%d]", r.ValueInt())
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, r.ValueInt())
+	}
 	return nil
 }
 
@@ -195,28 +880,413 @@ func sumCmd(c *cmd, txn *client.Txn, t *testing.T) error {
 			sum += v
 		}
 	}
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
 	r, err := txn.Inc(c.getKey(), sum)
 	c.debug = fmt.Sprintf("[%d ts=%d]", sum, r.Timestamp())
+	if err == nil && c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, r.ValueInt())
+	}
 	return err
 }
 
-// commitCmd commits the transaction.
+// intentCmd inspects the intent on c.key and writes the index of the txn
+// owning it, or 0 if there is none, to c.toKey. The intent is read from
+// the engine directly, so the inspection neither conflicts with nor
+// resolves it. Intents of committed txns are resolved asynchronously,
+// so an intent may still be observed shortly after its txn commits.
+func intentCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if c.eng == nil || c.txnOwner == nil {
+		return util.Errorf("%s requires access to the engine", c.name)
+	}
+	intent, err := inspectIntent(c.eng, c.getKey())
+	if err != nil {
+		return err
+	}
+	var owner int64
+	if intent != nil {
+		owner = int64(c.txnOwner(intent.Txn.ID))
+	}
+	if err := c.recordUndo(c.toKey, txn); err != nil {
+		return err
+	}
+	if err := txn.Put(c.makeKey(c.toKey), owner); err != nil {
+		return err
+	}
+	c.env[c.toKey] = owner
+	if intent != nil {
+		c.debug = fmt.Sprintf("[txn%d epoch=%d]", owner, intent.Txn.Epoch)
+	} else {
+		c.debug = "[none]"
+	}
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.toKey, owner)
+	}
+	return nil
+}
+
+// inspectIntent returns the intent on key, or nil if there is none.
+func inspectIntent(eng engine.Engine, key proto.Key) (*proto.Intent, error) {
+	_, intents, err := engine.MVCCGet(eng, key, proto.MaxTimestamp, false /* !consistent */, nil)
+	if err != nil || len(intents) == 0 {
+		return nil, err
+	}
+	return &intents[0], nil
+}
+
+// versionsCmd counts the MVCC versions of c.key and writes the count to
+// c.toKey. Like intentCmd, it reads the engine directly, so versions
+// which normal reads never see are counted, including the provisional
+// value of an intent. Each committed txn leaving a value retains one
+// version until it is garbage collected, however often it wrote the key.
+func versionsCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if c.eng == nil {
+		return util.Errorf("%s requires access to the engine", c.name)
+	}
+	count, err := countVersions(c.eng, c.getKey())
+	if err != nil {
+		return err
+	}
+	if err := c.recordUndo(c.toKey, txn); err != nil {
+		return err
+	}
+	if err := txn.Put(c.makeKey(c.toKey), count); err != nil {
+		return err
+	}
+	c.env[c.toKey] = count
+	c.debug = fmt.Sprintf("[%d]", count)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.toKey, count)
+	}
+	return nil
+}
+
+// countVersions returns the number of MVCC versions of key.
+func countVersions(eng engine.Engine, key proto.Key) (int64, error) {
+	var count int64
+	err := eng.Iterate(engine.MVCCEncodeKey(key), engine.MVCCEncodeKey(key.Next()),
+		func(kv proto.RawKeyValue) (bool, error) {
+			if _, _, isValue := engine.MVCCDecodeKey(kv.Key); isValue {
+				count++
+			}
+			return false, nil
+		})
+	return count, err
+}
+
+// seqKey is the key of the global sequence counter incremented by
+// seqCmd.
+const seqKey = "SEQ"
+
+// seqCmd increments the global sequence counter and writes the value it
+// obtained to c.key. As every txn obtaining a value writes the counter,
+// the values establish a total order of those txns, which must match the
+// order in which they were serialized. See checkSequence.
+func seqCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if err := c.recordUndo(seqKey, txn); err != nil {
+		return err
+	}
+	r, err := txn.Inc(c.makeKey(seqKey), 1)
+	if err != nil {
+		return err
+	}
+	seq := r.ValueInt()
+	if err := c.recordUndo(c.key, txn); err != nil {
+		return err
+	}
+	if err := txn.Put(c.getKey(), seq); err != nil {
+		return err
+	}
+	c.env[seqKey] = seq
+	c.env[c.key] = seq
+	c.debug = fmt.Sprintf("[%d]", seq)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, seqKey, seq)
+		c.recordWrite(c.txnIdx, c.key, seq)
+	}
+	return nil
+}
+
+// heartbeatCmd heartbeats the txn's record at the current time, as the
+// txn's coordinator does periodically. The heartbeat bypasses the
+// coordinator, which would send it at the txn's timestamp instead. A txn
+// which hasn't written has no record to keep alive, so there is nothing
+// to heartbeat.
+func heartbeatCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if c.cluster == nil {
+		return util.Errorf("%s requires access to the test cluster", c.name)
+	}
+	if !txn.Proto.Writing {
+		c.debug = "[no record]"
+		return nil
+	}
+	txnProto := txn.Proto
+	ba := proto.BatchRequest{}
+	ba.Timestamp = c.cluster.Clock.Now()
+	ba.Key = txnProto.Key
+	ba.Txn = &txnProto
+	ba.Add(&proto.HeartbeatTxnRequest{RequestHeader: proto.RequestHeader{Key: txnProto.Key}})
+	if _, err := c.cluster.distSender.SendBatch(context.Background(), ba); err != nil {
+		return err.GoError()
+	}
+	c.debug = fmt.Sprintf("[ts=%s]", ba.Timestamp)
+	return nil
+}
+
+// lapseCmd advances the clock past the expiration of the records of all
+// pending txns, as if their coordinators had missed their heartbeats. A
+// conflicting txn then aborts a pending txn regardless of priority, unless
+// the pending txn is heartbeated again first.
+func lapseCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if c.cluster == nil {
+		return util.Errorf("%s requires access to the test cluster", c.name)
+	}
+	c.cluster.Manual.Increment(2*storage.DefaultHeartbeatInterval.Nanoseconds() + 1)
+	c.debug = fmt.Sprintf("[now=%s]", c.cluster.Clock.Now())
+	return nil
+}
+
+// cntCmd counts the rows in [key, endKey) and writes the count to
+// c.toKey.
+func cntCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	rows, err := txn.Scan(c.getKey(), c.getEndKey(), 0)
+	if err != nil {
+		return err
+	}
+	count := int64(len(rows))
+	if err := c.recordUndo(c.toKey, txn); err != nil {
+		return err
+	}
+	if err := txn.Put(c.makeKey(c.toKey), count); err != nil {
+		return err
+	}
+	c.env[c.toKey] = count
+	c.debug = fmt.Sprintf("[%d]", count)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.toKey, count)
+	}
+	return nil
+}
+
+// splitCmd splits the range containing c.key at c.key. The split is
+// issued outside of the txn, so it runs concurrently with all txns. If
+// the txn restarts, the range is already split, which isn't an error.
+func splitCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if err := c.db.AdminSplit(c.getKey()); err != nil && !testutils.IsError(err, "range is already split") {
+		return err
+	}
+	return nil
+}
+
+// mergeCmd merges the range containing c.key with the range following
+// it, outside of the txn. If there is no following range, there is
+// nothing to merge.
+func mergeCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if err := c.db.AdminMerge(c.getKey()); err != nil && !testutils.IsError(err, "cannot merge final range") {
+		return err
+	}
+	return nil
+}
+
+// xferCmd transfers c.amount from c.key to c.toKey. Both keys are read
+// in a single batch and then both are written in a single batch, so the
+// transfer can't be interleaved with commands from other txns.
+func xferCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	from, to := c.getKey(), c.makeKey(c.toKey)
+	b := &client.Batch{}
+	b.Get(from)
+	b.Get(to)
+	if err := txn.Run(b); err != nil {
+		return err
+	}
+	fromVal := b.Results[0].Rows[0].ValueInt() - c.amount
+	toVal := b.Results[1].Rows[0].ValueInt() + c.amount
+	for _, key := range []string{c.key, c.toKey} {
+		if err := c.recordUndo(key, txn); err != nil {
+			return err
+		}
+	}
+	b = &client.Batch{}
+	b.Put(from, fromVal)
+	b.Put(to, toVal)
+	if err := txn.Run(b); err != nil {
+		return err
+	}
+	c.env[c.key] = fromVal
+	c.env[c.toKey] = toVal
+	c.debug = fmt.Sprintf("[%s=%d %s=%d]", c.key, fromVal, c.toKey, toVal)
+	if c.recordWrite != nil {
+		c.recordWrite(c.txnIdx, c.key, fromVal)
+		c.recordWrite(c.txnIdx, c.toKey, toVal)
+	}
+	return nil
+}
+
+// isolationCmd verifies that the txn currently runs at the isolation
+// named by c.key, e.g. ISO(SNAPSHOT). The txn's isolation is as last
+// returned by the server, so that any change made while handling a
+// conflict, such as an upgrade to SERIALIZABLE, is reflected.
+func isolationCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	expected, ok := proto.IsolationType_value[c.key]
+	if !ok {
+		return util.Errorf("unknown isolation %s", c.key)
+	}
+	if actual := txn.Proto.Isolation; actual != proto.IsolationType(expected) {
+		return util.Errorf("expected txn to run at %s isolation; found %s", c.key, actual)
+	}
+	return nil
+}
+
+// nameCmd sets the debug name of the txn to "txn<n>:<name>", where
+// name is c.key in lower case. The debug name is part of the trace
+// name of the txn, so a NAME command should precede any writes.
+func nameCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	txn.SetDebugName(fmt.Sprintf("txn%d:%s", c.txnIdx, strings.ToLower(c.key)), 0)
+	return nil
+}
+
+// savepointCmd creates a savepoint named c.key.
+func savepointCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	c.savepoints.create(c.key, c.env)
+	return nil
+}
+
+// rollbackCmd rolls the transaction back to the savepoint named c.key,
+// undoing all writes made since and restoring the env. The savepoint
+// itself remains active.
+func rollbackCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	sp := c.savepoints.release(c.key)
+	if sp == nil {
+		return util.Errorf("savepoint %s does not exist", c.key)
+	}
+	var restored []string
+	for key, entry := range sp.undo {
+		var err error
+		if entry.exists {
+			err = txn.Put(c.makeKey(key), entry.value)
+		} else {
+			err = txn.Del(c.makeKey(key))
+		}
+		if err != nil {
+			return err
+		}
+		restored = append(restored, key)
+	}
+	for k := range c.env {
+		delete(c.env, k)
+	}
+	for k, v := range sp.env {
+		c.env[k] = v
+	}
+	c.savepoints.create(c.key, c.env)
+	sort.Strings(restored)
+	c.debug = fmt.Sprintf("[%s]", strings.Join(restored, " "))
+	return nil
+}
+
+// escalatedCmd verifies that, if the txn has restarted, its priority was
+// escalated above its planned priority, as happens when a txn restarts
+// after losing a conflict to a higher priority txn. The restart forced
+// in a history following a restart, see restartHistories, doesn't
+// escalate the priority, so it isn't counted.
+func escalatedCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	c.debug = fmt.Sprintf("[pri=%d]", txn.Priority())
+	restarts := c.attempt - 1
+	if c.restarted {
+		restarts--
+	}
+	if restarts > 0 && txn.Priority() <= c.priority {
+		return util.Errorf("txn%d restarted, but its priority %d was not escalated above %d",
+			c.txnIdx, txn.Priority(), c.priority)
+	}
+	return nil
+}
+
+// restartCmd forces the txn to restart the first time the command is
+// reached in each history, and does nothing on the txn's later attempts.
+// It exercises the re-execution of the commands preceding it.
+func restartCmd(c *cmd, txn *client.Txn, t *testing.T) error {
+	if c.faultFired || c.reached {
+		return nil
+	}
+	c.faultFired = true
+	return &injectedError{msg: "forced restart"}
+}
+
+// commitCmd commits the transaction and records its commit timestamp.
 func commitCmd(c *cmd, txn *client.Txn, t *testing.T) error {
-	return txn.CommitNoCleanup()
+	if err := txn.CommitNoCleanup(); err != nil {
+		return err
+	}
+	if c.recordCommit != nil {
+		c.recordCommit(c.txnIdx, txn.Proto.Timestamp)
+	}
+	return nil
 }
 
 // cmdDict maps from command name to function implementing the command.
 // Use only upper case letters for commands. More than one letter is OK.
 var cmdDict = map[string]func(c *cmd, txn *client.Txn, t *testing.T) error{
-	"R":   readCmd,
-	"I":   incCmd,
-	"DR":  deleteRngCmd,
-	"SC":  scanCmd,
-	"SUM": sumCmd,
-	"C":   commitCmd,
+	"R":       readCmd,
+	"NR":      notReadCmd,
+	"RFU":     readForUpdateCmd,
+	"I":       incCmd,
+	"W":       writeCmd,
+	"ILT":     incLessThanCmd,
+	"DR":      deleteRngCmd,
+	"CDEL":    conditionalDeleteCmd,
+	"CPUT":    conditionalPutCmd,
+	"SC":      scanCmd,
+	"SCO":     scanOrderedCmd,
+	"RSC":     rescanCmd,
+	"BSC":     batchScanCmd,
+	"SUM":     sumCmd,
+	"CNT":     cntCmd,
+	"INT":     intentCmd,
+	"HB":      heartbeatCmd,
+	"LAPSE":   lapseCmd,
+	"VER":     versionsCmd,
+	"SEQ":     seqCmd,
+	"XFER":    xferCmd,
+	"SPLIT":   splitCmd,
+	"MERGE":   mergeCmd,
+	"SP":      savepointCmd,
+	"RB":      rollbackCmd,
+	"NAME":    nameCmd,
+	"ISO":     isolationCmd,
+	"RESTART": restartCmd,
+	"ESC":     escalatedCmd,
+	"C":       commitCmd,
+}
+
+// nonTxnCmdDict maps from command name to function implementing the
+// command for histories which run without a txn.
+var nonTxnCmdDict = map[string]func(c *cmd, db *client.DB, t *testing.T) error{
+	"R": nonTxnReadCmd,
+	"I": nonTxnIncCmd,
 }
 
-var cmdRE = regexp.MustCompile(`([A-Z]+)(?:\(([A-Z]+)(?:-([A-Z]+))?\))?`)
+// nonTxnPrefix marks a history whose commands each execute as a
+// single operation outside of any txn.
+const nonTxnPrefix = "NONTXN "
+
+// retryPrefix marks a history whose txn is expected to retry at least
+// once in every planned history in which it overlaps another txn so
+// marked. Of two overlapping marked txns, at least one must retry. Mark
+// each txn which could lose a conflict, e.g. both txns of a lost update.
+const retryPrefix = "RETRY "
+
+// conflictSep separates a command from its conflict tag, e.g. "I(A)!x".
+// The two commands of a history tagged alike, which must belong to
+// different txns, are expected to conflict: whenever both are planned
+// to execute before either txn commits, at least one of the txns must
+// have been retried, aborted or pushed. See checkExpectedConflicts.
+const conflictSep = "!"
+
+var conflictTagRE = regexp.MustCompile(`^[a-z]+$`)
+
+var cmdRE = regexp.MustCompile(`([A-Z]+)(?:\(([A-Z]+)(?:=([0-9]+))?(?:-([A-Z]+))?((?:,[A-Z]+-[A-Z]+)*)(?:,([A-Z]+))?(?:,([0-9]+))?\))?`)
 
 func historyString(cmds []*cmd) string {
 	var cmdStrs []string
@@ -226,13 +1296,65 @@ func historyString(cmds []*cmd) string {
 	return strings.Join(cmdStrs, " ")
 }
 
+var macroRE = regexp.MustCompile(`^DEFINE ([A-Z]+) = (.+)$`)
+
+// expandMacros expands macro references in the history string. A
+// history may begin with any number of macro definitions of the form
+// "DEFINE NAME = cmd cmd ...", each terminated by a semicolon. Every
+// reference to a defined name in the remainder of the history (or in a
+// later definition) is replaced by its command sequence. Expansion is
+// purely textual, so each expanded command is still enumerated and
+// ordered individually.
+func expandMacros(history string, t *testing.T) string {
+	parts := strings.Split(history, ";")
+	macros := map[string][]string{}
+	expand := func(s string) []string {
+		var elems []string
+		for _, elem := range strings.Fields(s) {
+			if seq, ok := macros[elem]; ok {
+				elems = append(elems, seq...)
+			} else {
+				elems = append(elems, elem)
+			}
+		}
+		return elems
+	}
+	for _, def := range parts[:len(parts)-1] {
+		match := macroRE.FindStringSubmatch(strings.TrimSpace(def))
+		if match == nil {
+			t.Fatalf("failed to parse macro definition %q", def)
+		}
+		if _, ok := cmdDict[match[1]]; ok {
+			t.Fatalf("macro %s shadows an existing command", match[1])
+		}
+		macros[match[1]] = expand(match[2])
+	}
+	return strings.Join(expand(parts[len(parts)-1]), " ")
+}
+
 // parseHistory parses the history string into individual commands
-// and returns a slice.
+// and returns a slice. Macros are expanded first; see expandMacros. A
+// history starting with nonTxnPrefix is non-transactional, and one
+// starting with retryPrefix is expected to retry.
 func parseHistory(txnIdx int, history string, t *testing.T) []*cmd {
+	expRetry := strings.HasPrefix(history, retryPrefix)
+	history = strings.TrimPrefix(history, retryPrefix)
+	nonTxn := strings.HasPrefix(history, nonTxnPrefix)
+	history = strings.TrimPrefix(history, nonTxnPrefix)
+	if expRetry && nonTxn {
+		t.Fatalf("a non-transactional history can't retry: %q", history)
+	}
 	// Parse commands.
 	var cmds []*cmd
-	elems := strings.Split(history, " ")
+	elems := strings.Split(expandMacros(history, t), " ")
 	for _, elem := range elems {
+		var conflictTag string
+		if i := strings.Index(elem, conflictSep); i >= 0 {
+			elem, conflictTag = elem[:i], elem[i+len(conflictSep):]
+			if !conflictTagRE.MatchString(conflictTag) {
+				t.Fatalf("invalid conflict tag %q in command %q", conflictTag, elem)
+			}
+		}
 		match := cmdRE.FindStringSubmatch(elem)
 		if len(match) < 2 {
 			t.Fatalf("failed to parse command %q", elem)
@@ -241,25 +1363,75 @@ func parseHistory(txnIdx int, history string, t *testing.T) []*cmd {
 		if !ok {
 			t.Fatalf("cmd %s not defined", match[1])
 		}
+		var nonTxnFn func(c *cmd, db *client.DB, t *testing.T) error
+		if nonTxn {
+			if nonTxnFn, ok = nonTxnCmdDict[match[1]]; !ok {
+				t.Fatalf("cmd %s not supported without a txn", match[1])
+			}
+		}
 		var key, endKey string
 		if len(match) > 2 {
 			key = match[2]
 		}
-		if len(match) > 3 {
-			endKey = match[3]
+		var value *int64
+		if len(match) > 3 && len(match[3]) > 0 {
+			v, err := strconv.ParseInt(match[3], 10, 64)
+			if err != nil {
+				t.Fatalf("failed to parse value in command %q: %s", elem, err)
+			}
+			value = &v
+		}
+		if (match[1] == "W") != (value != nil) {
+			t.Fatalf("only W takes a value, which it requires: %q", elem)
+		}
+		if len(match) > 4 {
+			endKey = match[4]
+		}
+		var spans []span
+		if len(match) > 5 && len(match[5]) > 0 {
+			for _, s := range strings.Split(match[5][1:], ",") {
+				keys := strings.Split(s, "-")
+				spans = append(spans, span{key: keys[0], endKey: keys[1]})
+			}
+		}
+		var toKey string
+		var amount int64
+		if len(match) > 6 {
+			toKey = match[6]
+		}
+		if len(match) > 7 && len(match[7]) > 0 {
+			var err error
+			if amount, err = strconv.ParseInt(match[7], 10, 64); err != nil {
+				t.Fatalf("failed to parse amount in command %q: %s", elem, err)
+			}
 		}
-		c := &cmd{name: match[1], key: key, endKey: endKey, txnIdx: txnIdx, fn: fn}
+		c := &cmd{name: match[1], key: key, value: value, endKey: endKey, spans: spans,
+			toKey: toKey, amount: amount, txnIdx: txnIdx, fn: fn, nonTxnFn: nonTxnFn, expRetry: expRetry,
+			conflictTag: conflictTag}
 		cmds = append(cmds, c)
 	}
 	return cmds
 }
 
 // parseHistories parses a slice of history strings and returns
-// a slice of command slices, one for each history.
+// a slice of command slices, one for each history. Each conflict tag
+// must be carried by exactly two commands of different txns.
 func parseHistories(histories []string, t *testing.T) [][]*cmd {
 	var results [][]*cmd
+	tagged := map[string][]*cmd{}
 	for i, history := range histories {
-		results = append(results, parseHistory(i+1, history, t))
+		cmds := parseHistory(i+1, history, t)
+		for _, c := range cmds {
+			if c.conflictTag != "" {
+				tagged[c.conflictTag] = append(tagged[c.conflictTag], c)
+			}
+		}
+		results = append(results, cmds)
+	}
+	for tag, cmds := range tagged {
+		if len(cmds) != 2 || cmds[0].txnIdx == cmds[1].txnIdx {
+			t.Fatalf("conflict tag %q must be carried by two commands of different txns; got %v", tag, cmds)
+		}
 	}
 	return results
 }
@@ -321,16 +1493,33 @@ func TestEnumerateIsolations(t *testing.T) {
 // enumeratePriorities returns a slice enumerating all combinations of the
 // specified slice of priorities.
 func enumeratePriorities(priorities []int32) [][]int32 {
+	n := len(priorities)
+	if n == 0 {
+		return nil
+	}
+	// Build each permutation in a single reused buffer, only copying it
+	// once complete.
 	var results [][]int32
-	for i := 0; i < len(priorities); i++ {
-		leftover := enumeratePriorities(append(append([]int32(nil), priorities[:i]...), priorities[i+1:]...))
-		if len(leftover) == 0 {
-			results = [][]int32{{priorities[i]}}
+	used := make([]bool, n)
+	perm := make([]int32, 0, n)
+	var enumerate func()
+	enumerate = func() {
+		if len(perm) == n {
+			results = append(results, append(make([]int32, 0, n), perm...))
+			return
 		}
-		for j := 0; j < len(leftover); j++ {
-			results = append(results, append([]int32{priorities[i]}, leftover[j]...))
+		for i, p := range priorities {
+			if used[i] {
+				continue
+			}
+			used[i] = true
+			perm = append(perm, p)
+			enumerate()
+			perm = perm[:len(perm)-1]
+			used[i] = false
 		}
 	}
+	enumerate()
 	return results
 }
 
@@ -360,25 +1549,40 @@ func TestEnumeratePriorities(t *testing.T) {
 // possible interleavings between transactions. If symmetric is true,
 // skips exactly N-1/N of the enumeration (where N=len(txns)).
 func enumerateHistories(txns [][]*cmd, symmetric bool) [][]*cmd {
+	var total int
+	for _, txn := range txns {
+		total += len(txn)
+	}
+	if total == 0 {
+		return nil
+	}
+	// Build each history in a single reused buffer, tracking the next
+	// command of each txn, and only copy it once complete.
 	var results [][]*cmd
+	next := make([]int, len(txns))
+	history := make([]*cmd, 0, total)
+	var enumerate func(numTxns int)
+	enumerate = func(numTxns int) {
+		if len(history) == total {
+			results = append(results, append(make([]*cmd, 0, total), history...))
+			return
+		}
+		for i := 0; i < numTxns; i++ {
+			if next[i] == len(txns[i]) {
+				continue
+			}
+			history = append(history, txns[i][next[i]])
+			next[i]++
+			enumerate(len(txns))
+			next[i]--
+			history = history[:len(history)-1]
+		}
+	}
 	numTxns := len(txns)
 	if symmetric {
 		numTxns = 1
 	}
-	for i := 0; i < numTxns; i++ {
-		if len(txns[i]) == 0 {
-			continue
-		}
-		cp := append([][]*cmd(nil), txns...)
-		cp[i] = append([]*cmd(nil), cp[i][1:]...)
-		leftover := enumerateHistories(cp, false)
-		if len(leftover) == 0 {
-			results = [][]*cmd{{txns[i][0]}}
-		}
-		for j := 0; j < len(leftover); j++ {
-			results = append(results, append([]*cmd{txns[i][0]}, leftover[j]...))
-		}
-	}
+	enumerate(numTxns)
 	return results
 }
 
@@ -416,339 +1620,3786 @@ func TestEnumerateHistories(t *testing.T) {
 	}
 }
 
-// verifier executes the history and then invokes checkFn to verify
-// the environment (map from key to value) left from executing the
-// history.
-type verifier struct {
-	history string
-	checkFn func(env map[string]int64) error
+// restart identifies the restart of txn txnIdx at the command at
+// position pos of the planned history.
+type restart struct {
+	txnIdx, pos int
 }
 
-// historyVerifier parses a planned transaction execution history into
-// commands per transaction and each command's previous dependency.
-// When run, each transaction's commands are executed via a goroutine
-// in a separate txn. The results of the execution are added to the
-// actual commands slice. When all txns have completed the actual history
-// is compared to the expected history.
-type historyVerifier struct {
-	name       string
-	txns       [][]*cmd
-	verify     *verifier
-	verifyCmds []*cmd
-	expSuccess bool
-	symmetric  bool
+// restartHistories returns the histories which may follow the restart
+// of txn txnIdx at the command at position pos of the planned history.
+// Each starts with the commands planned up to pos, the command at pos
+// failing with a forced restart, and continues with an interleaving of
+// the commands of the other txns planned after pos with all commands of
+// the restarted txn, run again on its second attempt.
+func restartHistories(history []*cmd, txnIdx, pos int) [][]*cmd {
+	// The commands are copied, leaving those of the planned history, which
+	// may be shared with other planned histories, untouched.
+	copies := make([]*cmd, len(history))
+	for i, c := range history {
+		cp := *c
+		copies[i] = &cp
+	}
+	copies[pos].fault = &injectedError{msg: "forced restart"}
+	prefix := copies[:pos+1]
 
-	sync.Mutex // protects actual slice of command outcomes.
-	actual     []string
-	wg         sync.WaitGroup
+	remaining := map[int][]*cmd{}
+	for i, c := range history {
+		if c.txnIdx != txnIdx {
+			if i > pos {
+				remaining[c.txnIdx] = append(remaining[c.txnIdx], copies[i])
+			}
+			continue
+		}
+		retried := *c
+		retried.restarted = true
+		retried.reached = i <= pos
+		remaining[txnIdx] = append(remaining[txnIdx], &retried)
+	}
+	var txnIdxs []int
+	for i := range remaining {
+		txnIdxs = append(txnIdxs, i)
+	}
+	sort.Ints(txnIdxs)
+	var txns [][]*cmd
+	for _, i := range txnIdxs {
+		txns = append(txns, remaining[i])
+	}
+
+	var results [][]*cmd
+	for _, h := range enumerateHistories(txns, false) {
+		results = append(results, append(append(make([]*cmd, 0, len(prefix)+len(h)), prefix...), h...))
+	}
+	return results
 }
 
-func newHistoryVerifier(name string, txns []string, verify *verifier, expSuccess bool, t *testing.T) *historyVerifier {
-	return &historyVerifier{
-		name:       name,
-		txns:       parseHistories(txns, t),
-		verify:     verify,
-		verifyCmds: parseHistory(0, verify.history, t),
-		expSuccess: expSuccess,
-		symmetric:  areHistoriesSymmetric(txns),
+func TestRestartHistories(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txns := parseHistories([]string{"R(A) I(A) C", "I(A) C"}, t)
+	history := []*cmd{txns[0][0], txns[1][0], txns[0][1], txns[1][1], txns[0][2]}
+	restarts := restartHistories(history, 1, 2)
+	var strs []string
+	for _, h := range restarts {
+		strs = append(strs, historyString(h))
+		if h[2].fault == nil || history[2].fault != nil {
+			t.Errorf("expected only the restarting command of %s to fail", historyString(h))
+		}
+		for i, c := range h {
+			for _, orig := range history {
+				if c == orig {
+					t.Errorf("expected command %d of %s to be a copy", i, historyString(h))
+				}
+			}
+			if expRestarted := i > 2 && c.txnIdx == 1; c.restarted != expRestarted {
+				t.Errorf("expected command %d of %s to be restarted %t", i, historyString(h), expRestarted)
+			}
+			if expReached := c.restarted && c.name != "C"; c.reached != expReached {
+				t.Errorf("expected command %d of %s to be reached %t", i, historyString(h), expReached)
+			}
+		}
+	}
+	expStrs := []string{
+		"R1(A) I2(A) I1(A) R1(A) I1(A) C1 C2",
+		"R1(A) I2(A) I1(A) R1(A) I1(A) C2 C1",
+		"R1(A) I2(A) I1(A) R1(A) C2 I1(A) C1",
+		"R1(A) I2(A) I1(A) C2 R1(A) I1(A) C1",
+	}
+	if !reflect.DeepEqual(strs, expStrs) {
+		t.Errorf("expected restart histories to match %s; got %s", expStrs, strs)
 	}
 }
 
-// areHistoriesSymmetric returns whether all txn histories are the same.
-func areHistoriesSymmetric(txns []string) bool {
-	for i := 1; i < len(txns); i++ {
-		if txns[i] != txns[0] {
-			return false
+// benchmarkTxns returns numTxns txns, each consisting of numCmds
+// commands.
+func benchmarkTxns(numTxns, numCmds int) [][]*cmd {
+	txns := make([][]*cmd, numTxns)
+	for i := range txns {
+		for j := 0; j < numCmds; j++ {
+			txns[i] = append(txns[i], &cmd{name: "I", key: "A", txnIdx: i + 1})
 		}
 	}
-	return true
+	return txns
 }
 
-func (hv *historyVerifier) run(isolations []proto.IsolationType, db *client.DB, t *testing.T) {
-	log.Infof("verifying all possible histories for the %q anomaly", hv.name)
-	priorities := make([]int32, len(hv.txns))
-	for i := 0; i < len(hv.txns); i++ {
-		priorities[i] = int32(i + 1)
+// TestEnumerateHistoriesCount verifies the number of histories enumerated
+// for a larger set of txns: the number of interleavings of three txns of
+// three commands each is 9!/(3!*3!*3!).
+func TestEnumerateHistoriesCount(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txns := benchmarkTxns(3, 3)
+	if a, e := len(enumerateHistories(txns, false)), 1680; a != e {
+		t.Errorf("expected %d histories; got %d", e, a)
 	}
-	enumPri := enumeratePriorities(priorities)
-	enumIso := enumerateIsolations(len(hv.txns), isolations)
-	enumHis := enumerateHistories(hv.txns, hv.symmetric)
+	if a, e := len(enumerateHistories(txns, true)), 1680/3; a != e {
+		t.Errorf("expected %d symmetric histories; got %d", e, a)
+	}
+	if a, e := len(enumeratePriorities([]int32{1, 2, 3, 4, 5})), 120; a != e {
+		t.Errorf("expected %d priority permutations; got %d", e, a)
+	}
+}
 
-	historyIdx := 1
-	var failures []error
-	for _, p := range enumPri {
-		for _, i := range enumIso {
-			for _, h := range enumHis {
-				if err := hv.runHistory(historyIdx, p, i, h, db, t); err != nil {
-					failures = append(failures, err)
+// multinomial returns the number of interleavings of sequences of the
+// given lengths: (n1+...+nk)! / (n1! * ... * nk!).
+func multinomial(lengths []int) int {
+	result, total := 1, 0
+	for _, n := range lengths {
+		// Multiply by C(total+n, n) one factor at a time, which keeps
+		// each intermediate result an integer.
+		for i := 1; i <= n; i++ {
+			total++
+			result = result * total / i
+		}
+	}
+	return result
+}
+
+// TestEnumerateHistoriesProperties verifies the enumeration of histories
+// for txns of various shapes: every interleaving is produced exactly
+// once, each txn's commands keep their order in every history, and the
+// symmetric enumeration yields just the histories starting with the
+// first txn.
+func TestEnumerateHistoriesProperties(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	shapes := [][]int{
+		{1},
+		{3},
+		{1, 1},
+		{2, 1},
+		{1, 3},
+		{2, 2},
+		{1, 2, 3},
+		{2, 2, 2},
+		{1, 1, 1, 1},
+		{4, 1, 2},
+	}
+	for _, shape := range shapes {
+		txns := make([][]*cmd, len(shape))
+		pos := map[*cmd]int{}
+		for i, n := range shape {
+			for j := 0; j < n; j++ {
+				c := &cmd{name: "I", key: string(rune('A' + j)), txnIdx: i + 1}
+				pos[c] = j
+				txns[i] = append(txns[i], c)
+			}
+		}
+		// The symmetric enumeration starts every history with the first
+		// command of the first txn, leaving the interleavings of the rest.
+		symShape := append([]int{shape[0] - 1}, shape[1:]...)
+		for _, symmetric := range []bool{false, true} {
+			enum := enumerateHistories(txns, symmetric)
+			expCount := multinomial(shape)
+			if symmetric {
+				expCount = multinomial(symShape)
+			}
+			if len(enum) != expCount {
+				t.Errorf("%v (symmetric=%t): expected %d histories; got %d", shape, symmetric, expCount, len(enum))
+			}
+			seen := map[string]struct{}{}
+			for _, history := range enum {
+				str := historyString(history)
+				if _, ok := seen[str]; ok {
+					t.Errorf("%v (symmetric=%t): history %q enumerated twice", shape, symmetric, str)
+				}
+				seen[str] = struct{}{}
+				if symmetric && history[0] != txns[0][0] {
+					t.Errorf("%v: symmetric history %q doesn't start with the first txn", shape, str)
+				}
+				if len(pos) != len(history) {
+					t.Errorf("%v (symmetric=%t): expected %d commands in history %q", shape, symmetric, len(pos), str)
+					continue
+				}
+				// Each txn's commands must appear in order, so the next
+				// command seen for a txn is always the one at its position.
+				next := make([]int, len(txns))
+				for _, c := range history {
+					p, ok := pos[c]
+					if !ok {
+						t.Fatalf("%v (symmetric=%t): unknown command in history %q", shape, symmetric, str)
+					}
+					if p != next[c.txnIdx-1] {
+						t.Errorf("%v (symmetric=%t): txn %d's commands are out of order in history %q",
+							shape, symmetric, c.txnIdx, str)
+						break
+					}
+					next[c.txnIdx-1]++
 				}
-				historyIdx++
 			}
 		}
 	}
+}
 
-	if hv.expSuccess == true && len(failures) > 0 {
-		t.Errorf("expected success, experienced %d errors", len(failures))
-	} else if !hv.expSuccess && len(failures) == 0 {
-		t.Errorf("expected failures for the %q anomaly, but experienced none", hv.name)
+func BenchmarkEnumerateHistories(b *testing.B) {
+	txns := benchmarkTxns(3, 3)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumerateHistories(txns, false)
 	}
 }
 
-func (hv *historyVerifier) runHistory(historyIdx int, priorities []int32,
-	isolations []proto.IsolationType, cmds []*cmd, db *client.DB, t *testing.T) error {
-	plannedStr := historyString(cmds)
-	if log.V(1) {
-		log.Infof("attempting iso=%v pri=%v history=%s", isolations, priorities, plannedStr)
+func BenchmarkEnumeratePriorities(b *testing.B) {
+	priorities := []int32{1, 2, 3, 4, 5}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumeratePriorities(priorities)
 	}
+}
 
-	hv.actual = []string{}
-	hv.wg.Add(len(priorities))
-	txnMap := map[int][]*cmd{}
-	var prev *cmd
-	for _, c := range cmds {
-		c.historyIdx = historyIdx
-		txnMap[c.txnIdx] = append(txnMap[c.txnIdx], c)
-		c.init(prev)
-		prev = c
+// verifier executes the history and then invokes checkFn to verify
+// the environment (map from key to value) left from executing the
+// history. If checkOrderFn is set, it is additionally invoked with the
+// commit timestamps of all transactions which committed via an explicit
+// "C" command, keyed by transaction index, to verify the actual
+// serialization order. If checkOutcomeFn is set, it is invoked with the
+// outcome of every transaction, keyed by transaction index.
+type verifier struct {
+	history        string
+	checkFn        func(env map[string]int64) error
+	checkOrderFn   func(env map[string]int64, commits map[int]proto.Timestamp) error
+	checkOutcomeFn func(env map[string]int64, outcomes map[int]*txnOutcome) error
+	// checkTimestampsFn, if set, verifies the MVCC timestamps of the
+	// values read by each txn against the commit timestamps.
+	checkTimestampsFn func(commits map[int]proto.Timestamp, outcomes map[int]*txnOutcome) error
+	// observe, if set, lists keys which an observer txn repeatedly reads
+	// while the txns of each history run. See checkAtomicObservations.
+	observe []string
+	// boundaries, if set, lists keys at which the range is split before
+	// each history runs, so that commands on those keys address the
+	// start key of a range. See splitBoundaries.
+	boundaries []string
+	// expOutcomes, if set, lists every distinct outcome, as formatted by
+	// outcomeString, which the histories are expected to produce across
+	// the enumeration. See checkOutcomeSet.
+	expOutcomes []string
+}
+
+// txnOutcome records how a transaction fared while running a history.
+type txnOutcome struct {
+	priority  int32
+	attempts  int  // number of times the txn was run
+	aborts    int  // attempts which ended in a TransactionAbortedError
+	committed bool // whether the txn eventually committed
+	// elapsed is the wall-clock duration of the txn, including retries.
+	elapsed time.Duration
+	// writes holds the last value the txn wrote to each key.
+	writes map[string]int64
+	// reads holds the values read by the txn's last attempt, and scans
+	// the spans it scanned.
+	reads []timestampedRead
+	scans []span
+	// plannedWrites holds the position in the planned history of the
+	// txn's first write to each key, and plannedCommit the position of
+	// its commit (or the length of the history if it has none).
+	plannedWrites map[string]int
+	plannedCommit int
+	// plannedStart is the position in the planned history of the txn's
+	// first command, and expRetry whether the txn is expected to retry.
+	plannedStart int
+	expRetry     bool
+	// plannedTags holds the position in the planned history of the
+	// txn's command carrying each conflict tag, and pushed whether the
+	// txn's last attempt ended with its timestamp pushed past its
+	// original timestamp.
+	plannedTags map[string]int
+	pushed      bool
+}
+
+// timestampedRead is a value read by a txn, along with its MVCC
+// timestamp.
+type timestampedRead struct {
+	key   string
+	value int64
+	ts    proto.Timestamp
+}
+
+// conflictsWith returns whether the planned writes of both txns to
+// key precede the other txn's commit.
+func (o *txnOutcome) conflictsWith(other *txnOutcome, key string) bool {
+	w, ok := o.plannedWrites[key]
+	otherW, otherOK := other.plannedWrites[key]
+	return ok && otherOK && w < other.plannedCommit && otherW < o.plannedCommit
+}
+
+// checkPriorityWinner returns a checkOutcomeFn verifying that
+// write/write conflicts on each of the given keys were resolved in
+// favor of the higher priority txn: of two txns whose planned writes
+// to a key conflicted, the higher priority one may only have been
+// aborted if the lower priority one was as well. The surviving value
+// of each key must also have been written by a txn which committed.
+func checkPriorityWinner(keys ...string) func(env map[string]int64, outcomes map[int]*txnOutcome) error {
+	return func(env map[string]int64, outcomes map[int]*txnOutcome) error {
+		for _, key := range keys {
+			var writer int
+			for txnIdx, o := range outcomes {
+				if v, ok := o.writes[key]; ok && v == env[key] {
+					writer = txnIdx
+				}
+			}
+			if writer == 0 {
+				continue
+			}
+			if !outcomes[writer].committed {
+				return util.Errorf("surviving value %s=%d was written by txn%d, which didn't commit", key, env[key], writer)
+			}
+			for hi, hiO := range outcomes {
+				for lo, loO := range outcomes {
+					if hiO.priority <= loO.priority || !hiO.conflictsWith(loO, key) {
+						continue
+					}
+					if hiO.aborts > 0 && loO.aborts == 0 {
+						return util.Errorf("txn%d (priority %d) was aborted in a write/write conflict on %s "+
+							"with txn%d (priority %d), which wasn't; surviving value %s=%d was written by txn%d",
+							hi, hiO.priority, key, lo, loO.priority, key, env[key], writer)
+					}
+				}
+			}
+		}
+		return nil
 	}
-	for i, txnCmds := range txnMap {
-		go func(i int, txnCmds []*cmd) {
-			if err := hv.runTxn(i, priorities[i-1], isolations[i-1], txnCmds, db, t); err != nil {
-				t.Errorf("(%s): unexpected failure running %s: %v", cmds, cmds[i], err)
+}
+
+// checkExpectedRetries verifies that of every two txns which are
+// expected to retry and whose planned executions overlap, each starting
+// before the other commits, at least one was retried.
+func checkExpectedRetries(outcomes map[int]*txnOutcome) error {
+	for i, o := range outcomes {
+		for j, other := range outcomes {
+			if i >= j || !o.expRetry || !other.expRetry {
+				continue
 			}
-		}(i, txnCmds)
+			if o.plannedStart < other.plannedCommit && other.plannedStart < o.plannedCommit &&
+				o.attempts < 2 && other.attempts < 2 {
+				return util.Errorf("expected txn%d or txn%d to retry, but both committed on their first attempt", i, j)
+			}
+		}
 	}
-	hv.wg.Wait()
+	return nil
+}
 
-	// Construct string for actual history.
-	actualStr := strings.Join(hv.actual, " ")
+// conflicted returns whether the txn ran into a conflict: it was retried,
+// aborted or had its timestamp pushed.
+func (o *txnOutcome) conflicted() bool {
+	return o.attempts > 1 || o.aborts > 0 || o.pushed
+}
 
-	// Verify history.
-	var verifyStrs []string
-	verifyEnv := map[string]int64{}
-	for _, c := range hv.verifyCmds {
-		c.historyIdx = historyIdx
-		c.env = verifyEnv
-		c.init(nil)
-		err := db.Txn(func(txn *client.Txn) error {
-			fmtStr, err := c.execute(txn, t)
-			if err != nil {
+// checkExpectedConflicts verifies that of every two txns with commands
+// carrying the same conflict tag, each planned to execute before the
+// other txn commits, at least one ran into a conflict. A conflict which
+// goes undetected is a serializability hole, even if the final state
+// happens to be correct.
+func checkExpectedConflicts(outcomes map[int]*txnOutcome) error {
+	for i, o := range outcomes {
+		for j, other := range outcomes {
+			if i >= j {
+				continue
+			}
+			for tag, pos := range o.plannedTags {
+				otherPos, ok := other.plannedTags[tag]
+				if !ok || pos >= other.plannedCommit || otherPos >= o.plannedCommit {
+					continue
+				}
+				if !o.conflicted() && !other.conflicted() {
+					return util.Errorf("expected txn%d and txn%d to conflict on the commands tagged %q, "+
+						"but neither was retried, aborted or pushed", i, j, tag)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkMonotonicReads verifies that no txn read an older value of a key
+// than it had already read: once a value is read, re-reading the key
+// must return it or a value with a later timestamp. Only the reads of
+// each txn's last attempt are checked, as a restarted txn no longer sees
+// the intents written by its earlier attempts.
+func checkMonotonicReads(outcomes map[int]*txnOutcome) error {
+	for txnIdx, o := range outcomes {
+		last := map[string]timestampedRead{}
+		for _, r := range o.reads {
+			if prev, ok := last[r.key]; ok && r.ts.Less(prev.ts) {
+				return util.Errorf("txn%d read %s=%d at %s after reading %s=%d at %s",
+					txnIdx, r.key, r.value, r.ts, prev.key, prev.value, prev.ts)
+			}
+			last[r.key] = r
+		}
+	}
+	return nil
+}
+
+// checkSequence returns a checkOrderFn verifying the values obtained by
+// SEQ commands, where keys[i] is the key to which txn i+1 writes the
+// value it obtained. The values obtained by the committed txns must be
+// distinct and leave no gaps up to the final value of the counter, as
+// a gap or a repeated value implies a lost or reordered increment. A
+// txn which obtained a lower value must also have committed before one
+// which obtained a higher value, since the latter read the former's
+// increment.
+func checkSequence(keys ...string) func(env map[string]int64, commits map[int]proto.Timestamp) error {
+	return func(env map[string]int64, commits map[int]proto.Timestamp) error {
+		holders := map[int64]int{}
+		for i, key := range keys {
+			seq := env[key]
+			if seq == 0 {
+				continue
+			}
+			if seq < 0 || seq > env[seqKey] {
+				return util.Errorf("txn%d obtained %s=%d outside of [1, %d]", i+1, key, seq, env[seqKey])
+			}
+			if prev, ok := holders[seq]; ok {
+				return util.Errorf("txn%d and txn%d both obtained sequence value %d", prev, i+1, seq)
+			}
+			holders[seq] = i + 1
+		}
+		if int64(len(holders)) != env[seqKey] {
+			return util.Errorf("sequence counter is %d, but %d value(s) were obtained: %v",
+				env[seqKey], len(holders), holders)
+		}
+		var prev int
+		for seq := int64(1); seq <= env[seqKey]; seq++ {
+			txnIdx := holders[seq]
+			if prevTS, ok := commits[prev]; ok {
+				if ts, ok := commits[txnIdx]; ok && !prevTS.Less(ts) {
+					return util.Errorf("txn%d obtained sequence value %d and committed at %s, not after "+
+						"txn%d, which obtained %d and committed at %s", txnIdx, seq, ts, prev, seq-1, prevTS)
+				}
+			}
+			prev = txnIdx
+		}
+		return nil
+	}
+}
+
+// outcomeTimestampRE matches the timestamps in the debug output of a
+// command, which vary from run to run.
+var outcomeTimestampRE = regexp.MustCompile(` (?:ts|snapshot)=[^ \]]+`)
+
+// outcomeString formats the observable outcome of a history: its actual
+// history, stripped of timestamps, and the final values of the keys read
+// by the verification history, in key order. For example:
+// "I1.0(A)[1] C1.0 R2.0(A)[1] C2.0 => A=1".
+func outcomeString(actualStr string, env map[string]int64) string {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var vals []string
+	for _, key := range keys {
+		vals = append(vals, fmt.Sprintf("%s=%d", key, env[key]))
+	}
+	return fmt.Sprintf("%s => %s", outcomeTimestampRE.ReplaceAllString(actualStr, ""), strings.Join(vals, " "))
+}
+
+// checkOutcomeSet verifies that the distinct outcomes observed across the
+// enumeration exactly match the expected ones. Any unexpected outcome is
+// an error, as is any expected outcome which wasn't observed, provided
+// the enumeration was complete.
+func checkOutcomeSet(expected []string, observed map[string]struct{}, complete bool) error {
+	expSet := map[string]struct{}{}
+	for _, outcome := range expected {
+		expSet[outcome] = struct{}{}
+	}
+	var unexpected, missing []string
+	for outcome := range observed {
+		if _, ok := expSet[outcome]; !ok {
+			unexpected = append(unexpected, outcome)
+		}
+	}
+	if complete {
+		for outcome := range expSet {
+			if _, ok := observed[outcome]; !ok {
+				missing = append(missing, outcome)
+			}
+		}
+	}
+	if len(unexpected) == 0 && len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(unexpected)
+	sort.Strings(missing)
+	return util.Errorf("unexpected outcomes %q; missing outcomes %q", unexpected, missing)
+}
+
+// outcomeTxnRE matches a command of an outcome, capturing the index of
+// its txn, e.g. "I2.0".
+var outcomeTxnRE = regexp.MustCompile(`\b([A-Z]+)([0-9]+)\.`)
+
+// canonicalOutcome relabels the txns of an outcome in the order in which
+// they first execute a command, so that outcomes which differ only by a
+// permutation of identical txns are equal. For example,
+// "I2.0(A)[1] I1.0(A)[2] => A=2" becomes "I1.0(A)[1] I2.0(A)[2] => A=2".
+func canonicalOutcome(outcome string) string {
+	labels := map[string]int{}
+	return outcomeTxnRE.ReplaceAllStringFunc(outcome, func(s string) string {
+		match := outcomeTxnRE.FindStringSubmatch(s)
+		label, ok := labels[match[2]]
+		if !ok {
+			label = len(labels) + 1
+			labels[match[2]] = label
+		}
+		return fmt.Sprintf("%s%d.", match[1], label)
+	})
+}
+
+// canonicalOutcomes returns the canonical form of each of the outcomes.
+func canonicalOutcomes(outcomes map[string]struct{}) map[string]struct{} {
+	canonical := map[string]struct{}{}
+	for outcome := range outcomes {
+		canonical[canonicalOutcome(outcome)] = struct{}{}
+	}
+	return canonical
+}
+
+// checkDependencyTimestamps verifies that the timestamps of committed
+// txns respect the dependencies between them: whenever a txn read a
+// value written by another committed txn, the value's MVCC timestamp
+// must be the writer's commit timestamp, and if the reader committed,
+// it must have committed at a strictly greater timestamp.
+func checkDependencyTimestamps(commits map[int]proto.Timestamp, outcomes map[int]*txnOutcome) error {
+	for reader, o := range outcomes {
+		for _, r := range o.reads {
+			for writer, writerO := range outcomes {
+				if v, ok := writerO.writes[r.key]; writer == reader || !ok || v != r.value || !writerO.committed {
+					continue
+				}
+				if !r.ts.Equal(commits[writer]) {
+					return util.Errorf("txn%d read %s=%d at ts=%s, but txn%d wrote it with commit ts=%s",
+						reader, r.key, r.value, r.ts, writer, commits[writer])
+				}
+				if readerTS, ok := commits[reader]; ok && !commits[writer].Less(readerTS) {
+					return util.Errorf("txn%d committed at ts=%s, not after txn%d at ts=%s, whose write of %s=%d it read",
+						reader, readerTS, writer, commits[writer], r.key, r.value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkSerializable is a general serializability oracle. It builds the
+// dependency graph of the committed txns from the values they read and
+// wrote and their commit timestamps, and returns an error describing a
+// cycle if there is one, which proves that the history isn't
+// serializable. The graph has an edge from txn i to txn j if:
+//
+//   - ww: j wrote the version of a key which follows i's write.
+//   - wr: j read the version of a key which i wrote.
+//   - rw: i read the version of a key, or scanned a span and missed the
+//     key, which precedes j's write.
+//
+// The versions of each key are ordered by the commit timestamps of their
+// writers, and a read is matched to the version with its timestamp.
+//
+// Only txns which committed via an explicit "C" command have a known
+// commit timestamp and take part; reads of other versions, such as
+// those written outside of a txn or a txn's reads of its own writes, are
+// ignored. So are the reads implied by increments. As such, the graph
+// may miss dependencies, but any cycle found is genuine.
+func checkSerializable(commits map[int]proto.Timestamp, outcomes map[int]*txnOutcome) error {
+	var txnIdxs []int
+	for txnIdx, o := range outcomes {
+		if _, ok := commits[txnIdx]; ok && o.committed {
+			txnIdxs = append(txnIdxs, txnIdx)
+		}
+	}
+	sort.Ints(txnIdxs)
+
+	// versions holds the txns which wrote each key, in commit timestamp
+	// order.
+	versions := map[string][]int{}
+	for _, txnIdx := range txnIdxs {
+		for key := range outcomes[txnIdx].writes {
+			writers := append(versions[key], txnIdx)
+			for i := len(writers) - 1; i > 0 && commits[writers[i]].Less(commits[writers[i-1]]); i-- {
+				writers[i], writers[i-1] = writers[i-1], writers[i]
+			}
+			versions[key] = writers
+		}
+	}
+
+	g := dependencyGraph{}
+	for key, writers := range versions {
+		for i := 1; i < len(writers); i++ {
+			g.add(writers[i-1], writers[i], fmt.Sprintf("ww(%s)", key))
+		}
+	}
+	for _, reader := range txnIdxs {
+		o := outcomes[reader]
+		read := map[string]bool{}
+		for _, r := range o.reads {
+			read[r.key] = true
+			writers := versions[r.key]
+			// pos is the position of the writer of the version read in
+			// writers, or -1 for the key's initial, absent version.
+			pos := -1
+			if !r.ts.Equal(proto.ZeroTimestamp) {
+				for i, writer := range writers {
+					if commits[writer].Equal(r.ts) {
+						pos = i
+						break
+					}
+				}
+				if pos == -1 {
+					continue
+				}
+				g.add(writers[pos], reader, fmt.Sprintf("wr(%s)", r.key))
+			}
+			if pos+1 < len(writers) {
+				g.add(reader, writers[pos+1], fmt.Sprintf("rw(%s)", r.key))
+			}
+		}
+		for _, s := range o.scans {
+			for key, writers := range versions {
+				if !read[key] && s.contains(key) {
+					g.add(reader, writers[0], fmt.Sprintf("rw(%s)", key))
+				}
+			}
+		}
+	}
+	if cycle := g.findCycle(txnIdxs); cycle != "" {
+		return util.Errorf("history is not serializable; dependency cycle: %s", cycle)
+	}
+	return nil
+}
+
+// allSerializable returns whether all of the isolations are
+// SERIALIZABLE.
+func allSerializable(isolations []proto.IsolationType) bool {
+	for _, iso := range isolations {
+		if iso != proto.SERIALIZABLE {
+			return false
+		}
+	}
+	return true
+}
+
+// dependencyGraph holds, for each txn, the txns which depend on it,
+// along with the reason for each dependency.
+type dependencyGraph map[int]map[int]string
+
+// add adds an edge from txn from to txn to. Self edges are ignored.
+func (g dependencyGraph) add(from, to int, reason string) {
+	if from == to {
+		return
+	}
+	if g[from] == nil {
+		g[from] = map[int]string{}
+	}
+	if _, ok := g[from][to]; !ok {
+		g[from][to] = reason
+	}
+}
+
+// findCycle returns a description of a cycle in the graph, such as
+// "txn1 -rw(B)-> txn2 -rw(A)-> txn1", or the empty string if the graph
+// is acyclic. The txns are visited in the given order.
+func (g dependencyGraph) findCycle(txnIdxs []int) string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[int]int{}
+	var path []int
+	var visit func(txnIdx int) string
+	visit = func(txnIdx int) string {
+		state[txnIdx] = visiting
+		path = append(path, txnIdx)
+		var tos []int
+		for to := range g[txnIdx] {
+			tos = append(tos, to)
+		}
+		sort.Ints(tos)
+		for _, to := range tos {
+			switch state[to] {
+			case visiting:
+				var buf bytes.Buffer
+				start := len(path) - 1
+				for path[start] != to {
+					start--
+				}
+				for i := start; i < len(path); i++ {
+					next := to
+					if i+1 < len(path) {
+						next = path[i+1]
+					}
+					fmt.Fprintf(&buf, "txn%d -%s-> ", path[i], g[path[i]][next])
+				}
+				fmt.Fprintf(&buf, "txn%d", to)
+				return buf.String()
+			case unvisited:
+				if cycle := visit(to); cycle != "" {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[txnIdx] = visited
+		return ""
+	}
+	for _, txnIdx := range txnIdxs {
+		if state[txnIdx] == unvisited {
+			if cycle := visit(txnIdx); cycle != "" {
+				return cycle
+			}
+		}
+	}
+	return ""
+}
+
+// abortedWrites returns, for each key, the values last written to it
+// by txns which didn't commit, mapped to the writing txn. Values which a
+// committed txn also left as its last write to the key are omitted, as
+// they can't be told apart.
+func abortedWrites(outcomes map[int]*txnOutcome) map[string]map[int64]int {
+	writes := map[string]map[int64]int{}
+	for txnIdx, o := range outcomes {
+		if o.committed {
+			continue
+		}
+		for key, value := range o.writes {
+			if writes[key] == nil {
+				writes[key] = map[int64]int{}
+			}
+			writes[key][value] = txnIdx
+		}
+	}
+	for _, o := range outcomes {
+		if !o.committed {
+			continue
+		}
+		for key, value := range o.writes {
+			delete(writes[key], value)
+		}
+	}
+	return writes
+}
+
+// strictPriority adds checkPriorityWinner for the given keys to the
+// verifier if --txn-correctness-strict-priority is set.
+func strictPriority(verify *verifier, keys ...string) *verifier {
+	if *correctnessStrictPriority {
+		verify.checkOutcomeFn = checkPriorityWinner(keys...)
+	}
+	return verify
+}
+
+// aggregate reduces the values of a set of keys to a single value.
+type aggregate struct {
+	name string
+	fn   func(values []int64) int64
+}
+
+var (
+	sumOf = aggregate{"sum", func(values []int64) int64 {
+		var sum int64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	}}
+	minOf = aggregate{"min", func(values []int64) int64 {
+		min := values[0]
+		for _, v := range values[1:] {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	}}
+	maxOf = aggregate{"max", func(values []int64) int64 {
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	}}
+	// countOf counts the keys with a non-zero value. Absent keys read as
+	// zero, so this is the number of keys which are present.
+	countOf = aggregate{"count", func(values []int64) int64 {
+		var count int64
+		for _, v := range values {
+			if v != 0 {
+				count++
+			}
+		}
+		return count
+	}}
+)
+
+// invariant returns a checkFn which verifies that the aggregate of the
+// values of the given keys equals expected.
+func invariant(agg aggregate, expected int64, keys ...string) func(env map[string]int64) error {
+	return func(env map[string]int64) error {
+		values := make([]int64, len(keys))
+		strs := make([]string, len(keys))
+		for i, key := range keys {
+			values[i] = env[key]
+			strs[i] = fmt.Sprintf("%s=%d", key, env[key])
+		}
+		if actual := agg.fn(values); actual != expected {
+			return util.Errorf("expected %s(%s) = %d, got %d (%s)", agg.name, strings.Join(keys, ", "),
+				expected, actual, strings.Join(strs, ", "))
+		}
+		return nil
+	}
+}
+
+// allOf returns a checkFn which verifies all of the given checkFns,
+// returning the first error encountered.
+func allOf(checkFns ...func(env map[string]int64) error) func(env map[string]int64) error {
+	return func(env map[string]int64) error {
+		for _, checkFn := range checkFns {
+			if err := checkFn(env); err != nil {
 				return err
 			}
-			cmdStr := fmt.Sprintf(fmtStr, 0, 0)
-			verifyStrs = append(verifyStrs, cmdStr)
+		}
+		return nil
+	}
+}
+
+// observer repeatedly reads a set of keys, all in one txn of its own,
+// while the txns of a history run.
+type observer struct {
+	stopCh       chan struct{}
+	doneCh       chan struct{}
+	observations []map[string]int64
+	err          error
+}
+
+// startObserver starts an observer of the given keys of the history.
+// Absent keys are observed as zero.
+func startObserver(historyIdx int, keys []string, db *client.DB) *observer {
+	o := &observer{
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	c := &cmd{historyIdx: historyIdx}
+	go func() {
+		defer close(o.doneCh)
+		for {
+			select {
+			case <-o.stopCh:
+				return
+			default:
+			}
+			var observation map[string]int64
+			if err := db.Txn(func(txn *client.Txn) error {
+				observation = map[string]int64{}
+				for _, key := range keys {
+					r, err := txn.Get(c.makeKey(key))
+					if err != nil {
+						return err
+					}
+					if r.Value != nil {
+						observation[key] = r.ValueInt()
+					} else {
+						observation[key] = 0
+					}
+				}
+				return nil
+			}); err != nil {
+				o.err = err
+				return
+			}
+			o.observations = append(o.observations, observation)
+		}
+	}()
+	return o
+}
+
+// stop stops the observer and returns its observations.
+func (o *observer) stop() ([]map[string]int64, error) {
+	close(o.stopCh)
+	<-o.doneCh
+	return o.observations, o.err
+}
+
+// checkAtomicObservations verifies that every observation saw either
+// all or none of the writes to the observed keys of each committed txn.
+// The writer of each observed value is identified by the value, so
+// values written by more than one txn are ignored. A txn's write to a
+// key counts as seen if the observed value was written by that txn or
+// by one which committed after it; otherwise the observation saw the
+// key as it was before the txn.
+func checkAtomicObservations(keys []string, observations []map[string]int64,
+	commits map[int]proto.Timestamp, outcomes map[int]*txnOutcome) error {
+	// writers maps each key and value to the txns which wrote it.
+	writers := map[string]map[int64][]int{}
+	for _, key := range keys {
+		writers[key] = map[int64][]int{}
+	}
+	for txnIdx, o := range outcomes {
+		for key, value := range o.writes {
+			if vals, ok := writers[key]; ok {
+				vals[value] = append(vals[value], txnIdx)
+			}
+		}
+	}
+	// seen returns whether the observed value of key follows the write
+	// to it by txnIdx, and whether that could be determined.
+	seen := func(txnIdx int, key string, value int64) (bool, bool) {
+		txnIdxs := writers[key][value]
+		switch {
+		case len(txnIdxs) == 0 && value == 0:
+			return false, true
+		case len(txnIdxs) != 1:
+			return false, false
+		}
+		writerTS, ok := commits[txnIdxs[0]]
+		if !ok {
+			return false, false
+		}
+		return txnIdxs[0] == txnIdx || commits[txnIdx].Less(writerTS), true
+	}
+	txnIdxs := make([]int, 0, len(outcomes))
+	for txnIdx := range outcomes {
+		txnIdxs = append(txnIdxs, txnIdx)
+	}
+	sort.Ints(txnIdxs)
+	for _, txnIdx := range txnIdxs {
+		o := outcomes[txnIdx]
+		if !o.committed {
+			continue
+		}
+		if _, ok := commits[txnIdx]; !ok {
+			continue
+		}
+		for i, observation := range observations {
+			var seenKey, unseenKey string
+			for _, key := range keys {
+				if _, ok := o.writes[key]; !ok {
+					continue
+				}
+				isSeen, ok := seen(txnIdx, key, observation[key])
+				if !ok {
+					continue
+				}
+				if isSeen && seenKey == "" {
+					seenKey = key
+				} else if !isSeen && unseenKey == "" {
+					unseenKey = key
+				}
+			}
+			if seenKey != "" && unseenKey != "" {
+				return util.Errorf("observation %d %v saw txn%d's write to %s but not to %s",
+					i+1, observation, txnIdx, seenKey, unseenKey)
+			}
+		}
+	}
+	return nil
+}
+
+// historyVerifier parses a planned transaction execution history into
+// commands per transaction and each command's previous dependency.
+// When run, each transaction's commands are executed via a goroutine
+// in a separate txn. The results of the execution are added to the
+// actual commands slice. When all txns have completed the actual history
+// is compared to the expected history.
+type historyVerifier struct {
+	name       string
+	txns       [][]*cmd
+	verify     *verifier
+	verifyCmds []*cmd
+	expSuccess bool
+	symmetric  bool
+	// failFast stops the enumeration at the first failing tuple.
+	failFast bool
+	// txnBudget, if non-zero, is the duration beyond which a txn is
+	// flagged as slow. Slow txns don't fail the history.
+	txnBudget time.Duration
+	// maxRetryExhausted is the number of tuples in which a txn may
+	// exhaust its retries, leaving the tuple unverified, before the
+	// anomaly fails.
+	maxRetryExhausted int
+
+	sync.Mutex // protects actual slice of command outcomes, commits, outcomes and cmdTimes.
+	actual     []string
+	commits    map[int]proto.Timestamp // commit timestamps by txn index
+	outcomes   map[int]*txnOutcome     // txn outcomes by txn index
+	// cmdTimes, if non-nil, accumulates the time spent executing the
+	// commands of the histories, by command name.
+	cmdTimes map[string]*cmdTime
+	// txnIdxs maps the IDs of the current history's txns to their
+	// indexes. A txn may have several IDs if it was aborted.
+	txnIdxs map[string]int
+	wg      sync.WaitGroup
+	// eng, if set, is the engine underlying the database the histories
+	// are run against. It is required by commands which examine intents.
+	eng engine.Engine
+	// cluster, if set, is the test cluster the histories are run
+	// against. It is required by commands which manage txn records.
+	cluster *LocalTestCluster
+	// observed collects the distinct outcomes of the histories if the
+	// verifier expects a set of outcomes.
+	observed map[string]struct{}
+	// retryCmds holds the commands which the txns of the current history
+	// are planned to run on their second attempt, by txn index. It is
+	// only set for histories following a restart; see restartHistories.
+	retryCmds map[int][]*cmd
+	// restarts lists the restarts of the txns of the current history.
+	restarts []restart
+	// restartIdx is the index of the last history run following a
+	// restart. These are numbered -1, -2, ... so that their keys don't
+	// overlap those of the tuples of the plan.
+	restartIdx int
+	// restartHistories, attempts and slow are the number of histories
+	// run following a restart, the number of txn attempts and the
+	// descriptions of the slow txns of the last call to runHistory,
+	// including those of the histories following a restart.
+	restartHistories int
+	attempts         int
+	slow             []string
+}
+
+// cmdTime is the time spent executing all commands of one type.
+type cmdTime struct {
+	name  string
+	count int
+	total time.Duration
+}
+
+// byTotalTime sorts cmdTimes by decreasing total time, then by name.
+type byTotalTime []*cmdTime
+
+func (s byTotalTime) Len() int      { return len(s) }
+func (s byTotalTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byTotalTime) Less(i, j int) bool {
+	if s[i].total != s[j].total {
+		return s[i].total > s[j].total
+	}
+	return s[i].name < s[j].name
+}
+
+func newHistoryVerifier(name string, txns []string, verify *verifier, expSuccess bool, t *testing.T) *historyVerifier {
+	hv := &historyVerifier{
+		name:       name,
+		txns:       parseHistories(txns, t),
+		verify:     verify,
+		verifyCmds: parseHistory(0, verify.history, t),
+		expSuccess: expSuccess,
+		symmetric:  areHistoriesSymmetric(txns),
+		txnBudget:  *correctnessTxnBudget,
+	}
+	if *correctnessCmdTimes {
+		hv.cmdTimes = map[string]*cmdTime{}
+	}
+	return hv
+}
+
+// injectFault makes the command at position cmdIdx (starting at 0)
+// within the history of txn txnIdx (starting at 1) fail with err the
+// first time it is reached in each verified history. When err is a
+// transaction restart error, the txn retries and the command succeeds
+// on the retry.
+func (hv *historyVerifier) injectFault(txnIdx, cmdIdx int, err error) {
+	hv.txns[txnIdx-1][cmdIdx].fault = err
+}
+
+// areHistoriesSymmetric returns whether all txn histories are the same.
+func areHistoriesSymmetric(txns []string) bool {
+	for i := 1; i < len(txns); i++ {
+		if txns[i] != txns[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// planEntry is a single (priority, isolation, history) tuple which the
+// verifier executes.
+type planEntry struct {
+	priorities []int32
+	isolations []proto.IsolationType
+	history    []*cmd
+}
+
+func (pe planEntry) String() string {
+	return fmt.Sprintf("iso=%v pri=%v history=%s", pe.isolations, pe.priorities, historyString(pe.history))
+}
+
+// matchesFilters returns whether the tuple matches the isolations and
+// priorities requested by --txn-correctness-iso and --txn-correctness-pri.
+func (pe planEntry) matchesFilters() bool {
+	if *correctnessIso != "" {
+		var isos []string
+		for _, iso := range pe.isolations {
+			isos = append(isos, iso.String())
+		}
+		if strings.Join(isos, ",") != strings.ToUpper(*correctnessIso) {
+			return false
+		}
+	}
+	if *correctnessPri != "" {
+		var pris []string
+		for _, pri := range pe.priorities {
+			pris = append(pris, strconv.Itoa(int(pri)))
+		}
+		if strings.Join(pris, ",") != *correctnessPri {
+			return false
+		}
+	}
+	return true
+}
+
+// Plan returns every (priority, isolation, history) tuple the verifier
+// executes when run with the given isolations, in order, leaving out any
+// tuple not matching the --txn-correctness-iso and --txn-correctness-pri
+// filters. The database is not touched.
+func (hv *historyVerifier) Plan(isolations []proto.IsolationType) []planEntry {
+	priorities := make([]int32, len(hv.txns))
+	for i := 0; i < len(hv.txns); i++ {
+		priorities[i] = int32(i + 1)
+	}
+	enumPri := enumeratePriorities(priorities)
+	enumIso := enumerateIsolations(len(hv.txns), isolations)
+	enumHis := enumerateHistories(hv.txns, hv.symmetric)
+
+	var plan []planEntry
+	for _, p := range enumPri {
+		for _, i := range enumIso {
+			for _, h := range enumHis {
+				if pe := (planEntry{priorities: p, isolations: i, history: h}); pe.matchesFilters() {
+					plan = append(plan, pe)
+				}
+			}
+		}
+	}
+	return plan
+}
+
+// run verifies every tuple of the plan, stopping at the first failure if
+// failFast is set.
+func (hv *historyVerifier) run(isolations []proto.IsolationType, db *client.DB, t *testing.T) {
+	log.Infof("verifying all possible histories for the %q anomaly", hv.name)
+	plan := hv.Plan(isolations)
+	if len(plan) == 0 {
+		log.Infof("no tuples of the %q anomaly match the filters", hv.name)
+		return
+	}
+	if hv.verify.expOutcomes != nil {
+		hv.observed = map[string]struct{}{}
+	}
+	start := time.Now()
+	result := hv.runPlan(plan, isolations, db, t)
+	elapsed := time.Since(start)
+	result.ElapsedSecs = elapsed.Seconds()
+	log.Infof("the %q anomaly ran %d txn attempts over %d tuples in %s (%.1f txns/sec)",
+		hv.name, result.Txns, result.Tuples, elapsed, float64(result.Txns)/elapsed.Seconds())
+
+	if hv.expSuccess == true && result.Failures > 0 {
+		t.Errorf("expected success, experienced %d errors", result.Failures)
+	} else if !hv.expSuccess && result.Failures == 0 {
+		t.Errorf("expected failures for the %q anomaly, but experienced none", hv.name)
+	}
+	if result.RetryExhausted > hv.maxRetryExhausted {
+		t.Errorf("a txn exhausted its retries in %d tuples of the %q anomaly, more than the %d allowed, e.g. %s",
+			result.RetryExhausted, hv.name, hv.maxRetryExhausted, result.SampleRetryExhausted)
+	}
+	if hv.observed != nil {
+		// Expected outcomes can only be missing if every tuple was run.
+		complete := *correctnessIso == "" && *correctnessPri == "" && result.Tuples == len(plan)
+		if err := checkOutcomeSet(hv.verify.expOutcomes, hv.observed, complete); err != nil {
+			t.Errorf("unexpected outcomes for the %q anomaly: %s", hv.name, err)
+		}
+	}
+
+	if *correctnessJSON != "" {
+		if err := result.appendTo(*correctnessJSON); err != nil {
+			t.Errorf("unable to write results for the %q anomaly: %s", hv.name, err)
+		}
+	}
+}
+
+// TestCheckPriorityWinner verifies that checkPriorityWinner only fails
+// if the higher priority of two conflicting txns was aborted alone, or
+// the surviving value was written by a txn which didn't commit.
+func TestCheckPriorityWinner(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	// makeOutcomes returns outcomes for two txns which both increment A;
+	// txn1 with priority 1 and txn2 with priority 2. If serial is true,
+	// txn1 commits before txn2 writes, so they don't conflict.
+	makeOutcomes := func(serial bool, aborts1, aborts2 int, committed2 bool) map[int]*txnOutcome {
+		outcomes := map[int]*txnOutcome{
+			1: {priority: 1, aborts: aborts1, committed: true, writes: map[string]int64{"A": 1},
+				plannedWrites: map[string]int{"A": 0}, plannedCommit: 2},
+			2: {priority: 2, aborts: aborts2, committed: committed2, writes: map[string]int64{"A": 2},
+				plannedWrites: map[string]int{"A": 1}, plannedCommit: 3},
+		}
+		if serial {
+			outcomes[2].plannedWrites["A"] = 3
+			outcomes[2].plannedCommit = 4
+		}
+		return outcomes
+	}
+	env := map[string]int64{"A": 2}
+	testCases := []struct {
+		outcomes map[int]*txnOutcome
+		expErr   bool
+	}{
+		{makeOutcomes(false, 0, 0, true), false},
+		{makeOutcomes(false, 1, 0, true), false},
+		{makeOutcomes(false, 1, 1, true), false},
+		{makeOutcomes(false, 0, 1, true), true},
+		{makeOutcomes(true, 0, 1, true), false},
+		{makeOutcomes(false, 0, 0, false), true},
+	}
+	check := checkPriorityWinner("A")
+	for i, test := range testCases {
+		if err := check(env, test.outcomes); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckDependencyTimestamps verifies that checkDependencyTimestamps
+// only fails if a value read from another committed txn doesn't carry
+// that txn's commit timestamp, or the reader didn't commit after it.
+func TestCheckDependencyTimestamps(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	ts := func(wallTime int64) proto.Timestamp { return proto.Timestamp{WallTime: wallTime} }
+	// makeOutcomes returns outcomes in which txn2 reads A=1, at readTS,
+	// after txn1 increments it.
+	makeOutcomes := func(committed1 bool, readTS proto.Timestamp) map[int]*txnOutcome {
+		return map[int]*txnOutcome{
+			1: {committed: committed1, writes: map[string]int64{"A": 1}},
+			2: {committed: true, writes: map[string]int64{"A": 2},
+				reads: []timestampedRead{{key: "A", value: 1, ts: readTS}}},
+		}
+	}
+	testCases := []struct {
+		commits  map[int]proto.Timestamp
+		outcomes map[int]*txnOutcome
+		expErr   bool
+	}{
+		{map[int]proto.Timestamp{1: ts(1), 2: ts(2)}, makeOutcomes(true, ts(1)), false},
+		// The read value doesn't carry the writer's commit timestamp.
+		{map[int]proto.Timestamp{1: ts(1), 2: ts(2)}, makeOutcomes(true, ts(0)), true},
+		// The reader didn't commit strictly after the writer.
+		{map[int]proto.Timestamp{1: ts(2), 2: ts(2)}, makeOutcomes(true, ts(2)), true},
+		{map[int]proto.Timestamp{1: ts(3), 2: ts(2)}, makeOutcomes(true, ts(3)), true},
+		// Reads of values written by txns which didn't commit are ignored.
+		{map[int]proto.Timestamp{2: ts(2)}, makeOutcomes(false, ts(0)), false},
+		// As is the commit order if the reader didn't commit.
+		{map[int]proto.Timestamp{1: ts(2)}, makeOutcomes(true, ts(2)), false},
+	}
+	for i, test := range testCases {
+		if err := checkDependencyTimestamps(test.commits, test.outcomes); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckExpectedRetries verifies that checkExpectedRetries only
+// fails if two overlapping txns expected to retry both succeeded on
+// their first attempt.
+func TestCheckExpectedRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	// makeOutcomes returns the outcomes of two txns planned as
+	// R1(A) R2(A) I1(A) I2(A) C1 C2, or, if !overlap, as
+	// R1(A) I1(A) C1 R2(A) I2(A) C2.
+	makeOutcomes := func(overlap bool, expRetry1, expRetry2 bool, attempts1, attempts2 int) map[int]*txnOutcome {
+		o1 := &txnOutcome{plannedStart: 0, plannedCommit: 4, expRetry: expRetry1, attempts: attempts1}
+		o2 := &txnOutcome{plannedStart: 1, plannedCommit: 5, expRetry: expRetry2, attempts: attempts2}
+		if !overlap {
+			o1.plannedCommit, o2.plannedStart = 2, 3
+		}
+		return map[int]*txnOutcome{1: o1, 2: o2}
+	}
+	testCases := []struct {
+		outcomes map[int]*txnOutcome
+		expErr   bool
+	}{
+		{makeOutcomes(true, true, true, 1, 1), true},
+		{makeOutcomes(true, true, true, 2, 1), false},
+		{makeOutcomes(true, true, true, 1, 3), false},
+		// Serial txns needn't retry.
+		{makeOutcomes(false, true, true, 1, 1), false},
+		// Nor need txns which aren't both expected to.
+		{makeOutcomes(true, true, false, 1, 1), false},
+		{makeOutcomes(true, false, false, 1, 1), false},
+	}
+	for i, test := range testCases {
+		if err := checkExpectedRetries(test.outcomes); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckMonotonicReads verifies that a txn re-reading a key may only
+// see the same or a later value, independently of its other keys.
+func TestCheckMonotonicReads(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	read := func(key string, value, wallTime int64) timestampedRead {
+		return timestampedRead{key: key, value: value, ts: proto.Timestamp{WallTime: wallTime}}
+	}
+	testCases := []struct {
+		reads  []timestampedRead
+		expErr bool
+	}{
+		{[]timestampedRead{read("A", 1, 1), read("A", 1, 1)}, false},
+		{[]timestampedRead{read("A", 1, 1), read("A", 2, 2)}, false},
+		{[]timestampedRead{read("A", 2, 2), read("A", 1, 1)}, true},
+		// Keys are checked independently.
+		{[]timestampedRead{read("A", 2, 2), read("B", 1, 1)}, false},
+		{[]timestampedRead{read("A", 1, 1), read("B", 3, 3), read("A", 2, 2), read("B", 1, 1)}, true},
+	}
+	for i, test := range testCases {
+		outcomes := map[int]*txnOutcome{
+			1: {reads: test.reads},
+			// Another txn's reads don't affect the first txn's.
+			2: {reads: []timestampedRead{read("A", 5, 5)}},
+		}
+		if err := checkMonotonicReads(outcomes); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckSequence verifies that sequence values must be distinct and
+// gapless, and ordered as the txns which obtained them committed.
+func TestCheckSequence(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	ts := func(wallTime int64) proto.Timestamp {
+		return proto.Timestamp{WallTime: wallTime}
+	}
+	ordered := map[int]proto.Timestamp{1: ts(1), 2: ts(2)}
+	testCases := []struct {
+		seq, a, b int64
+		commits   map[int]proto.Timestamp
+		expErr    bool
+	}{
+		{2, 1, 2, ordered, false},
+		{2, 2, 1, map[int]proto.Timestamp{1: ts(2), 2: ts(1)}, false},
+		// Only a txn which committed explicitly has a commit timestamp.
+		{2, 2, 1, map[int]proto.Timestamp{1: ts(2)}, false},
+		{1, 1, 0, ordered, false},
+		// A repeated value, a gap and a lost increment.
+		{2, 1, 1, ordered, true},
+		{3, 1, 3, ordered, true},
+		{1, 1, 2, ordered, true},
+		// Values obtained out of commit order.
+		{2, 2, 1, ordered, true},
+	}
+	check := checkSequence("A", "B")
+	for i, test := range testCases {
+		env := map[string]int64{seqKey: test.seq, "A": test.a, "B": test.b}
+		if err := check(env, test.commits); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckSameRows verifies that two scans must return the same keys
+// with the same values, even if their aggregates agree.
+func TestCheckSameRows(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	sp := span{"A", "C"}
+	testCases := []struct {
+		first, second map[string]int64
+		expErr        string
+	}{
+		{map[string]int64{}, map[string]int64{}, ""},
+		{map[string]int64{"A": 1, "B": 2}, map[string]int64{"A": 1, "B": 2}, ""},
+		{map[string]int64{"A": 1}, map[string]int64{"A": 1, "B": 1}, "phantom row B=1"},
+		{map[string]int64{"A": 1, "B": 1}, map[string]int64{"A": 1}, "row B=1 disappeared"},
+		// The sums of the scans agree.
+		{map[string]int64{"A": 2}, map[string]int64{"A": 1, "B": 1}, "row A changed from 2 to 1"},
+		{map[string]int64{"A": 1, "B": 0}, map[string]int64{"A": 1}, "row B=0 disappeared"},
+	}
+	for i, test := range testCases {
+		err := checkSameRows(sp, test.first, test.second)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: expected success; got %s", i, err)
+			}
+		} else if !testutils.IsError(err, test.expErr) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckExpectedConflicts verifies that txns whose tagged commands
+// overlap must have run into a conflict, and that the tags of serial
+// txns are ignored.
+func TestCheckExpectedConflicts(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	// makeOutcomes returns the outcomes of two txns planned as
+	// I1(A)!x I2(A)!x C1 C2, or, if !overlap, as I1(A)!x C1 I2(A)!x C2.
+	makeOutcomes := func(overlap bool, tag2 string, o1, o2 txnOutcome) map[int]*txnOutcome {
+		o1.plannedTags, o1.plannedCommit = map[string]int{"x": 0}, 2
+		o2.plannedTags, o2.plannedCommit = map[string]int{tag2: 1}, 3
+		if !overlap {
+			o1.plannedCommit, o2.plannedTags[tag2] = 1, 2
+		}
+		return map[int]*txnOutcome{1: &o1, 2: &o2}
+	}
+	clean := txnOutcome{attempts: 1}
+	testCases := []struct {
+		outcomes map[int]*txnOutcome
+		expErr   bool
+	}{
+		{makeOutcomes(true, "x", clean, clean), true},
+		{makeOutcomes(true, "x", txnOutcome{attempts: 2}, clean), false},
+		{makeOutcomes(true, "x", clean, txnOutcome{attempts: 1, aborts: 1}), false},
+		{makeOutcomes(true, "x", clean, txnOutcome{attempts: 1, pushed: true}), false},
+		// Serial txns needn't conflict.
+		{makeOutcomes(false, "x", clean, clean), false},
+		// Nor need commands with different tags.
+		{makeOutcomes(true, "y", clean, clean), false},
+	}
+	for i, test := range testCases {
+		if err := checkExpectedConflicts(test.outcomes); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCanonicalOutcome verifies that the txns of an outcome are
+// relabeled in the order in which they first execute a command, leaving
+// keys and values untouched.
+func TestCanonicalOutcome(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	testCases := []struct {
+		outcome, exp string
+	}{
+		{"I1.0(A)[1] I2.0(A)[2] C1.0 C2.0 => A=2", "I1.0(A)[1] I2.0(A)[2] C1.0 C2.0 => A=2"},
+		{"I2.0(A)[1] I1.0(A)[2] C1.0 C2.0 => A=2", "I1.0(A)[1] I2.0(A)[2] C2.0 C1.0 => A=2"},
+		{"I3.0(B)[1] C3.0 ILT1.1(A,2)[3] C1.1 R2.0(A)[3] => A=3 B=1",
+			"I1.0(B)[1] C1.0 ILT2.1(A,2)[3] C2.1 R3.0(A)[3] => A=3 B=1"},
+	}
+	for i, test := range testCases {
+		if s := canonicalOutcome(test.outcome); s != test.exp {
+			t.Errorf("%d: expected %q; got %q", i, test.exp, s)
+		}
+	}
+}
+
+// TestCheckOutcomeSet verifies that the outcomes of histories are
+// formatted without timestamps, and that checkOutcomeSet fails on any
+// unexpected outcome, and on any missing one if the enumeration was
+// complete.
+func TestCheckOutcomeSet(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	if s, exp := outcomeString("R1.0(A)[1 ts=5] SC2.1(A-C)[A:1 snapshot=3.000000000,1] C2.1",
+		map[string]int64{"B": 2, "A": 1}), "R1.0(A)[1] SC2.1(A-C)[A:1] C2.1 => A=1 B=2"; s != exp {
+		t.Errorf("expected outcome %q, got %q", exp, s)
+	}
+
+	expected := []string{"x => A=1", "y => A=2"}
+	observed := func(outcomes ...string) map[string]struct{} {
+		m := map[string]struct{}{}
+		for _, outcome := range outcomes {
+			m[outcome] = struct{}{}
+		}
+		return m
+	}
+	testCases := []struct {
+		observed map[string]struct{}
+		complete bool
+		expErr   bool
+	}{
+		{observed("x => A=1", "y => A=2"), true, false},
+		{observed("x => A=1", "y => A=2", "z => A=3"), true, true},
+		{observed("x => A=1"), true, true},
+		// Missing outcomes are tolerated unless the enumeration was
+		// complete, but unexpected ones never are.
+		{observed("x => A=1"), false, false},
+		{observed("x => A=1", "z => A=3"), false, true},
+	}
+	for i, test := range testCases {
+		if err := checkOutcomeSet(expected, test.observed, test.complete); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckSerializable verifies that checkSerializable finds the
+// dependency cycles of write skew and lost updates, and only considers
+// txns which committed.
+func TestCheckSerializable(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	ts := func(wallTime int64) proto.Timestamp { return proto.Timestamp{WallTime: wallTime} }
+	commits := map[int]proto.Timestamp{1: ts(1), 2: ts(2)}
+	scanAC := []span{{key: "A", endKey: "C"}}
+	readA := []span{{key: "A", endKey: "A\x00"}}
+	testCases := []struct {
+		outcomes map[int]*txnOutcome
+		expErr   string
+	}{
+		// Write skew: each txn misses the other's write.
+		{map[int]*txnOutcome{
+			1: {committed: true, scans: scanAC, writes: map[string]int64{"A": 1}},
+			2: {committed: true, scans: scanAC, writes: map[string]int64{"B": 1}},
+		}, "txn1 -rw(B)-> txn2 -rw(A)-> txn1"},
+		// As above, but txn2 sees txn1's write.
+		{map[int]*txnOutcome{
+			1: {committed: true, scans: scanAC, writes: map[string]int64{"A": 1}},
+			2: {committed: true, scans: scanAC, writes: map[string]int64{"B": 2},
+				reads: []timestampedRead{{key: "A", value: 1, ts: ts(1)}}},
+		}, ""},
+		// As the first, but txn2 didn't commit.
+		{map[int]*txnOutcome{
+			1: {committed: true, scans: scanAC, writes: map[string]int64{"A": 1}},
+			2: {committed: false, scans: scanAC, writes: map[string]int64{"B": 1}},
+		}, ""},
+		// Lost update: both txns read A before either increments it.
+		{map[int]*txnOutcome{
+			1: {committed: true, scans: readA, writes: map[string]int64{"A": 1}},
+			2: {committed: true, scans: readA, writes: map[string]int64{"A": 1}},
+		}, "txn1 -ww(A)-> txn2 -rw(A)-> txn1"},
+		// As above, but txn2 reads A after txn1's increment.
+		{map[int]*txnOutcome{
+			1: {committed: true, scans: readA, writes: map[string]int64{"A": 1}},
+			2: {committed: true, writes: map[string]int64{"A": 2},
+				reads: []timestampedRead{{key: "A", value: 1, ts: ts(1)}}},
+		}, ""},
+	}
+	for i, test := range testCases {
+		err := checkSerializable(commits, test.outcomes)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+		} else if !testutils.IsError(err, regexp.QuoteMeta(test.expErr)) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckAtomicObservations verifies that checkAtomicObservations only
+// fails if an observation saw some but not all of a committed txn's
+// writes, accounting for values overwritten by later txns.
+func TestCheckAtomicObservations(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	ts := func(wallTime int64) proto.Timestamp { return proto.Timestamp{WallTime: wallTime} }
+	keys := []string{"A", "B"}
+	commits := map[int]proto.Timestamp{1: ts(1), 2: ts(2)}
+	// txn1 writes A=1 and B=1, then txn2 overwrites A with 2.
+	outcomes := map[int]*txnOutcome{
+		1: {committed: true, writes: map[string]int64{"A": 1, "B": 1}},
+		2: {committed: true, writes: map[string]int64{"A": 2}},
+		3: {committed: false, writes: map[string]int64{"B": 3}},
+	}
+	testCases := []struct {
+		observation map[string]int64
+		expErr      string
+	}{
+		{map[string]int64{"A": 0, "B": 0}, ""},
+		{map[string]int64{"A": 1, "B": 1}, ""},
+		{map[string]int64{"A": 2, "B": 1}, ""},
+		{map[string]int64{"A": 1, "B": 0}, "saw txn1's write to A but not to B"},
+		{map[string]int64{"A": 0, "B": 1}, "saw txn1's write to B but not to A"},
+		{map[string]int64{"A": 2, "B": 0}, "saw txn1's write to A but not to B"},
+		// txn3 didn't commit, so its write can't be placed.
+		{map[string]int64{"A": 1, "B": 3}, ""},
+	}
+	for i, test := range testCases {
+		err := checkAtomicObservations(keys, []map[string]int64{test.observation}, commits, outcomes)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+		} else if !testutils.IsError(err, regexp.QuoteMeta(test.expErr)) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestInvariant verifies the checkFns built by invariant and allOf.
+func TestInvariant(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	env := map[string]int64{"A": 2, "B": -1, "C": 0}
+	testCases := []struct {
+		checkFn func(env map[string]int64) error
+		expErr  string
+	}{
+		{invariant(sumOf, 1, "A", "B", "C"), ""},
+		{invariant(sumOf, 0, "A", "B", "C"), "expected sum(A, B, C) = 0, got 1 (A=2, B=-1, C=0)"},
+		{invariant(minOf, -1, "A", "B"), ""},
+		{invariant(maxOf, 2, "A", "B"), ""},
+		{invariant(maxOf, 0, "B", "C"), ""},
+		// C is absent, and D was never written.
+		{invariant(countOf, 2, "A", "B", "C", "D"), ""},
+		{invariant(countOf, 1, "C", "D"), "expected count(C, D) = 1, got 0 (C=0, D=0)"},
+		{allOf(invariant(sumOf, 2, "A"), invariant(sumOf, -1, "B")), ""},
+		{allOf(invariant(sumOf, 2, "A"), invariant(sumOf, 1, "B")), "expected sum(B) = 1, got -1"},
+		{allOf(), ""},
+	}
+	for i, test := range testCases {
+		err := test.checkFn(env)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+		} else if !testutils.IsError(err, regexp.QuoteMeta(test.expErr)) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckKeyOrder verifies that checkKeyOrder fails unless the keys
+// returned by a scan are strictly increasing.
+func TestCheckKeyOrder(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rows := func(keys ...string) []client.KeyValue {
+		var rows []client.KeyValue
+		for _, key := range keys {
+			rows = append(rows, client.KeyValue{Key: []byte(key)})
+		}
+		return rows
+	}
+	testCases := []struct {
+		rows   []client.KeyValue
+		expErr string
+	}{
+		{rows(), ""},
+		{rows("0.A"), ""},
+		{rows("0.A", "0.B", "0.C"), ""},
+		{rows("0.A", "0.C", "0.B"), `scan returned key "0.B" after "0.C"`},
+		{rows("0.A", "0.A"), `scan returned key "0.A" after "0.A"`},
+	}
+	for i, test := range testCases {
+		err := checkKeyOrder(test.rows)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+		} else if !testutils.IsError(err, regexp.QuoteMeta(test.expErr)) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCheckSnapshot verifies that a scan may only return rows written at
+// or before its snapshot, or by its own txn.
+func TestCheckSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rows := func(walltimes ...int64) []client.KeyValue {
+		var rows []client.KeyValue
+		for i, wt := range walltimes {
+			rows = append(rows, client.KeyValue{
+				Key:   []byte(fmt.Sprintf("0.%c", 'A'+i)),
+				Value: &proto.Value{Timestamp: &proto.Timestamp{WallTime: wt}},
+			})
+		}
+		return rows
+	}
+	snapshot := proto.Timestamp{WallTime: 10}
+	// The txn wrote B.
+	own := map[string]struct{}{"0.B": {}}
+	testCases := []struct {
+		rows   []client.KeyValue
+		expErr string
+	}{
+		{rows(), ""},
+		{rows(1, 5, 10), ""},
+		// The txn's own intents, written at any timestamp, even if the
+		// txn has since been pushed further.
+		{rows(5, 20), ""},
+		{rows(5, 11), ""},
+		{rows(5, 11, 12), `returned key "0.C" written at`},
+		{rows(15, 5), `returned key "0.A" written at`},
+	}
+	for i, test := range testCases {
+		err := checkSnapshot(test.rows, snapshot, own)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+		} else if !testutils.IsError(err, regexp.QuoteMeta(test.expErr)) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestCmdTimesString verifies that the command time summary lists
+// command types in decreasing order of total time.
+func TestCmdTimesString(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	hv := &historyVerifier{name: "test", cmdTimes: map[string]*cmdTime{}}
+	for _, d := range []time.Duration{time.Second, 3 * time.Second} {
+		hv.recordDuration("SC", d)
+	}
+	hv.recordDuration("I", 2*time.Second)
+	hv.recordDuration("C", 2*time.Second)
+	expected := `command times for the "test" anomaly:
+  SC                  4s   50.0%  (2 cmds, 2s each)
+  C                   2s   25.0%  (1 cmds, 2s each)
+  I                   2s   25.0%  (1 cmds, 2s each)
+`
+	if s := hv.cmdTimesString(); s != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, s)
+	}
+}
+
+// TestAbortedWrites verifies that abortedWrites returns only the writes
+// of txns which didn't commit, leaving out values a committed txn also
+// wrote.
+func TestAbortedWrites(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	outcomes := map[int]*txnOutcome{
+		1: {committed: true, writes: map[string]int64{"A": 1}},
+		2: {committed: false, writes: map[string]int64{"A": 1, "B": 2}},
+		3: {committed: false, writes: map[string]int64{"A": 3}},
+	}
+	expected := map[string]map[int64]int{
+		"A": {3: 3},
+		"B": {2: 2},
+	}
+	if writes := abortedWrites(outcomes); !reflect.DeepEqual(writes, expected) {
+		t.Errorf("expected %v; got %v", expected, writes)
+	}
+}
+
+// TestHistoryVerifierFailFast verifies that a fail-fast verifier stops
+// after the first failing tuple.
+func TestHistoryVerifierFailFast(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	var checks int
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			checks++
+			return util.Errorf("always fails")
+		},
+	}
+	hv := newHistoryVerifier("fail fast", []string{"R(A) C", "R(A) C"}, verify, false, t)
+	hv.failFast = true
+	s := createTestDB(t)
+	defer s.Stop()
+	hv.run(bothIsolations, s.DB, t)
+	if checks != 1 {
+		t.Errorf("expected verification to stop after the first failure; ran %d checks", checks)
+	}
+}
+
+// TestHistoryVerifierPlan verifies that the plan covers every combination
+// of priorities, isolations and histories exactly once.
+func TestHistoryVerifierPlan(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txns := []string{"R(A) C", "I(A) C"}
+	hv := newHistoryVerifier("plan", txns, &verifier{history: "R(A)"}, true, t)
+	plan := hv.Plan(bothIsolations)
+
+	numHistories := len(enumerateHistories(hv.txns, hv.symmetric))
+	if a, e := len(plan), 2*4*numHistories; a != e {
+		t.Fatalf("expected %d plan entries; got %d", e, a)
+	}
+	seen := map[string]struct{}{}
+	for _, pe := range plan {
+		if _, ok := seen[pe.String()]; ok {
+			t.Errorf("duplicate plan entry %s", pe)
+		}
+		seen[pe.String()] = struct{}{}
+	}
+	if a, e := plan[0].String(), "iso=[SERIALIZABLE SERIALIZABLE] pri=[1 2] history=R1(A) C1 I2(A) C2"; a != e {
+		t.Errorf("expected first plan entry %q; got %q", e, a)
+	}
+}
+
+// TestHistoryVerifierPlanFilters verifies that the isolation and
+// priority filters restrict the plan to the matching tuples.
+func TestHistoryVerifierPlanFilters(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	defer func(iso, pri string) {
+		*correctnessIso, *correctnessPri = iso, pri
+	}(*correctnessIso, *correctnessPri)
+	txns := []string{"R(A) C", "I(A) C"}
+	hv := newHistoryVerifier("plan", txns, &verifier{history: "R(A)"}, true, t)
+	numHistories := len(enumerateHistories(hv.txns, hv.symmetric))
+
+	testCases := []struct {
+		iso, pri string
+		expLen   int
+	}{
+		{"", "", 2 * 4 * numHistories},
+		{"snapshot,serializable", "", 2 * numHistories},
+		{"", "2,1", 4 * numHistories},
+		{"SNAPSHOT,SERIALIZABLE", "2,1", numHistories},
+		{"SNAPSHOT", "", 0},
+	}
+	for i, test := range testCases {
+		*correctnessIso, *correctnessPri = test.iso, test.pri
+		plan := hv.Plan(bothIsolations)
+		if len(plan) != test.expLen {
+			t.Errorf("%d: expected %d plan entries; got %d", i, test.expLen, len(plan))
+		}
+		for _, pe := range plan {
+			if !pe.matchesFilters() {
+				t.Errorf("%d: plan entry %s doesn't match the filters", i, pe)
+			}
+		}
+	}
+}
+
+// runPlan runs each entry of the plan against db and summarizes the
+// outcome. It stops at the first failure if failFast is set.
+func (hv *historyVerifier) runPlan(plan []planEntry, isolations []proto.IsolationType,
+	db *client.DB, t *testing.T) anomalyResult {
+	result := anomalyResult{
+		Name:       hv.name,
+		ExpSuccess: hv.expSuccess,
+	}
+	for _, iso := range isolations {
+		result.Isolations = append(result.Isolations, iso.String())
+	}
+	for i, pe := range plan {
+		result.Tuples++
+		err := hv.runHistory(i+1, pe.priorities, pe.isolations, pe.history, db, t)
+		result.Txns += hv.attempts
+		result.RestartHistories += hv.restartHistories
+		for _, slow := range hv.slow {
+			if result.SlowTxns == 0 {
+				result.SampleSlowTxn = fmt.Sprintf("%s: %s", pe, slow)
+			}
+			result.SlowTxns++
+		}
+		if retryErr, ok := err.(*retryExhaustedError); ok {
+			if result.RetryExhausted == 0 {
+				result.SampleRetryExhausted = fmt.Sprintf("%s: %s", pe, retryErr)
+			}
+			result.RetryExhausted++
+		} else if err != nil {
+			if result.Failures == 0 {
+				result.SampleFailure = fmt.Sprintf("%s: %s", pe, err)
+			}
+			result.Failures++
+			if hv.failFast {
+				log.Infof("stopping the %q anomaly at the first failure: %s", hv.name, result.SampleFailure)
+				break
+			}
+		}
+	}
+	result.Passes = result.Tuples - result.Failures - result.RetryExhausted
+	if hv.cmdTimes != nil {
+		fmt.Print(hv.cmdTimesString())
+	}
+	if result.SlowTxns > 0 {
+		log.Warningf("%d txns of the %q anomaly exceeded the budget of %s, e.g. %s",
+			result.SlowTxns, hv.name, hv.txnBudget, result.SampleSlowTxn)
+	}
+	if result.RetryExhausted > 0 {
+		log.Warningf("%d tuples of the %q anomaly were not verified as a txn exhausted its retries, e.g. %s",
+			result.RetryExhausted, hv.name, result.SampleRetryExhausted)
+	}
+	return result
+}
+
+// slowTxns returns a description of each txn of the last history whose
+// duration exceeded the txn budget, ordered by txn index.
+func (hv *historyVerifier) slowTxns() []string {
+	if hv.txnBudget == 0 {
+		return nil
+	}
+	hv.Lock()
+	defer hv.Unlock()
+	var txnIdxs []int
+	for txnIdx, o := range hv.outcomes {
+		if o.elapsed > hv.txnBudget {
+			txnIdxs = append(txnIdxs, txnIdx)
+		}
+	}
+	sort.Ints(txnIdxs)
+	var slow []string
+	for _, txnIdx := range txnIdxs {
+		o := hv.outcomes[txnIdx]
+		slow = append(slow, fmt.Sprintf("txn%d took %s over %d attempts", txnIdx, o.elapsed, o.attempts))
+	}
+	return slow
+}
+
+// txnAttempts returns the number of times the txns of the last history
+// were run, counting each retry as another txn.
+func (hv *historyVerifier) txnAttempts() int {
+	hv.Lock()
+	defer hv.Unlock()
+	var attempts int
+	for _, o := range hv.outcomes {
+		attempts += o.attempts
+	}
+	return attempts
+}
+
+// anomalyResult summarizes the outcome of verifying every enumerated
+// (priority, isolation, history) tuple for a single anomaly. Results are
+// only written out when the --txn-correctness-json flag is set.
+type anomalyResult struct {
+	Name          string   `json:"name"`
+	Isolations    []string `json:"isolations"`
+	ExpSuccess    bool     `json:"expected_success"`
+	Tuples        int      `json:"tuples"`
+	Passes        int      `json:"passes"`
+	Failures      int      `json:"failures"`
+	SampleFailure string   `json:"sample_failure,omitempty"`
+	SlowTxns      int      `json:"slow_txns,omitempty"`
+	SampleSlowTxn string   `json:"sample_slow_txn,omitempty"`
+	// RetryExhausted counts the tuples in which a txn exhausted its
+	// retries. They are neither passes nor failures, as their results
+	// weren't verified.
+	RetryExhausted       int    `json:"retry_exhausted,omitempty"`
+	SampleRetryExhausted string `json:"sample_retry_exhausted,omitempty"`
+	// RestartHistories counts the histories following a restart which
+	// were run in addition to the tuples. See restartHistories.
+	RestartHistories int `json:"restart_histories,omitempty"`
+	// Txns is the number of txns run across all tuples, counting each
+	// retry, and ElapsedSecs the wall time taken to run them.
+	Txns        int     `json:"txns"`
+	ElapsedSecs float64 `json:"elapsed_secs"`
+}
+
+// appendTo appends the result as a single line of JSON to the named file,
+// creating the file if necessary.
+func (ar anomalyResult) appendTo(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(ar); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runHistory runs and verifies the planned history cmds and then each
+// history which may follow the restart of one of its txns, as enumerated
+// by restartHistories, so that anomalies which only occur once a txn has
+// retried aren't missed. Once it returns, the verifier's actual history,
+// commits and outcomes are those of the planned history. It returns the
+// first error of a history which failed verification or, failing that,
+// of one in which a txn exhausted its retries.
+func (hv *historyVerifier) runHistory(historyIdx int, priorities []int32,
+	isolations []proto.IsolationType, cmds []*cmd, db *client.DB, t *testing.T) error {
+	hv.restartHistories = 0
+	err := hv.runSingleHistory(historyIdx, priorities, isolations, cmds, db, t)
+	hv.attempts, hv.slow = hv.txnAttempts(), hv.slowTxns()
+	if err != nil {
+		return err
+	}
+	hv.Lock()
+	restarts, actual, commits, outcomes := hv.restarts, hv.actual, hv.commits, hv.outcomes
+	hv.Unlock()
+	defer func() {
+		hv.Lock()
+		hv.actual, hv.commits, hv.outcomes = actual, commits, outcomes
+		hv.Unlock()
+	}()
+	for _, r := range restarts {
+		for _, history := range restartHistories(cmds, r.txnIdx, r.pos) {
+			hv.restartIdx--
+			hv.restartHistories++
+			rErr := hv.runSingleHistory(hv.restartIdx, priorities, isolations, history, db, t)
+			hv.attempts += hv.txnAttempts()
+			for _, slow := range hv.slowTxns() {
+				hv.slow = append(hv.slow, fmt.Sprintf("following the restart of txn%d, %s", r.txnIdx, slow))
+			}
+			if _, ok := rErr.(*retryExhaustedError); ok {
+				// The history isn't verified, but doesn't prevent verifying
+				// the others.
+				if err == nil {
+					err = rErr
+				}
+			} else if rErr != nil {
+				return util.Errorf("history %s following the restart of txn%d: %s",
+					historyString(history), r.txnIdx, rErr)
+			}
+		}
+	}
+	return err
+}
+
+// runSingleHistory runs and verifies the history cmds, recording the
+// restarts of its txns.
+func (hv *historyVerifier) runSingleHistory(historyIdx int, priorities []int32,
+	isolations []proto.IsolationType, cmds []*cmd, db *client.DB, t *testing.T) error {
+	plannedStr := historyString(cmds)
+	if log.V(1) {
+		log.Infof("attempting iso=%v pri=%v history=%s", isolations, priorities, plannedStr)
+	}
+	if err := splitBoundaries(historyIdx, hv.verify.boundaries, db); err != nil {
+		t.Errorf("failed to split at boundaries %v: %s", hv.verify.boundaries, err)
+		return err
+	}
+
+	hv.actual = []string{}
+	hv.commits = map[int]proto.Timestamp{}
+	hv.outcomes = map[int]*txnOutcome{}
+	hv.txnIdxs = map[string]int{}
+	hv.restarts = nil
+	hv.retryCmds = nil
+	hv.wg.Add(len(priorities))
+	txnMap := map[int][]*cmd{}
+	var prev *cmd
+	for i, c := range cmds {
+		c.plannedIdx = i
+		c.historyIdx = historyIdx
+		c.priority = priorities[c.txnIdx-1]
+		c.recordCommit = hv.recordCommit
+		c.recordWrite = hv.recordWrite
+		c.recordRead = hv.recordRead
+		c.recordScan = hv.recordScan
+		if hv.cmdTimes != nil {
+			c.recordDuration = hv.recordDuration
+		}
+		c.db = db
+		c.eng = hv.eng
+		c.cluster = hv.cluster
+		c.txnOwner = hv.txnOwner
+		if c.restarted {
+			if hv.retryCmds == nil {
+				hv.retryCmds = map[int][]*cmd{}
+			}
+			hv.retryCmds[c.txnIdx] = append(hv.retryCmds[c.txnIdx], c)
+		} else {
+			txnMap[c.txnIdx] = append(txnMap[c.txnIdx], c)
+		}
+		c.init(prev)
+		prev = c
+
+		o, ok := hv.outcomes[c.txnIdx]
+		if !ok {
+			o = &txnOutcome{
+				priority:      priorities[c.txnIdx-1],
+				writes:        map[string]int64{},
+				plannedWrites: map[string]int{},
+				plannedCommit: len(cmds),
+				plannedStart:  i,
+				expRetry:      c.expRetry,
+				plannedTags:   map[string]int{},
+			}
+			hv.outcomes[c.txnIdx] = o
+		}
+		if c.conflictTag != "" {
+			o.plannedTags[c.conflictTag] = i
+		}
+		// Commands which write conditionally, e.g. ILT, are planned to
+		// write.
+		planWrite := func(key string) {
+			if _, ok := o.plannedWrites[key]; !ok {
+				o.plannedWrites[key] = i
+			}
+		}
+		switch c.name {
+		case "I", "W", "CPUT", "ILT", "CDEL", "SUM", "RFU":
+			planWrite(c.key)
+		case "XFER":
+			planWrite(c.key)
+			planWrite(c.toKey)
+		case "SEQ":
+			planWrite(seqKey)
+			planWrite(c.key)
+		case "INT", "VER", "CNT":
+			planWrite(c.toKey)
+		case "C":
+			o.plannedCommit = i
+		}
+	}
+	var obs *observer
+	if len(hv.verify.observe) > 0 {
+		obs = startObserver(historyIdx, hv.verify.observe, db)
+	}
+	// exhausted holds the first error of a txn which exhausted its
+	// retries. The history's result is then meaningless, so it isn't
+	// verified.
+	var exhausted struct {
+		sync.Mutex
+		err *retryExhaustedError
+	}
+	for i, txnCmds := range txnMap {
+		go func(i int, txnCmds []*cmd) {
+			if err := hv.runTxn(i, priorities[i-1], isolations[i-1], txnCmds, db, t); err != nil {
+				if retryErr, ok := err.(*retryExhaustedError); ok {
+					exhausted.Lock()
+					if exhausted.err == nil {
+						exhausted.err = retryErr
+					}
+					exhausted.Unlock()
+					return
+				}
+				t.Errorf("(%s): unexpected failure running %s: %v", cmds, cmds[i], err)
+			}
+		}(i, txnCmds)
+	}
+	hv.wg.Wait()
+	// Stop the observer before any return, so that it doesn't keep
+	// running against the histories which follow.
+	var observations []map[string]int64
+	var obsErr error
+	if obs != nil {
+		observations, obsErr = obs.stop()
+	}
+	if exhausted.err != nil {
+		return exhausted.err
+	}
+	if obsErr != nil {
+		t.Errorf("observer of %v failed: %s", hv.verify.observe, obsErr)
+		return obsErr
+	}
+
+	// Construct string for actual history.
+	actualStr := strings.Join(hv.actual, " ")
+
+	// Verify history.
+	var verifyStrs []string
+	verifyEnv := map[string]int64{}
+	for _, c := range hv.verifyCmds {
+		c.historyIdx = historyIdx
+		c.env = verifyEnv
+		c.eng = hv.eng
+		c.cluster = hv.cluster
+		c.txnOwner = hv.txnOwner
+		c.init(nil)
+		err := db.Txn(func(txn *client.Txn) error {
+			fmtStr, err := c.execute(txn, t)
+			if err != nil {
+				return err
+			}
+			cmdStr := fmt.Sprintf(fmtStr, 0, 0)
+			verifyStrs = append(verifyStrs, cmdStr)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("failed on execution of verification cmd %s: %s", c, err)
+			return err
+		}
+	}
+
+	if hv.observed != nil {
+		hv.observed[outcomeString(actualStr, verifyEnv)] = struct{}{}
+	}
+
+	err := hv.verify.checkFn(verifyEnv)
+	if err == nil && hv.verify.checkOrderFn != nil {
+		hv.Lock()
+		err = hv.verify.checkOrderFn(verifyEnv, hv.commits)
+		hv.Unlock()
+	}
+	if err == nil && hv.verify.checkOutcomeFn != nil {
+		hv.Lock()
+		err = hv.verify.checkOutcomeFn(verifyEnv, hv.outcomes)
+		hv.Unlock()
+	}
+	if err == nil && hv.verify.checkTimestampsFn != nil {
+		hv.Lock()
+		err = hv.verify.checkTimestampsFn(hv.commits, hv.outcomes)
+		hv.Unlock()
+	}
+	if err == nil {
+		hv.Lock()
+		err = checkExpectedRetries(hv.outcomes)
+		hv.Unlock()
+	}
+	if err == nil {
+		hv.Lock()
+		err = checkExpectedConflicts(hv.outcomes)
+		hv.Unlock()
+	}
+	if err == nil {
+		hv.Lock()
+		err = checkMonotonicReads(hv.outcomes)
+		hv.Unlock()
+	}
+	if err == nil && obs != nil {
+		hv.Lock()
+		err = checkAtomicObservations(hv.verify.observe, observations, hv.commits, hv.outcomes)
+		hv.Unlock()
+	}
+	if err == nil && *correctnessCheckSerializable && allSerializable(isolations) {
+		hv.Lock()
+		err = checkSerializable(hv.commits, hv.outcomes)
+		hv.Unlock()
+	}
+	if err == nil && *correctnessCheckAborted {
+		err = hv.checkAbortedWrites(historyIdx, db)
+	}
+	if err == nil {
+		if log.V(1) {
+			log.Infof("PASSED: iso=%v, pri=%v, history=%q", isolations, priorities, actualStr)
+		}
+	}
+	if hv.expSuccess && err != nil {
+		verifyStr := strings.Join(verifyStrs, " ")
+		t.Errorf("%d: iso=%v, pri=%v, history=%q: actual=%q, verify=%q: %s",
+			historyIdx, isolations, priorities, plannedStr, actualStr, verifyStr, err)
+	}
+	return err
+}
+
+// splitBoundaries splits the range at each of the given keys of the
+// history, deriving the keys as the history's commands do, and verifies
+// that each key is now the start key of a range. Routing a request for
+// a range's start key has historically been prone to off-by-one errors.
+func splitBoundaries(historyIdx int, boundaries []string, db *client.DB) error {
+	c := &cmd{historyIdx: historyIdx}
+	for _, boundary := range boundaries {
+		key := c.makeKey(boundary)
+		if err := db.AdminSplit(key); err != nil && !testutils.IsError(err, "range is already split") {
+			return err
+		}
+		desc := &proto.RangeDescriptor{}
+		if err := db.GetProto(keys.RangeDescriptorKey(key), desc); err != nil {
+			return err
+		}
+		if !bytes.Equal(desc.StartKey, key) {
+			return util.Errorf("expected a range to start at %q; found %s", key, desc)
+		}
+	}
+	return nil
+}
+
+// checkAbortedWrites reads back every key written by a txn which didn't
+// commit, and returns an error if any of those writes is visible.
+func (hv *historyVerifier) checkAbortedWrites(historyIdx int, db *client.DB) error {
+	hv.Lock()
+	writes := abortedWrites(hv.outcomes)
+	hv.Unlock()
+	c := &cmd{historyIdx: historyIdx}
+	for key, values := range writes {
+		if len(values) == 0 {
+			continue
+		}
+		r, err := db.Get(c.makeKey(key))
+		if err != nil {
+			return err
+		}
+		if r.Value == nil {
+			continue
+		}
+		if txnIdx, ok := values[r.ValueInt()]; ok {
+			return util.Errorf("value %s=%d written by txn%d, which didn't commit, is visible", key, r.ValueInt(), txnIdx)
+		}
+	}
+	return nil
+}
+
+// recordCommit records the commit timestamp of the specified txn.
+func (hv *historyVerifier) recordCommit(txnIdx int, ts proto.Timestamp) {
+	hv.Lock()
+	defer hv.Unlock()
+	hv.commits[txnIdx] = ts
+}
+
+// txnOwner returns the index of the current history's txn with the
+// given ID, or -1 if there is no such txn.
+func (hv *historyVerifier) txnOwner(id []byte) int {
+	hv.Lock()
+	defer hv.Unlock()
+	if txnIdx, ok := hv.txnIdxs[string(id)]; ok {
+		return txnIdx
+	}
+	return -1
+}
+
+// recordDuration adds the time taken to execute a command to the total
+// for its type.
+func (hv *historyVerifier) recordDuration(name string, d time.Duration) {
+	hv.Lock()
+	defer hv.Unlock()
+	ct, ok := hv.cmdTimes[name]
+	if !ok {
+		ct = &cmdTime{name: name}
+		hv.cmdTimes[name] = ct
+	}
+	ct.count++
+	ct.total += d
+}
+
+// cmdTimesString returns a summary of the time spent executing each type
+// of command, in decreasing order of total time.
+func (hv *historyVerifier) cmdTimesString() string {
+	hv.Lock()
+	defer hv.Unlock()
+	var cts []*cmdTime
+	var total time.Duration
+	for _, ct := range hv.cmdTimes {
+		cts = append(cts, ct)
+		total += ct.total
+	}
+	sort.Sort(byTotalTime(cts))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "command times for the %q anomaly:\n", hv.name)
+	for _, ct := range cts {
+		var pct float64
+		if total > 0 {
+			pct = 100 * float64(ct.total) / float64(total)
+		}
+		fmt.Fprintf(&buf, "  %-8s  %12s  %5.1f%%  (%d cmds, %s each)\n",
+			ct.name, ct.total, pct, ct.count, ct.total/time.Duration(ct.count))
+	}
+	return buf.String()
+}
+
+// recordWrite records a value written by the specified txn.
+func (hv *historyVerifier) recordWrite(txnIdx int, key string, value int64) {
+	hv.updateOutcome(txnIdx, func(o *txnOutcome) {
+		o.writes[key] = value
+	})
+}
+
+// recordRead records a value read by the specified txn, along with
+// its MVCC timestamp.
+func (hv *historyVerifier) recordRead(txnIdx int, key string, value int64, ts proto.Timestamp) {
+	hv.updateOutcome(txnIdx, func(o *txnOutcome) {
+		o.reads = append(o.reads, timestampedRead{key: key, value: value, ts: ts})
+	})
+}
+
+// recordScan records a span scanned by the specified txn.
+func (hv *historyVerifier) recordScan(txnIdx int, key, endKey string) {
+	hv.updateOutcome(txnIdx, func(o *txnOutcome) {
+		o.scans = append(o.scans, span{key: key, endKey: endKey})
+	})
+}
+
+// updateOutcome invokes fn with the outcome of the specified txn, if
+// outcomes are being tracked.
+func (hv *historyVerifier) updateOutcome(txnIdx int, fn func(o *txnOutcome)) {
+	hv.Lock()
+	defer hv.Unlock()
+	if o, ok := hv.outcomes[txnIdx]; ok {
+		fn(o)
+	}
+}
+
+// runNonTxn runs each of the commands as a single operation outside of
+// any txn.
+func (hv *historyVerifier) runNonTxn(txnIdx int, cmds []*cmd, t *testing.T) error {
+	defer hv.wg.Done()
+	env := map[string]int64{}
+	for i := range cmds {
+		cmds[i].env = env
+		if err := hv.runCmd(nil, txnIdx, 1, i, cmds, t); err != nil {
+			return err
+		}
+	}
+	hv.updateOutcome(txnIdx, func(o *txnOutcome) {
+		o.attempts = 1
+		o.committed = true
+	})
+	return nil
+}
+
+func (hv *historyVerifier) runTxn(txnIdx int, priority int32,
+	isolation proto.IsolationType, cmds []*cmd, db *client.DB, t *testing.T) error {
+	if cmds[0].nonTxnFn != nil {
+		return hv.runNonTxn(txnIdx, cmds, t)
+	}
+	var retry int
+	// failedIdx is the planned position of the command at which the
+	// first attempt failed, if any, and reset is set once cmds no longer
+	// wait on the planned history.
+	failedIdx := -1
+	var reset bool
+	txnName := fmt.Sprintf("txn%d", txnIdx)
+	start := time.Now()
+	err := db.Txn(func(txn *client.Txn) error {
+		txn.SetDebugName(txnName, 0)
+		// Always set the isolation explicitly so that the enumerated
+		// isolation doesn't depend on the server's default.
+		if err := txn.SetIsolation(isolation); err != nil {
+			return err
+		}
+		txn.InternalSetPriority(priority)
+
+		env := map[string]int64{}
+		sps := &savepoints{}
+		scanned := map[span]map[string]int64{}
+		written := map[string]struct{}{}
+		// On a restart, the histories containing the remaining commands
+		// of the other txns and all commands of this txn are verified
+		// separately, see restartHistories. Unless this attempt is planned
+		// by such a history, reset cmds so no waits.
+		if retry++; retry > 1 && !reset {
+			if retry == 2 && failedIdx >= 0 {
+				hv.Lock()
+				hv.restarts = append(hv.restarts, restart{txnIdx: txnIdx, pos: failedIdx})
+				hv.Unlock()
+			}
+			for _, c := range cmds {
+				c.done()
+			}
+			if retryCmds := hv.retryCmds[txnIdx]; retry == 2 && retryCmds != nil {
+				cmds = retryCmds
+			} else {
+				reset = true
+			}
+		}
+		if log.V(1) {
+			log.Infof("%s, retry=%d", txnName, retry)
+		}
+		hv.updateOutcome(txnIdx, func(o *txnOutcome) {
+			o.attempts = retry
+			o.reads = nil
+			o.scans = nil
+		})
+		for i := range cmds {
+			cmds[i].env = env
+			cmds[i].savepoints = sps
+			cmds[i].scanned = scanned
+			cmds[i].written = written
+			cmds[i].attempt = retry
+			if err := hv.runCmd(txn, txnIdx, retry, i, cmds, t); err != nil {
+				if retry == 1 {
+					failedIdx = cmds[i].plannedIdx
+				}
+				if _, ok := err.(*proto.TransactionAbortedError); ok {
+					hv.updateOutcome(txnIdx, func(o *txnOutcome) { o.aborts++ })
+				}
+				return err
+			}
+		}
+		hv.updateOutcome(txnIdx, func(o *txnOutcome) {
+			o.pushed = txn.Proto.OrigTimestamp.Less(txn.Proto.Timestamp)
+		})
+		return nil
+	})
+	elapsed := time.Since(start)
+	hv.updateOutcome(txnIdx, func(o *txnOutcome) {
+		o.committed = err == nil
+		o.elapsed = elapsed
+	})
+	if isRetryExhausted(err) {
+		err = &retryExhaustedError{txnIdx: txnIdx, attempts: retry, cause: err}
+	}
+	hv.wg.Done()
+	return err
+}
+
+func (hv *historyVerifier) runCmd(txn *client.Txn, txnIdx, retry, cmdIdx int, cmds []*cmd, t *testing.T) error {
+	fmtStr, err := cmds[cmdIdx].execute(txn, t)
+	// A command whose condition failed still shows in the actual history,
+	// with the actual value which failed it.
+	if _, ok := err.(*proto.ConditionFailedError); err != nil && !ok {
+		return err
+	}
+	hv.Lock()
+	defer hv.Unlock()
+	cmdStr := fmt.Sprintf(fmtStr, txnIdx, retry)
+	hv.actual = append(hv.actual, cmdStr)
+	if err != nil {
+		return err
+	}
+	// Commands of histories run without a txn have no txn ID to map.
+	if txn != nil && len(txn.Proto.ID) > 0 && hv.txnIdxs != nil {
+		hv.txnIdxs[string(txn.Proto.ID)] = txnIdx
+	}
+	return nil
+}
+
+// TestRunTxnIsolation verifies that runTxn runs each transaction at
+// exactly the requested isolation.
+func TestRunTxnIsolation(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+
+	for _, isolation := range bothIsolations {
+		var actual proto.IsolationType
+		c := &cmd{
+			name: "ISO",
+			fn: func(c *cmd, txn *client.Txn, t *testing.T) error {
+				actual = txn.Proto.Isolation
+				return nil
+			},
+		}
+		hv := &historyVerifier{}
+		hv.wg.Add(1)
+		if err := hv.runTxn(1, 1, isolation, []*cmd{c}, s.DB, t); err != nil {
+			t.Fatal(err)
+		}
+		if actual != isolation {
+			t.Errorf("expected txn to run at %s isolation; got %s", isolation, actual)
+		}
+	}
+}
+
+// TestTxnPriorityEscalation verifies that a txn which loses a write
+// conflict to a higher priority txn restarts with an escalated priority,
+// making repeated losses, and so starvation, less likely. In the history
+// run, txn2 increments A while txn1's intent on A is still pending.
+func TestTxnPriorityEscalation(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, got %d", env["A"])
+			}
+			return nil
+		},
+	}
+	hv := newHistoryVerifier("priority escalation", []string{"I(A) C", "I(A) ESC C"}, verify, true, t)
+	txn1, txn2 := hv.txns[0], hv.txns[1]
+	history := []*cmd{txn1[0], txn2[0], txn1[1], txn2[1], txn2[2]}
+	isolations := []proto.IsolationType{proto.SERIALIZABLE, proto.SERIALIZABLE}
+	if err := hv.runHistory(0, []int32{3, 1}, isolations, history, s.DB, t); err != nil {
+		t.Fatal(err)
+	}
+	if attempts := hv.outcomes[2].attempts; attempts < 2 {
+		t.Errorf("expected txn2 to lose the conflict and restart, but it ran %d time(s)", attempts)
+	}
+}
+
+// TestTxnRetryExhausted verifies that a history in which a txn exhausts
+// its retries is counted apart from the histories which failed
+// verification. txn2 loses its conflict with txn1 and, allowed no
+// retries, gives up.
+func TestTxnRetryExhausted(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	defer func(maxRetries int, opts retry.Options) {
+		*correctnessMaxRetries, client.DefaultTxnRetryOptions = maxRetries, opts
+	}(*correctnessMaxRetries, client.DefaultTxnRetryOptions)
+	*correctnessMaxRetries = 1
+	s := createTestDB(t)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: invariant(sumOf, 2, "A"),
+	}
+	hv := newHistoryVerifier("retry exhausted", []string{"I(A) C", "I(A) C"}, verify, true, t)
+	txn1, txn2 := hv.txns[0], hv.txns[1]
+	plan := []planEntry{{
+		priorities: []int32{2, 1},
+		isolations: []proto.IsolationType{proto.SERIALIZABLE, proto.SERIALIZABLE},
+		history:    []*cmd{txn1[0], txn2[0], txn1[1], txn2[1]},
+	}}
+	result := hv.runPlan(plan, onlySerializable, s.DB, t)
+	if result.RetryExhausted != 1 || result.Failures != 0 || result.Passes != 0 {
+		t.Errorf("expected only an exhausted retry; got %+v", result)
+	}
+	if !strings.Contains(result.SampleRetryExhausted, "txn2 exhausted its retries") {
+		t.Errorf("expected txn2 to exhaust its retries; got %q", result.SampleRetryExhausted)
+	}
+}
+
+// TestTxnRestartHistories verifies that the histories following a
+// restart are verified once the planned history has been. txn1 restarts
+// after txn2 has written B, leaving txn2's commit to interleave with
+// each of txn1's commands on its second attempt.
+func TestTxnRestartHistories(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+
+	verify := &verifier{
+		history: "R(A) R(B)",
+		checkFn: allOf(invariant(sumOf, 1, "A"), invariant(sumOf, 1, "B")),
+	}
+	hv := newHistoryVerifier("restart histories", []string{"I(A) RESTART C", "I(B) C"}, verify, true, t)
+	txn1, txn2 := hv.txns[0], hv.txns[1]
+	plan := []planEntry{{
+		priorities: []int32{1, 2},
+		isolations: []proto.IsolationType{proto.SERIALIZABLE, proto.SERIALIZABLE},
+		history:    []*cmd{txn1[0], txn2[0], txn1[1], txn2[1], txn1[2]},
+	}}
+	result := hv.runPlan(plan, onlySerializable, s.DB, t)
+	if result.Passes != 1 || result.Failures != 0 {
+		t.Errorf("expected the tuple to pass; got %+v", result)
+	}
+	if result.RestartHistories != 4 {
+		t.Errorf("expected 4 histories following txn1's restart; got %d", result.RestartHistories)
+	}
+}
+
+// TestTxnIntentLifecycle verifies the intent written by a txn across
+// a restart. txn2 observes the intent txn1 wrote before restarting,
+// txn1 observes its own intent once it has rewritten it on its second
+// attempt, and once txn1 commits its intent is resolved. txn3, run
+// without a txn, has no intents to map to a txn index.
+func TestTxnIntentLifecycle(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+
+	verify := &verifier{
+		history: "R(A) R(B) R(C) R(D)",
+		checkFn: allOf(invariant(sumOf, 1, "A"), invariant(sumOf, 1, "B"), invariant(sumOf, 1, "C"),
+			invariant(sumOf, 1, "D")),
+	}
+	hv := newHistoryVerifier("intent lifecycle",
+		[]string{"I(A) RESTART INT(A,B) C", "INT(A,C)", "NONTXN I(D)"}, verify, true, t)
+	hv.eng = s.Eng
+	txn1, txn2, txn3 := hv.txns[0], hv.txns[1], hv.txns[2]
+	history := []*cmd{txn1[0], txn2[0], txn3[0], txn1[1], txn1[2], txn1[3]}
+	isolations := []proto.IsolationType{proto.SERIALIZABLE, proto.SERIALIZABLE, proto.SERIALIZABLE}
+	if err := hv.runHistory(0, []int32{1, 1, 1}, isolations, history, s.DB, t); err != nil {
+		t.Fatal(err)
+	}
+	if attempts := hv.outcomes[1].attempts; attempts != 2 {
+		t.Errorf("expected txn1 to run twice, but it ran %d time(s)", attempts)
+	}
+	// Intents are resolved asynchronously once their txn commits.
+	key := txn1[0].getKey()
+	util.SucceedsWithin(t, time.Second, func() error {
+		intent, err := inspectIntent(s.Eng, key)
+		if err != nil {
+			return err
+		}
+		if intent != nil {
+			return util.Errorf("intent on %q is unresolved: %+v", key, intent)
+		}
+		return nil
+	})
+}
+
+// TestTxnHeartbeatLapse verifies that a txn whose heartbeat lapses is
+// aborted by a conflicting txn, even one with a lower priority, and that
+// heartbeating the txn again before the conflict keeps it alive.
+func TestTxnHeartbeatLapse(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, got %d", env["A"])
+			}
+			return nil
+		},
+	}
+	isolations := []proto.IsolationType{proto.SERIALIZABLE, proto.SERIALIZABLE}
+
+	// Without a heartbeat, txn2 aborts txn1 despite its lower priority.
+	hv := newHistoryVerifier("heartbeat lapse", []string{"I(A) LAPSE C", "I(A) C"}, verify, true, t)
+	hv.cluster = s
+	txn1, txn2 := hv.txns[0], hv.txns[1]
+	history := []*cmd{txn1[0], txn1[1], txn2[0], txn2[1], txn1[2]}
+	if err := hv.runHistory(0, []int32{3, 1}, isolations, history, s.DB, t); err != nil {
+		t.Fatal(err)
+	}
+	if aborts := hv.outcomes[1].aborts; aborts == 0 {
+		t.Errorf("expected txn1 to be aborted once its heartbeat lapsed")
+	}
+	if attempts := hv.outcomes[2].attempts; attempts != 1 {
+		t.Errorf("expected txn2 to win the conflict, but it ran %d time(s)", attempts)
+	}
+
+	// With a heartbeat, txn1 is alive and wins the conflict by priority.
+	hv = newHistoryVerifier("heartbeat renewal", []string{"I(A) LAPSE HB C", "I(A) C"}, verify, true, t)
+	hv.cluster = s
+	txn1, txn2 = hv.txns[0], hv.txns[1]
+	history = []*cmd{txn1[0], txn1[1], txn1[2], txn2[0], txn1[3], txn2[1]}
+	if err := hv.runHistory(1, []int32{3, 1}, isolations, history, s.DB, t); err != nil {
+		t.Fatal(err)
+	}
+	if aborts := hv.outcomes[1].aborts; aborts != 0 {
+		t.Errorf("expected txn1 to survive its heartbeat, but it was aborted %d time(s)", aborts)
+	}
+	if attempts := hv.outcomes[2].attempts; attempts < 2 {
+		t.Errorf("expected txn2 to lose the conflict and restart, but it ran %d time(s)", attempts)
+	}
+}
+
+// TestTxnBudget verifies that txns exceeding the txn budget are counted
+// in the anomaly's summary without failing the history.
+func TestTxnBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error { return nil },
+	}
+	hv := newHistoryVerifier("txn budget", []string{"I(A) C"}, verify, true, t)
+	hv.txnBudget = time.Nanosecond
+	result := hv.runPlan(hv.Plan(onlySerializable), onlySerializable, s.DB, t)
+	if result.Failures != 0 {
+		t.Errorf("expected no failures; got %d", result.Failures)
+	}
+	if result.SlowTxns != result.Tuples {
+		t.Errorf("expected all %d txns to exceed the budget; got %d", result.Tuples, result.SlowTxns)
+	}
+	if !strings.Contains(result.SampleSlowTxn, "txn1 took") {
+		t.Errorf("unexpected sample slow txn %q", result.SampleSlowTxn)
+	}
+
+	hv.txnBudget = time.Hour
+	if result := hv.runPlan(hv.Plan(onlySerializable), onlySerializable, s.DB, t); result.SlowTxns != 0 {
+		t.Errorf("expected no txns to exceed the budget; got %d", result.SlowTxns)
+	}
+}
+
+// TestRunTxnName verifies that a NAME command sets the debug name of
+// the txn, and that the name is included in the txn's trace name.
+func TestRunTxnName(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+
+	cmds := parseHistory(1, "NAME(TRANSFER) I(A)", t)
+	var traceName string
+	cmds = append(cmds, &cmd{
+		name: "TRACE",
+		fn: func(c *cmd, txn *client.Txn, t *testing.T) error {
+			traceName = proto.NamedTransaction{Transaction: &txn.Proto}.TraceName()
+			return nil
+		},
+	})
+	hv := &historyVerifier{}
+	hv.wg.Add(1)
+	if err := hv.runTxn(1, 1, proto.SERIALIZABLE, cmds, s.DB, t); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(traceName, ` "txn1:transfer"`) {
+		t.Errorf("expected trace name to include the debug name; got %s", traceName)
+	}
+}
+
+// TestConditionalPutCmd verifies that CPUT writes the key only if it
+// holds the value the txn expects, and otherwise fails, reporting the
+// actual value in the actual history.
+func TestConditionalPutCmd(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+
+	if err := s.DB.Put("0.A", 5); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		history   string
+		expActual string
+		expValue  int64
+		expFailed bool
+	}{
+		// The txn expects A to be absent.
+		{"CPUT(A) C", "CPUT1.1(A)[failed 5]", 5, true},
+		{"R(A) CPUT(A) C", "CPUT1.1(A)[ok 6]", 6, false},
+		{"W(A=1) CPUT(A) C", "CPUT1.1(A)[ok 2]", 2, false},
+	}
+	for i, test := range testCases {
+		cmds := parseHistory(1, test.history, t)
+		hv := &historyVerifier{}
+		hv.wg.Add(1)
+		err := hv.runTxn(1, 1, proto.SERIALIZABLE, cmds, s.DB, t)
+		if _, ok := err.(*proto.ConditionFailedError); ok != test.expFailed {
+			t.Fatalf("%d: expected condition failure %t; got %v", i, test.expFailed, err)
+		} else if err != nil && !ok {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if actual := strings.Join(hv.actual, " "); !strings.Contains(actual, test.expActual) {
+			t.Errorf("%d: expected %s in the actual history; got %s", i, test.expActual, actual)
+		}
+		r, err := s.DB.Get("0.A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := r.ValueInt(); value != test.expValue {
+			t.Errorf("%d: expected A=%d; got %d", i, test.expValue, value)
+		}
+	}
+}
+
+// checkConcurrency creates a history verifier, starts a new database
+// and runs the verifier. The database's clock is configured with the
+// maximum offset specified by --txn-correctness-max-offset.
+func checkConcurrency(name string, isolations []proto.IsolationType, txns []string,
+	verify *verifier, expSuccess bool, t *testing.T) {
+	checkConcurrencyWithMaxOffset(name, isolations, txns, verify, expSuccess, *correctnessMaxOffset, t)
+}
+
+// checkConcurrencyWithMaxOffset is like checkConcurrency, but runs the
+// verifier against a database whose clock is configured with the given
+// maximum offset. A non-zero offset gives every transaction an
+// uncertainty interval, exercising uncertainty restarts.
+//
+// The full enumeration is repeated --txn-correctness-repeat times, each
+// against a fresh database, as an interleaving the enumeration doesn't
+// control may only rarely cause a failure.
+func checkConcurrencyWithMaxOffset(name string, isolations []proto.IsolationType, txns []string,
+	verify *verifier, expSuccess bool, maxOffset time.Duration, t *testing.T) {
+	verifier := newHistoryVerifier(name, txns, verify, expSuccess, t)
+	verifier.failFast = failFastEnabled()
+	plan := verifier.Plan(isolations)
+	if *correctnessPlan {
+		for i, pe := range plan {
+			fmt.Printf("%s %d: %s\n", name, i+1, pe)
+		}
+		return
+	}
+	if len(plan) == 0 {
+		// Every tuple was filtered out; don't bother starting a server.
+		return
+	}
+	for i := 1; i <= *correctnessRepeat; i++ {
+		if *correctnessRepeat > 1 {
+			log.Infof("repetition %d of %d of the %q anomaly", i, *correctnessRepeat, name)
+		}
+		if !runConcurrency(verifier, isolations, maxOffset, t) {
+			if *correctnessRepeat > 1 {
+				t.Errorf("the %q anomaly failed on repetition %d of %d", name, i, *correctnessRepeat)
+			}
+			return
+		}
+		verifier = newHistoryVerifier(name, txns, verify, expSuccess, t)
+		verifier.failFast = failFastEnabled()
+	}
+}
+
+// runConcurrency runs the verifier against a fresh database and returns
+// whether the test is still passing.
+func runConcurrency(verifier *historyVerifier, isolations []proto.IsolationType,
+	maxOffset time.Duration, t *testing.T) bool {
+	s := createTestDBWithMaxOffset(t, maxOffset)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+	verifier.eng = s.Eng
+	verifier.cluster = s
+	verifier.run(isolations, s.DB, t)
+	return !t.Failed()
+}
+
+// checkIsolationMatrix verifies the anomaly once per isolation level,
+// running every txn at that level, and prints a matrix of the levels
+// which permit and prevent it. The matrix is printed whether or not the
+// outcome matches expPrevented, which maps each isolation level to
+// whether it is expected to prevent the anomaly; a mismatch is reported
+// as a test error.
+func checkIsolationMatrix(name string, txns []string, verify *verifier,
+	expPrevented map[proto.IsolationType]bool, t *testing.T) {
+	// Failures are expected for some levels, so don't have runHistory
+	// report them; they're tallied and compared below instead.
+	verifier := newHistoryVerifier(name, txns, verify, false, t)
+	verifier.failFast = failFastEnabled()
+	plans := make([][]planEntry, len(bothIsolations))
+	var tuples int
+	for i, iso := range bothIsolations {
+		plans[i] = verifier.Plan([]proto.IsolationType{iso})
+		tuples += len(plans[i])
+		if *correctnessPlan {
+			for j, pe := range plans[i] {
+				fmt.Printf("%s %s %d: %s\n", name, iso, j+1, pe)
+			}
+		}
+	}
+	if *correctnessPlan || tuples == 0 {
+		return
+	}
+	s := createTestDBWithMaxOffset(t, *correctnessMaxOffset)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+	verifier.eng = s.Eng
+	verifier.cluster = s
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "isolation matrix for the %q anomaly:\n", name)
+	var mismatches []string
+	for i, iso := range bothIsolations {
+		if len(plans[i]) == 0 {
+			fmt.Fprintf(&buf, "  %-12s  skipped\n", iso)
+			continue
+		}
+		log.Infof("verifying the %q anomaly at %s isolation", name, iso)
+		result := verifier.runPlan(plans[i], []proto.IsolationType{iso}, s.DB, t)
+		prevented := result.Failures == 0
+		outcome := "prevents"
+		if !prevented {
+			outcome = "permits"
+		}
+		fmt.Fprintf(&buf, "  %-12s  %-8s  (%d/%d histories failed)", iso, outcome, result.Failures, result.Tuples)
+		if exp, ok := expPrevented[iso]; ok && exp != prevented {
+			fmt.Fprintf(&buf, "  UNEXPECTED")
+			mismatches = append(mismatches, fmt.Sprintf("%s %s it", iso, outcome))
+		}
+		buf.WriteString("\n")
+	}
+	fmt.Print(buf.String())
+	if len(mismatches) > 0 {
+		t.Errorf("unexpected isolation behavior for the %q anomaly: %s", name, strings.Join(mismatches, "; "))
+	}
+}
+
+// The following tests for concurrency anomalies include documentation
+// taken from the "Concurrency Control Chapter" from the Handbook of
+// Database Technology, written by Patrick O'Neil <poneil@cs.umb.edu>:
+// http://www.cs.umb.edu/~poneil/CCChapter.PDF.
+//
+// Notation for planned histories:
+//   R(x) - read from key "x"
+//   NR(x) - read from key "x", failing if the key is present
+//   RFU(x) - read from key "x" for update, writing the value back
+//   I(x) - increment key "x" by 1
+//   W(x=n) - write "n" to key "x"
+//   ILT(x,n) - increment key "x" by 1 if its value is below "n"
+//   SC(x-y) - scan values from keys "x"-"y", failing if any was written after the txn's snapshot
+//   SCO(x-y) - scan values from keys "x"-"y", failing if the keys are out of order
+//   RSC(x-y) - scan values from keys "x"-"y", failing if the rows differ from the txn's first RSC of "x"-"y"
+//   BSC(x-y,z-w) - scan values from keys "x"-"y" and "z"-"w" in one batch
+//   SUM(x) - sums all values read during txn and writes sum to "x"
+//   CNT(x-y,z) - counts rows in keys "x"-"y" and writes the count to "z"
+//   INT(x,y) - writes the index of the txn owning the intent on key "x", or 0 if none, to "y"
+//   VER(x,y) - writes the number of MVCC versions of key "x" to "y"
+//   SEQ(x) - increments the global sequence counter "SEQ" and writes the value obtained to "x"
+//   HB - heartbeat the txn's record at the current time
+//   LAPSE - advance the clock until the records of pending txns expire, unless heartbeated again
+//   XFER(x,y,n) - transfer "n" from key "x" to key "y"
+//   CDEL(x,n) - delete key "x" if its value is "n"
+//   CPUT(x) - write one more than the txn's value of key "x", failing the txn unless the key still holds it
+//   SP(x) - create savepoint "x"
+//   RB(x) - roll back to savepoint "x"
+//   SPLIT(x) - split the range at key "x"
+//   MERGE(x) - merge the range containing key "x" with the following range
+//   NAME(x) - set the txn's debug name, as shown in traces, to "x"
+//   ISO(x) - verify the txn currently runs at isolation "x", e.g. ISO(SNAPSHOT)
+//   RESTART - restart the txn, the first time it is reached only
+//   ESC - verify the txn's priority was escalated, if it has restarted
+//   C - commit
+//
+// A planned history prefixed with "NONTXN " runs each of its commands
+// as a single operation outside of any txn. Only R and I are supported.
+//
+// A planned history prefixed with "RETRY " is expected to retry: of any
+// two such txns whose planned executions overlap, at least one must
+// have been retried. See checkExpectedRetries.
+//
+// A command suffixed with "!" and a lower case tag, e.g. "I(A)!x", is
+// expected to conflict with the command of another txn carrying the same
+// tag, whenever both execute before either txn commits. See
+// checkExpectedConflicts.
+//
+// A planned history may start with macro definitions, each ending in a
+// semicolon, e.g. "DEFINE RI = R(A) I(A); RI C" expands to "R(A) I(A) C".
+//
+// Notation for actual histories:
+//   Rn.m(x) - read from txn "n" ("m"th retry) of key "x"
+//   NRn.m(x) - absent read from txn "n" ("m"th retry) of key "x"
+//   RFUn.m(x) - read for update from txn "n" ("m"th retry) of key "x"
+//   In.m(x) - increment from txn "n" ("m"th retry) of key "x"
+//   Wn.m(x=v) - write of "v" from txn "n" ("m"th retry) to key "x"
+//   CPUTn.m(x)[ok v] - conditional put of "v" from txn "n" ("m"th retry) to key "x"
+//   CPUTn.m(x)[failed v] - conditional put from txn "n" ("m"th retry) to key "x", which held "v"
+//   SCn.m(x-y) - scan from txn "n" ("m"th retry) of keys "x"-"y"
+//   SCOn.m(x-y) - ordered scan from txn "n" ("m"th retry) of keys "x"-"y"
+//   BSCn.m(x-y,z-w) - batch scan from txn "n" ("m"th retry) of keys "x"-"y" and "z"-"w"
+//   SUMn.m(x) - sums all values read from txn "n" ("m"th retry)
+//   CNTn.m(x-y,z) - count of keys "x"-"y" written to "z" by txn "n" ("m"th retry)
+//   INTn.m(x,y) - owner of the intent on "x" written to "y" by txn "n" ("m"th retry)
+//   XFERn.m(x,y,n) - transfer from txn "n" ("m"th retry) of "n" from "x" to "y"
+//   SPn.m(x) - savepoint "x" created by txn "n" ("m"th retry)
+//   RBn.m(x) - rollback to savepoint "x" by txn "n" ("m"th retry)
+//   SPLITn.m(x) - split at key "x" by txn "n" ("m"th retry)
+//   MERGEn.m(x) - merge of the range containing key "x" by txn "n" ("m"th retry)
+//   NAMEn.m(x) - debug name of txn "n" ("m"th retry) set to "x"
+//   ISOn.m(x) - isolation of txn "n" ("m"th retry) verified to be "x"
+//   Cn.m - commit of txn "n" ("m"th retry)
+
+// TestTxnDBInconsistentAnalysisAnomaly verifies that neither SI nor
+// SSI isolation are subject to the inconsistent analysis anomaly.
+// This anomaly is also known as dirty reads and is prevented by the
+// READ_COMMITTED ANSI isolation level.
+//
+// With inconsistent analysis, there are two concurrent txns. One
+// reads keys A & B, the other reads and then writes keys A & B. The
+// reader must not see intermediate results from the reader/writer.
+//
+// Lost update would typically fail with a history such as:
+//    R1(A) R2(B) W2(B) R2(A) W2(A) R1(B) C1 C2
+func TestTxnDBInconsistentAnalysisAnomaly(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "R(A) R(B) SUM(C) C"
+	txn2 := "I(A) I(B) C"
+	verify := &verifier{
+		history: "R(C)",
+		checkFn: func(env map[string]int64) error {
+			if env["C"] != 2 && env["C"] != 0 {
+				return util.Errorf("expected C to be either 0 or 2, got %d", env["C"])
+			}
+			return nil
+		},
+		checkTimestampsFn: checkDependencyTimestamps,
+	}
+	checkConcurrency("inconsistent analysis", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBInconsistentAnalysisAnomalyWithClockOffset verifies that the
+// inconsistent analysis anomaly is still prevented when the clock has a
+// non-zero maximum offset. Every value written by txn2 then falls within
+// txn1's uncertainty interval, forcing uncertainty restarts.
+func TestTxnDBInconsistentAnalysisAnomalyWithClockOffset(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "R(A) R(B) SUM(C) C"
+	txn2 := "I(A) I(B) C"
+	verify := &verifier{
+		history: "R(C)",
+		checkFn: func(env map[string]int64) error {
+			if env["C"] != 2 && env["C"] != 0 {
+				return util.Errorf("expected C to be either 0 or 2, got %d", env["C"])
+			}
+			return nil
+		},
+	}
+	checkConcurrencyWithMaxOffset("inconsistent analysis with clock offset", bothIsolations,
+		[]string{txn1, txn2}, verify, true, 250*time.Millisecond, t)
+}
+
+// TestTxnDBLostUpdateAnomaly verifies that neither SI nor SSI isolation
+// are subject to the lost update anomaly. This anomaly is prevented
+// in most cases by using the the READ_COMMITTED ANSI isolation level.
+// However, only REPEATABLE_READ fully protects against it.
+//
+// With lost update, the write from txn1 is overwritten by the write
+// from txn2, and thus txn1's update is lost. Both SI and SSI notice
+// this write/write conflict and either txn1 or txn2 is aborted,
+// depending on priority.
+//
+// Lost update would typically fail with a history such as:
+//   R1(A) R2(A) I1(A) I2(A) C1 C2
+//
+// However, the following variant will cause a lost update in
+// READ_COMMITTED and in practice requires REPEATABLE_READ to avoid.
+//   R1(A) R2(A) I1(A) C1 I2(A) C2
+func TestTxnDBLostUpdateAnomaly(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn := "RETRY R(A) I(A) C"
+	verify := strictPriority(&verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, got %d", env["A"])
+			}
+			return nil
+		},
+		// Both txns write A, so they must have been serialized at
+		// distinct commit timestamps.
+		checkOrderFn: func(env map[string]int64, commits map[int]proto.Timestamp) error {
+			if len(commits) != 2 {
+				return util.Errorf("expected both txns to commit, got %v", commits)
+			}
+			if commits[1].Equal(commits[2]) {
+				return util.Errorf("expected distinct commit timestamps, got %s for both txns", commits[1])
+			}
+			return nil
+		},
+		// Whichever txn read the other's increment must have committed
+		// after it.
+		checkTimestampsFn: checkDependencyTimestamps,
+	}, "A")
+	checkConcurrency("lost update", bothIsolations, []string{txn, txn}, verify, true, t)
+}
+
+// TestTxnDBPhantomReadAnomaly verifies that neither SI nor SSI isolation
+// are subject to the phantom reads anomaly. This anomaly is prevented by
+// the SQL ANSI SERIALIZABLE isolation level, though it's also prevented
+// by snapshot isolation (i.e. Oracle's traditional "serializable").
+//
+// Phantom reads occur when a single txn does two identical queries but
+// ends up reading different results. This is a variant of non-repeatable
+// reads, but is special because it requires the database to be aware of
+// ranges when settling concurrency issues.
+//
+// Phantom reads would typically fail with a history such as:
+//   RSC1(A-C) I2(B) C2 RSC1(A-C) C1
+//
+// The rescan compares the rows of both scans, not just their sums, so a
+// phantom can't go unnoticed by happening to preserve the sum.
+func TestTxnDBPhantomReadAnomaly(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "RSC(A-C) SUM(D) RSC(A-C) SUM(E) C"
+	txn2 := "I(B) C"
+	verify := &verifier{
+		history: "R(D) R(E)",
+		checkFn: func(env map[string]int64) error {
+			if env["D"] != env["E"] {
+				return util.Errorf("expected first SUM == second SUM (%d != %d)", env["D"], env["E"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("phantom read", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBPhantomCountAnomaly is a variant of the phantom reads test
+// in which the invariant is about the number of rows in a range rather
+// than their sum: two identical counts in one txn must agree despite a
+// concurrent insert into the counted range.
+//
+// Phantom counts would typically fail with a history such as:
+//   CNT1(A-C,D) I2(B) C2 CNT1(A-C,E) C1
+func TestTxnDBPhantomCountAnomaly(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "CNT(A-C,D) CNT(A-C,E) C"
+	txn2 := "I(B) C"
+	verify := &verifier{
+		history: "R(D) R(E)",
+		checkFn: func(env map[string]int64) error {
+			if env["D"] != env["E"] {
+				return util.Errorf("expected first CNT == second CNT (%d != %d)", env["D"], env["E"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("phantom count", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBPhantomDeleteAnomaly verifies that neither SI nor SSI
+// isolation are subject to the phantom deletion anomaly; this is
+// similar to phantom reads, but verifies the delete range
+// functionality causes read/write conflicts.
+//
+// Phantom deletes would typically fail with a history such as:
+//   DR1(A-C) I2(B) C2 SC1(A-C) C1
+//
+// In addition to the summed scan, txn1 explicitly verifies that the
+// concurrently incremented key B is absent after the delete range.
+func TestTxnDBPhantomDeleteAnomaly(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "DR(A-C) SC(A-C) SUM(D) NR(B) C"
+	txn2 := "I(B) C"
+	verify := &verifier{
+		history: "R(D)",
+		checkFn: func(env map[string]int64) error {
+			if env["D"] != 0 {
+				return util.Errorf("expected delete range to yield an empty scan of same range, sum=%d", env["D"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("phantom delete", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBDeleteRangeAtomicity verifies that a delete range is atomic
+// with respect to concurrent scans. txn1 writes A and B, txn2 deletes
+// both, and txn3 counts the rows in between. As both txn1 and txn2
+// change either both rows or neither, the count must be 0 or 2; a count
+// of 1 would mean txn3 saw a partial deletion.
+//
+// A non-atomic delete range would fail with a history such as:
+//   I1(A) I1(B) DR2(A-C) CNT3(A-C,D) C2
+func TestTxnDBDeleteRangeAtomicity(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) I(B)"
+	txn2 := "DR(A-C) C"
+	txn3 := "CNT(A-C,D)"
+	verify := &verifier{
+		history: "R(D)",
+		checkFn: func(env map[string]int64) error {
+			if env["D"] != 0 && env["D"] != 2 {
+				return util.Errorf("expected the scan to see both rows or neither, but it counted %d", env["D"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("delete range atomicity", onlySerializable, []string{txn1, txn2, txn3}, verify, true, t)
+}
+
+// TestTxnDBMultiKeyAtomicity verifies that a concurrent reader sees
+// either all or none of the writes of a committed txn which wrote
+// several keys. An observer txn repeatedly reads A and B while the
+// txns, each of which increments both keys, run.
+func TestTxnDBMultiKeyAtomicity(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) I(B) C"
+	txn2 := "I(B) I(A) C"
+	verify := &verifier{
+		history: "R(A) R(B)",
+		checkFn: allOf(invariant(minOf, 2, "A", "B"), invariant(maxOf, 2, "A", "B")),
+		observe: []string{"A", "B"},
+	}
+	checkConcurrency("multi-key atomicity", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBMultiSpanScanConsistency verifies that a single batch
+// scanning several disjoint spans observes a consistent snapshot, even
+// when concurrent writers modify keys in each of the spans.
+//
+// Each writer increments one key in each of the two spans, so a
+// consistent reader must see either both or neither of a writer's
+// increments and the sum of the scanned values must be even. A torn
+// read would see txn2's increment of A but not its increment of D,
+// leaving an odd sum.
+func TestTxnDBMultiSpanScanConsistency(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "BSC(A-C,D-F) SUM(G)"
+	txn2 := "I(A) I(D)"
+	txn3 := "I(B) I(E)"
+	verify := &verifier{
+		history: "R(G)",
+		checkFn: func(env map[string]int64) error {
+			if env["G"]%2 != 0 {
+				return util.Errorf("expected G to be one of 0, 2 or 4, got %d", env["G"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("multi-span scan", onlySerializable, []string{txn1, txn2, txn3}, verify, true, t)
+}
+
+// TestTxnDBSavepointRollback verifies that rolling back to a savepoint
+// undoes only the writes made after the savepoint, and that concurrent
+// txns never observe the writes which were rolled back.
+//
+// Txn1 increments A, creates a savepoint, increments B and then rolls
+// back to the savepoint before committing. Only the increment of A may
+// persist, and txn2, which sums A and B, must see either nothing or
+// only the increment of A.
+func TestTxnDBSavepointRollback(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) SP(X) I(B) RB(X) C"
+	txn2 := "SC(A-C) SUM(D) C"
+	verify := &verifier{
+		history: "R(A) NR(B) R(D)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 1 {
+				return util.Errorf("expected A=1, got %d", env["A"])
+			}
+			if env["D"] != 0 && env["D"] != 1 {
+				return util.Errorf("expected D to be either 0 or 1, got %d", env["D"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("savepoint rollback", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBTransferConservation verifies that concurrent transfers
+// between a small set of accounts neither create nor destroy value
+// under serializable isolation.
+//
+// Each of three txns transfers a different amount around the cycle of
+// accounts A, B and C. The sum of all balances must remain zero, and
+// since all transfers commit, each balance is fully determined.
+func TestTxnDBTransferConservation(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "XFER(A,B,1) C"
+	txn2 := "XFER(B,C,2) C"
+	txn3 := "XFER(C,A,3) C"
+	verify := &verifier{
+		history: "R(A) R(B) R(C)",
+		checkFn: allOf(
+			invariant(sumOf, 0, "A", "B", "C"),
+			invariant(sumOf, 2, "A"),
+			invariant(sumOf, -1, "B"),
+			invariant(sumOf, -1, "C"),
+		),
+	}
+	checkConcurrency("transfer", onlySerializable, []string{txn1, txn2, txn3}, verify, true, t)
+}
+
+// TestTxnRecordsWrites verifies that the writes of commands which write
+// several keys, or write conditionally, are recorded and planned, so
+// that they're subject to the checks based on txn outcomes.
+func TestTxnRecordsWrites(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	s := createTestDB(t)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+
+	verify := &verifier{
+		history: "R(A) R(B) R(C)",
+		checkFn: allOf(invariant(sumOf, 0, "A"), invariant(sumOf, -1, "B"), invariant(sumOf, 1, "C")),
+	}
+	hv := newHistoryVerifier("records writes", []string{"XFER(B,A,1) C", "SEQ(C) CDEL(A,1) C"}, verify, true, t)
+	txn1, txn2 := hv.txns[0], hv.txns[1]
+	history := []*cmd{txn1[0], txn1[1], txn2[0], txn2[1], txn2[2]}
+	isolations := []proto.IsolationType{proto.SERIALIZABLE, proto.SERIALIZABLE}
+	if err := hv.runHistory(0, []int32{1, 1}, isolations, history, s.DB, t); err != nil {
+		t.Fatal(err)
+	}
+	expWrites := map[int]map[string]int64{
+		1: {"A": 1, "B": -1},
+		2: {seqKey: 1, "C": 1, "A": 0},
+	}
+	expPlannedWrites := map[int]map[string]int{
+		1: {"A": 0, "B": 0},
+		2: {seqKey: 2, "C": 2, "A": 3},
+	}
+	for txnIdx, o := range hv.outcomes {
+		if !reflect.DeepEqual(o.writes, expWrites[txnIdx]) {
+			t.Errorf("expected txn%d to write %v; got %v", txnIdx, expWrites[txnIdx], o.writes)
+		}
+		if !reflect.DeepEqual(o.plannedWrites, expPlannedWrites[txnIdx]) {
+			t.Errorf("expected txn%d to plan writes %v; got %v", txnIdx, expPlannedWrites[txnIdx], o.plannedWrites)
+		}
+	}
+}
+
+// TestExpandMacros verifies that macro definitions are expanded,
+// including references to earlier macros, and that histories without
+// definitions are left unchanged.
+func TestExpandMacros(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	testCases := []struct {
+		history  string
+		expected string
+	}{
+		{"R(A) I(A) C", "R(A) I(A) C"},
+		{"DEFINE RI = R(A) I(A); RI C", "R(A) I(A) C"},
+		{"DEFINE RI = R(A) I(A); DEFINE TWICE = RI RI; TWICE R(B) C", "R(A) I(A) R(A) I(A) R(B) C"},
+		{"DEFINE T = XFER(A,B,1); T T C", "XFER(A,B,1) XFER(A,B,1) C"},
+	}
+	for i, test := range testCases {
+		if history := expandMacros(test.history, t); history != test.expected {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, history)
+		}
+	}
+}
+
+// TestTxnDBMacroHistory verifies that a history written with macros
+// behaves exactly like its expanded form. This is the lost update test
+// with the read-modify-write sequence defined as a macro.
+func TestTxnDBMacroHistory(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn := "DEFINE RMW = R(A) I(A); RMW C"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, got %d", env["A"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("macro lost update", bothIsolations, []string{txn, txn}, verify, true, t)
+}
+
+// TestTxnDBInjectedFaultRetry verifies that a transient error on the
+// first attempt of a command is retried and doesn't produce an anomaly.
+// This is the lost update test with the initial read of the first txn
+// failing once with a simulated RPC timeout.
+func TestTxnDBInjectedFaultRetry(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn := "R(A) I(A) C"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, got %d", env["A"])
+			}
+			return nil
+		},
+	}
+	hv := newHistoryVerifier("injected fault", []string{txn, txn}, verify, true, t)
+	hv.injectFault(1, 0, &injectedError{msg: "simulated RPC timeout"})
+	s := createTestDB(t)
+	defer s.Stop()
+	setCorrectnessRetryOptions(s)
+	hv.run(bothIsolations, s.DB, t)
+}
+
+// TestTxnDBIncrementIdempotency verifies that the increments of a txn
+// which restarts are applied exactly once, not once per attempt. The
+// first txn is forced to restart after incrementing A, so it increments
+// A again on its second attempt.
+func TestTxnDBIncrementIdempotency(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) RESTART C"
+	txn2 := "I(A) C"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, got %d", env["A"])
+			}
+			return nil
+		},
+		checkOutcomeFn: func(env map[string]int64, outcomes map[int]*txnOutcome) error {
+			if o := outcomes[1]; o.attempts < 2 {
+				return util.Errorf("expected txn1 to restart, but it ran %d time(s)", o.attempts)
+			}
+			return nil
+		},
+	}
+	checkConcurrency("increment idempotency", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBIncrementCommutativity verifies that concurrent increments of
+// the same key are neither lost nor applied twice. Increments commute,
+// so every interleaving of txns consisting only of increments must leave
+// the key equal to the total number of increments, regardless of which
+// txns are retried or in what order they commit. Unlike the lost update
+// test, no txn reads the key first, so it's only the increments
+// themselves which conflict.
+func TestTxnDBIncrementCommutativity(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A)!x I(A) C"
+	txn2 := "I(A)!x C"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: invariant(sumOf, 3, "A"),
+	}
+	checkConcurrency("increment commutativity", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBConditionalDelete verifies that the condition of a
+// conditional delete is evaluated against a serializable snapshot. Two
+// txns each increment A while a third deletes it if it is 1. In any
+// serial order, A is either deleted between the increments and ends up
+// 1, or isn't deleted and ends up 2. If the condition were checked
+// against a stale value, A=1 could be deleted after the second
+// increment committed, leaving it absent.
+func TestTxnDBConditionalDelete(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) C"
+	txn2 := "CDEL(A,1) C"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 1 && env["A"] != 2 {
+				return util.Errorf("expected A to be 1 or 2, got %d", env["A"])
+			}
 			return nil
-		})
-		if err != nil {
-			t.Errorf("failed on execution of verification cmd %s: %s", c, err)
-			return err
-		}
+		},
 	}
+	checkConcurrency("conditional delete", onlySerializable, []string{txn1, txn1, txn2}, verify, true, t)
+}
 
-	err := hv.verify.checkFn(verifyEnv)
-	if err == nil {
-		if log.V(1) {
-			log.Infof("PASSED: iso=%v, pri=%v, history=%q", isolations, priorities, actualStr)
-		}
-	}
-	if hv.expSuccess && err != nil {
-		verifyStr := strings.Join(verifyStrs, " ")
-		t.Errorf("%d: iso=%v, pri=%v, history=%q: actual=%q, verify=%q: %s",
-			historyIdx, isolations, priorities, plannedStr, actualStr, verifyStr, err)
+// TestTxnDBOutcomeSet verifies the exact set of outcomes of two txns
+// incrementing different keys. They never conflict, so each of the six
+// interleavings of their commands must execute as planned, without any
+// retries, and no other outcome may appear.
+func TestTxnDBOutcomeSet(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) C"
+	txn2 := "I(B) C"
+	verify := &verifier{
+		history: "R(A) R(B)",
+		checkFn: invariant(sumOf, 2, "A", "B"),
+		expOutcomes: []string{
+			"I1.0(A)[1] C1.0 I2.0(B)[1] C2.0 => A=1 B=1",
+			"I1.0(A)[1] I2.0(B)[1] C1.0 C2.0 => A=1 B=1",
+			"I1.0(A)[1] I2.0(B)[1] C2.0 C1.0 => A=1 B=1",
+			"I2.0(B)[1] I1.0(A)[1] C1.0 C2.0 => A=1 B=1",
+			"I2.0(B)[1] I1.0(A)[1] C2.0 C1.0 => A=1 B=1",
+			"I2.0(B)[1] C2.0 I1.0(A)[1] C1.0 => A=1 B=1",
+		},
 	}
-	return err
+	checkConcurrency("outcome set", onlySerializable, []string{txn1, txn2}, verify, true, t)
 }
 
-func (hv *historyVerifier) runTxn(txnIdx int, priority int32,
-	isolation proto.IsolationType, cmds []*cmd, db *client.DB, t *testing.T) error {
-	var retry int
-	txnName := fmt.Sprintf("txn%d", txnIdx)
-	err := db.Txn(func(txn *client.Txn) error {
-		txn.SetDebugName(txnName, 0)
-		if isolation == proto.SNAPSHOT {
-			if err := txn.SetIsolation(proto.SNAPSHOT); err != nil {
-				return err
-			}
+// TestTxnDBSymmetricPruning verifies that skipping all but 1/N of the
+// histories of N identical txns hides no outcome. Each set of identical
+// txns is run with and without the pruning, and every outcome of the
+// full enumeration must match an outcome of the pruned one once the txns
+// are relabeled in the order in which they execute.
+func TestTxnDBSymmetricPruning(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	if *correctnessIso != "" || *correctnessPri != "" {
+		t.Skip("the enumerations can only be compared if no tuples are filtered out")
+	}
+	// runOutcomes runs the enumeration against a fresh database, as the
+	// keys of each history are only unique within an enumeration, and
+	// returns the canonical outcomes.
+	runOutcomes := func(txns []string, verify *verifier, symmetric bool) map[string]struct{} {
+		s := createTestDBWithMaxOffset(t, *correctnessMaxOffset)
+		defer s.Stop()
+		setCorrectnessRetryOptions(s)
+		hv := newHistoryVerifier("symmetric pruning", txns, verify, true, t)
+		hv.symmetric = symmetric
+		hv.eng = s.Eng
+		hv.cluster = s
+		hv.observed = map[string]struct{}{}
+		plan := hv.Plan(onlySerializable)
+		if result := hv.runPlan(plan, onlySerializable, s.DB, t); result.Failures > 0 {
+			t.Fatalf("%q (symmetric=%t): %s", txns[0], symmetric, result.SampleFailure)
 		}
-		txn.InternalSetPriority(priority)
+		return canonicalOutcomes(hv.observed)
+	}
 
-		env := map[string]int64{}
-		// TODO(spencer): restarts must create additional histories. They
-		// look like: given the current partial history and a restart on
-		// txn txnIdx, re-enumerate a set of all histories containing the
-		// remaining commands from extant txns and all commands from this
-		// restarted txn.
-
-		// If this is attempt > 1, reset cmds so no waits.
-		if retry++; retry == 2 {
-			for _, c := range cmds {
-				c.done()
-			}
+	testCases := []struct {
+		txn    string
+		verify *verifier
+	}{
+		{"R(A) C", &verifier{history: "R(A)", checkFn: invariant(sumOf, 0, "A")}},
+		{"I(A) C", &verifier{history: "R(A)", checkFn: invariant(sumOf, 2, "A")}},
+		{"I(A) I(B) C", &verifier{history: "R(A) R(B)", checkFn: invariant(sumOf, 4, "A", "B")}},
+	}
+	for _, test := range testCases {
+		txns := []string{test.txn, test.txn}
+		observed := [2]map[string]struct{}{
+			runOutcomes(txns, test.verify, true),
+			runOutcomes(txns, test.verify, false),
 		}
-		if log.V(1) {
-			log.Infof("%s, retry=%d", txnName, retry)
+		var pruned []string
+		for outcome := range observed[0] {
+			pruned = append(pruned, outcome)
 		}
-		for i := range cmds {
-			cmds[i].env = env
-			if err := hv.runCmd(txn, txnIdx, retry, i, cmds, t); err != nil {
-				return err
-			}
+		if err := checkOutcomeSet(pruned, observed[1], true); err != nil {
+			t.Errorf("%q: pruning changed the outcomes: %s", test.txn, err)
 		}
-		return nil
-	})
-	hv.wg.Done()
-	return err
+	}
 }
 
-func (hv *historyVerifier) runCmd(txn *client.Txn, txnIdx, retry, cmdIdx int, cmds []*cmd, t *testing.T) error {
-	fmtStr, err := cmds[cmdIdx].execute(txn, t)
-	if err != nil {
-		return err
+// TestTxnDBIncrementBelowLimit verifies that txns enforcing a quota with
+// a read-then-write never exceed it. Three txns each increment A unless
+// it has reached the limit of 2, so A must end up exactly 2 and one of
+// the txns must have found A at the limit.
+//
+// Both SI and SSI prevent the quota from being exceeded: the txns all
+// write A, and as with lost update, the write/write conflict restarts or
+// aborts all but one of any concurrent txns. SI would only exceed a
+// quota split across several keys, each txn reading all of them but
+// writing one, which is the write skew anomaly.
+func TestTxnDBIncrementBelowLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn := "ILT(A,2) C"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, the limit, got %d", env["A"])
+			}
+			return nil
+		},
 	}
-	hv.Lock()
-	cmdStr := fmt.Sprintf(fmtStr, txnIdx, retry)
-	hv.actual = append(hv.actual, cmdStr)
-	hv.Unlock()
-	return nil
+	checkIsolationMatrix("increment below limit", []string{txn, txn, txn}, verify, map[proto.IsolationType]bool{
+		proto.SERIALIZABLE: true,
+		proto.SNAPSHOT:     true,
+	}, t)
 }
 
-// checkConcurrency creates a history verifier, starts a new database
-// and runs the verifier.
-func checkConcurrency(name string, isolations []proto.IsolationType, txns []string,
-	verify *verifier, expSuccess bool, t *testing.T) {
-	verifier := newHistoryVerifier(name, txns, verify, expSuccess, t)
-	s := createTestDB(t)
-	defer s.Stop()
-	setCorrectnessRetryOptions(s.localSender)
-	verifier.run(isolations, s.DB, t)
+// TestTxnDBVersionCount verifies the MVCC versions retained for a key
+// written by several txns. A txn writing a key repeatedly rewrites its
+// intent, and restarts and pushes replace it, so each of the two
+// committed txns incrementing A leaves exactly one version, whether it
+// incremented A once or twice.
+func TestTxnDBVersionCount(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) I(A) C"
+	txn2 := "I(A) C"
+	verify := &verifier{
+		history: "R(A) VER(A,V)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 3 || env["V"] != 2 {
+				return util.Errorf("expected A=3 with 2 versions, got A=%d with %d versions", env["A"], env["V"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("version count", onlySerializable, []string{txn1, txn2}, verify, true, t)
 }
 
-// The following tests for concurrency anomalies include documentation
-// taken from the "Concurrency Control Chapter" from the Handbook of
-// Database Technology, written by Patrick O'Neil <poneil@cs.umb.edu>:
-// http://www.cs.umb.edu/~poneil/CCChapter.PDF.
-//
-// Notation for planned histories:
-//   R(x) - read from key "x"
-//   I(x) - increment key "x" by 1
-//   SC(x-y) - scan values from keys "x"-"y"
-//   SUM(x) - sums all values read during txn and writes sum to "x"
-//   C - commit
-//
-// Notation for actual histories:
-//   Rn.m(x) - read from txn "n" ("m"th retry) of key "x"
-//   In.m(x) - increment from txn "n" ("m"th retry) of key "x"
-//   SCn.m(x-y) - scan from txn "n" ("m"th retry) of keys "x"-"y"
-//   SUMn.m(x) - sums all values read from txn "n" ("m"th retry)
-//   Cn.m - commit of txn "n" ("m"th retry)
+// TestTxnDBMonotonicReads verifies that a txn re-reading a key while
+// another txn increments it never reads an older value than it already
+// has, at either isolation level. Every history is checked by
+// checkMonotonicReads; here the re-reads are interleaved with the
+// concurrent write and its commit.
+func TestTxnDBMonotonicReads(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "R(A) R(A) R(A) C"
+	txn2 := "I(A) C"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: invariant(sumOf, 1, "A"),
+	}
+	checkConcurrency("monotonic reads", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
 
-// TestTxnDBInconsistentAnalysisAnomaly verifies that neither SI nor
-// SSI isolation are subject to the inconsistent analysis anomaly.
-// This anomaly is also known as dirty reads and is prevented by the
-// READ_COMMITTED ANSI isolation level.
-//
-// With inconsistent analysis, there are two concurrent txns. One
-// reads keys A & B, the other reads and then writes keys A & B. The
-// reader must not see intermediate results from the reader/writer.
-//
-// Lost update would typically fail with a history such as:
-//    R1(A) R2(B) W2(B) R2(A) W2(A) R1(B) C1 C2
-func TestTxnDBInconsistentAnalysisAnomaly(t *testing.T) {
+// TestTxnDBSequenceOrder verifies that txns obtaining values from the
+// global sequence counter are serialized in the order of the values they
+// obtained, with no value lost or obtained twice, at either isolation
+// level.
+func TestTxnDBSequenceOrder(t *testing.T) {
 	defer leaktest.AfterTest(t)
-	txn1 := "R(A) R(B) SUM(C) C"
-	txn2 := "I(A) I(B) C"
+	txn1 := "SEQ(A) C"
+	txn2 := "R(A) SEQ(B) C"
 	verify := &verifier{
-		history: "R(C)",
-		checkFn: func(env map[string]int64) error {
-			if env["C"] != 2 && env["C"] != 0 {
-				return util.Errorf("expected C to be either 0 or 2, got %d", env["C"])
+		history:      "R(SEQ) R(A) R(B)",
+		checkFn:      allOf(invariant(sumOf, 2, seqKey), invariant(sumOf, 3, "A", "B")),
+		checkOrderFn: checkSequence("A", "B"),
+	}
+	checkConcurrency("sequence order", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBBlindWrite verifies that a txn blindly writing a key and a
+// txn incrementing it are serialized in the order of their commit
+// timestamps, at either isolation level: the increment is lost to the
+// write exactly if it committed first.
+func TestTxnDBBlindWrite(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "W(A=5) C"
+	txn2 := "I(A) C"
+	verify := &verifier{
+		history: "R(A)",
+		checkOrderFn: func(env map[string]int64, commits map[int]proto.Timestamp) error {
+			if len(commits) != 2 {
+				return util.Errorf("expected both txns to commit, got %v", commits)
+			}
+			switch env["A"] {
+			case 5:
+				if !commits[2].Less(commits[1]) {
+					return util.Errorf("expected the increment to commit before the write, got %v", commits)
+				}
+			case 6:
+				if !commits[1].Less(commits[2]) {
+					return util.Errorf("expected the write to commit before the increment, got %v", commits)
+				}
+			default:
+				return util.Errorf("expected A=5 or A=6, got %d", env["A"])
 			}
 			return nil
 		},
 	}
-	checkConcurrency("inconsistent analysis", bothIsolations, []string{txn1, txn2}, verify, true, t)
+	checkConcurrency("blind write", bothIsolations, []string{txn1, txn2}, verify, true, t)
 }
 
-// TestTxnDBLostUpdateAnomaly verifies that neither SI nor SSI isolation
-// are subject to the lost update anomaly. This anomaly is prevented
-// in most cases by using the the READ_COMMITTED ANSI isolation level.
-// However, only REPEATABLE_READ fully protects against it.
-//
-// With lost update, the write from txn1 is overwritten by the write
-// from txn2, and thus txn1's update is lost. Both SI and SSI notice
-// this write/write conflict and either txn1 or txn2 is aborted,
-// depending on priority.
-//
-// Lost update would typically fail with a history such as:
-//   R1(A) R2(A) I1(A) I2(A) C1 C2
-//
-// However, the following variant will cause a lost update in
-// READ_COMMITTED and in practice requires REPEATABLE_READ to avoid.
-//   R1(A) R2(A) I1(A) C1 I2(A) C2
-func TestTxnDBLostUpdateAnomaly(t *testing.T) {
+// TestTxnDBCompareAndSet verifies that txns incrementing a key by
+// reading it and conditionally writing one more than the value read
+// don't lose an update, at either isolation level.
+func TestTxnDBCompareAndSet(t *testing.T) {
 	defer leaktest.AfterTest(t)
-	txn := "R(A) I(A) C"
+	txn := "R(A) CPUT(A) C"
 	verify := &verifier{
 		history: "R(A)",
+		checkFn: invariant(sumOf, 2, "A"),
+	}
+	checkConcurrency("compare and set", bothIsolations, []string{txn, txn}, verify, true, t)
+}
+
+// TestTxnDBConcurrentSplit verifies that a txn writing keys on both
+// sides of a range boundary created by a concurrent split commits with
+// the expected results.
+func TestTxnDBConcurrentSplit(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "I(A) I(C) C"
+	txn2 := "SPLIT(B) C"
+	verify := &verifier{
+		history: "R(A) R(C)",
 		checkFn: func(env map[string]int64) error {
-			if env["A"] != 2 {
-				return util.Errorf("expected A=2, got %d", env["A"])
+			if env["A"] != 1 || env["C"] != 1 {
+				return util.Errorf("expected A=1 and C=1, got A=%d, C=%d", env["A"], env["C"])
 			}
 			return nil
 		},
 	}
-	checkConcurrency("lost update", bothIsolations, []string{txn, txn}, verify, true, t)
+	checkConcurrency("concurrent split", bothIsolations, []string{txn1, txn2}, verify, true, t)
 }
 
-// TestTxnDBPhantomReadAnomaly verifies that neither SI nor SSI isolation
-// are subject to the phantom reads anomaly. This anomaly is prevented by
-// the SQL ANSI SERIALIZABLE isolation level, though it's also prevented
-// by snapshot isolation (i.e. Oracle's traditional "serializable").
-//
-// Phantom reads occur when a single txn does two identical queries but
-// ends up reading different results. This is a variant of non-repeatable
-// reads, but is special because it requires the database to be aware of
-// ranges when settling concurrency issues.
-//
-// Phantom reads would typically fail with a history such as:
-//   SC1(A-C) I2(B) C2 SC1(A-C) C1
-func TestTxnDBPhantomReadAnomaly(t *testing.T) {
+// TestTxnDBConcurrentMerge verifies that a txn writing keys on both
+// sides of a range boundary which is created and then removed by a
+// concurrent split and merge commits with the expected results, or
+// restarts cleanly. Depending on the interleaving, the txn's writes
+// straddle the boundary when it appears, when it disappears, or both.
+func TestTxnDBConcurrentMerge(t *testing.T) {
 	defer leaktest.AfterTest(t)
-	txn1 := "SC(A-C) SUM(D) SC(A-C) SUM(E) C"
-	txn2 := "I(B) C"
+	txn1 := "I(A) I(C) C"
+	txn2 := "SPLIT(B) MERGE(A) C"
 	verify := &verifier{
-		history: "R(D) R(E)",
+		history: "R(A) R(C)",
+		checkFn: allOf(invariant(minOf, 1, "A", "C"), invariant(maxOf, 1, "A", "C")),
+	}
+	checkConcurrency("concurrent merge", bothIsolations, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBRangeBoundary verifies that reads and writes of a key which
+// is exactly the start key of a range are routed correctly. B is split
+// off before each history runs; both txns read and increment it, and
+// txn2 also scans across the boundary. No increment of B may be lost,
+// and the scan must see B, as the first key of its range.
+func TestTxnDBRangeBoundary(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "R(B) I(B) C"
+	txn2 := "I(A) SC(A-C) I(B) C"
+	verify := &verifier{
+		history:    "R(A) R(B)",
+		boundaries: []string{"B"},
 		checkFn: func(env map[string]int64) error {
-			if env["D"] != env["E"] {
-				return util.Errorf("expected first SUM == second SUM (%d != %d)", env["D"], env["E"])
+			if env["A"] != 1 || env["B"] != 2 {
+				return util.Errorf("expected A=1 and B=2, got A=%d, B=%d", env["A"], env["B"])
 			}
 			return nil
 		},
 	}
-	checkConcurrency("phantom read", bothIsolations, []string{txn1, txn2}, verify, true, t)
+	checkConcurrency("range boundary", bothIsolations, []string{txn1, txn2}, verify, true, t)
 }
 
-// TestTxnDBPhantomDeleteAnomaly verifies that neither SI nor SSI
-// isolation are subject to the phantom deletion anomaly; this is
-// similar to phantom reads, but verifies the delete range
-// functionality causes read/write conflicts.
-//
-// Phantom deletes would typically fail with a history such as:
-//   DR1(A-C) I2(B) C2 SC1(A-C) C1
-func TestTxnDBPhantomDeleteAnomaly(t *testing.T) {
+// TestTxnDBScanOrderAcrossSplit verifies that a scan spanning a range
+// boundary created by a concurrent split returns its keys in order.
+// txn1 writes keys on both sides of the boundary, and txn3 scans across
+// it, before or after the split, failing if the keys are out of order.
+func TestTxnDBScanOrderAcrossSplit(t *testing.T) {
 	defer leaktest.AfterTest(t)
-	txn1 := "DR(A-C) SC(A-C) SUM(D) C"
-	txn2 := "I(B) C"
+	txn1 := "I(A) I(C) C"
+	txn2 := "SPLIT(B) C"
+	txn3 := "SCO(A-D)"
 	verify := &verifier{
-		history: "R(D)",
+		history: "SCO(A-D)",
+		checkFn: allOf(invariant(minOf, 1, "A", "C"), invariant(maxOf, 1, "A", "C")),
+	}
+	checkConcurrency("scan order across split", onlySerializable, []string{txn1, txn2, txn3}, verify, true, t)
+}
+
+// TestTxnDBScanSnapshot verifies that a scan by a SNAPSHOT txn reflects
+// only the txn's snapshot, even when keys within the scanned span are
+// inserted concurrently. txn1 fixes its snapshot with a read of D before
+// scanning, and every scan fails if it returns a row written after the
+// snapshot. Since txn2 inserts A and B atomically, txn1 must see both or
+// neither, so the sum it writes to D is either 0 or 2.
+func TestTxnDBScanSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "R(D) SC(A-C) SUM(D) C"
+	txn2 := "I(A) I(B) C"
+	verify := &verifier{
+		history: "R(A) R(B) R(D)",
 		checkFn: func(env map[string]int64) error {
-			if env["D"] != 0 {
-				return util.Errorf("expected delete range to yield an empty scan of same range, sum=%d", env["D"])
+			if env["A"] != 1 || env["B"] != 1 {
+				return util.Errorf("expected A=1 and B=1, got A=%d, B=%d", env["A"], env["B"])
+			}
+			if env["D"] != 0 && env["D"] != 2 {
+				return util.Errorf("expected D to be either 0 or 2, got %d", env["D"])
 			}
 			return nil
 		},
 	}
-	checkConcurrency("phantom delete", bothIsolations, []string{txn1, txn2}, verify, true, t)
+	checkConcurrency("scan snapshot", onlySnapshot, []string{txn1, txn2}, verify, true, t)
+}
+
+// TestTxnDBIsolationUpgrade documents that a txn's isolation is never
+// changed while handling conflicts. In particular, a SNAPSHOT txn isn't
+// upgraded to SERIALIZABLE: when a write's timestamp is pushed past a
+// conflicting read, it commits at the pushed timestamp, whereas a
+// SERIALIZABLE txn must restart, and restarts at SERIALIZABLE. The txns
+// below conflict as in write skew, each writing the key the other read,
+// and verify their isolation after each conflicting command. Should some
+// conflict begin to upgrade the isolation, this test will fail and must
+// be updated to document when the upgrade happens.
+func TestTxnDBIsolationUpgrade(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	verify := &verifier{
+		history: "R(A) R(B)",
+		checkFn: allOf(invariant(minOf, 1, "A", "B"), invariant(maxOf, 1, "A", "B")),
+	}
+	for _, iso := range bothIsolations {
+		txn1 := fmt.Sprintf("R(B) ISO(%[1]s) I(A) ISO(%[1]s) C", iso)
+		txn2 := fmt.Sprintf("R(A) ISO(%[1]s) I(B) ISO(%[1]s) C", iso)
+		checkConcurrency(fmt.Sprintf("isolation upgrade at %s", iso), []proto.IsolationType{iso},
+			[]string{txn1, txn2}, verify, true, t)
+	}
+}
+
+// TestTxnDBNonTxnIncrement verifies that a txn which reads and then
+// increments a key doesn't lose a concurrent non-transactional
+// increment of the same key.
+func TestTxnDBNonTxnIncrement(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "R(A) I(A) C"
+	txn2 := "NONTXN I(A)"
+	verify := &verifier{
+		history: "R(A)",
+		checkFn: func(env map[string]int64) error {
+			if env["A"] != 2 {
+				return util.Errorf("expected A=2, got %d", env["A"])
+			}
+			return nil
+		},
+	}
+	checkConcurrency("non-txn increment", bothIsolations, []string{txn1, txn2}, verify, true, t)
 }
 
 // TestTxnDBWriteSkewAnomaly verifies that SI suffers from the write
@@ -774,6 +5425,51 @@ func TestTxnDBWriteSkewAnomaly(t *testing.T) {
 	defer leaktest.AfterTest(t)
 	txn1 := "SC(A-C) I(A) SUM(A) C"
 	txn2 := "SC(A-C) I(B) SUM(B) C"
+	verify := strictPriority(&verifier{
+		history: "R(A) R(B)",
+		checkFn: func(env map[string]int64) error {
+			if !((env["A"] == 1 && env["B"] == 2) || (env["A"] == 2 && env["B"] == 1)) {
+				return util.Errorf("expected either A=1, B=2 -or- A=2, B=1, but have A=%d, B=%d", env["A"], env["B"])
+			}
+			return nil
+		},
+	}, "A", "B")
+	checkIsolationMatrix("write skew", []string{txn1, txn2}, verify, map[proto.IsolationType]bool{
+		proto.SERIALIZABLE: true,
+		proto.SNAPSHOT:     false,
+	}, t)
+}
+
+// TestTxnDBSerializabilityOracle runs the write skew histories without
+// a bespoke invariant, relying on checkSerializable alone to find the
+// dependency cycle which SI permits.
+func TestTxnDBSerializabilityOracle(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	txn1 := "SC(A-C) I(A) SUM(A) C"
+	txn2 := "SC(A-C) I(B) SUM(B) C"
+	verify := &verifier{
+		history:           "R(A) R(B)",
+		checkFn:           func(env map[string]int64) error { return nil },
+		checkTimestampsFn: checkSerializable,
+	}
+	checkIsolationMatrix("serializability oracle", []string{txn1, txn2}, verify, map[proto.IsolationType]bool{
+		proto.SERIALIZABLE: true,
+		proto.SNAPSHOT:     false,
+	}, t)
+}
+
+// TestTxnDBReadForUpdate contrasts optimistic reads with reads for
+// update. Each txn reads the key the other one writes and writes the
+// sum of its reads, as in the write skew test. With plain reads, SI
+// doesn't notice the dependency between the txns, and each may write a
+// sum which misses the other's write. Reading for update turns each
+// read into a write/write conflict with the other txn's write, so the
+// txns are serialized under both isolations.
+//
+// With plain reads, SI would typically fail with a history such as:
+//   R1(B) R2(A) I1(A) SUM1(A) I2(B) SUM2(B) C1 C2
+func TestTxnDBReadForUpdate(t *testing.T) {
+	defer leaktest.AfterTest(t)
 	verify := &verifier{
 		history: "R(A) R(B)",
 		checkFn: func(env map[string]int64) error {
@@ -783,6 +5479,67 @@ func TestTxnDBWriteSkewAnomaly(t *testing.T) {
 			return nil
 		},
 	}
-	checkConcurrency("write skew", onlySerializable, []string{txn1, txn2}, verify, true, t)
-	checkConcurrency("write skew", onlySnapshot, []string{txn1, txn2}, verify, false, t)
+	checkConcurrency("optimistic read", onlySnapshot,
+		[]string{"R(B) I(A) SUM(A) C", "R(A) I(B) SUM(B) C"}, verify, false, t)
+	checkConcurrency("read for update", bothIsolations,
+		[]string{"RFU(B) I(A) SUM(A) C", "RFU(A) I(B) SUM(B) C"}, verify, true, t)
+}
+
+// anomalies maps the name of each anomaly to the test which verifies it,
+// so that a single anomaly can be run on its own by TestTxnDBAnomaly.
+var anomalies = map[string]func(t *testing.T){
+	"inconsistent analysis":                   TestTxnDBInconsistentAnalysisAnomaly,
+	"inconsistent analysis with clock offset": TestTxnDBInconsistentAnalysisAnomalyWithClockOffset,
+	"lost update":                             TestTxnDBLostUpdateAnomaly,
+	"phantom read":                            TestTxnDBPhantomReadAnomaly,
+	"phantom count":                           TestTxnDBPhantomCountAnomaly,
+	"phantom delete":                          TestTxnDBPhantomDeleteAnomaly,
+	"delete range atomicity":                  TestTxnDBDeleteRangeAtomicity,
+	"multi-key atomicity":                     TestTxnDBMultiKeyAtomicity,
+	"multi-span scan":                         TestTxnDBMultiSpanScanConsistency,
+	"savepoint rollback":                      TestTxnDBSavepointRollback,
+	"transfer":                                TestTxnDBTransferConservation,
+	"macro lost update":                       TestTxnDBMacroHistory,
+	"injected fault":                          TestTxnDBInjectedFaultRetry,
+	"increment idempotency":                   TestTxnDBIncrementIdempotency,
+	"increment commutativity":                 TestTxnDBIncrementCommutativity,
+	"scan snapshot":                           TestTxnDBScanSnapshot,
+	"concurrent split":                        TestTxnDBConcurrentSplit,
+	"concurrent merge":                        TestTxnDBConcurrentMerge,
+	"range boundary":                          TestTxnDBRangeBoundary,
+	"non-txn increment":                       TestTxnDBNonTxnIncrement,
+	"write skew":                              TestTxnDBWriteSkewAnomaly,
+	"serializability oracle":                  TestTxnDBSerializabilityOracle,
+	"read for update":                         TestTxnDBReadForUpdate,
+	"isolation upgrade":                       TestTxnDBIsolationUpgrade,
+	"conditional delete":                      TestTxnDBConditionalDelete,
+	"outcome set":                             TestTxnDBOutcomeSet,
+	"increment below limit":                   TestTxnDBIncrementBelowLimit,
+	"version count":                           TestTxnDBVersionCount,
+	"monotonic reads":                         TestTxnDBMonotonicReads,
+	"sequence order":                          TestTxnDBSequenceOrder,
+	"blind write":                             TestTxnDBBlindWrite,
+	"compare and set":                         TestTxnDBCompareAndSet,
+}
+
+// TestTxnDBAnomaly runs the single anomaly named by
+// --txn-correctness-anomaly, restricted to the tuples matching the
+// --txn-correctness-iso and --txn-correctness-pri filters. For example:
+//
+//   go test ./kv -run TestTxnDBAnomaly -txn-correctness-anomaly="write skew" \
+//     -txn-correctness-iso=SNAPSHOT,SNAPSHOT -txn-correctness-pri=2,1
+func TestTxnDBAnomaly(t *testing.T) {
+	if *correctnessAnomaly == "" {
+		t.Skip("no anomaly selected with --txn-correctness-anomaly")
+	}
+	fn, ok := anomalies[*correctnessAnomaly]
+	if !ok {
+		var names []string
+		for name := range anomalies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t.Fatalf("unknown anomaly %q; expected one of %q", *correctnessAnomaly, names)
+	}
+	fn(t)
 }
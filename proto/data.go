@@ -24,6 +24,7 @@ import (
 	"math/rand"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/biogo/store/interval"
@@ -472,6 +473,27 @@ func (t *Transaction) TraceName() string {
 	return "t" + t.Short()
 }
 
+// NamedTransaction wraps a Transaction to implement tracer.Traceable with a
+// trace name which also carries the transaction's debug name, so that its
+// traces can be told apart by name.
+type NamedTransaction struct {
+	*Transaction
+}
+
+// TraceName implements tracer.Traceable. It returns the transaction's
+// TraceName, followed by its debug name (if any) without the "file:line"
+// location prefix added by the client.
+func (n NamedTransaction) TraceName() string {
+	if n.Transaction == nil || len(n.ID) == 0 || n.Name == "" {
+		return n.Transaction.TraceName()
+	}
+	name := n.Name
+	if i := strings.Index(name, " "); i >= 0 {
+		name = name[i+1:]
+	}
+	return fmt.Sprintf("%s %q", n.Transaction.TraceName(), name)
+}
+
 // IsInitialized returns true if the transaction has been initialized.
 func (t *Transaction) IsInitialized() bool {
 	return len(t.ID) > 0
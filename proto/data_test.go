@@ -327,6 +327,32 @@ func TestTransactionString(t *testing.T) {
 	}
 }
 
+// TestNamedTransactionTraceName verifies that the trace name of a named
+// txn includes its debug name, without the location prefix, while that of
+// the txn itself doesn't.
+func TestNamedTransactionTraceName(t *testing.T) {
+	id := []byte("ת\x0f^\xe4-Fؽ\xf7\x16\xe4\xf9\xbe^\xbe")
+	testCases := []struct {
+		txn          *Transaction
+		expName      string
+		expNamedName string
+	}{
+		{nil, "(none)", "(none)"},
+		{&Transaction{Name: "name"}, "(none)", "(none)"},
+		{&Transaction{ID: id}, "td7aa0f5e", "td7aa0f5e"},
+		{&Transaction{ID: id, Name: "name"}, "td7aa0f5e", `td7aa0f5e "name"`},
+		{&Transaction{ID: id, Name: "txn.go:10 txn1 transfer"}, "td7aa0f5e", `td7aa0f5e "txn1 transfer"`},
+	}
+	for i, test := range testCases {
+		if name := test.txn.TraceName(); name != test.expName {
+			t.Errorf("%d: expected trace name %s; got %s", i, test.expName, name)
+		}
+		if name := (NamedTransaction{test.txn}).TraceName(); name != test.expNamedName {
+			t.Errorf("%d: expected named trace name %s; got %s", i, test.expNamedName, name)
+		}
+	}
+}
+
 // TestNodeList verifies that its exported methods Add() and Contain()
 // operate as expected.
 func TestNodeList(t *testing.T) {
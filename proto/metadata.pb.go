@@ -200,6 +200,9 @@ type StoreCapacity struct {
 	Capacity   int64 `protobuf:"varint,1,opt,name=Capacity" json:"Capacity"`
 	Available  int64 `protobuf:"varint,2,opt,name=Available" json:"Available"`
 	RangeCount int32 `protobuf:"varint,3,opt,name=RangeCount" json:"RangeCount"`
+	// IncomingSnapshots is the number of replicas the store has been asked to
+	// host which are still awaiting their initial snapshot.
+	IncomingSnapshots int32 `protobuf:"varint,4,opt,name=IncomingSnapshots" json:"IncomingSnapshots"`
 }
 
 func (m *StoreCapacity) Reset()         { *m = StoreCapacity{} }
@@ -227,6 +230,13 @@ func (m *StoreCapacity) GetRangeCount() int32 {
 	return 0
 }
 
+func (m *StoreCapacity) GetIncomingSnapshots() int32 {
+	if m != nil {
+		return m.IncomingSnapshots
+	}
+	return 0
+}
+
 // NodeDescriptor holds details on node physical/network topology.
 type NodeDescriptor struct {
 	NodeID  NodeID                        `protobuf:"varint,1,opt,name=node_id,casttype=NodeID" json:"node_id"`
@@ -266,6 +276,14 @@ type StoreDescriptor struct {
 	Attrs    Attributes     `protobuf:"bytes,2,opt,name=attrs" json:"attrs"`
 	Node     NodeDescriptor `protobuf:"bytes,3,opt,name=node" json:"node"`
 	Capacity StoreCapacity  `protobuf:"bytes,4,opt,name=capacity" json:"capacity"`
+	// health is the store's health score, ranging from 0 (completely
+	// unhealthy) to 1 (fully healthy). A store which doesn't report a score
+	// is considered fully healthy.
+	Health *float64 `protobuf:"fixed64,5,opt,name=health" json:"health,omitempty"`
+	// draining is set while the store is being decommissioned. A draining
+	// store is never chosen as a target for new replicas, and each of its
+	// replicas is replaced by one on another store before being removed.
+	Draining bool `protobuf:"varint,6,opt,name=draining" json:"draining"`
 }
 
 func (m *StoreDescriptor) Reset()         { *m = StoreDescriptor{} }
@@ -300,6 +318,20 @@ func (m *StoreDescriptor) GetCapacity() StoreCapacity {
 	return StoreCapacity{}
 }
 
+func (m *StoreDescriptor) GetHealth() float64 {
+	if m != nil && m.Health != nil {
+		return *m.Health
+	}
+	return 0
+}
+
+func (m *StoreDescriptor) GetDraining() bool {
+	if m != nil {
+		return m.Draining
+	}
+	return false
+}
+
 func (m *Attributes) Marshal() (data []byte, err error) {
 	size := m.Size()
 	data = make([]byte, size)
@@ -506,6 +538,9 @@ func (m *StoreCapacity) MarshalTo(data []byte) (int, error) {
 	data[i] = 0x18
 	i++
 	i = encodeVarintMetadata(data, i, uint64(m.RangeCount))
+	data[i] = 0x20
+	i++
+	i = encodeVarintMetadata(data, i, uint64(m.IncomingSnapshots))
 	return i, nil
 }
 
@@ -588,6 +623,19 @@ func (m *StoreDescriptor) MarshalTo(data []byte) (int, error) {
 		return 0, err
 	}
 	i += n5
+	if m.Health != nil {
+		data[i] = 0x29
+		i++
+		i = encodeFixed64Metadata(data, i, uint64(math.Float64bits(*m.Health)))
+	}
+	data[i] = 0x30
+	i++
+	if m.Draining {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
 	return i, nil
 }
 
@@ -700,6 +748,7 @@ func (m *StoreCapacity) Size() (n int) {
 	n += 1 + sovMetadata(uint64(m.Capacity))
 	n += 1 + sovMetadata(uint64(m.Available))
 	n += 1 + sovMetadata(uint64(m.RangeCount))
+	n += 1 + sovMetadata(uint64(m.IncomingSnapshots))
 	return n
 }
 
@@ -724,6 +773,10 @@ func (m *StoreDescriptor) Size() (n int) {
 	n += 1 + l + sovMetadata(uint64(l))
 	l = m.Capacity.Size()
 	n += 1 + l + sovMetadata(uint64(l))
+	if m.Health != nil {
+		n += 9
+	}
+	n += 2
 	return n
 }
 
@@ -1447,6 +1500,25 @@ func (m *StoreCapacity) Unmarshal(data []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field IncomingSnapshots", wireType)
+			}
+			m.IncomingSnapshots = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMetadata
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.IncomingSnapshots |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMetadata(data[iNdEx:])
@@ -1735,6 +1807,45 @@ func (m *StoreDescriptor) Unmarshal(data []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 1 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Health", wireType)
+			}
+			var v uint64
+			if (iNdEx + 8) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += 8
+			v = uint64(data[iNdEx-8])
+			v |= uint64(data[iNdEx-7]) << 8
+			v |= uint64(data[iNdEx-6]) << 16
+			v |= uint64(data[iNdEx-5]) << 24
+			v |= uint64(data[iNdEx-4]) << 32
+			v |= uint64(data[iNdEx-3]) << 40
+			v |= uint64(data[iNdEx-2]) << 48
+			v |= uint64(data[iNdEx-1]) << 56
+			v2 := float64(math.Float64frombits(v))
+			m.Health = &v2
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Draining", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMetadata
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Draining = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMetadata(data[iNdEx:])
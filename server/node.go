@@ -69,6 +69,11 @@ type Node struct {
 	feed       status.NodeEventFeed // Feed publisher for local events
 	status     *status.NodeStatusMonitor
 	startedAt  int64
+
+	// queueRejections holds the replicate queue rejection count of each
+	// store as of the last QueueFullEvent. Only accessed from the status
+	// publishing loop.
+	queueRejections map[proto.StoreID]int64
 }
 
 // allocateNodeID increments the node id generator key to allocate
@@ -162,9 +167,10 @@ func BootstrapCluster(clusterID string, engines []engine.Engine, stopper *stop.S
 // NewNode returns a new instance of Node.
 func NewNode(ctx storage.StoreContext) *Node {
 	return &Node{
-		ctx:     ctx,
-		status:  status.NewNodeStatusMonitor(),
-		lSender: kv.NewLocalSender(),
+		ctx:             ctx,
+		status:          status.NewNodeStatusMonitor(),
+		lSender:         kv.NewLocalSender(),
+		queueRejections: map[proto.StoreID]int64{},
 	}
 }
 
@@ -457,6 +463,12 @@ func (n *Node) startPublishStatuses(stopper *stop.Stopper) {
 				if err != nil {
 					log.Error(err)
 				}
+				if err := n.publishHealth(); err != nil {
+					log.Error(err)
+				}
+				if err := n.publishQueueRejections(); err != nil {
+					log.Error(err)
+				}
 			case <-stopper.ShouldStop():
 				return
 			}
@@ -471,6 +483,34 @@ func (n *Node) publishStoreStatuses() error {
 	})
 }
 
+// publishHealth publishes a summary of the node's health to the event feed.
+func (n *Node) publishHealth() error {
+	var liveStores, queueBacklog int
+	if err := n.lSender.VisitStores(func(store *storage.Store) error {
+		liveStores++
+		queueBacklog += store.QueueBacklog()
+		return nil
+	}); err != nil {
+		return err
+	}
+	n.feed.NodeHealth(n.ctx.Clock.PhysicalNow(), liveStores, queueBacklog)
+	return nil
+}
+
+// publishQueueRejections publishes a QueueFullEvent for each store whose
+// replicate queue has dropped replicas since the previous call.
+func (n *Node) publishQueueRejections() error {
+	return n.lSender.VisitStores(func(store *storage.Store) error {
+		storeID := store.StoreID()
+		rejections := store.ReplicateQueueRejections()
+		if delta := rejections - n.queueRejections[storeID]; delta > 0 {
+			n.feed.QueueFull(storeID, "replicate", delta)
+		}
+		n.queueRejections[storeID] = rejections
+		return nil
+	})
+}
+
 // executeCmd creates a proto.Call struct and sends it via our local sender.
 func (n *Node) executeCmd(argsI gogoproto.Message) (gogoproto.Message, error) {
 	args := argsI.(proto.Request)
@@ -41,6 +41,41 @@ type CallErrorEvent struct {
 	Method proto.Method
 }
 
+// CallUncertaintyRestartEvent is published when a call to a node fails
+// because it read a value within the uncertainty interval of its
+// transaction, requiring the transaction to restart. A spike in these
+// events is an indication of clock skew between nodes.
+type CallUncertaintyRestartEvent struct {
+	NodeID proto.NodeID
+	Method proto.Method
+}
+
+// NodeHealthEvent is published periodically by a running node. It serves as a
+// liveness signal which is independent of request traffic.
+type NodeHealthEvent struct {
+	NodeID    proto.NodeID
+	Timestamp int64
+	// LiveStores is the number of stores started on the node.
+	LiveStores int
+	// QueueBacklog is the total number of replicas waiting in the queues
+	// of all stores on the node.
+	QueueBacklog int
+}
+
+// QueueFullEvent is published by a node when a store's replicate queue has
+// dropped replicas because it was full since the previous event. Each
+// dropped replica is repair work which will only be retried once the
+// replica is next scanned, so a steady stream of these events means the
+// cluster cannot keep up with its repair demand.
+type QueueFullEvent struct {
+	NodeID  proto.NodeID
+	StoreID proto.StoreID
+	Queue   string
+	// Rejections is the number of replicas dropped since the previous
+	// QueueFullEvent for the same store and queue.
+	Rejections int64
+}
+
 // NodeEventFeed is a helper structure which publishes node-specific events to a
 // util.Feed. If the target feed is nil, event methods become no-ops.
 type NodeEventFeed struct {
@@ -81,6 +116,11 @@ func (nef NodeEventFeed) CallComplete(args proto.Request, reply proto.Response)
 			NodeID: nef.id,
 			Method: method,
 		})
+	} else if err != nil && err.GetDetail().GetReadWithinUncertaintyInterval() != nil {
+		nef.f.Publish(&CallUncertaintyRestartEvent{
+			NodeID: nef.id,
+			Method: method,
+		})
 	} else {
 		nef.f.Publish(&CallSuccessEvent{
 			NodeID: nef.id,
@@ -89,12 +129,37 @@ func (nef NodeEventFeed) CallComplete(args proto.Request, reply proto.Response)
 	}
 }
 
+// NodeHealth is called periodically by a running node to publish a summary of
+// its health.
+func (nef NodeEventFeed) NodeHealth(timestamp int64, liveStores, queueBacklog int) {
+	nef.f.Publish(&NodeHealthEvent{
+		NodeID:       nef.id,
+		Timestamp:    timestamp,
+		LiveStores:   liveStores,
+		QueueBacklog: queueBacklog,
+	})
+}
+
+// QueueFull is called by a node when one of its stores' queues has dropped
+// replicas because it was full.
+func (nef NodeEventFeed) QueueFull(storeID proto.StoreID, queue string, rejections int64) {
+	nef.f.Publish(&QueueFullEvent{
+		NodeID:     nef.id,
+		StoreID:    storeID,
+		Queue:      queue,
+		Rejections: rejections,
+	})
+}
+
 // NodeEventListener is an interface that can be implemented by objects which
 // listen for events published by nodes.
 type NodeEventListener interface {
 	OnStartNode(event *StartNodeEvent)
 	OnCallSuccess(event *CallSuccessEvent)
 	OnCallError(event *CallErrorEvent)
+	OnCallUncertaintyRestart(event *CallUncertaintyRestartEvent)
+	OnNodeHealth(event *NodeHealthEvent)
+	OnQueueFull(event *QueueFullEvent)
 	// TODO(tschottdorf): break this out into a TraceEventListener.
 	OnTrace(event *tracer.Trace)
 }
@@ -110,5 +175,11 @@ func ProcessNodeEvent(l NodeEventListener, event interface{}) {
 		l.OnCallSuccess(specificEvent)
 	case *CallErrorEvent:
 		l.OnCallError(specificEvent)
+	case *CallUncertaintyRestartEvent:
+		l.OnCallUncertaintyRestart(specificEvent)
+	case *NodeHealthEvent:
+		l.OnNodeHealth(specificEvent)
+	case *QueueFullEvent:
+		l.OnQueueFull(specificEvent)
 	}
 }
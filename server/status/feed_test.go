@@ -92,6 +92,42 @@ func TestNodeEventFeed(t *testing.T) {
 				Method: proto.Get,
 			},
 		},
+		{
+			name: "Get Uncertainty Restart",
+			publishTo: func(nef status.NodeEventFeed) {
+				call := proto.GetCall(proto.Key("abc"))
+				call.Reply.Header().SetGoError(&proto.ReadWithinUncertaintyIntervalError{})
+				nef.CallComplete(call.Args, call.Reply)
+			},
+			expected: &status.CallUncertaintyRestartEvent{
+				NodeID: proto.NodeID(1),
+				Method: proto.Get,
+			},
+		},
+		{
+			name: "Health",
+			publishTo: func(nef status.NodeEventFeed) {
+				nef.NodeHealth(200, 2, 5)
+			},
+			expected: &status.NodeHealthEvent{
+				NodeID:       proto.NodeID(1),
+				Timestamp:    200,
+				LiveStores:   2,
+				QueueBacklog: 5,
+			},
+		},
+		{
+			name: "QueueFull",
+			publishTo: func(nef status.NodeEventFeed) {
+				nef.QueueFull(proto.StoreID(2), "replicate", 3)
+			},
+			expected: &status.QueueFullEvent{
+				NodeID:     proto.NodeID(1),
+				StoreID:    proto.StoreID(2),
+				Queue:      "replicate",
+				Rejections: 3,
+			},
+		},
 	}
 
 	// Compile expected events into a single slice.
@@ -152,6 +188,9 @@ func (ner *nodeEventReader) recordEvent(event interface{}) {
 	case *status.CallErrorEvent:
 		nid = event.NodeID
 		eventStr = "failed " + event.Method.String()
+	case *status.CallUncertaintyRestartEvent:
+		nid = event.NodeID
+		eventStr = "uncertain " + event.Method.String()
 	}
 	if nid > 0 {
 		ner.perNodeFeeds[nid] = append(ner.perNodeFeeds[nid], eventStr)
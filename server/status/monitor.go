@@ -57,6 +57,14 @@ type NodeStatusMonitor struct {
 	startedAt  int64
 	callCount  int64
 	callErrors int64
+	// callUncertaintyRestarts counts calls which read a value within the
+	// uncertainty interval of their transaction.
+	callUncertaintyRestarts int64
+	// lastHealthAt is the timestamp of the most recent NodeHealthEvent,
+	// recorded as the node's "health.last" time series.
+	lastHealthAt int64
+	// queueRejections counts replicas dropped by full store queues.
+	queueRejections int64
 }
 
 // NewNodeStatusMonitor initializes a new NodeStatusMonitor instance.
@@ -211,6 +219,25 @@ func (nsm *NodeStatusMonitor) OnCallError(event *CallErrorEvent) {
 	atomic.AddInt64(&nsm.callErrors, 1)
 }
 
+// OnCallUncertaintyRestart receives CallUncertaintyRestartEvents from a node
+// event subscription. This method is part of the implementation of
+// NodeEventListener.
+func (nsm *NodeStatusMonitor) OnCallUncertaintyRestart(event *CallUncertaintyRestartEvent) {
+	atomic.AddInt64(&nsm.callUncertaintyRestarts, 1)
+}
+
+// OnNodeHealth receives NodeHealthEvents from a node event subscription. This
+// method is part of the implementation of NodeEventListener.
+func (nsm *NodeStatusMonitor) OnNodeHealth(event *NodeHealthEvent) {
+	atomic.StoreInt64(&nsm.lastHealthAt, event.Timestamp)
+}
+
+// OnQueueFull receives QueueFullEvents from a node event subscription. This
+// method is part of the implementation of NodeEventListener.
+func (nsm *NodeStatusMonitor) OnQueueFull(event *QueueFullEvent) {
+	atomic.AddInt64(&nsm.queueRejections, event.Rejections)
+}
+
 // OnTrace receives Trace objects from a node event subscription. This method
 // is part of the implementation of NodeEventListener.
 func (nsm *NodeStatusMonitor) OnTrace(trace *tracer.Trace) {
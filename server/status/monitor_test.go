@@ -153,6 +153,17 @@ func TestNodeStatusMonitor(t *testing.T) {
 				NodeID: proto.NodeID(1),
 				Method: proto.Scan,
 			},
+			&NodeHealthEvent{
+				NodeID:     proto.NodeID(1),
+				Timestamp:  int64(id) * 100,
+				LiveStores: 3,
+			},
+			&QueueFullEvent{
+				NodeID:     proto.NodeID(1),
+				StoreID:    id,
+				Queue:      "replicate",
+				Rejections: 2,
+			},
 		}
 		for _, event := range eventList {
 			feed.Publish(event)
@@ -194,4 +205,10 @@ func TestNodeStatusMonitor(t *testing.T) {
 	if a, e := monitor.callErrors, int64(3); a != e {
 		t.Errorf("monitored stats for node recorded wrong number of errors %d, expected %d", a, e)
 	}
+	if a, e := monitor.lastHealthAt, int64(300); a != e {
+		t.Errorf("monitored last health timestamp %d, expected %d", a, e)
+	}
+	if a, e := monitor.queueRejections, int64(6); a != e {
+		t.Errorf("monitored queue rejections %d, expected %d", a, e)
+	}
 }
@@ -100,6 +100,9 @@ func (nsr *NodeStatusRecorder) GetTimeSeriesData() []proto.TimeSeriesData {
 	now := nsr.clock.PhysicalNow()
 	data = append(data, nsr.recordInt(now, "calls.success", atomic.LoadInt64(&nsr.callCount)))
 	data = append(data, nsr.recordInt(now, "calls.error", atomic.LoadInt64(&nsr.callErrors)))
+	data = append(data, nsr.recordInt(now, "calls.uncertainty_restart", atomic.LoadInt64(&nsr.callUncertaintyRestarts)))
+	data = append(data, nsr.recordInt(now, "queue.rejections", atomic.LoadInt64(&nsr.queueRejections)))
+	data = append(data, nsr.recordInt(now, "health.last", atomic.LoadInt64(&nsr.lastHealthAt)))
 
 	// Record per store stats.
 	nsr.visitStoreMonitors(func(ssm *StoreStatusMonitor) {
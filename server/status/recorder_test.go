@@ -201,6 +201,20 @@ func TestNodeStatusRecorder(t *testing.T) {
 		NodeID: proto.NodeID(1),
 		Method: proto.Scan,
 	})
+	monitor.OnCallUncertaintyRestart(&CallUncertaintyRestartEvent{
+		NodeID: proto.NodeID(1),
+		Method: proto.Get,
+	})
+	monitor.OnQueueFull(&QueueFullEvent{
+		NodeID:     proto.NodeID(1),
+		StoreID:    proto.StoreID(1),
+		Queue:      "replicate",
+		Rejections: 4,
+	})
+	monitor.OnNodeHealth(&NodeHealthEvent{
+		NodeID:    proto.NodeID(1),
+		Timestamp: 90,
+	})
 
 	generateNodeData := func(nodeId int, name string, time, val int64) proto.TimeSeriesData {
 		return proto.TimeSeriesData{
@@ -271,6 +285,9 @@ func TestNodeStatusRecorder(t *testing.T) {
 		// Node stats.
 		generateNodeData(1, "calls.success", 100, 2),
 		generateNodeData(1, "calls.error", 100, 1),
+		generateNodeData(1, "calls.uncertainty_restart", 100, 1),
+		generateNodeData(1, "queue.rejections", 100, 4),
+		generateNodeData(1, "health.last", 100, 90),
 	}
 
 	actual := recorder.GetTimeSeriesData()
@@ -0,0 +1,135 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package status
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/tracer"
+)
+
+// TraceCollector is a NodeEventListener which accumulates the traces
+// published to a node event feed, keyed by trace ID, so that they can be
+// inspected after the fact. This allows tests to verify that a transaction or
+// operation took the expected internal path, e.g. that it performed a push.
+// All other node events are ignored.
+type TraceCollector struct {
+	sync.Mutex
+	traces map[string][]*tracer.Trace
+	ids    []string // trace IDs in the order first seen
+}
+
+// NewTraceCollector returns a new, empty TraceCollector.
+func NewTraceCollector() *TraceCollector {
+	return &TraceCollector{
+		traces: map[string][]*tracer.Trace{},
+	}
+}
+
+// StartCollectorFeed starts collecting the traces published to the supplied
+// feed.
+func (tc *TraceCollector) StartCollectorFeed(feed *util.Feed) {
+	feed.Subscribe(func(event interface{}) {
+		ProcessNodeEvent(tc, event)
+	})
+}
+
+// OnTrace records the trace under its ID. This method is part of the
+// implementation of NodeEventListener.
+func (tc *TraceCollector) OnTrace(trace *tracer.Trace) {
+	tc.Lock()
+	defer tc.Unlock()
+	if _, ok := tc.traces[trace.ID]; !ok {
+		tc.ids = append(tc.ids, trace.ID)
+	}
+	tc.traces[trace.ID] = append(tc.traces[trace.ID], trace)
+}
+
+// OnStartNode implements NodeEventListener.
+func (tc *TraceCollector) OnStartNode(event *StartNodeEvent) {}
+
+// OnCallSuccess implements NodeEventListener.
+func (tc *TraceCollector) OnCallSuccess(event *CallSuccessEvent) {}
+
+// OnCallError implements NodeEventListener.
+func (tc *TraceCollector) OnCallError(event *CallErrorEvent) {}
+
+// OnCallUncertaintyRestart implements NodeEventListener.
+func (tc *TraceCollector) OnCallUncertaintyRestart(event *CallUncertaintyRestartEvent) {}
+
+// OnNodeHealth implements NodeEventListener.
+func (tc *TraceCollector) OnNodeHealth(event *NodeHealthEvent) {}
+
+// OnQueueFull implements NodeEventListener.
+func (tc *TraceCollector) OnQueueFull(event *QueueFullEvent) {}
+
+// IDs returns the IDs of all collected traces, in the order in which each
+// was first received.
+func (tc *TraceCollector) IDs() []string {
+	tc.Lock()
+	defer tc.Unlock()
+	return append([]string(nil), tc.ids...)
+}
+
+// Traces returns the traces collected with the given ID, in the order in
+// which they were received. A transaction's trace ID is "t" followed by its
+// ID; see proto.Transaction.TraceID.
+func (tc *TraceCollector) Traces(id string) []*tracer.Trace {
+	tc.Lock()
+	defer tc.Unlock()
+	return append([]*tracer.Trace(nil), tc.traces[id]...)
+}
+
+// TracesByName returns the collected traces whose name contains the given
+// substring, in the order in which they were received. Since the trace name
+// of a proto.NamedTransaction includes its debug name, this allows the
+// traces of a named transaction to be found without knowing its ID.
+func (tc *TraceCollector) TracesByName(name string) []*tracer.Trace {
+	tc.Lock()
+	defer tc.Unlock()
+	var traces []*tracer.Trace
+	for _, id := range tc.ids {
+		for _, trace := range tc.traces[id] {
+			if strings.Contains(trace.Name, name) {
+				traces = append(traces, trace)
+			}
+		}
+	}
+	return traces
+}
+
+// HasEvent returns whether any trace collected with the given ID contains an
+// event or epoch whose name contains the given substring.
+func (tc *TraceCollector) HasEvent(id, event string) bool {
+	for _, trace := range tc.Traces(id) {
+		for _, item := range trace.Content {
+			if strings.Contains(item.Name, event) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reset discards all collected traces.
+func (tc *TraceCollector) Reset() {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.traces = map[string][]*tracer.Trace{}
+	tc.ids = nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package status_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/server/status"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/leaktest"
+	"github.com/cockroachdb/cockroach/util/stop"
+	"github.com/cockroachdb/cockroach/util/tracer"
+)
+
+// TestTraceCollector verifies that a TraceCollector accumulates the
+// traces published to a feed by ID and by name, and ignores other events.
+func TestTraceCollector(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	stopper := stop.NewStopper()
+	feed := util.NewFeed(stopper)
+	tc := status.NewTraceCollector()
+	tc.StartCollectorFeed(feed)
+	tr := tracer.NewTracer(feed, "test")
+
+	txn1 := &proto.Transaction{ID: []byte("0123456789abcdef"), Name: "file.go:1 txn1:transfer"}
+	txn2 := &proto.Transaction{ID: []byte("fedcba9876543210"), Name: "file.go:2 txn2:audit"}
+	for _, txn := range []*proto.Transaction{txn1, txn2, txn1} {
+		trace := tr.NewTrace(proto.NamedTransaction{Transaction: txn})
+		trace.Event("start")
+		if txn == txn2 {
+			trace.Event("push")
+		}
+		trace.Finalize()
+	}
+	status.NewNodeEventFeed(proto.NodeID(1), feed).StartNode(proto.NodeDescriptor{}, 0)
+
+	feed.Flush()
+	stopper.Stop()
+
+	if ids, exp := tc.IDs(), []string{txn1.TraceID(), txn2.TraceID()}; !reflect.DeepEqual(ids, exp) {
+		t.Errorf("expected trace IDs %v; got %v", exp, ids)
+	}
+	if traces := tc.Traces(txn1.TraceID()); len(traces) != 2 {
+		t.Errorf("expected 2 traces for txn1; got %d", len(traces))
+	}
+	if traces := tc.TracesByName("txn2:audit"); len(traces) != 1 || traces[0].ID != txn2.TraceID() {
+		t.Errorf("expected a single trace for txn2; got %v", traces)
+	}
+	if tc.HasEvent(txn1.TraceID(), "push") {
+		t.Error("expected no push event for txn1")
+	}
+	if !tc.HasEvent(txn2.TraceID(), "push") {
+		t.Error("expected a push event for txn2")
+	}
+
+	tc.Reset()
+	if ids := tc.IDs(); len(ids) != 0 {
+		t.Errorf("expected no trace IDs after reset; got %v", ids)
+	}
+}
@@ -22,6 +22,7 @@ package storage
 import (
 	"math"
 	"math/rand"
+	"time"
 
 	"github.com/cockroachdb/cockroach/config"
 	"github.com/cockroachdb/cockroach/proto"
@@ -50,6 +51,10 @@ const (
 	// probabilistic "jitter" to shouldRebalance() function: the store will not
 	// take every rebalancing opportunity available.
 	rebalanceShouldRebalanceChance = 0.05
+	// minStoreHealth is the lowest health score, as gossiped in the store's
+	// descriptor, with which a store will still be considered as a target for
+	// new replicas. Replicas already on an unhealthy store are left in place.
+	minStoreHealth = 0.5
 
 	// priorities for various repair operations.
 	removeDeadReplicaPriority  float64 = 10000
@@ -68,6 +73,10 @@ const (
 	AllocatorRemove
 	AllocatorAdd
 	AllocatorRemoveDead
+	// AllocatorReplace moves a replica to a new store, adding the new
+	// replica and removing the old one in a single pass of the replicate
+	// queue. It is never returned by ComputeAction; see RebalanceAction.
+	AllocatorReplace
 )
 
 // RebalancingOptions are configurable options which effect the way that the
@@ -82,6 +91,49 @@ type RebalancingOptions struct {
 	// will have random behavior. This flag is intended to be set for testing
 	// purposes only.
 	Deterministic bool
+
+	// BalanceBytes makes rebalancing decisions in clusters with very low disk
+	// usage consider the bytes used on each store in addition to range
+	// counts. When range sizes vary, balancing on counts alone can leave one
+	// store holding all of the large ranges.
+	BalanceBytes bool
+
+	// MaxNodeFractionUsed, if non-zero, prevents a store from being chosen
+	// as a target if the stores of its node, in aggregate, use more than
+	// this fraction of their capacity, even if the store itself has room.
+	MaxNodeFractionUsed float64
+
+	// WeightByFreeCapacity makes AllocateTarget choose amongst all valid
+	// stores at random, weighting each by its free capacity, rather than
+	// choosing the least loaded of a few. A newly added, empty store then
+	// receives new replicas in proportion to its free space instead of
+	// receiving nearly all of them.
+	WeightByFreeCapacity bool
+
+	// MaxFillPerPass, if non-zero, caps the bytes which AllocateTarget
+	// allocates to a single store between updates of its gossiped
+	// descriptor at this fraction of the store's capacity. Each allocation
+	// is assumed to be the size of an average replica.
+	MaxFillPerPass float64
+
+	// ReplaceOnRebalance makes rebalancing move a replica, removing one of
+	// the range's replicas as soon as the new one is added, instead of
+	// adding a replica and leaving the removal to a later pass. This avoids
+	// leaving the range over-replicated while the rebalance is underway.
+	ReplaceOnRebalance bool
+
+	// MaxIncomingSnapshots, if non-zero, prevents a store from being chosen
+	// as a target for a new replica while it is receiving this many
+	// snapshots, as reported in its gossiped capacity.
+	MaxIncomingSnapshots int
+
+	// FailureBackoff is the time the replicate queue waits before
+	// reprocessing a range whose last replication change failed. It doubles
+	// with each consecutive failure, up to MaxFailureBackoff, and is reset
+	// by a success. Zero values use defaultFailureBackoff and
+	// defaultMaxFailureBackoff.
+	FailureBackoff    time.Duration
+	MaxFailureBackoff time.Duration
 }
 
 // Allocator makes allocation decisions based on available capacity
@@ -125,6 +177,73 @@ func getUsedNodes(existing []proto.Replica) map[proto.NodeID]struct{} {
 	return usedNodes
 }
 
+// localityTiers returns the locality of the supplied store as a list of
+// tiers, ordered from the most to the least significant, e.g. region, zone
+// and rack. The tiers are the attributes of the node the store resides on,
+// in the order in which they were given, so that a locality may be written
+// as "region=us,zone=us-east,rack=3". A node with a single attribute (e.g.
+// its datacenter) has a locality of a single tier.
+func localityTiers(desc *proto.StoreDescriptor) []string {
+	return desc.Node.Attrs.Attrs
+}
+
+// sharedTiers returns the number of leading locality tiers which two
+// localities have in common.
+func sharedTiers(a, b []string) int {
+	var n int
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// localityOverlap returns, for each locality tier of the supplied store, the
+// number of existing replicas on other stores whose locality matches the
+// store's down to that tier. For example, the overlap [2 1] means that two
+// replicas are in the store's region, one of which is also in its zone.
+// Replicas on stores unknown to the store pool are not counted.
+func (a Allocator) localityOverlap(desc *proto.StoreDescriptor, existing []proto.Replica) []int {
+	tiers := localityTiers(desc)
+	overlap := make([]int, len(tiers))
+	for _, replica := range existing {
+		if replica.StoreID == desc.StoreID {
+			continue
+		}
+		other := a.storePool.getStoreDescriptor(replica.StoreID)
+		if other == nil {
+			continue
+		}
+		for i := 0; i < sharedTiers(tiers, localityTiers(other)); i++ {
+			overlap[i]++
+		}
+	}
+	return overlap
+}
+
+// compareOverlap compares two locality overlaps tier by tier, starting with
+// the most significant, and returns -1, 0 or 1 if a is less than, equal to
+// or greater than b. A store with the lesser overlap adds more diversity to
+// a range; the range is spread across distinct regions before distinct
+// zones. Missing tiers have no overlap.
+func compareOverlap(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
 // ComputeAction determines the exact operation needed to repair the supplied
 // range, as governed by the supplied zone configuration. It returns the
 // required action that should be taken and a replica on which the action should
@@ -142,15 +261,28 @@ func (a *Allocator) ComputeAction(zone config.ZoneConfig, desc *proto.RangeDescr
 
 	// TODO(mrtracy): Handle non-homogenous and mismatched attribute sets.
 	need := len(zone.ReplicaAttrs)
+	minNodes := int(zone.MinDistinctNodes)
 	have := len(desc.Replicas)
-	if have < need {
+	// Replicas on draining stores are about to be removed, so a replacement
+	// for each is added first in order to never drop below quorum.
+	remaining := have - len(a.storePool.drainingReplicas(desc.Replicas))
+	if remaining < need {
 		// Range is under-replicated, and should add an additional replica.
 		// Priority is adjusted by the difference between the current replica
 		// count and the quorum of the desired replica count.
 		neededQuorum := computeQuorum(need)
-		return AllocatorAdd, addMissingReplicaPriority + float64(neededQuorum-have)
+		return AllocatorAdd, addMissingReplicaPriority + float64(neededQuorum-remaining)
+	}
+	spanned := a.spannedNodes(desc.Replicas)
+	if spanned < minNodes {
+		// Range has enough replicas, but they span too few nodes; add a
+		// replica on another node.
+		return AllocatorAdd, addMissingReplicaPriority
 	}
-	if have > need {
+	// A replica may only be removed if doing so leaves the range spanning
+	// enough nodes: either it spans more than required, or some replica is
+	// draining or shares its node with another.
+	if have > need && (spanned > minNodes || have > spanned) {
 		// Range is over-replicated, and should remove a replica.
 		// Ranges with an even number of replicas get extra priority because
 		// they have a more fragile quorum.
@@ -163,25 +295,55 @@ func (a *Allocator) ComputeAction(zone config.ZoneConfig, desc *proto.RangeDescr
 
 // AllocateTarget returns a suitable store for a new allocation with the
 // required attributes. Nodes already accommodating existing replicas are ruled
-// out as targets. If relaxConstraints is true, then the required attributes
-// will be relaxed as necessary, from least specific to most specific, in order
-// to allocate a target. If needed, a filter function can be added that further
-// filter the results. The function will be passed the storeDesc and the used
-// and new counts. It returns a bool indicating inclusion or exclusion from the
-// set of stores being considered.
-func (a *Allocator) AllocateTarget(required proto.Attributes, existing []proto.Replica, relaxConstraints bool,
-	filter func(storeDesc *proto.StoreDescriptor, count, used *stat) bool) (*proto.StoreDescriptor, error) {
+// out as targets, as are stores whose localities hold more of the existing
+// replicas than others do, compared tier by tier (see localityOverlap). If no
+// target is found and the replicas can never span minNodes distinct nodes with
+// the stores available, the returned error says so. If relaxConstraints is
+// true, then the required attributes will be relaxed as necessary, from least
+// specific to most specific, in order to allocate a target. If needed, a filter
+// function can be added that further filter the results. The function will be
+// passed the storeDesc and the list of stores matching the required attributes,
+// along with its stats. It returns a bool indicating inclusion or exclusion
+// from the set of stores being considered.
+func (a *Allocator) AllocateTarget(required proto.Attributes, existing []proto.Replica, minNodes int, relaxConstraints bool,
+	filter func(storeDesc *proto.StoreDescriptor, sl *StoreList) bool) (*proto.StoreDescriptor, error) {
+	target, _, err := a.allocateTarget(required, existing, minNodes, relaxConstraints, filter)
+	return target, err
+}
+
+// allocateTarget implements AllocateTarget, additionally returning the
+// number of bytes reserved on the returned store.
+func (a *Allocator) allocateTarget(required proto.Attributes, existing []proto.Replica, minNodes int, relaxConstraints bool,
+	filter func(storeDesc *proto.StoreDescriptor, sl *StoreList) bool) (*proto.StoreDescriptor, int64, error) {
 	// Because more redundancy is better than less, if relaxConstraints, the
 	// matching here is lenient, and tries to find a target by relaxing an
 	// attribute constraint, from last attribute to first.
 	for attrs := append([]string(nil), required.Attrs...); ; attrs = attrs[:len(attrs)-1] {
-		stores, sl := a.selectRandom(3, proto.Attributes{Attrs: attrs}, existing)
+		count := 3
+		if a.options.WeightByFreeCapacity {
+			count = math.MaxInt32
+		}
+		stores, sl := a.selectRandom(count, proto.Attributes{Attrs: attrs}, existing)
+		var rangeBytes int64
+		if sl != nil {
+			rangeBytes = int64(sl.meanRangeBytes())
+		}
 
 		// Choose the store with the least fraction of bytes used.
 		var leastStore *proto.StoreDescriptor
+		var candidates []*proto.StoreDescriptor
 		for _, s := range stores {
 			// Filter store descriptor.
-			if filter != nil && !filter(s, &sl.count, &sl.used) {
+			if filter != nil && !filter(s, sl) {
+				continue
+			}
+			// Skip stores which have been allocated their fill for this pass.
+			if a.options.MaxFillPerPass > 0 && a.storePool.reservedBytes(s.StoreID)+rangeBytes >
+				int64(a.options.MaxFillPerPass*float64(s.Capacity.Capacity)) {
+				continue
+			}
+			if a.options.WeightByFreeCapacity {
+				candidates = append(candidates, s)
 				continue
 			}
 			if leastStore == nil {
@@ -199,51 +361,110 @@ func (a *Allocator) AllocateTarget(required proto.Attributes, existing []proto.R
 				leastStore = s
 			}
 		}
+		if a.options.WeightByFreeCapacity {
+			leastStore = a.selectWeighted(candidates)
+		}
 		if leastStore != nil {
-			return leastStore, nil
+			if a.options.WeightByFreeCapacity || a.options.MaxFillPerPass > 0 {
+				a.storePool.reserve(leastStore.StoreID, rangeBytes)
+				return leastStore, rangeBytes, nil
+			}
+			return leastStore, 0, nil
+		}
+		if len(attrs) == 0 || !relaxConstraints {
+			if available := a.availableNodes(existing); available < minNodes {
+				return nil, 0, util.Errorf("unable to allocate a target store; replicas must span at least %d "+
+					"distinct nodes, but only %d are available", minNodes, available)
+			}
 		}
 		if len(attrs) == 0 {
-			return nil, util.Errorf("unable to allocate a target store; no candidates available")
+			return nil, 0, util.Errorf("unable to allocate a target store; no candidates available")
 		} else if !relaxConstraints {
-			return nil, util.Errorf("unable to allocate a target store; no candidates available with attributes %s", required)
+			return nil, 0, util.Errorf("unable to allocate a target store; no candidates available with attributes %s", required)
+		}
+	}
+}
+
+// spannedNodes returns the number of distinct nodes holding the supplied
+// replicas, not counting replicas on draining stores.
+func (a Allocator) spannedNodes(existing []proto.Replica) int {
+	nodes := map[proto.NodeID]struct{}{}
+	for _, replica := range existing {
+		if !a.storePool.isDraining(replica.StoreID) {
+			nodes[replica.NodeID] = struct{}{}
+		}
+	}
+	return len(nodes)
+}
+
+// availableNodes returns the number of distinct nodes the supplied replicas
+// could span: the nodes already holding them, plus every node with a store
+// which is a valid allocation target.
+func (a Allocator) availableNodes(existing []proto.Replica) int {
+	nodes := getUsedNodes(existing)
+	for _, s := range a.storePool.getStoreList(proto.Attributes{}, a.options.Deterministic).stores {
+		if a.storePool.storeHealth(s.StoreID) >= minStoreHealth && !a.storePool.isDraining(s.StoreID) {
+			nodes[s.Node.NodeID] = struct{}{}
 		}
 	}
+	return len(nodes)
 }
 
 // RemoveTarget returns a suitable replica to remove from the provided replica
 // set. It attempts to consider which of the provided replicas would be the best
-// candidate for removal.
+// candidate for removal. Replicas on draining stores are always removed first,
+// followed by replicas sharing a node with another replica. Otherwise, replicas
+// in the locality holding the most replicas are preferred for removal, so that
+// removing a replica never reduces the number of localities the range spans.
+// Localities are compared tier by tier, so a replica is removed from the most
+// crowded zone of the most crowded region. Among the replicas which remain
+// equally good candidates, one other than the leaseholder's, on the store with
+// ID leaseStoreID, is preferred, so that removing a replica doesn't force an
+// unnecessary lease transfer. Pass 0 if the leaseholder is unknown. An error is
+// returned if the descriptor of any replica's store is unknown.
 //
 // TODO(mrtracy): removeTarget eventually needs to accept the attributes from
 // the zone config associated with the provided replicas. This will allow it to
 // make correct decisions in the case of ranges with heterogeneous replica
 // requirements (i.e. multiple data centers).
-func (a Allocator) RemoveTarget(existing []proto.Replica) (proto.Replica, error) {
+func (a Allocator) RemoveTarget(existing []proto.Replica, leaseStoreID proto.StoreID) (proto.Replica, error) {
 	if len(existing) == 0 {
 		return proto.Replica{}, util.Errorf("must supply at least one replica to allocator.RemoveTarget()")
 	}
 
 	// Retrieve store descriptors for the provided replicas from the StorePool.
 	type replStore struct {
-		repl  proto.Replica
-		store *proto.StoreDescriptor
+		repl    proto.Replica
+		store   *proto.StoreDescriptor
+		overlap []int
 	}
+	// A replica on a store which hasn't been gossiped can't be compared with
+	// the others, and removing one of the others instead could leave the
+	// range relying on a store nothing is known about. Don't guess.
 	replStores := make([]replStore, len(existing))
-	usedStat := stat{}
+	var sl StoreList
 	for i := range existing {
 		desc := a.storePool.getStoreDescriptor(existing[i].StoreID)
 		if desc == nil {
-			continue
+			return proto.Replica{}, util.Errorf("unable to choose a replica to remove: store %d has not been gossiped",
+				existing[i].StoreID)
 		}
 		replStores[i] = replStore{
 			repl:  existing[i],
 			store: desc,
 		}
-		usedStat.update(desc.Capacity.FractionUsed())
+		sl.add(desc)
 	}
 
-	// Based on store statistics, determine which replica is the "worst" and
-	// thus should be removed.
+	// Based on locality and store statistics, determine which replica is the
+	// "worst" and thus should be removed.
+	for i := range replStores {
+		replStores[i].overlap = a.localityOverlap(replStores[i].store, existing)
+	}
+	nodeCounts := map[proto.NodeID]int{}
+	for _, replica := range existing {
+		nodeCounts[replica.NodeID]++
+	}
 	var worst replStore
 	for i, rs := range replStores {
 		if i == 0 {
@@ -251,7 +472,50 @@ func (a Allocator) RemoveTarget(existing []proto.Replica) (proto.Replica, error)
 			continue
 		}
 
-		if usedStat.mean < minFractionUsedThreshold {
+		rsDraining := a.storePool.isDraining(rs.repl.StoreID)
+		worstDraining := a.storePool.isDraining(worst.repl.StoreID)
+		if rsDraining != worstDraining {
+			if rsDraining {
+				worst = rs
+			}
+			continue
+		}
+
+		rsShared := nodeCounts[rs.repl.NodeID] > 1
+		worstShared := nodeCounts[worst.repl.NodeID] > 1
+		if rsShared != worstShared {
+			if rsShared {
+				worst = rs
+			}
+			continue
+		}
+
+		if c := compareOverlap(rs.overlap, worst.overlap); c != 0 {
+			if c > 0 {
+				worst = rs
+			}
+			continue
+		}
+
+		rsLease := rs.repl.StoreID == leaseStoreID
+		worstLease := worst.repl.StoreID == leaseStoreID
+		if rsLease != worstLease {
+			if worstLease {
+				worst = rs
+			}
+			continue
+		}
+
+		if sl.used.mean < minFractionUsedThreshold {
+			// When balancing bytes and the stores differ by more than a
+			// typical replica in bytes used, prefer the one using more.
+			rsBytes, worstBytes := usedBytes(rs.store), usedBytes(worst.store)
+			if a.options.BalanceBytes && math.Abs(rsBytes-worstBytes) > sl.meanRangeBytes() {
+				if rsBytes > worstBytes {
+					worst = rs
+				}
+				continue
+			}
 			if rs.store.Capacity.RangeCount > worst.store.Capacity.RangeCount {
 				worst = rs
 			}
@@ -264,6 +528,62 @@ func (a Allocator) RemoveTarget(existing []proto.Replica) (proto.Replica, error)
 	return worst.repl, nil
 }
 
+// TransferLeaseTarget returns the replica to which the lease held by the
+// replica on the store with ID leaseStoreID should be transferred, such as
+// before the leaseholder's node is shut down. Replicas on the leaseholder's
+// node would stop along with it and are never chosen, nor are replicas on
+// dead stores or on stores which haven't been gossiped. Replicas on draining
+// or unhealthy stores are chosen only if no other replica remains.
+// Otherwise, the replica on the store holding the fewest ranges is chosen.
+// An error is returned if no replica is suitable.
+func (a Allocator) TransferLeaseTarget(existing []proto.Replica, leaseStoreID proto.StoreID) (proto.Replica, error) {
+	var leaseNodeID proto.NodeID
+	for _, repl := range existing {
+		if repl.StoreID == leaseStoreID {
+			leaseNodeID = repl.NodeID
+		}
+	}
+	if leaseNodeID == 0 {
+		return proto.Replica{}, util.Errorf("store %d does not hold a replica of the range", leaseStoreID)
+	}
+	dead := map[proto.StoreID]struct{}{}
+	for _, repl := range a.storePool.deadReplicas(existing) {
+		dead[repl.StoreID] = struct{}{}
+	}
+
+	var best proto.Replica
+	var bestStore *proto.StoreDescriptor
+	var bestDegraded bool
+	for _, repl := range existing {
+		if repl.NodeID == leaseNodeID {
+			continue
+		}
+		if _, ok := dead[repl.StoreID]; ok {
+			continue
+		}
+		desc := a.storePool.getStoreDescriptor(repl.StoreID)
+		if desc == nil {
+			continue
+		}
+		degraded := a.storePool.isDraining(repl.StoreID) || a.storePool.storeHealth(repl.StoreID) < minStoreHealth
+		if bestStore != nil {
+			if degraded != bestDegraded {
+				if degraded {
+					continue
+				}
+			} else if desc.Capacity.RangeCount >= bestStore.Capacity.RangeCount {
+				continue
+			}
+		}
+		best, bestStore, bestDegraded = repl, desc, degraded
+	}
+	if bestStore == nil {
+		return proto.Replica{}, util.Errorf("unable to transfer the lease from store %d; no live replica on another node",
+			leaseStoreID)
+	}
+	return best, nil
+}
+
 // RebalanceTarget returns a suitable store for a rebalance target
 // with required attributes. Rebalance targets are selected via the
 // same mechanism as AllocateTarget(), except the chosen target must
@@ -275,19 +595,41 @@ func (a Allocator) RemoveTarget(existing []proto.Replica) (proto.Replica, error)
 // is perfectly fine, as other stores in the cluster will also be
 // doing their probabilistic best to rebalance. This helps prevent
 // a stampeding herd targeting an abnormally under-utilized store.
+//
+// To avoid degrading the range's fault tolerance, a target is, as with
+// AllocateTarget, only chosen from the stores whose localities hold the
+// fewest of the range's existing replicas.
 func (a Allocator) RebalanceTarget(required proto.Attributes, existing []proto.Replica) *proto.StoreDescriptor {
-	filter := func(s *proto.StoreDescriptor, count, used *stat) bool {
+	target, _ := a.rebalanceTarget(required, existing)
+	return target
+}
+
+// rebalanceTarget implements RebalanceTarget, additionally returning the
+// number of bytes reserved on the returned store.
+func (a Allocator) rebalanceTarget(required proto.Attributes, existing []proto.Replica) (*proto.StoreDescriptor, int64) {
+	if !a.options.AllowRebalance {
+		return nil, 0
+	}
+	filter := func(s *proto.StoreDescriptor, sl *StoreList) bool {
 		// In clusters with very low disk usage, a store is eligible to be a
 		// rebalancing target if the number of ranges on that store is below
 		// average. This is primarily useful for distributing load evenly in a
-		// nascent deployment.
-		if used.mean < minFractionUsedThreshold {
-			return float64(s.Capacity.RangeCount) < count.mean
+		// nascent deployment. When balancing bytes, the store must also not
+		// use more bytes than average, unless it uses more than a typical
+		// replica fewer bytes than average.
+		if sl.used.mean < minFractionUsedThreshold {
+			belowCount := float64(s.Capacity.RangeCount) < sl.count.mean
+			if !a.options.BalanceBytes {
+				return belowCount
+			}
+			bytes := usedBytes(s)
+			return bytes < sl.usedBytes.mean-sl.meanRangeBytes() ||
+				(belowCount && bytes <= sl.usedBytes.mean)
 		}
 		// A store is eligible to be a rebalancing target if its disk usage is
 		// sufficiently below the mean usage for stores with matching
 		// attributes.
-		maxFractionUsed := used.mean * (1 - rebalanceFromMean)
+		maxFractionUsed := sl.used.mean * (1 - rebalanceFromMean)
 		if maxFractionUsedThreshold < maxFractionUsed {
 			// In clusters with very high average usage, rebalancing is clamped
 			// at maxFractionUsedThreshold: even if a store's usage is below
@@ -297,17 +639,55 @@ func (a Allocator) RebalanceTarget(required proto.Attributes, existing []proto.R
 		}
 		return s.Capacity.FractionUsed() < maxFractionUsed
 	}
-	if !a.options.AllowRebalance {
-		return nil
-	}
 	// Note that relaxConstraints is false; on a rebalance, there is
 	// no sense in relaxing constraints; wait until a better option
 	// is available.
-	s, err := a.AllocateTarget(required, existing, false /* relaxConstraints */, filter)
+	s, reserved, err := a.allocateTarget(required, existing, 0, false /* relaxConstraints */, filter)
 	if err != nil {
-		return nil
+		return nil, 0
 	}
-	return s
+	return s, reserved
+}
+
+// RebalanceAction returns the action with which a rebalance opportunity
+// is taken: AllocatorReplace if RebalancingOptions.ReplaceOnRebalance is
+// set and AllocatorAdd otherwise.
+func (a Allocator) RebalanceAction() AllocatorAction {
+	if a.options.ReplaceOnRebalance {
+		return AllocatorReplace
+	}
+	return AllocatorAdd
+}
+
+// ReplaceTarget returns a rebalance target for a range of rangeBytes bytes
+// along with the existing replica which should be removed once the new
+// replica has been added. Since the replica is moved rather than copied,
+// only stores with at least rangeBytes available are candidates; a target
+// is never over-committed by the move. Returns nil if there is no target
+// or if, with the target added, the allocator would remove the new
+// replica again. As with RemoveTarget, the leaseholder's replica is
+// replaced only if no other replica is as good a candidate. Any bytes
+// reserved on a target which is discarded are released.
+func (a Allocator) ReplaceTarget(required proto.Attributes, existing []proto.Replica,
+	rangeBytes int64, leaseStoreID proto.StoreID) (*proto.StoreDescriptor, proto.Replica) {
+	target, reserved := a.rebalanceTarget(required, existing)
+	if target == nil {
+		return nil, proto.Replica{}
+	}
+	if target.Capacity.Available < rangeBytes {
+		a.storePool.release(target.StoreID, reserved)
+		return nil, proto.Replica{}
+	}
+	newReplica := proto.Replica{
+		NodeID:  target.Node.NodeID,
+		StoreID: target.StoreID,
+	}
+	remove, err := a.RemoveTarget(append(append([]proto.Replica(nil), existing...), newReplica), leaseStoreID)
+	if err != nil || remove.StoreID == target.StoreID {
+		a.storePool.release(target.StoreID, reserved)
+		return nil, proto.Replica{}
+	}
+	return target, remove
 }
 
 // ShouldRebalance returns whether the specified store should attempt to
@@ -334,9 +714,17 @@ func (a Allocator) ShouldRebalance(storeID proto.StoreID) bool {
 
 	// In clusters with very low disk usage, a store is eligible for rebalancing
 	// if the number of ranges on the store is above average. This is primarily
-	// useful for distributing load in a nascent deployment.
+	// useful for distributing load in a nascent deployment. When balancing
+	// bytes, the store must also not use fewer bytes than average, unless it
+	// uses more than a typical replica more bytes than average.
 	if sl.used.mean < minFractionUsedThreshold {
-		return float64(storeDesc.Capacity.RangeCount) > math.Ceil(sl.count.mean)
+		aboveCount := float64(storeDesc.Capacity.RangeCount) > math.Ceil(sl.count.mean)
+		if !a.options.BalanceBytes {
+			return aboveCount
+		}
+		bytes := usedBytes(storeDesc)
+		return bytes > sl.usedBytes.mean+sl.meanRangeBytes() ||
+			(aboveCount && bytes >= sl.usedBytes.mean)
 	}
 	// A store is eligible for rebalancing if its disk usage is sufficiently above
 	// the mean usage for stores with matching attributes.
@@ -352,13 +740,22 @@ func (a Allocator) ShouldRebalance(storeID proto.StoreID) bool {
 
 // selectRandom chooses count random store descriptors which match the
 // required attributes and do not include any of the existing
-// replicas. If the supplied filter is nil, it is ignored. Returns the
-// list of matching descriptors, and the store list matching the
-// required attributes.
+// replicas. Stores with a health score below minStoreHealth, draining stores
+// and overcommitted stores (those with negative available capacity) are never
+// chosen, nor, if MaxNodeFractionUsed is set, are stores on nodes which are
+// nearly full, nor, if MaxIncomingSnapshots is set, are stores already
+// receiving that many snapshots. Of the remaining stores, only those adding
+// the most locality diversity to the range are chosen. If the supplied
+// filter is nil, it is ignored. Returns the list of matching descriptors,
+// and the store list matching the required attributes.
 func (a Allocator) selectRandom(count int, required proto.Attributes, existing []proto.Replica) ([]*proto.StoreDescriptor, *StoreList) {
 	var descs []*proto.StoreDescriptor
 	sl := a.storePool.getStoreList(required, a.options.Deterministic)
 	used := getUsedNodes(existing)
+	var nodeCapacities map[proto.NodeID]proto.StoreCapacity
+	if a.options.MaxNodeFractionUsed > 0 {
+		nodeCapacities = a.storePool.nodeCapacities()
+	}
 
 	// Randomly permute available stores matching the required attributes.
 	for _, idx := range a.randGen.Perm(len(sl.stores)) {
@@ -366,18 +763,86 @@ func (a Allocator) selectRandom(count int, required proto.Attributes, existing [
 		if _, ok := used[sl.stores[idx].Node.NodeID]; ok {
 			continue
 		}
-		// Add this store; exit loop if we've satisfied count.
-		descs = append(descs, sl.stores[idx])
-		if len(descs) >= count {
-			break
+		// Skip unhealthy and draining stores.
+		if a.storePool.storeHealth(sl.stores[idx].StoreID) < minStoreHealth ||
+			a.storePool.isDraining(sl.stores[idx].StoreID) {
+			continue
 		}
+		// Skip overcommitted stores; they are already full.
+		if sl.stores[idx].Capacity.Available < 0 {
+			continue
+		}
+		// Skip stores on nearly full nodes.
+		if nodeCapacities != nil &&
+			nodeCapacities[sl.stores[idx].Node.NodeID].FractionUsed() > a.options.MaxNodeFractionUsed {
+			continue
+		}
+		// Skip stores already receiving their fill of snapshots.
+		if a.options.MaxIncomingSnapshots > 0 &&
+			int(sl.stores[idx].Capacity.IncomingSnapshots) >= a.options.MaxIncomingSnapshots {
+			continue
+		}
+		descs = append(descs, sl.stores[idx])
 	}
+	// Only the stores adding the most locality diversity to the range are
+	// chosen; of those, the first count in the random order.
+	descs = a.mostDiverse(descs, existing)
 	if len(descs) == 0 {
 		return nil, nil
 	}
+	if len(descs) > count {
+		descs = descs[:count]
+	}
 	return descs, sl
 }
 
+// mostDiverse returns the supplied stores with the least locality overlap
+// with the existing replicas, preserving their order. See localityOverlap.
+func (a Allocator) mostDiverse(stores []*proto.StoreDescriptor, existing []proto.Replica) []*proto.StoreDescriptor {
+	var best []*proto.StoreDescriptor
+	var bestOverlap []int
+	for _, s := range stores {
+		overlap := a.localityOverlap(s, existing)
+		c := -1
+		if best != nil {
+			c = compareOverlap(overlap, bestOverlap)
+		}
+		if c < 0 {
+			best, bestOverlap = nil, overlap
+		}
+		if c <= 0 {
+			best = append(best, s)
+		}
+	}
+	return best
+}
+
+// selectWeighted chooses one of the stores at random, with each store's
+// chance of being chosen proportional to its free capacity less the bytes
+// allocated to it since it was last gossiped. It returns nil if no store
+// has free capacity.
+func (a Allocator) selectWeighted(stores []*proto.StoreDescriptor) *proto.StoreDescriptor {
+	weights := make([]int64, len(stores))
+	var total int64
+	for i, s := range stores {
+		if w := s.Capacity.Available - a.storePool.reservedBytes(s.StoreID); w > 0 {
+			weights[i] = w
+			total += w
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := a.randGen.Int63n(total)
+	for i, w := range weights {
+		if n < w {
+			return stores[i]
+		}
+		n -= w
+	}
+	return nil
+}
+
 // computeQuorum computes the quorum value for the given number of nodes.
 func computeQuorum(nodes int) int {
 	return (nodes / 2) + 1
@@ -30,6 +30,7 @@ import (
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/testutils"
 	"github.com/cockroachdb/cockroach/testutils/gossiputil"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/leaktest"
@@ -173,6 +174,21 @@ func createTestAllocator() (*stop.Stopper, *gossip.Gossip, *StorePool, Allocator
 	return stopper, g, storePool, a
 }
 
+// gossipStoreUpdate gossips a copy of the descriptor of the given store in
+// stores, as modified by update, and waits for the store pool to receive it.
+func gossipStoreUpdate(sg *gossiputil.StoreGossiper, stores []*proto.StoreDescriptor,
+	storeID proto.StoreID, update func(desc *proto.StoreDescriptor), t *testing.T) {
+	for _, s := range stores {
+		if s.StoreID == storeID {
+			desc := *s
+			update(&desc)
+			sg.GossipStores([]*proto.StoreDescriptor{&desc}, t)
+			return
+		}
+	}
+	t.Fatalf("store %d not found", storeID)
+}
+
 // mockStorePool sets up a collection of a alive and dead stores in the
 // store pool for testing purposes.
 func mockStorePool(storePool *StorePool, aliveStoreIDs, deadStoreIDs []proto.StoreID) {
@@ -192,6 +208,7 @@ func mockStorePool(storePool *StorePool, aliveStoreIDs, deadStoreIDs []proto.Sto
 			desc: proto.StoreDescriptor{StoreID: storeID},
 		}
 	}
+	storePool.generation++
 }
 
 func TestAllocatorSimpleRetrieval(t *testing.T) {
@@ -199,7 +216,7 @@ func TestAllocatorSimpleRetrieval(t *testing.T) {
 	stopper, g, _, a := createTestAllocator()
 	defer stopper.Stop()
 	gossiputil.NewStoreGossiper(g).GossipStores(singleStore, t)
-	result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, false, nil)
+	result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
 	if err != nil {
 		t.Errorf("Unable to perform allocation: %v", err)
 	}
@@ -212,7 +229,7 @@ func TestAllocatorNoAvailableDisks(t *testing.T) {
 	defer leaktest.AfterTest(t)
 	stopper, _, _, a := createTestAllocator()
 	defer stopper.Stop()
-	result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, false, nil)
+	result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
 	if result != nil {
 		t.Errorf("expected nil result: %+v", result)
 	}
@@ -226,7 +243,7 @@ func TestAllocatorThreeDisksSameDC(t *testing.T) {
 	stopper, g, _, a := createTestAllocator()
 	defer stopper.Stop()
 	gossiputil.NewStoreGossiper(g).GossipStores(sameDCStores, t)
-	result1, err := a.AllocateTarget(multiDisksConfig.ReplicaAttrs[0], []proto.Replica{}, false, nil)
+	result1, err := a.AllocateTarget(multiDisksConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
 	if err != nil {
 		t.Fatalf("Unable to perform allocation: %v", err)
 	}
@@ -239,7 +256,7 @@ func TestAllocatorThreeDisksSameDC(t *testing.T) {
 			StoreID: result1.StoreID,
 		},
 	}
-	result2, err := a.AllocateTarget(multiDisksConfig.ReplicaAttrs[1], exReplicas, false, nil)
+	result2, err := a.AllocateTarget(multiDisksConfig.ReplicaAttrs[1], exReplicas, 0, false, nil)
 	if err != nil {
 		t.Errorf("Unable to perform allocation: %v", err)
 	}
@@ -249,7 +266,7 @@ func TestAllocatorThreeDisksSameDC(t *testing.T) {
 	if result1.Node.NodeID == result2.Node.NodeID {
 		t.Errorf("Expected node ids to be different %+v vs %+v", result1, result2)
 	}
-	result3, err := a.AllocateTarget(multiDisksConfig.ReplicaAttrs[2], []proto.Replica{}, false, nil)
+	result3, err := a.AllocateTarget(multiDisksConfig.ReplicaAttrs[2], []proto.Replica{}, 0, false, nil)
 	if err != nil {
 		t.Errorf("Unable to perform allocation: %v", err)
 	}
@@ -263,11 +280,11 @@ func TestAllocatorTwoDatacenters(t *testing.T) {
 	stopper, g, _, a := createTestAllocator()
 	defer stopper.Stop()
 	gossiputil.NewStoreGossiper(g).GossipStores(multiDCStores, t)
-	result1, err := a.AllocateTarget(multiDCConfig.ReplicaAttrs[0], []proto.Replica{}, false, nil)
+	result1, err := a.AllocateTarget(multiDCConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
 	if err != nil {
 		t.Fatalf("Unable to perform allocation: %v", err)
 	}
-	result2, err := a.AllocateTarget(multiDCConfig.ReplicaAttrs[1], []proto.Replica{}, false, nil)
+	result2, err := a.AllocateTarget(multiDCConfig.ReplicaAttrs[1], []proto.Replica{}, 0, false, nil)
 	if err != nil {
 		t.Fatalf("Unable to perform allocation: %v", err)
 	}
@@ -280,7 +297,7 @@ func TestAllocatorTwoDatacenters(t *testing.T) {
 			NodeID:  result2.Node.NodeID,
 			StoreID: result2.StoreID,
 		},
-	}, false, nil)
+	}, 0, false, nil)
 	if err == nil {
 		t.Errorf("expected error on allocation without available stores")
 	}
@@ -296,7 +313,7 @@ func TestAllocatorExistingReplica(t *testing.T) {
 			NodeID:  2,
 			StoreID: 2,
 		},
-	}, false, nil)
+	}, 0, false, nil)
 	if err != nil {
 		t.Fatalf("Unable to perform allocation: %v", err)
 	}
@@ -305,6 +322,136 @@ func TestAllocatorExistingReplica(t *testing.T) {
 	}
 }
 
+// TestAllocatorUnhealthyStore verifies that a store reporting a low health
+// score is never chosen as an allocation target.
+func TestAllocatorUnhealthyStore(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	sg := gossiputil.NewStoreGossiper(g)
+	sg.GossipStores(sameDCStores, t)
+	setHealth := func(storeID proto.StoreID, health float64) {
+		gossipStoreUpdate(sg, sameDCStores, storeID, func(desc *proto.StoreDescriptor) {
+			desc.Health = &health
+		}, t)
+	}
+	setHealth(1, minStoreHealth/2)
+
+	for i := 0; i < 10; i++ {
+		result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
+		if err != nil {
+			t.Fatalf("Unable to perform allocation: %v", err)
+		}
+		if result.StoreID != 2 {
+			t.Errorf("expected store 2 as store 1 is unhealthy; got %+v", result)
+		}
+	}
+
+	// Once the only other matching store is used, no target remains.
+	if _, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{
+		{NodeID: 2, StoreID: 2},
+	}, 0, false, nil); err == nil {
+		t.Errorf("expected allocation to fail with only an unhealthy store available")
+	}
+
+	// A recovered store is a valid target again.
+	setHealth(1, 1)
+	result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{
+		{NodeID: 2, StoreID: 2},
+	}, 0, false, nil)
+	if err != nil {
+		t.Fatalf("Unable to perform allocation: %v", err)
+	}
+	if result.StoreID != 1 {
+		t.Errorf("expected store 1 once healthy again; got %+v", result)
+	}
+}
+
+// TestAllocatorDrainingStore verifies that a draining store is never chosen
+// as an allocation target, that ranges with a replica on a draining store are
+// up-replicated first, and that the draining replica is then removed.
+func TestAllocatorDrainingStore(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	sg := gossiputil.NewStoreGossiper(g)
+	sg.GossipStores(sameDCStores, t)
+	gossipStoreUpdate(sg, sameDCStores, 1, func(desc *proto.StoreDescriptor) {
+		desc.Draining = true
+	}, t)
+
+	for i := 0; i < 10; i++ {
+		result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
+		if err != nil {
+			t.Fatalf("Unable to perform allocation: %v", err)
+		}
+		if result.StoreID != 2 {
+			t.Errorf("expected store 2 as store 1 is draining; got %+v", result)
+		}
+	}
+
+	draining := proto.Replica{NodeID: 1, StoreID: 1, ReplicaID: 1}
+	replacement := proto.Replica{NodeID: 2, StoreID: 2, ReplicaID: 2}
+	desc := &proto.RangeDescriptor{Replicas: []proto.Replica{draining}}
+	if action, _ := a.ComputeAction(simpleZoneConfig, desc); action != AllocatorAdd {
+		t.Errorf("expected a replacement to be added for the draining replica; got action %d", action)
+	}
+
+	desc.Replicas = append(desc.Replicas, replacement)
+	if action, _ := a.ComputeAction(simpleZoneConfig, desc); action != AllocatorRemove {
+		t.Errorf("expected a replica to be removed once replaced; got action %d", action)
+	}
+	target, err := a.RemoveTarget(desc.Replicas, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != draining {
+		t.Errorf("expected the draining replica %v to be removed; got %v", draining, target)
+	}
+}
+
+// TestAllocatorIncomingSnapshots verifies that a store receiving
+// MaxIncomingSnapshots snapshots isn't chosen as an allocation target
+// until one of them completes.
+func TestAllocatorIncomingSnapshots(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	a.options.MaxIncomingSnapshots = 2
+	sg := gossiputil.NewStoreGossiper(g)
+	sg.GossipStores(sameDCStores, t)
+	setIncomingSnapshots := func(storeID proto.StoreID, snapshots int32) {
+		gossipStoreUpdate(sg, sameDCStores, storeID, func(desc *proto.StoreDescriptor) {
+			desc.Capacity.IncomingSnapshots = snapshots
+		}, t)
+	}
+
+	setIncomingSnapshots(1, 2)
+	for i := 0; i < 10; i++ {
+		result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
+		if err != nil {
+			t.Fatalf("Unable to perform allocation: %v", err)
+		}
+		if result.StoreID != 2 {
+			t.Errorf("expected store 2 as store 1 is receiving its fill of snapshots; got %+v", result)
+		}
+	}
+
+	setIncomingSnapshots(2, 2)
+	if result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil); err == nil {
+		t.Errorf("expected no target while every store is receiving its fill of snapshots; got %+v", result)
+	}
+
+	setIncomingSnapshots(1, 1)
+	result, err := a.AllocateTarget(simpleZoneConfig.ReplicaAttrs[0], []proto.Replica{}, 0, false, nil)
+	if err != nil {
+		t.Fatalf("Unable to perform allocation: %v", err)
+	}
+	if result.StoreID != 1 {
+		t.Errorf("expected store 1 once one of its snapshots completed; got %+v", result)
+	}
+}
+
 // TestAllocatorRelaxConstraints verifies that attribute constraints
 // will be relaxed in order to match nodes lacking required attributes,
 // if necessary to find an allocation target.
@@ -345,7 +492,7 @@ func TestAllocatorRelaxConstraints(t *testing.T) {
 		for _, id := range test.existing {
 			existing = append(existing, proto.Replica{NodeID: proto.NodeID(id), StoreID: proto.StoreID(id)})
 		}
-		result, err := a.AllocateTarget(proto.Attributes{Attrs: test.required}, existing, test.relaxConstraints, nil)
+		result, err := a.AllocateTarget(proto.Attributes{Attrs: test.required}, existing, 0, test.relaxConstraints, nil)
 		if haveErr := (err != nil); haveErr != test.expErr {
 			t.Errorf("%d: expected error %t; got %t: %s", i, test.expErr, haveErr, err)
 		} else if err == nil && proto.StoreID(test.expID) != result.StoreID {
@@ -389,7 +536,7 @@ func TestAllocatorRandomAllocation(t *testing.T) {
 	// store 1 or store 2 will be chosen, as the least loaded of the
 	// three random choices is returned.
 	for i := 0; i < 10; i++ {
-		result, err := a.AllocateTarget(proto.Attributes{}, []proto.Replica{}, false, nil)
+		result, err := a.AllocateTarget(proto.Attributes{}, []proto.Replica{}, 0, false, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -399,6 +546,92 @@ func TestAllocatorRandomAllocation(t *testing.T) {
 	}
 }
 
+// TestAllocatorOvercommittedStore verifies that a store with negative
+// available capacity is treated as full and never chosen as a target.
+func TestAllocatorOvercommittedStore(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+
+	stores := []*proto.StoreDescriptor{
+		{
+			StoreID:  1,
+			Node:     proto.NodeDescriptor{NodeID: 1},
+			Capacity: proto.StoreCapacity{Capacity: 200, Available: -50, RangeCount: 1},
+		},
+		{
+			StoreID:  2,
+			Node:     proto.NodeDescriptor{NodeID: 2},
+			Capacity: proto.StoreCapacity{Capacity: 200, Available: 10, RangeCount: 20},
+		},
+	}
+	gossiputil.NewStoreGossiper(g).GossipStores(stores, t)
+
+	for i := 0; i < 10; i++ {
+		result, err := a.AllocateTarget(proto.Attributes{}, []proto.Replica{}, 0, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.StoreID != 2 {
+			t.Errorf("expected store 2; got %d", result.StoreID)
+		}
+	}
+
+	// With the only other node already in use, there is no target at all.
+	existing := []proto.Replica{{NodeID: 2, StoreID: 2}}
+	if result, err := a.AllocateTarget(proto.Attributes{}, existing, 0, false, nil); err == nil {
+		t.Errorf("expected no target, got store %d", result.StoreID)
+	}
+}
+
+// TestAllocatorMaxNodeFractionUsed verifies that, when set, stores on
+// nodes whose stores are nearly full in aggregate are not chosen as
+// targets, even if the store itself is the least used.
+func TestAllocatorMaxNodeFractionUsed(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+
+	stores := []*proto.StoreDescriptor{
+		{
+			StoreID:  1,
+			Node:     proto.NodeDescriptor{NodeID: 1},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 70},
+		},
+		{
+			StoreID:  2,
+			Node:     proto.NodeDescriptor{NodeID: 1},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 1},
+		},
+		{
+			StoreID:  3,
+			Node:     proto.NodeDescriptor{NodeID: 2},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 60},
+		},
+	}
+	gossiputil.NewStoreGossiper(g).GossipStores(stores, t)
+
+	// Node 1's stores are 64.5% used in aggregate.
+	testCases := []struct {
+		maxNodeFractionUsed float64
+		expStoreID          proto.StoreID
+	}{
+		{0, 1},
+		{0.7, 1},
+		{0.6, 3},
+	}
+	for i, test := range testCases {
+		a.options.MaxNodeFractionUsed = test.maxNodeFractionUsed
+		result, err := a.AllocateTarget(proto.Attributes{}, []proto.Replica{}, 0, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.StoreID != test.expStoreID {
+			t.Errorf("%d: expected store %d; got %d", i, test.expStoreID, result.StoreID)
+		}
+	}
+}
+
 // TestAllocatorRebalance verifies that rebalance targets are chosen
 // randomly from amongst stores over the minAvailCapacityThreshold.
 func TestAllocatorRebalance(t *testing.T) {
@@ -551,6 +784,478 @@ func TestAllocatorRebalanceByCount(t *testing.T) {
 	}
 }
 
+// TestAllocatorWeightByFreeCapacity verifies that, with weighting by free
+// capacity, new replicas are spread over the stores with room for them and
+// that no store is allocated more than its fill for the pass until it is
+// gossiped again.
+func TestAllocatorWeightByFreeCapacity(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	a.options.WeightByFreeCapacity = true
+	a.options.MaxFillPerPass = 0.2
+
+	// Replicas average 10 bytes, so store 3 may be allocated two per pass.
+	stores := []*proto.StoreDescriptor{
+		{
+			StoreID:  1,
+			Node:     proto.NodeDescriptor{NodeID: 1},
+			Capacity: proto.StoreCapacity{Capacity: 1000, Available: 950, RangeCount: 5},
+		},
+		{
+			StoreID:  2,
+			Node:     proto.NodeDescriptor{NodeID: 2},
+			Capacity: proto.StoreCapacity{Capacity: 1000, Available: 950, RangeCount: 5},
+		},
+		{
+			StoreID:  3,
+			Node:     proto.NodeDescriptor{NodeID: 3},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 100},
+		},
+	}
+	sg := gossiputil.NewStoreGossiper(g)
+	sg.GossipStores(stores, t)
+
+	counts := map[proto.StoreID]int{}
+	for i := 0; i < 40; i++ {
+		result, err := a.AllocateTarget(proto.Attributes{}, []proto.Replica{}, 0, false, nil)
+		if err != nil {
+			t.Fatalf("%d: unable to get allocation target: %s", i, err)
+		}
+		counts[result.StoreID]++
+	}
+	if counts[3] > 2 {
+		t.Errorf("expected store 3 to be allocated at most 2 replicas per pass; got %d", counts[3])
+	}
+	if counts[1] == 0 || counts[2] == 0 {
+		t.Errorf("expected replicas to be spread over stores 1 and 2; got %v", counts)
+	}
+
+	// Gossiping the stores starts a new pass.
+	sg.GossipStores(stores, t)
+	for storeID := range counts {
+		if reserved := a.storePool.reservedBytes(storeID); reserved != 0 {
+			t.Errorf("expected store %d to have no reserved bytes after gossip; got %d", storeID, reserved)
+		}
+	}
+}
+
+// TestAllocatorReplaceTarget verifies that a rebalance via replace moves a
+// replica away from one of the range's existing stores and never chooses a
+// target without room for the range.
+func TestAllocatorReplaceTarget(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+
+	if action := a.RebalanceAction(); action != AllocatorAdd {
+		t.Errorf("expected rebalance action %d; got %d", AllocatorAdd, action)
+	}
+	a.options.ReplaceOnRebalance = true
+	if action := a.RebalanceAction(); action != AllocatorReplace {
+		t.Errorf("expected rebalance action %d; got %d", AllocatorReplace, action)
+	}
+
+	// Stores 1-3 hold the range; store 4 is the only rebalance target.
+	stores := []*proto.StoreDescriptor{
+		{
+			StoreID:  1,
+			Node:     proto.NodeDescriptor{NodeID: 1},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 20},
+		},
+		{
+			StoreID:  2,
+			Node:     proto.NodeDescriptor{NodeID: 2},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 20},
+		},
+		{
+			StoreID:  3,
+			Node:     proto.NodeDescriptor{NodeID: 3},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 20},
+		},
+		{
+			StoreID:  4,
+			Node:     proto.NodeDescriptor{NodeID: 4},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 30},
+		},
+	}
+	gossiputil.NewStoreGossiper(g).GossipStores(stores, t)
+	existing := []proto.Replica{
+		{NodeID: 1, StoreID: 1},
+		{NodeID: 2, StoreID: 2},
+		{NodeID: 3, StoreID: 3},
+	}
+
+	// A range larger than store 4's available bytes is never moved there.
+	for i := 0; i < 10; i++ {
+		if target, _ := a.ReplaceTarget(proto.Attributes{}, existing, 40, 0); target != nil {
+			t.Errorf("%d: expected no target for a range larger than available; got %d", i, target.StoreID)
+		}
+	}
+
+	// A range which fits is moved from one of the existing stores to store 4
+	// (or nil for case of missing the only option).
+	var found bool
+	for i := 0; i < 10; i++ {
+		target, remove := a.ReplaceTarget(proto.Attributes{}, existing, 30, 0)
+		if target == nil {
+			continue
+		}
+		found = true
+		if target.StoreID != 4 {
+			t.Errorf("%d: expected store 4; got %d", i, target.StoreID)
+		}
+		if remove.StoreID < 1 || remove.StoreID > 3 {
+			t.Errorf("%d: expected to remove one of stores 1-3; got %d", i, remove.StoreID)
+		}
+	}
+	if !found {
+		t.Error("expected store 4 to be chosen as a replace target")
+	}
+}
+
+// TestAllocatorReplaceTargetReleasesReservation verifies that the bytes
+// reserved on a rebalance target are released when ReplaceTarget discards
+// it, and kept when the target is returned.
+func TestAllocatorReplaceTargetReleasesReservation(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, sp, a := createTestAllocator()
+	defer stopper.Stop()
+	a.options.MaxFillPerPass = 1
+
+	// Stores 1-3 hold the range; store 4 is the only rebalance target.
+	var stores []*proto.StoreDescriptor
+	for i, available := range []int64{20, 20, 20, 30} {
+		rangeCount := int32(8)
+		if i == 3 {
+			rangeCount = 0
+		}
+		stores = append(stores, &proto.StoreDescriptor{
+			StoreID:  proto.StoreID(i + 1),
+			Node:     proto.NodeDescriptor{NodeID: proto.NodeID(i + 1)},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: available, RangeCount: rangeCount},
+		})
+	}
+	gossiputil.NewStoreGossiper(g).GossipStores(stores, t)
+	existing := []proto.Replica{
+		{NodeID: 1, StoreID: 1},
+		{NodeID: 2, StoreID: 2},
+		{NodeID: 3, StoreID: 3},
+	}
+
+	// Store 4 lacks room for a range of 40 bytes, so it is discarded.
+	for i := 0; i < 10; i++ {
+		if target, _ := a.ReplaceTarget(proto.Attributes{}, existing, 40, 0); target != nil {
+			t.Fatalf("%d: expected no target for a range larger than available; got %d", i, target.StoreID)
+		}
+		if reserved := sp.reservedBytes(4); reserved != 0 {
+			t.Fatalf("%d: expected no bytes reserved on a discarded target; got %d", i, reserved)
+		}
+	}
+
+	// A range which fits keeps its reservation on store 4.
+	if target, _ := a.ReplaceTarget(proto.Attributes{}, existing, 30, 0); target != nil {
+		if reserved := sp.reservedBytes(4); reserved == 0 {
+			t.Errorf("expected bytes to be reserved on store %d", target.StoreID)
+		}
+	}
+}
+
+// TestAllocatorRebalanceByBytes verifies that, when balancing bytes in a
+// cluster with low disk usage, rebalancing decisions account for the bytes
+// used on each store and not just range counts. Store 1 holds a few large
+// ranges and store 2 many small ones.
+func TestAllocatorRebalanceByBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	a.options.BalanceBytes = true
+
+	stores := []*proto.StoreDescriptor{
+		{
+			StoreID:  1,
+			Node:     proto.NodeDescriptor{NodeID: 1},
+			Capacity: proto.StoreCapacity{Capacity: 1000, Available: 984, RangeCount: 2},
+		},
+		{
+			StoreID:  2,
+			Node:     proto.NodeDescriptor{NodeID: 2},
+			Capacity: proto.StoreCapacity{Capacity: 1000, Available: 992, RangeCount: 8},
+		},
+		{
+			StoreID:  3,
+			Node:     proto.NodeDescriptor{NodeID: 3},
+			Capacity: proto.StoreCapacity{Capacity: 1000, Available: 990, RangeCount: 5},
+		},
+		{
+			StoreID:  4,
+			Node:     proto.NodeDescriptor{NodeID: 4},
+			Capacity: proto.StoreCapacity{Capacity: 1000, Available: 995, RangeCount: 5},
+		},
+	}
+	gossiputil.NewStoreGossiper(g).GossipStores(stores, t)
+
+	// Store 1 has the fewest ranges but the most bytes; only store 4 is
+	// sufficiently below the mean bytes used to be a target.
+	for i := 0; i < 10; i++ {
+		result := a.RebalanceTarget(proto.Attributes{}, []proto.Replica{})
+		if result != nil && result.StoreID != 4 {
+			t.Errorf("expected store 4; got %d", result.StoreID)
+		}
+	}
+
+	// Only store 1 should rebalance; store 2 has the most ranges but uses
+	// fewer bytes than average.
+	a.options.Deterministic = true
+	for i, store := range stores {
+		result := a.ShouldRebalance(store.StoreID)
+		if expResult := (i == 0); expResult != result {
+			t.Errorf("%d: expected rebalance %t; got %t", i, expResult, result)
+		}
+	}
+
+	// The replica on the store using the most bytes should be removed.
+	var replicas []proto.Replica
+	for _, store := range stores {
+		replicas = append(replicas, proto.Replica{StoreID: store.StoreID, NodeID: store.Node.NodeID})
+	}
+	targetRepl, err := a.RemoveTarget(replicas, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, e := targetRepl.StoreID, proto.StoreID(1); a != e {
+		t.Fatalf("RemoveTarget did not select expected replica; expected %v, got %v", e, a)
+	}
+}
+
+// localityStores are spread across three localities, identified by their
+// node attributes, with two stores in each. The first three stores are
+// more heavily loaded than the others.
+var localityStores = []*proto.StoreDescriptor{
+	{
+		StoreID:  1,
+		Node:     proto.NodeDescriptor{NodeID: 1, Attrs: proto.Attributes{Attrs: []string{"dc1"}}},
+		Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: 10},
+	},
+	{
+		StoreID:  2,
+		Node:     proto.NodeDescriptor{NodeID: 2, Attrs: proto.Attributes{Attrs: []string{"dc1"}}},
+		Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: 12},
+	},
+	{
+		StoreID:  3,
+		Node:     proto.NodeDescriptor{NodeID: 3, Attrs: proto.Attributes{Attrs: []string{"dc2"}}},
+		Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: 20},
+	},
+	{
+		StoreID:  4,
+		Node:     proto.NodeDescriptor{NodeID: 4, Attrs: proto.Attributes{Attrs: []string{"dc2"}}},
+		Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: 2},
+	},
+	{
+		StoreID:  5,
+		Node:     proto.NodeDescriptor{NodeID: 5, Attrs: proto.Attributes{Attrs: []string{"dc3"}}},
+		Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: 2},
+	},
+	{
+		StoreID:  6,
+		Node:     proto.NodeDescriptor{NodeID: 6, Attrs: proto.Attributes{Attrs: []string{"dc3"}}},
+		Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: 2},
+	},
+}
+
+// TestAllocatorRebalanceLocality verifies that rebalance targets are only
+// chosen from the localities holding the fewest of the existing replicas.
+func TestAllocatorRebalanceLocality(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	gossiputil.NewStoreGossiper(g).GossipStores(localityStores, t)
+
+	// Two replicas in dc1 and one in dc2, so the only eligible targets
+	// are the stores in dc3, even though store 4 is equally unloaded.
+	existing := []proto.Replica{
+		{NodeID: 1, StoreID: 1},
+		{NodeID: 2, StoreID: 2},
+		{NodeID: 3, StoreID: 3},
+	}
+	for i := 0; i < 10; i++ {
+		result := a.RebalanceTarget(proto.Attributes{}, existing)
+		if result != nil && result.StoreID != 5 && result.StoreID != 6 {
+			t.Errorf("%d: expected store 5 or 6; got %d", i, result.StoreID)
+		}
+	}
+}
+
+// TestAllocatorRemoveTargetLocality verifies that RemoveTarget removes a
+// replica from the locality holding the most replicas, even if a replica in
+// another locality is on a more heavily loaded store.
+func TestAllocatorRemoveTargetLocality(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	gossiputil.NewStoreGossiper(g).GossipStores(localityStores, t)
+
+	replicas := []proto.Replica{
+		{NodeID: 1, StoreID: 1, ReplicaID: 1},
+		{NodeID: 2, StoreID: 2, ReplicaID: 2},
+		{NodeID: 3, StoreID: 3, ReplicaID: 3},
+		{NodeID: 5, StoreID: 5, ReplicaID: 4},
+	}
+	targetRepl, err := a.RemoveTarget(replicas, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, e := targetRepl, replicas[1]; a != e {
+		t.Fatalf("RemoveTarget did not select expected replica; expected %v, got %v", e, a)
+	}
+}
+
+// tieredStores are spread across two regions of two zones each, with two
+// stores in each zone. Their localities are ordered lists of tiers.
+var tieredStores = func() []*proto.StoreDescriptor {
+	var stores []*proto.StoreDescriptor
+	for _, region := range []string{"us", "eu"} {
+		for _, zone := range []string{"a", "b"} {
+			for i := 0; i < 2; i++ {
+				id := len(stores) + 1
+				stores = append(stores, &proto.StoreDescriptor{
+					StoreID: proto.StoreID(id),
+					Node: proto.NodeDescriptor{
+						NodeID: proto.NodeID(id),
+						Attrs:  proto.Attributes{Attrs: []string{"region=" + region, "zone=" + region + "-" + zone}},
+					},
+					Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: int32(id)},
+				})
+			}
+		}
+	}
+	return stores
+}()
+
+// TestAllocatorLocalityTiers verifies that AllocateTarget spreads replicas
+// across regions before spreading them across the zones of a region, and
+// that RemoveTarget removes a replica from the most crowded zone of the
+// most crowded region.
+func TestAllocatorLocalityTiers(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	gossiputil.NewStoreGossiper(g).GossipStores(tieredStores, t)
+
+	// Stores 1-2 are in us-a, 3-4 in us-b, 5-6 in eu-a and 7-8 in eu-b.
+	testCases := []struct {
+		existing []int // existing store/node IDs
+		expIDs   []int // acceptable store IDs of the target
+	}{
+		{[]int{1}, []int{5, 6, 7, 8}},
+		{[]int{1, 5}, []int{3, 4, 7, 8}},
+		{[]int{1, 3}, []int{5, 6, 7, 8}},
+		{[]int{1, 3, 5}, []int{7, 8}},
+		{[]int{1, 3, 5, 7}, []int{2, 4, 6, 8}},
+	}
+	for i, test := range testCases {
+		var existing []proto.Replica
+		for _, id := range test.existing {
+			existing = append(existing, proto.Replica{NodeID: proto.NodeID(id), StoreID: proto.StoreID(id)})
+		}
+		for j := 0; j < 10; j++ {
+			result, err := a.AllocateTarget(proto.Attributes{}, existing, 0, false, nil)
+			if err != nil {
+				t.Fatalf("%d: unable to perform allocation: %v", i, err)
+			}
+			var ok bool
+			for _, id := range test.expIDs {
+				ok = ok || result.StoreID == proto.StoreID(id)
+			}
+			if !ok {
+				t.Errorf("%d: expected one of stores %v; got %d", i, test.expIDs, result.StoreID)
+			}
+		}
+	}
+
+	// Three replicas in us, two of them in us-a, and one in eu. A replica
+	// in us-a is removed, even though store 3 is more heavily loaded.
+	replicas := []proto.Replica{
+		{NodeID: 1, StoreID: 1, ReplicaID: 1},
+		{NodeID: 2, StoreID: 2, ReplicaID: 2},
+		{NodeID: 3, StoreID: 3, ReplicaID: 3},
+		{NodeID: 5, StoreID: 5, ReplicaID: 4},
+	}
+	targetRepl, err := a.RemoveTarget(replicas, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, e := targetRepl, replicas[1]; a != e {
+		t.Fatalf("RemoveTarget did not select expected replica; expected %v, got %v", e, a)
+	}
+}
+
+// TestAllocatorMinDistinctNodes verifies that a range is repaired until its
+// replicas span the zone's minimum number of distinct nodes, and that an
+// unsatisfiable minimum is reported by AllocateTarget.
+func TestAllocatorMinDistinctNodes(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, sp, a := createTestAllocator()
+	defer stopper.Stop()
+	// Stores 2 and 3 share node 2, leaving four distinct nodes.
+	gossiputil.NewStoreGossiper(g).GossipStores(sameDCStores, t)
+
+	all := []proto.Replica{
+		{NodeID: 1, StoreID: 1},
+		{NodeID: 2, StoreID: 2},
+		{NodeID: 3, StoreID: 4},
+		{NodeID: 4, StoreID: 5},
+	}
+	if _, err := a.AllocateTarget(proto.Attributes{}, all, 5, false, nil); !testutils.IsError(err, "at least 5 distinct nodes, but only 4") {
+		t.Errorf("expected unsatisfiable minimum to be reported; got %v", err)
+	}
+	if _, err := a.AllocateTarget(proto.Attributes{}, all, 4, false, nil); !testutils.IsError(err, "no candidates available") {
+		t.Errorf("expected no candidates to be reported; got %v", err)
+	}
+
+	// A replica sharing its node with another is removed first.
+	shared := []proto.Replica{
+		{NodeID: 1, StoreID: 1},
+		{NodeID: 2, StoreID: 2},
+		{NodeID: 2, StoreID: 3},
+		{NodeID: 3, StoreID: 4},
+	}
+	if repl, err := a.RemoveTarget(shared, 0); err != nil {
+		t.Fatal(err)
+	} else if repl.NodeID != 2 {
+		t.Errorf("expected a replica on node 2 to be removed; got %+v", repl)
+	}
+
+	mockStorePool(sp, []proto.StoreID{1, 2, 3, 4, 5}, nil)
+	zone := func(minNodes int32) config.ZoneConfig {
+		return config.ZoneConfig{
+			ReplicaAttrs:     []proto.Attributes{{}, {}, {}},
+			MinDistinctNodes: minNodes,
+		}
+	}
+	testCases := []struct {
+		zone      config.ZoneConfig
+		replicas  []proto.Replica
+		expAction AllocatorAction
+	}{
+		// Three replicas on two nodes.
+		{zone(0), shared[:3], AllocatorNoop},
+		{zone(3), shared[:3], AllocatorAdd},
+		// Four replicas on three nodes; the shared replica can go.
+		{zone(3), shared, AllocatorRemove},
+		// Four replicas on four nodes.
+		{zone(3), all, AllocatorRemove},
+		{zone(4), all, AllocatorNoop},
+	}
+	for i, test := range testCases {
+		desc := &proto.RangeDescriptor{Replicas: test.replicas}
+		if action, _ := a.ComputeAction(test.zone, desc); action != test.expAction {
+			t.Errorf("%d: expected action %d; got %d", i, test.expAction, action)
+		}
+	}
+}
+
 // TestAllocatorRemoveTarget verifies that the replica chosen by RemoveTarget is
 // the one with the lowest capacity.
 func TestAllocatorRemoveTarget(t *testing.T) {
@@ -608,7 +1313,7 @@ func TestAllocatorRemoveTarget(t *testing.T) {
 	sg := gossiputil.NewStoreGossiper(g)
 	sg.GossipStores(stores, t)
 
-	targetRepl, err := a.RemoveTarget(replicas)
+	targetRepl, err := a.RemoveTarget(replicas, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -616,6 +1321,16 @@ func TestAllocatorRemoveTarget(t *testing.T) {
 		t.Fatalf("RemoveTarget did not select expected replica; expected %v, got %v", e, a)
 	}
 
+	// If store 3 holds the lease, the next worst candidate, store 4, is
+	// removed instead.
+	targetRepl, err = a.RemoveTarget(replicas, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, e := targetRepl, replicas[3]; a != e {
+		t.Fatalf("RemoveTarget did not spare the leaseholder; expected %v, got %v", e, a)
+	}
+
 	// Setup the stores again so that store 2 is the worst, but with very low
 	// used capacity to force the range count criteria to be used.
 	stores = []*proto.StoreDescriptor{
@@ -642,7 +1357,7 @@ func TestAllocatorRemoveTarget(t *testing.T) {
 	}
 	sg.GossipStores(stores, t)
 
-	targetRepl, err = a.RemoveTarget(replicas)
+	targetRepl, err = a.RemoveTarget(replicas, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -651,6 +1366,142 @@ func TestAllocatorRemoveTarget(t *testing.T) {
 	}
 }
 
+// TestAllocatorRemoveTargetLeaseholder verifies that RemoveTarget avoids
+// removing the leaseholder's replica when another replica is an equally
+// valid candidate, but still removes it if it is the better candidate for
+// reasons of placement.
+func TestAllocatorRemoveTargetLeaseholder(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	// Stores 2 and 3 share node 2.
+	gossiputil.NewStoreGossiper(g).GossipStores(sameDCStores, t)
+
+	replicas := []proto.Replica{
+		{NodeID: 1, StoreID: 1, ReplicaID: 1},
+		{NodeID: 2, StoreID: 2, ReplicaID: 2},
+		{NodeID: 2, StoreID: 3, ReplicaID: 3},
+		{NodeID: 3, StoreID: 4, ReplicaID: 4},
+	}
+	testCases := []struct {
+		replicas     []proto.Replica
+		leaseStoreID proto.StoreID
+		expStoreIDs  []proto.StoreID // acceptable removals
+	}{
+		// Either replica sharing node 2 may be removed, but not the
+		// leaseholder's.
+		{replicas, 2, []proto.StoreID{3}},
+		{replicas, 3, []proto.StoreID{2}},
+		// The leaseholder's replica doesn't share a node, so one of the
+		// replicas which do is removed regardless.
+		{replicas, 1, []proto.StoreID{2, 3}},
+		// With no other replica, the leaseholder's must be removed.
+		{replicas[:1], 1, []proto.StoreID{1}},
+	}
+	for i, test := range testCases {
+		repl, err := a.RemoveTarget(test.replicas, test.leaseStoreID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, storeID := range test.expStoreIDs {
+			found = found || repl.StoreID == storeID
+		}
+		if !found {
+			t.Errorf("%d: expected one of stores %v to be removed; got %d", i, test.expStoreIDs, repl.StoreID)
+		}
+	}
+}
+
+// TestAllocatorRemoveTargetUngossiped verifies that RemoveTarget refuses to
+// choose a replica to remove while any replica's store hasn't been gossiped,
+// rather than deciding based on partial information.
+func TestAllocatorRemoveTargetUngossiped(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	gossiputil.NewStoreGossiper(g).GossipStores(singleStore, t)
+
+	replicas := []proto.Replica{
+		{NodeID: 1, StoreID: 1, ReplicaID: 1},
+		{NodeID: 2, StoreID: 2, ReplicaID: 2},
+	}
+	if _, err := a.RemoveTarget(replicas, 0); !testutils.IsError(err, "store 2 has not been gossiped") {
+		t.Errorf("expected removal to be refused; got %v", err)
+	}
+	if _, err := a.RemoveTarget(replicas[:1], 0); err != nil {
+		t.Errorf("expected removal from gossiped store to succeed; got %v", err)
+	}
+}
+
+// TestAllocatorTransferLeaseTarget verifies that leases are transferred to
+// the least loaded replica on another node than the leaseholder's, avoiding
+// draining stores unless no other replica remains.
+func TestAllocatorTransferLeaseTarget(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	// Stores 1 and 2 share node 1.
+	replicas := []proto.Replica{
+		{NodeID: 1, StoreID: 1, ReplicaID: 1},
+		{NodeID: 1, StoreID: 2, ReplicaID: 2},
+		{NodeID: 2, StoreID: 3, ReplicaID: 3},
+		{NodeID: 3, StoreID: 4, ReplicaID: 4},
+	}
+	var stores []*proto.StoreDescriptor
+	for i, rangeCount := range []int32{5, 1, 10, 3} {
+		stores = append(stores, &proto.StoreDescriptor{
+			StoreID:  replicas[i].StoreID,
+			Node:     proto.NodeDescriptor{NodeID: replicas[i].NodeID},
+			Capacity: proto.StoreCapacity{Capacity: 100, Available: 100, RangeCount: rangeCount},
+		})
+	}
+	sg := gossiputil.NewStoreGossiper(g)
+	sg.GossipStores(stores, t)
+	setDraining := func(storeID proto.StoreID, draining bool) {
+		gossipStoreUpdate(sg, stores, storeID, func(desc *proto.StoreDescriptor) {
+			desc.Draining = draining
+		}, t)
+	}
+
+	testCases := []struct {
+		replicas     []proto.Replica
+		leaseStoreID proto.StoreID
+		draining     proto.StoreID
+		expStoreID   proto.StoreID
+	}{
+		// Store 2 holds the fewest ranges but shares the leaseholder's node.
+		{replicas, 1, 0, 4},
+		{replicas, 4, 0, 2},
+		{replicas, 4, 2, 1},
+		// A draining store is chosen only if no other replica remains.
+		{replicas, 1, 4, 3},
+		{[]proto.Replica{replicas[1], replicas[3]}, 2, 4, 4},
+	}
+	for i, test := range testCases {
+		if test.draining != 0 {
+			setDraining(test.draining, true)
+		}
+		repl, err := a.TransferLeaseTarget(test.replicas, test.leaseStoreID)
+		if test.draining != 0 {
+			setDraining(test.draining, false)
+		}
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if repl.StoreID != test.expStoreID {
+			t.Errorf("%d: expected the lease to be transferred to store %d; got %d", i, test.expStoreID, repl.StoreID)
+		}
+	}
+
+	if _, err := a.TransferLeaseTarget(replicas[:2], 1); !testutils.IsError(err, "no live replica on another node") {
+		t.Errorf("expected the transfer to be refused; got %v", err)
+	}
+	if _, err := a.TransferLeaseTarget(replicas, 5); !testutils.IsError(err, "store 5 does not hold a replica") {
+		t.Errorf("expected the transfer to be refused; got %v", err)
+	}
+}
+
 func TestAllocatorComputeAction(t *testing.T) {
 	defer leaktest.AfterTest(t)
 	stopper, _, sp, a := createTestAllocator()
@@ -559,6 +559,11 @@ func TestStoreRangeUpReplicate(t *testing.T) {
 	}, 1*time.Second); err != nil {
 		t.Fatal(err)
 	}
+
+	// The replicas added by the leader's replicate queue were timed.
+	if stats := mtc.stores[0].ReplicateQueueStats(); stats.Processed == 0 || stats.TotalDuration == 0 {
+		t.Errorf("expected the replicate queue to record processing its replicas; got %+v", stats)
+	}
 }
 
 // getRangeMetadata retrieves the current range descriptor for the target
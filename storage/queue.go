@@ -82,6 +82,56 @@ var (
 	errReplicaNotAddable = errors.New("replica shouldn't be added to queue")
 )
 
+// QueueSkipReason enumerates the reasons for which a queue may decline to
+// add a replica.
+type QueueSkipReason int
+
+// These are the possible reasons for a replica not being queued.
+const (
+	_ QueueSkipReason = iota
+	// QueueSkipDisabled indicates the queue is disabled.
+	QueueSkipDisabled
+	// QueueSkipNoSystemConfig indicates the system config was not yet
+	// available via gossip.
+	QueueSkipNoSystemConfig
+	// QueueSkipNeedsSplit indicates the range spans multiple zone configs
+	// and must be split before the queue will accept it.
+	QueueSkipNeedsSplit
+	// QueueSkipNotNeeded indicates the queue determined the replica
+	// requires no processing.
+	QueueSkipNotNeeded
+	// QueueSkipZoneConfigError indicates the zone config for the range
+	// could not be determined.
+	QueueSkipZoneConfigError
+	// QueueSkipNoRebalance indicates the range is correctly replicated
+	// and its store is not eligible to rebalance.
+	QueueSkipNoRebalance
+	// QueueSkipBackoff indicates the range's previous processing attempts
+	// failed, and the queue is backing off before retrying.
+	QueueSkipBackoff
+	// QueueSkipPinned indicates the range's replicas are pinned to their
+	// stores, and it requires no repair.
+	QueueSkipPinned
+)
+
+var queueSkipReasonNames = map[QueueSkipReason]string{
+	QueueSkipDisabled:        "queue disabled",
+	QueueSkipNoSystemConfig:  "no system config available",
+	QueueSkipNeedsSplit:      "range needs to be split",
+	QueueSkipNotNeeded:       "no processing needed",
+	QueueSkipZoneConfigError: "unable to look up zone config",
+	QueueSkipNoRebalance:     "replication is correct and store should not rebalance",
+	QueueSkipBackoff:         "backing off after repeated failures",
+	QueueSkipPinned:          "replicas are pinned and need no repair",
+}
+
+func (r QueueSkipReason) String() string {
+	if name, ok := queueSkipReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 type queueImpl interface {
 	// needsLeaderLease returns whether this queue requires the leader
 	// lease to operate on a replica.
@@ -105,6 +155,15 @@ type queueImpl interface {
 	timer() time.Duration
 }
 
+// queueSkipReasoner may optionally be implemented by a queueImpl in
+// order to explain why a replica was not queued. If implemented,
+// shouldQueueWithReason is used in place of shouldQueue and must return
+// the same results along with the reason for not queueing the replica.
+type queueSkipReasoner interface {
+	shouldQueueWithReason(proto.Timestamp, *Replica, *config.SystemConfig) (
+		shouldQueue bool, priority float64, reason QueueSkipReason)
+}
+
 // baseQueue is the base implementation of the replicaQueue interface.
 // Queue implementations should embed a baseQueue and implement queueImpl.
 //
@@ -114,13 +173,16 @@ type baseQueue struct {
 	name       string
 	impl       queueImpl
 	gossip     *gossip.Gossip
-	maxSize    int                            // Maximum number of replicas to queue
-	incoming   chan struct{}                  // Channel signaled when a new replica is added to the queue.
-	sync.Mutex                                // Mutex protects priorityQ and replicas
-	priorityQ  priorityQueue                  // The priority queue
-	replicas   map[proto.RangeID]*replicaItem // Map from RangeID to replicaItem (for updating priority)
+	maxSize    int                               // Maximum number of replicas to queue
+	incoming   chan struct{}                     // Channel signaled when a new replica is added to the queue.
+	sync.Mutex                                   // Mutex protects priorityQ, replicas and skipped
+	priorityQ  priorityQueue                     // The priority queue
+	replicas   map[proto.RangeID]*replicaItem    // Map from RangeID to replicaItem (for updating priority)
+	skipped    map[proto.RangeID]QueueSkipReason // Most recent reason each unqueued range was skipped
 	// Some tests in this package disable queues.
 	disabled int32 // updated atomically
+	// rejections counts replicas dropped because the queue was at maxSize.
+	rejections int64 // updated atomically
 }
 
 // newBaseQueue returns a new instance of baseQueue with the
@@ -137,6 +199,7 @@ func newBaseQueue(name string, impl queueImpl, gossip *gossip.Gossip, maxSize in
 		maxSize:  maxSize,
 		incoming: make(chan struct{}, 1),
 		replicas: map[proto.RangeID]*replicaItem{},
+		skipped:  map[proto.RangeID]QueueSkipReason{},
 	}
 }
 
@@ -147,6 +210,31 @@ func (bq *baseQueue) Length() int {
 	return bq.priorityQ.Len()
 }
 
+// Rejections returns the number of replicas which have been dropped from
+// the queue because it was full.
+func (bq *baseQueue) Rejections() int64 {
+	return atomic.LoadInt64(&bq.rejections)
+}
+
+// SkipReason returns the reason the range with the given ID was most
+// recently declined by MaybeAdd. Returns false if the range was added to
+// the queue on its most recent attempt, or has never been considered.
+func (bq *baseQueue) SkipReason(rangeID proto.RangeID) (QueueSkipReason, bool) {
+	bq.Lock()
+	defer bq.Unlock()
+	reason, ok := bq.skipped[rangeID]
+	return reason, ok
+}
+
+// setSkipReason records the reason the replica was not added to the queue.
+// Expects the queue lock is held by caller.
+func (bq *baseQueue) setSkipReason(repl *Replica, reason QueueSkipReason) {
+	if log.V(3) {
+		log.Infof("not adding replica %s to %s queue: %s", repl, bq.name, reason)
+	}
+	bq.skipped[repl.Desc().RangeID] = reason
+}
+
 // SetDisabled turns queue processing off or on as directed.
 func (bq *baseQueue) SetDisabled(disabled bool) {
 	if disabled {
@@ -179,10 +267,14 @@ func (bq *baseQueue) Add(repl *Replica, priority float64) error {
 // not be added, as the replica with the lowest priority will be
 // dropped.
 func (bq *baseQueue) MaybeAdd(repl *Replica, now proto.Timestamp) {
+	bq.Lock()
+	defer bq.Unlock()
+
 	// Load the system config.
 	cfg := bq.gossip.GetSystemConfig()
 	if cfg == nil {
 		log.Infof("no system config available. skipping...")
+		bq.setSkipReason(repl, QueueSkipNoSystemConfig)
 		return
 	}
 
@@ -190,17 +282,28 @@ func (bq *baseQueue) MaybeAdd(repl *Replica, now proto.Timestamp) {
 	if !bq.impl.acceptsUnsplitRanges() && cfg.NeedsSplit(desc.StartKey, desc.EndKey) {
 		// Range needs to be split due to zone configs, but queue does
 		// not accept unsplit ranges.
-		if log.V(3) {
-			log.Infof("range %s needs to be split; not adding", repl)
-		}
+		bq.setSkipReason(repl, QueueSkipNeedsSplit)
 		return
 	}
 
-	bq.Lock()
-	defer bq.Unlock()
-	should, priority := bq.impl.shouldQueue(now, repl, cfg)
-	if err := bq.addInternal(repl, should, priority); err != nil && log.V(3) {
-		log.Infof("couldn't add %s to queue %s: %s", repl, bq.name, err)
+	var should bool
+	var priority float64
+	reason := QueueSkipNotNeeded
+	if r, ok := bq.impl.(queueSkipReasoner); ok {
+		should, priority, reason = r.shouldQueueWithReason(now, repl, cfg)
+	} else {
+		should, priority = bq.impl.shouldQueue(now, repl, cfg)
+	}
+	switch err := bq.addInternal(repl, should, priority); err {
+	case nil:
+	case errQueueDisabled:
+		bq.setSkipReason(repl, QueueSkipDisabled)
+	case errReplicaNotAddable:
+		bq.setSkipReason(repl, reason)
+	default:
+		if log.V(3) {
+			log.Infof("couldn't add %s to queue %s: %s", repl, bq.name, err)
+		}
 	}
 }
 
@@ -230,14 +333,17 @@ func (bq *baseQueue) addInternal(repl *Replica, should bool, priority float64) e
 	if log.V(3) {
 		log.Infof("adding replica %s to %s queue", repl, bq.name)
 	}
+	delete(bq.skipped, rangeID)
 	item = &replicaItem{value: repl, priority: priority}
 	heap.Push(&bq.priorityQ, item)
 	bq.replicas[rangeID] = item
 
 	// If adding this replica has pushed the queue past its maximum size,
-	// remove the lowest priority element.
+	// remove the lowest priority element. Whichever replica that is, its
+	// work has been dropped, so count it as a rejection.
 	if pqLen := bq.priorityQ.Len(); pqLen > bq.maxSize {
 		bq.remove(pqLen - 1)
+		atomic.AddInt64(&bq.rejections, 1)
 	}
 	// Signal the processLoop that a replica has been added.
 	select {
@@ -252,6 +358,7 @@ func (bq *baseQueue) addInternal(repl *Replica, should bool, priority float64) e
 func (bq *baseQueue) MaybeRemove(repl *Replica) {
 	bq.Lock()
 	defer bq.Unlock()
+	delete(bq.skipped, repl.Desc().RangeID)
 	if item, ok := bq.replicas[repl.Desc().RangeID]; ok {
 		if log.V(3) {
 			log.Infof("removing replica %s from %s queue", item.value, bq.name)
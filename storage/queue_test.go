@@ -247,6 +247,105 @@ func TestBaseQueueAdd(t *testing.T) {
 	}
 }
 
+// TestBaseQueueRejections verifies that replicas dropped because the
+// queue is full are counted as rejections.
+func TestBaseQueueRejections(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	g, stopper := gossipForTest(t)
+	defer stopper.Stop()
+
+	testQueue := &testQueueImpl{
+		shouldQueueFn: func(now proto.Timestamp, r *Replica) (shouldQueue bool, priority float64) {
+			return true, 1.0
+		},
+	}
+	bq := newBaseQueue("test", testQueue, g, 2)
+	for i := 1; i <= 5; i++ {
+		r := &Replica{}
+		if err := r.setDesc(&proto.RangeDescriptor{RangeID: proto.RangeID(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bq.Add(r, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bq.Length() != 2 {
+		t.Fatalf("expected length 2; got %d", bq.Length())
+	}
+	if a, e := bq.Rejections(), int64(3); a != e {
+		t.Fatalf("expected %d rejections; got %d", e, a)
+	}
+}
+
+// testSkipReasonQueueImpl extends testQueueImpl to explain why replicas
+// are not queued.
+type testSkipReasonQueueImpl struct {
+	testQueueImpl
+	reason QueueSkipReason
+}
+
+func (tq *testSkipReasonQueueImpl) shouldQueueWithReason(now proto.Timestamp, r *Replica,
+	cfg *config.SystemConfig) (bool, float64, QueueSkipReason) {
+	should, priority := tq.shouldQueue(now, r, cfg)
+	return should, priority, tq.reason
+}
+
+// TestBaseQueueSkipReason verifies that the most recent reason for not
+// queueing a replica is recorded, and cleared once the replica is queued.
+func TestBaseQueueSkipReason(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	g, stopper := gossipForTest(t)
+	defer stopper.Stop()
+
+	r := &Replica{}
+	if err := r.setDesc(&proto.RangeDescriptor{RangeID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	should := false
+	testQueue := &testQueueImpl{
+		shouldQueueFn: func(now proto.Timestamp, r *Replica) (shouldQueue bool, priority float64) {
+			return should, 1.0
+		},
+	}
+	bq := newBaseQueue("test", testQueue, g, 1)
+	if reason, ok := bq.SkipReason(1); ok {
+		t.Errorf("expected no skip reason before MaybeAdd; got %s", reason)
+	}
+	bq.MaybeAdd(r, proto.ZeroTimestamp)
+	if reason, ok := bq.SkipReason(1); !ok || reason != QueueSkipNotNeeded {
+		t.Errorf("expected skip reason %s; got %s", QueueSkipNotNeeded, reason)
+	}
+
+	// Once added, the skip reason is cleared.
+	should = true
+	bq.MaybeAdd(r, proto.ZeroTimestamp)
+	if reason, ok := bq.SkipReason(1); ok {
+		t.Errorf("expected no skip reason once queued; got %s", reason)
+	}
+
+	bq.MaybeRemove(r)
+	bq.SetDisabled(true)
+	bq.MaybeAdd(r, proto.ZeroTimestamp)
+	if reason, ok := bq.SkipReason(1); !ok || reason != QueueSkipDisabled {
+		t.Errorf("expected skip reason %s; got %s", QueueSkipDisabled, reason)
+	}
+
+	// Queues implementing queueSkipReasoner supply their own reasons.
+	reasonQueue := &testSkipReasonQueueImpl{
+		testQueueImpl: testQueueImpl{
+			shouldQueueFn: func(now proto.Timestamp, r *Replica) (shouldQueue bool, priority float64) {
+				return false, 0.0
+			},
+		},
+		reason: QueueSkipNoRebalance,
+	}
+	bq = newBaseQueue("test", reasonQueue, g, 1)
+	bq.MaybeAdd(r, proto.ZeroTimestamp)
+	if reason, ok := bq.SkipReason(1); !ok || reason != QueueSkipNoRebalance {
+		t.Errorf("expected skip reason %s; got %s", QueueSkipNoRebalance, reason)
+	}
+}
+
 // TestBaseQueueProcess verifies that items from the queue are
 // processed according to the timer function.
 func TestBaseQueueProcess(t *testing.T) {
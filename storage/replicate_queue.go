@@ -18,6 +18,7 @@
 package storage
 
 import (
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/cockroach/config"
@@ -35,22 +36,311 @@ const (
 	// replicateQueueTimerDuration is the duration between replication of queued
 	// replicas.
 	replicateQueueTimerDuration = 0 // zero duration to process replication greedily
+
+	// actionCacheTTL is the duration for which an allocator action computed
+	// for a range may be reused.
+	actionCacheTTL = 1 * time.Second
+
+	// actionCacheMaxSize is the number of cached actions above which expired
+	// entries are pruned.
+	actionCacheMaxSize = 10000
+
+	// defaultFailureBackoff is the initial time to wait before reprocessing
+	// a range whose replication change failed.
+	defaultFailureBackoff = 1 * time.Second
+
+	// defaultMaxFailureBackoff caps the time to wait before reprocessing a
+	// range which keeps failing.
+	defaultMaxFailureBackoff = 5 * time.Minute
+
+	// maxReplicaCountMismatches is the number of consecutive times a range
+	// may be processed successfully while its replica count disagrees with
+	// its zone config before the mismatch is reported as an allocator bug.
+	maxReplicaCountMismatches = 10
 )
 
+// actionCacheEntry is an allocator action computed for a range, along with
+// the inputs it was computed from.
+type actionCacheEntry struct {
+	desc       *proto.RangeDescriptor
+	sysCfg     *config.SystemConfig
+	generation int64 // store pool generation
+	expiration int64 // wall time in nanoseconds
+	action     AllocatorAction
+	priority   float64
+}
+
+// ActionCache is a short-lived cache of allocator actions keyed by range ID.
+// Both shouldQueue and process compute the action for a range, and as the
+// replicate queue processes greedily, the same range is often evaluated
+// repeatedly with identical inputs. A cached action is only reused if the
+// range descriptor, the system config and the store pool generation it was
+// computed from are all unchanged. Descriptors and system configs are
+// replaced rather than modified when updated, so comparing pointers suffices.
+// The allocator simulation shares this cache to measure its effect.
+type ActionCache struct {
+	sync.Mutex
+	ttl          int64 // in nanoseconds; zero disables caching
+	entries      map[proto.RangeID]actionCacheEntry
+	evaluations  int64 // requests for a range's action
+	computations int64 // calls made to compute an action
+}
+
+// NewActionCache returns an ActionCache whose entries are reused for up to
+// ttl. A ttl of zero disables caching.
+func NewActionCache(ttl time.Duration) *ActionCache {
+	return &ActionCache{
+		ttl:     ttl.Nanoseconds(),
+		entries: map[proto.RangeID]actionCacheEntry{},
+	}
+}
+
+// ComputeAction returns the action for the range, reusing a cached action
+// computed from the same inputs if one hasn't expired, and otherwise
+// calling compute and caching its result. generation identifies the state
+// of the store pool.
+func (ac *ActionCache) ComputeAction(now proto.Timestamp, desc *proto.RangeDescriptor,
+	sysCfg *config.SystemConfig, generation int64,
+	compute func() (AllocatorAction, float64)) (AllocatorAction, float64) {
+	if action, priority, ok := ac.get(now, desc, sysCfg, generation); ok {
+		return action, priority
+	}
+	action, priority := compute()
+	ac.add(now, desc, sysCfg, generation, action, priority)
+	return action, priority
+}
+
+// Stats returns the number of actions requested from the cache and the
+// number of those which had to be computed.
+func (ac *ActionCache) Stats() (evaluations, computations int64) {
+	ac.Lock()
+	defer ac.Unlock()
+	return ac.evaluations, ac.computations
+}
+
+// Clear drops all cached actions, which is required whenever the way
+// actions are computed changes.
+func (ac *ActionCache) Clear() {
+	ac.Lock()
+	defer ac.Unlock()
+	ac.entries = map[proto.RangeID]actionCacheEntry{}
+}
+
+// get returns the cached action for the range, if still valid.
+func (ac *ActionCache) get(now proto.Timestamp, desc *proto.RangeDescriptor,
+	sysCfg *config.SystemConfig, generation int64) (AllocatorAction, float64, bool) {
+	ac.Lock()
+	defer ac.Unlock()
+	ac.evaluations++
+	e, ok := ac.entries[desc.RangeID]
+	if !ok || e.desc != desc || e.sysCfg != sysCfg || e.generation != generation ||
+		now.WallTime >= e.expiration {
+		return AllocatorNoop, 0, false
+	}
+	return e.action, e.priority, true
+}
+
+// add caches the action computed for the range.
+func (ac *ActionCache) add(now proto.Timestamp, desc *proto.RangeDescriptor,
+	sysCfg *config.SystemConfig, generation int64, action AllocatorAction, priority float64) {
+	ac.Lock()
+	defer ac.Unlock()
+	ac.computations++
+	if ac.ttl == 0 {
+		return
+	}
+	if len(ac.entries) >= actionCacheMaxSize {
+		for rangeID, e := range ac.entries {
+			if now.WallTime >= e.expiration {
+				delete(ac.entries, rangeID)
+			}
+		}
+	}
+	ac.entries[desc.RangeID] = actionCacheEntry{
+		desc:       desc,
+		sysCfg:     sysCfg,
+		generation: generation,
+		expiration: now.WallTime + ac.ttl,
+		action:     action,
+		priority:   priority,
+	}
+}
+
+// failureBackoff tracks consecutive processing failures per range. A range
+// which keeps failing, e.g. because no valid allocation target exists, would
+// otherwise be reprocessed by the greedy replicate queue on every cycle.
+type failureBackoff struct {
+	sync.Mutex
+	initial, max time.Duration
+	entries      map[proto.RangeID]failureEntry
+}
+
+// failureEntry records the consecutive failures of a range and the wall
+// time in nanoseconds before which it should not be reprocessed.
+type failureEntry struct {
+	failures int
+	retryAt  int64
+}
+
+// newFailureBackoff returns a failureBackoff with the given initial and
+// maximum backoff, substituting the defaults for zero values.
+func newFailureBackoff(initial, max time.Duration) *failureBackoff {
+	if initial == 0 {
+		initial = defaultFailureBackoff
+	}
+	if max == 0 {
+		max = defaultMaxFailureBackoff
+	}
+	return &failureBackoff{
+		initial: initial,
+		max:     max,
+		entries: map[proto.RangeID]failureEntry{},
+	}
+}
+
+// backingOff returns whether the range failed recently enough that it
+// should not be reprocessed yet.
+func (fb *failureBackoff) backingOff(now proto.Timestamp, rangeID proto.RangeID) bool {
+	fb.Lock()
+	defer fb.Unlock()
+	e, ok := fb.entries[rangeID]
+	return ok && now.WallTime < e.retryAt
+}
+
+// record notes the outcome of processing the range. A success clears the
+// range's failures; a failure doubles its backoff, up to the maximum.
+func (fb *failureBackoff) record(now proto.Timestamp, rangeID proto.RangeID, err error) {
+	fb.Lock()
+	defer fb.Unlock()
+	if err == nil {
+		delete(fb.entries, rangeID)
+		return
+	}
+	e := fb.entries[rangeID]
+	e.failures++
+	backoff := fb.max
+	if shift := uint(e.failures - 1); shift < 32 && fb.initial<<shift < fb.max {
+		backoff = fb.initial << shift
+	}
+	e.retryAt = now.WallTime + backoff.Nanoseconds()
+	fb.entries[rangeID] = e
+}
+
+// pinnedRanges is the set of ranges whose replicas have been pinned to
+// their current stores by an operator. The replicate queue neither removes
+// nor rebalances the replicas of a pinned range, but still up-replicates it
+// and replaces its dead replicas, as losing a replica to a pin would put the
+// range's availability at risk.
+type pinnedRanges struct {
+	sync.Mutex
+	ranges map[proto.RangeID]struct{}
+}
+
+// set pins or unpins the range.
+func (pr *pinnedRanges) set(rangeID proto.RangeID, pinned bool) {
+	pr.Lock()
+	defer pr.Unlock()
+	if pinned {
+		pr.ranges[rangeID] = struct{}{}
+	} else {
+		delete(pr.ranges, rangeID)
+	}
+}
+
+// pinned returns whether the range is pinned.
+func (pr *pinnedRanges) pinned(rangeID proto.RangeID) bool {
+	pr.Lock()
+	defer pr.Unlock()
+	_, ok := pr.ranges[rangeID]
+	return ok
+}
+
+// replicaCountMismatches tracks, per range, the number of consecutive
+// times the range was processed successfully while its replica count
+// disagreed with its zone config.
+type replicaCountMismatches struct {
+	sync.Mutex
+	counts map[proto.RangeID]int
+}
+
+// record notes whether the range's replica count disagreed with its zone
+// config after processing, and returns the number of consecutive
+// mismatches. A match clears the range's count.
+func (rm *replicaCountMismatches) record(rangeID proto.RangeID, mismatch bool) int {
+	rm.Lock()
+	defer rm.Unlock()
+	if !mismatch {
+		delete(rm.counts, rangeID)
+		return 0
+	}
+	rm.counts[rangeID]++
+	return rm.counts[rangeID]
+}
+
+// ReplicateQueueStats summarizes the time taken by a store's replicate
+// queue to process replicas, which covers both the allocator's decision and
+// the replication change it leads to.
+type ReplicateQueueStats struct {
+	Processed      int64         // replicas processed, successfully or not
+	Failed         int64         // replicas whose processing returned an error
+	TotalDuration  time.Duration // time spent processing all replicas
+	FailedDuration time.Duration // time spent processing failed replicas
+	MaxDuration    time.Duration // longest time spent processing a replica
+}
+
+// processStats accumulates ReplicateQueueStats as replicas are processed.
+type processStats struct {
+	sync.Mutex
+	stats ReplicateQueueStats
+}
+
+// record notes that processing a replica took the given duration and
+// returned err.
+func (ps *processStats) record(d time.Duration, err error) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.stats.Processed++
+	ps.stats.TotalDuration += d
+	if err != nil {
+		ps.stats.Failed++
+		ps.stats.FailedDuration += d
+	}
+	if d > ps.stats.MaxDuration {
+		ps.stats.MaxDuration = d
+	}
+}
+
+// snapshot returns a copy of the stats accumulated so far.
+func (ps *processStats) snapshot() ReplicateQueueStats {
+	ps.Lock()
+	defer ps.Unlock()
+	return ps.stats
+}
+
 // replicateQueue manages a queue of replicas which may need to add an
 // additional replica to their range.
 type replicateQueue struct {
 	*baseQueue
-	allocator Allocator
-	clock     *hlc.Clock
+	allocator  Allocator
+	clock      *hlc.Clock
+	actions    *ActionCache
+	backoff    *failureBackoff
+	pins       *pinnedRanges
+	stats      *processStats
+	mismatches *replicaCountMismatches
 }
 
 // makeReplicateQueue returns a new instance of replicateQueue.
 func makeReplicateQueue(gossip *gossip.Gossip, allocator Allocator, clock *hlc.Clock,
 	options RebalancingOptions) replicateQueue {
 	rq := replicateQueue{
-		allocator: allocator,
-		clock:     clock,
+		allocator:  allocator,
+		clock:      clock,
+		actions:    NewActionCache(actionCacheTTL),
+		backoff:    newFailureBackoff(options.FailureBackoff, options.MaxFailureBackoff),
+		pins:       &pinnedRanges{ranges: map[proto.RangeID]struct{}{}},
+		stats:      &processStats{},
+		mismatches: &replicaCountMismatches{counts: map[proto.RangeID]int{}},
 	}
 	// rq must be a pointer in order to setup the reference cycle.
 	rq.baseQueue = newBaseQueue("replicate", &rq, gossip, replicateQueueMaxSize)
@@ -69,37 +359,150 @@ func (rq *replicateQueue) acceptsUnsplitRanges() bool {
 
 func (rq replicateQueue) shouldQueue(now proto.Timestamp, repl *Replica,
 	sysCfg *config.SystemConfig) (shouldQ bool, priority float64) {
+	shouldQ, priority, _ = rq.shouldQueueWithReason(now, repl, sysCfg)
+	return
+}
+
+// shouldQueueWithReason implements queueSkipReasoner, explaining why an
+// under-replicated range may not be queued.
+func (rq replicateQueue) shouldQueueWithReason(now proto.Timestamp, repl *Replica,
+	sysCfg *config.SystemConfig) (shouldQ bool, priority float64, reason QueueSkipReason) {
 
 	desc := repl.Desc()
 	if len(sysCfg.ComputeSplitKeys(desc.StartKey, desc.EndKey)) > 0 {
 		// If the replica's range needs splitting, wait until done.
-		return
+		return false, 0, QueueSkipNeedsSplit
+	}
+
+	if rq.backoff.backingOff(now, desc.RangeID) {
+		return false, 0, QueueSkipBackoff
 	}
 
 	// Find the zone config for this range.
 	zone, err := sysCfg.GetZoneConfigForKey(desc.StartKey)
 	if err != nil {
 		log.Error(err)
-		return
+		return false, 0, QueueSkipZoneConfigError
 	}
 
-	action, priority := rq.allocator.ComputeAction(*zone, desc)
+	action, priority := rq.computeAction(now, *zone, desc, sysCfg)
+	if rq.skipsPinned(desc.RangeID, action) {
+		return false, 0, QueueSkipPinned
+	}
 	if action != AllocatorNoop {
-		return true, priority
+		return true, priority, 0
 	}
 	// See if there is a rebalancing opportunity present.
-	shouldRebalance := rq.allocator.ShouldRebalance(repl.rm.StoreID())
-	return shouldRebalance, 0
+	if !rq.allocator.ShouldRebalance(repl.rm.StoreID()) {
+		return false, 0, QueueSkipNoRebalance
+	}
+	return true, 0, 0
+}
+
+// computeAction returns the allocator action for the range, reusing the
+// result of a recent computation if its inputs are unchanged.
+func (rq replicateQueue) computeAction(now proto.Timestamp, zone config.ZoneConfig,
+	desc *proto.RangeDescriptor, sysCfg *config.SystemConfig) (AllocatorAction, float64) {
+	return rq.actions.ComputeAction(now, desc, sysCfg, rq.allocator.storePool.Generation(),
+		func() (AllocatorAction, float64) {
+			return rq.allocator.ComputeAction(zone, desc)
+		})
 }
 
+// skipsPinned returns whether the action must be skipped because the range
+// is pinned. Removals and rebalancing are skipped; additions and the removal
+// of dead replicas are not, so that a pinned range is still repaired.
+func (rq replicateQueue) skipsPinned(rangeID proto.RangeID, action AllocatorAction) bool {
+	if !rq.pins.pinned(rangeID) {
+		return false
+	}
+	return action == AllocatorRemove || action == AllocatorNoop
+}
+
+// process makes the replication change needed by the replica's range, if
+// any. Consecutive failures back the range off from being requeued. The
+// time taken is recorded in the queue's stats.
 func (rq replicateQueue) process(now proto.Timestamp, repl *Replica, sysCfg *config.SystemConfig) error {
+	start := time.Now()
+	err := rq.processChange(now, repl, sysCfg)
+	elapsed := time.Since(start)
+	rq.stats.record(elapsed, err)
+	if log.V(1) {
+		log.Infof("processed range %d in %s: %v", repl.Desc().RangeID, elapsed, err)
+	}
+	rq.backoff.record(now, repl.Desc().RangeID, err)
+	if err == nil {
+		rq.verifyReplicaCount(now, repl, sysCfg)
+	}
+	return err
+}
+
+// verifyReplicaCount is a safety net around the allocator. Once the range
+// has been processed, it cross-checks the range's replica count against
+// its zone config and requeues the replica if they differ, including when
+// the allocator found nothing to do. A zone with MinDistinctNodes may carry
+// extra replicas until they span that many nodes, and the extra replicas of
+// a pinned range are never removed, so only counts outside of those bounds
+// are mismatches. Replication changes are made one at a time, so a mismatch
+// is expected while a range is up-replicated or rebalanced; only one which
+// persists across maxReplicaCountMismatches consecutive passes indicates an
+// allocator bug.
+func (rq replicateQueue) verifyReplicaCount(now proto.Timestamp, repl *Replica, sysCfg *config.SystemConfig) {
+	desc := repl.Desc()
+	if _, r := desc.FindReplica(repl.rm.StoreID()); r == nil {
+		// The replica removed itself from the range.
+		rq.mismatches.record(desc.RangeID, false)
+		return
+	}
+	zone, err := sysCfg.GetZoneConfigForKey(desc.StartKey)
+	if err != nil {
+		return
+	}
+	have, need := len(desc.Replicas), len(zone.ReplicaAttrs)
+	mismatch := replicaCountMismatch(have, *zone, rq.pins.pinned(desc.RangeID))
+	n := rq.mismatches.record(desc.RangeID, mismatch)
+	if n == 0 {
+		return
+	}
+	if n == maxReplicaCountMismatches {
+		log.Errorf("range %d has had %d replicas after %d consecutive passes, but its zone config "+
+			"requires %d; this is likely an allocator bug", desc.RangeID, have, n, need)
+	} else if log.V(1) {
+		log.Infof("range %d has %d replicas after processing, but its zone config requires %d; requeueing",
+			desc.RangeID, have, need)
+	}
+	rq.MaybeAdd(repl, now)
+}
+
+// replicaCountMismatch returns whether a range with the given number of
+// replicas disagrees with its zone config once processed.
+func replicaCountMismatch(have int, zone config.ZoneConfig, pinned bool) bool {
+	need := len(zone.ReplicaAttrs)
+	if have < need {
+		return true
+	}
+	if pinned {
+		return false
+	}
+	max := need
+	if minNodes := int(zone.MinDistinctNodes); minNodes > max {
+		max = minNodes
+	}
+	return have > max
+}
+
+func (rq replicateQueue) processChange(now proto.Timestamp, repl *Replica, sysCfg *config.SystemConfig) error {
 	desc := repl.Desc()
 	// Find the zone config for this range.
 	zone, err := sysCfg.GetZoneConfigForKey(desc.StartKey)
 	if err != nil {
 		return err
 	}
-	action, _ := rq.allocator.ComputeAction(*zone, desc)
+	action, _ := rq.computeAction(now, *zone, desc, sysCfg)
+	if rq.skipsPinned(desc.RangeID, action) {
+		// Return without re-queueing this replica.
+		return nil
+	}
 
 	// Avoid taking action if the range has too many dead replicas to make
 	// quorum.
@@ -112,7 +515,8 @@ func (rq replicateQueue) process(now proto.Timestamp, repl *Replica, sysCfg *con
 
 	switch action {
 	case AllocatorAdd:
-		newStore, err := rq.allocator.AllocateTarget(zone.ReplicaAttrs[0], desc.Replicas, true, nil)
+		newStore, err := rq.allocator.AllocateTarget(zone.ReplicaAttrs[0], desc.Replicas,
+			int(zone.MinDistinctNodes), true, nil)
 		if err != nil {
 			return err
 		}
@@ -120,11 +524,16 @@ func (rq replicateQueue) process(now proto.Timestamp, repl *Replica, sysCfg *con
 			NodeID:  newStore.Node.NodeID,
 			StoreID: newStore.StoreID,
 		}
+		if err = rq.checkAddTarget(repl, newReplica, desc); err != nil {
+			return err
+		}
 		if err = repl.ChangeReplicas(proto.ADD_REPLICA, newReplica, desc); err != nil {
 			return err
 		}
 	case AllocatorRemove:
-		removeReplica, err := rq.allocator.RemoveTarget(desc.Replicas)
+		// The replica being processed holds the lease; prefer not to remove
+		// it.
+		removeReplica, err := rq.allocator.RemoveTarget(desc.Replicas, repl.rm.StoreID())
 		if err != nil {
 			return err
 		}
@@ -142,12 +551,19 @@ func (rq replicateQueue) process(now proto.Timestamp, repl *Replica, sysCfg *con
 			}
 			break
 		}
+		if rq.pins.pinned(desc.RangeID) {
+			log.Warningf("range %d is pinned, but has a dead replica on store %d; removing it",
+				desc.RangeID, deadReplicas[0].StoreID)
+		}
 		if err = repl.ChangeReplicas(proto.REMOVE_REPLICA, deadReplicas[0], desc); err != nil {
 			return err
 		}
 	case AllocatorNoop:
 		// The Noop case will result if this replica was queued in order to
 		// rebalance. Attempt to find a rebalancing target.
+		if rq.allocator.RebalanceAction() == AllocatorReplace {
+			return rq.replace(repl, zone.ReplicaAttrs[0], desc)
+		}
 		rebalanceStore := rq.allocator.RebalanceTarget(zone.ReplicaAttrs[0], desc.Replicas)
 		if rebalanceStore == nil {
 			// No action was necessary and no rebalance target was found. Return
@@ -158,6 +574,9 @@ func (rq replicateQueue) process(now proto.Timestamp, repl *Replica, sysCfg *con
 			NodeID:  rebalanceStore.Node.NodeID,
 			StoreID: rebalanceStore.StoreID,
 		}
+		if err = rq.checkAddTarget(repl, rebalanceReplica, desc); err != nil {
+			return err
+		}
 		if err = repl.ChangeReplicas(proto.ADD_REPLICA, rebalanceReplica, desc); err != nil {
 			return err
 		}
@@ -168,6 +587,70 @@ func (rq replicateQueue) process(now proto.Timestamp, repl *Replica, sysCfg *con
 	return nil
 }
 
+// replace rebalances the range by moving one of its replicas: the new
+// replica is added and the replica chosen by the allocator is removed in
+// the same pass, so the range is only over-replicated between the two
+// changes. If the removal fails, the range is requeued and the surplus
+// replica is removed as usual.
+func (rq replicateQueue) replace(repl *Replica, required proto.Attributes, desc *proto.RangeDescriptor) error {
+	ms := repl.GetMVCCStats()
+	target, removeReplica := rq.allocator.ReplaceTarget(required, desc.Replicas, ms.KeyBytes+ms.ValBytes,
+		repl.rm.StoreID())
+	if target == nil {
+		// No rebalance target was found. Return without re-queueing this
+		// replica.
+		return nil
+	}
+	addReplica := proto.Replica{
+		NodeID:  target.Node.NodeID,
+		StoreID: target.StoreID,
+	}
+	if err := rq.checkAddTarget(repl, addReplica, desc); err != nil {
+		return err
+	}
+	if err := repl.ChangeReplicas(proto.ADD_REPLICA, addReplica, desc); err != nil {
+		return err
+	}
+	if err := repl.ChangeReplicas(proto.REMOVE_REPLICA, removeReplica, repl.Desc()); err != nil {
+		rq.MaybeAdd(repl, rq.clock.Now())
+		return err
+	}
+	// Do not requeue if we removed ourselves.
+	if removeReplica.StoreID == repl.rm.StoreID() {
+		return nil
+	}
+	rq.MaybeAdd(repl, rq.clock.Now())
+	return nil
+}
+
+// checkAddTarget verifies that the store of a replica about to be added to
+// the range doesn't already hold one, which the change would duplicate. If
+// the replica's descriptor changed since desc was read and the store now
+// holds a replica, the range is requeued to be reprocessed against the new
+// descriptor.
+func (rq replicateQueue) checkAddTarget(repl *Replica, target proto.Replica, desc *proto.RangeDescriptor) error {
+	err := checkAddTarget(target, desc, repl.Desc())
+	if err != nil && desc != repl.Desc() {
+		rq.MaybeAdd(repl, rq.clock.Now())
+	}
+	return err
+}
+
+// checkAddTarget returns an error if the target store holds a replica in
+// either desc, the descriptor the target was chosen against, or current,
+// the range's latest descriptor.
+func checkAddTarget(target proto.Replica, desc, current *proto.RangeDescriptor) error {
+	if _, r := desc.FindReplica(target.StoreID); r != nil {
+		return util.Errorf("range %d already has a replica on store %d; not adding a duplicate",
+			desc.RangeID, target.StoreID)
+	}
+	if _, r := current.FindReplica(target.StoreID); r != nil {
+		return util.Errorf("descriptor of range %d changed and now has a replica on store %d; not adding a duplicate",
+			desc.RangeID, target.StoreID)
+	}
+	return nil
+}
+
 func (rq replicateQueue) timer() time.Duration {
 	return replicateQueueTimerDuration
 }
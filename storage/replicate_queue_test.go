@@ -0,0 +1,319 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/config"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/testutils/gossiputil"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/leaktest"
+)
+
+// TestReplicateQueueActionCache verifies that a computed allocator action is
+// reused only while the range descriptor, the system config and the store
+// pool are unchanged, and not beyond actionCacheTTL.
+func TestReplicateQueueActionCache(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+	var stores []*proto.StoreDescriptor
+	for storeID := proto.StoreID(1); storeID <= 4; storeID++ {
+		stores = append(stores, &proto.StoreDescriptor{
+			StoreID: storeID,
+			Node:    proto.NodeDescriptor{NodeID: proto.NodeID(storeID)},
+		})
+	}
+	sg := gossiputil.NewStoreGossiper(g)
+	sg.GossipStores(stores, t)
+	drainStore3 := func() {
+		gossipStoreUpdate(sg, stores, 3, func(desc *proto.StoreDescriptor) {
+			desc.Draining = true
+		}, t)
+	}
+
+	manual := hlc.NewManualClock(0)
+	rq := makeReplicateQueue(g, a, hlc.NewClock(manual.UnixNano), RebalancingOptions{})
+
+	zone := config.ZoneConfig{
+		ReplicaAttrs: []proto.Attributes{{}, {}, {}},
+	}
+	desc := &proto.RangeDescriptor{
+		RangeID: 1,
+		Replicas: []proto.Replica{
+			{StoreID: 1, NodeID: 1},
+			{StoreID: 2, NodeID: 2},
+			{StoreID: 3, NodeID: 3},
+		},
+	}
+	sysCfg := &config.SystemConfig{}
+	now := proto.Timestamp{WallTime: 1}
+
+	testCases := []struct {
+		update               func()
+		expAction            AllocatorAction
+		expTotalComputations int64
+	}{
+		// The first evaluation computes the action.
+		{func() {}, AllocatorNoop, 1},
+		// Identical inputs reuse it.
+		{func() {}, AllocatorNoop, 1},
+		// A replaced descriptor invalidates it.
+		{func() { d := *desc; desc = &d }, AllocatorNoop, 2},
+		{func() {}, AllocatorNoop, 2},
+		// As does a new system config.
+		{func() { sysCfg = &config.SystemConfig{} }, AllocatorNoop, 3},
+		// As does a change in the store pool.
+		{drainStore3, AllocatorAdd, 4},
+		{func() {}, AllocatorAdd, 4},
+		// Regossiping an already draining store changes nothing.
+		{drainStore3, AllocatorAdd, 4},
+		// An expired entry is recomputed.
+		{func() { now.WallTime += actionCacheTTL.Nanoseconds() }, AllocatorAdd, 5},
+	}
+	for i, test := range testCases {
+		test.update()
+		action, _ := rq.computeAction(now, zone, desc, sysCfg)
+		if action != test.expAction {
+			t.Errorf("%d: expected action %d, got %d", i, test.expAction, action)
+		}
+		if c := rq.actions.computations; c != test.expTotalComputations {
+			t.Errorf("%d: expected %d computations, got %d", i, test.expTotalComputations, c)
+		}
+	}
+}
+
+// TestReplicateQueueFailureBackoff verifies that a range which can never be
+// satisfied is reprocessed with exponentially decaying frequency rather than
+// on every cycle, and that a success resets its backoff.
+func TestReplicateQueueFailureBackoff(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+
+	manual := hlc.NewManualClock(0)
+	rq := makeReplicateQueue(g, a, hlc.NewClock(manual.UnixNano), RebalancingOptions{
+		FailureBackoff:    time.Second,
+		MaxFailureBackoff: 8 * time.Second,
+	})
+
+	const rangeID = proto.RangeID(1)
+	errNoTarget := util.Errorf("unable to allocate a target store")
+	// Step through 30 seconds in increments of 100ms, processing the range
+	// whenever it isn't backing off and failing every time.
+	var attempts []int64
+	for ms := int64(0); ms < 30000; ms += 100 {
+		now := proto.Timestamp{WallTime: ms * time.Millisecond.Nanoseconds()}
+		if rq.backoff.backingOff(now, rangeID) {
+			continue
+		}
+		attempts = append(attempts, ms/1000)
+		rq.backoff.record(now, rangeID, errNoTarget)
+	}
+	// The backoff doubles from 1s until it is capped at 8s.
+	expAttempts := []int64{0, 1, 3, 7, 15, 23}
+	if !reflect.DeepEqual(attempts, expAttempts) {
+		t.Errorf("expected attempts at %v seconds; got %v", expAttempts, attempts)
+	}
+
+	// A success clears the backoff entirely.
+	now := proto.Timestamp{WallTime: (30 * time.Second).Nanoseconds()}
+	rq.backoff.record(now, rangeID, nil)
+	if rq.backoff.backingOff(now, rangeID) {
+		t.Errorf("expected no backoff after a success")
+	}
+	rq.backoff.record(now, rangeID, errNoTarget)
+	now.WallTime += time.Second.Nanoseconds()
+	if rq.backoff.backingOff(now, rangeID) {
+		t.Errorf("expected the backoff to restart at 1s after a success")
+	}
+}
+
+// TestReplicateQueuePinnedRanges verifies that the replicas of a pinned
+// range are neither removed nor rebalanced, while the range may still be
+// up-replicated and have its dead replicas replaced.
+func TestReplicateQueuePinnedRanges(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+
+	manual := hlc.NewManualClock(0)
+	rq := makeReplicateQueue(g, a, hlc.NewClock(manual.UnixNano), RebalancingOptions{})
+
+	const rangeID = proto.RangeID(1)
+	actions := []AllocatorAction{AllocatorAdd, AllocatorRemove, AllocatorRemoveDead, AllocatorNoop}
+	testCases := []struct {
+		pinned  bool
+		expSkip []bool // indexed as actions
+	}{
+		{false, []bool{false, false, false, false}},
+		{true, []bool{false, true, false, true}},
+		// Unpinning the range restores all actions.
+		{false, []bool{false, false, false, false}},
+	}
+	for i, test := range testCases {
+		rq.pins.set(rangeID, test.pinned)
+		for j, action := range actions {
+			if skip := rq.skipsPinned(rangeID, action); skip != test.expSkip[j] {
+				t.Errorf("%d: expected skip=%t for action %d, got %t", i, test.expSkip[j], action, skip)
+			}
+		}
+		// Other ranges are unaffected.
+		if rq.skipsPinned(rangeID+1, AllocatorNoop) {
+			t.Errorf("%d: expected range %d not to be pinned", i, rangeID+1)
+		}
+	}
+}
+
+// TestCheckAddTarget verifies that a replica isn't added to a store which
+// already holds one, including when the store was added to the range by a
+// change racing with the allocator's choice of target.
+func TestCheckAddTarget(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	desc := &proto.RangeDescriptor{
+		RangeID: 1,
+		Replicas: []proto.Replica{
+			{StoreID: 1, NodeID: 1},
+			{StoreID: 2, NodeID: 2},
+		},
+	}
+	// raced is the descriptor after a concurrent change added a replica
+	// on store 3, which the allocator chose as its target from desc.
+	raced := *desc
+	raced.Replicas = append(append([]proto.Replica(nil), desc.Replicas...), proto.Replica{StoreID: 3, NodeID: 3})
+
+	testCases := []struct {
+		target  proto.StoreID
+		current *proto.RangeDescriptor
+		expErr  bool
+	}{
+		{3, desc, false},
+		{2, desc, true},
+		// The race would otherwise produce a duplicate replica on store 3.
+		{3, &raced, true},
+		{4, &raced, false},
+	}
+	for i, test := range testCases {
+		target := proto.Replica{StoreID: test.target, NodeID: proto.NodeID(test.target)}
+		if err := checkAddTarget(target, desc, test.current); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestReplicateQueueProcessStats verifies that the replicate queue's stats
+// record the time taken to process replicas whether or not processing
+// failed.
+func TestReplicateQueueProcessStats(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, _, a := createTestAllocator()
+	defer stopper.Stop()
+
+	manual := hlc.NewManualClock(0)
+	rq := makeReplicateQueue(g, a, hlc.NewClock(manual.UnixNano), RebalancingOptions{})
+
+	errNoTarget := util.Errorf("unable to allocate a target store")
+	rq.stats.record(2*time.Millisecond, nil)
+	rq.stats.record(5*time.Millisecond, errNoTarget)
+	rq.stats.record(time.Millisecond, nil)
+
+	expStats := ReplicateQueueStats{
+		Processed:      3,
+		Failed:         1,
+		TotalDuration:  8 * time.Millisecond,
+		FailedDuration: 5 * time.Millisecond,
+		MaxDuration:    5 * time.Millisecond,
+	}
+	if stats := rq.stats.snapshot(); stats != expStats {
+		t.Errorf("expected stats %+v; got %+v", expStats, stats)
+	}
+}
+
+// TestReplicaCountMismatch verifies that the extra replicas carried to span
+// MinDistinctNodes, or kept by a pin, aren't reported as mismatches, and
+// that mismatches are counted per range until the range's count matches.
+func TestReplicaCountMismatch(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	zone := func(replicas int, minNodes int32) config.ZoneConfig {
+		return config.ZoneConfig{
+			ReplicaAttrs:     make([]proto.Attributes, replicas),
+			MinDistinctNodes: minNodes,
+		}
+	}
+	testCases := []struct {
+		have        int
+		zone        config.ZoneConfig
+		pinned      bool
+		expMismatch bool
+	}{
+		{3, zone(3, 0), false, false},
+		{2, zone(3, 0), false, true},
+		{4, zone(3, 0), false, true},
+		// Extra replicas are carried until they span MinDistinctNodes.
+		{4, zone(3, 4), false, false},
+		{5, zone(3, 4), false, true},
+		// The extra replicas of a pinned range are never removed.
+		{5, zone(3, 0), true, false},
+		{2, zone(3, 0), true, true},
+	}
+	for i, test := range testCases {
+		if mismatch := replicaCountMismatch(test.have, test.zone, test.pinned); mismatch != test.expMismatch {
+			t.Errorf("%d: expected mismatch %t; got %t", i, test.expMismatch, mismatch)
+		}
+	}
+
+	rm := &replicaCountMismatches{counts: map[proto.RangeID]int{}}
+	for i := 1; i <= 3; i++ {
+		if n := rm.record(1, true); n != i {
+			t.Errorf("expected %d consecutive mismatches; got %d", i, n)
+		}
+	}
+	if n := rm.record(2, true); n != 1 {
+		t.Errorf("expected mismatches to be counted per range; got %d", n)
+	}
+	rm.record(1, false)
+	if n := rm.record(1, true); n != 1 {
+		t.Errorf("expected a match to reset the count; got %d", n)
+	}
+}
+
+// TestReplicateQueueRequeuesMismatch verifies that a range whose replica
+// count disagrees with its zone config once processed is queued again.
+func TestReplicateQueueRequeuesMismatch(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	tc := testContext{}
+	tc.Start(t)
+	defer tc.Stop()
+
+	rq := makeReplicateQueue(tc.gossip, tc.store.allocator(), tc.clock, RebalancingOptions{})
+	if l := rq.Length(); l != 0 {
+		t.Fatalf("expected an empty queue; got length %d", l)
+	}
+	// The range has a single replica, while the default zone config
+	// requires three.
+	rq.verifyReplicaCount(tc.clock.Now(), tc.rng, tc.gossip.GetSystemConfig())
+	if l := rq.Length(); l != 1 {
+		t.Errorf("expected the range to be requeued; got length %d", l)
+	}
+	if n := rq.mismatches.record(tc.rangeID, true); n != 2 {
+		t.Errorf("expected the mismatch to have been recorded once; got %d", n-1)
+	}
+}
@@ -20,15 +20,20 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/rand"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach/base"
+	"github.com/cockroachdb/cockroach/config"
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/testutils/gossiputil"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/randutil"
 	"github.com/cockroachdb/cockroach/util/stop"
@@ -42,15 +47,51 @@ type Cluster struct {
 	rpc           *rpc.Context
 	gossip        *gossip.Gossip
 	storePool     *storage.StorePool
-	allocator     storage.Allocator
+	allocator     allocatorPolicy
 	storeGossiper *gossiputil.StoreGossiper
 	nodes         map[proto.NodeID]*Node
 	stores        map[proto.StoreID]*Store
 	storeIDs      proto.StoreIDSlice // sorted
 	ranges        map[proto.RangeID]*Range
+	zone          config.ZoneConfig
+	gcDelay       int   // epochs a removed replica lingers before being GCed
+	deadAfter     int   // epochs a store may be down before its replicas are dead
+	throughput    int64 // per store write budget in bytes per epoch
+	actions       *storage.ActionCache
+	timeline      timeline
 	rand          *rand.Rand
 	seed          int64
 	epoch         int
+	// allocateErrs holds, for each range which could not be allocated a new
+	// replica during its last attempt, the reason why.
+	allocateErrs map[proto.RangeID]error
+	// replicasMoved counts every replica added or removed by the replicate
+	// queue, as a measure of the data movement (churn) of a run.
+	replicasMoved int
+	// nonVoterAttrs holds the attributes required of each non-voting replica
+	// of every range. See Range.nonVoterAttrs.
+	nonVoterAttrs []proto.Attributes
+	// feed, if set, receives the events published by every node and store,
+	// as it would in a real cluster. See setFeed.
+	feed *util.Feed
+	// tableZones holds the zone configs of individual tables, by table ID,
+	// which apply to the ranges within each table's key span in place of
+	// zone. They are looked up through sysCfg, as the replicate queue does.
+	tableZones map[uint32]*config.ZoneConfig
+	sysCfg     config.SystemConfig
+	// schedule holds the failure events yet to be applied, by default those
+	// of the --schedule flag. See setSchedule.
+	schedule failureSchedule
+	// pinned holds the ranges whose replicas are pinned to their stores, as
+	// with Store.SetRangePinned. See setPinned.
+	pinned map[proto.RangeID]struct{}
+	// snapshotEpochs is the number of epochs it takes a store to receive the
+	// snapshot of a replica added to it, or 0 if snapshots aren't modeled.
+	// See setSnapshotEpochs.
+	snapshotEpochs int
+	// recoveries tracks the recovery from every store and node failure, in
+	// the order in which they occurred. See recordFailure.
+	recoveries []*recovery
 }
 
 // createCluster generates a new cluster using the provided stopper and the
@@ -67,13 +108,22 @@ func createCluster(stopper *stop.Stopper, nodeCount int) *Cluster {
 		rpc:           rpcContext,
 		gossip:        g,
 		storePool:     storePool,
-		allocator:     storage.MakeAllocator(storePool, storage.RebalancingOptions{}),
+		allocator:     newDefaultPolicy(storePool, storage.RebalancingOptions{}),
 		storeGossiper: gossiputil.NewStoreGossiper(g),
 		nodes:         make(map[proto.NodeID]*Node),
 		stores:        make(map[proto.StoreID]*Store),
 		ranges:        make(map[proto.RangeID]*Range),
+		allocateErrs:  make(map[proto.RangeID]error),
+		zone:          *config.DefaultZoneConfig,
+		tableZones:    make(map[uint32]*config.ZoneConfig),
+		gcDelay:       *gcDelay,
+		deadAfter:     *timeUntilStoreDead,
+		throughput:    *storeThroughput,
+		actions:       newActionCache(*actionCacheTTL),
 		rand:          rand,
 		seed:          seed,
+		schedule:      flagSchedule,
+		pinned:        make(map[proto.RangeID]struct{}),
 	}
 
 	// Add the nodes.
@@ -81,25 +131,96 @@ func createCluster(stopper *stop.Stopper, nodeCount int) *Cluster {
 		c.addNewNodeWithStore()
 	}
 
-	// Add a single range and add to this first node's first store.
+	// Add a single range, spanning all keys, and add to this first node's
+	// first store.
 	firstRange := c.addRange()
+	firstRange.desc.StartKey = proto.KeyMin
+	firstRange.desc.EndKey = proto.KeyMax
 	firstRange.addReplica(c.stores[0])
 	return c
 }
 
+// createClusterWithStores generates a new cluster with one node for each
+// entry of storesPerNode, holding the given number of stores. This models a
+// deployment of mixed hardware, whose nodes have different numbers of drives.
+func createClusterWithStores(stopper *stop.Stopper, storesPerNode []int) *Cluster {
+	for i, stores := range storesPerNode {
+		if stores < 1 {
+			panic(fmt.Sprintf("node %d must have at least one store, got %d", i, stores))
+		}
+	}
+	c := createCluster(stopper, len(storesPerNode))
+	for i, stores := range storesPerNode {
+		for j := 1; j < stores; j++ {
+			c.addStore(proto.NodeID(i))
+		}
+	}
+	return c
+}
+
+// addNewNode adds a new node without any stores and returns its ID. Until a
+// store is added to it, the node never gossips a store descriptor and so is
+// never a candidate for any allocation.
+func (c *Cluster) addNewNode() proto.NodeID {
+	nodeID := proto.NodeID(len(c.nodes))
+	n := newNode(nodeID, c.gossip)
+	n.feed = c.feed
+	c.nodes[nodeID] = n
+	n.start(c.clock.PhysicalNow())
+	return nodeID
+}
+
 // addNewNodeWithStore adds new node with a single store.
 func (c *Cluster) addNewNodeWithStore() {
-	nodeID := proto.NodeID(len(c.nodes))
-	c.nodes[nodeID] = newNode(nodeID, c.gossip)
-	c.addStore(nodeID)
+	c.addStore(c.addNewNode())
+}
+
+// setLocality places the node with the provided nodeID, and all of its
+// stores, in the given locality. Localities are modeled as node attributes,
+// one per locality tier, ordered from the most significant, e.g.
+// setLocality(nodeID, "region=us", "zone=us-a").
+func (c *Cluster) setLocality(nodeID proto.NodeID, tiers ...string) {
+	n := c.nodes[nodeID]
+	n.desc.Attrs = proto.Attributes{Attrs: tiers}
+	for _, s := range n.stores {
+		s.desc.Node = n.desc
+	}
+}
+
+// rangeLocalities returns the number of replicas of the range in each
+// locality.
+func (c *Cluster) rangeLocalities(r *Range) map[string]int {
+	localities := map[string]int{}
+	for _, storeID := range r.getStoreIDs() {
+		localities[c.stores[storeID].desc.Node.Attrs.SortedString()]++
+	}
+	return localities
+}
+
+// rangeTierSpread returns the number of distinct localities holding the
+// range's voting replicas, considering only the first tiers tiers of each
+// locality. With localities of regions and zones, a tiers of 1 counts
+// the regions the range spans and a tiers of 2 its zones.
+func (c *Cluster) rangeTierSpread(r *Range, tiers int) int {
+	localities := map[string]struct{}{}
+	for _, replica := range r.desc.Replicas {
+		attrs := c.stores[replica.StoreID].desc.Node.Attrs.Attrs
+		if len(attrs) > tiers {
+			attrs = attrs[:tiers]
+		}
+		localities[strings.Join(attrs, ",")] = struct{}{}
+	}
+	return len(localities)
 }
 
 // addStore adds a new store to the node with the provided nodeID.
 func (c *Cluster) addStore(nodeID proto.NodeID) *Store {
 	n := c.nodes[nodeID]
 	s := n.addNewStore()
+	s.throughput = c.throughput
 	storeID, _ := s.getIDs()
 	c.stores[storeID] = s
+	s.start(c.clock.PhysicalNow())
 
 	// Save a sorted array of store IDs to avoid having to calculate them
 	// multiple times.
@@ -109,15 +230,587 @@ func (c *Cluster) addStore(nodeID proto.NodeID) *Store {
 	return s
 }
 
+// setStoreThroughput sets the number of bytes every store, including stores
+// added afterwards, can absorb each epoch before falling behind. A throughput
+// of 0 makes writes unlimited.
+func (c *Cluster) setStoreThroughput(bytes int64) {
+	c.throughput = bytes
+	for _, s := range c.stores {
+		s.throughput = bytes
+	}
+}
+
+// addReplica adds a replica of the range to the store, charging the store
+// for writing the replica's data.
+func (c *Cluster) addReplica(r *Range, s *Store) {
+	r.addReplica(s)
+	s.write(r.size)
+	c.replicasMoved++
+	storeID, _ := s.getIDs()
+	if c.snapshotEpochs > 0 {
+		s.startSnapshot(c.epoch + c.snapshotEpochs)
+		if !s.down {
+			c.regossipStores(storeID)
+		}
+	}
+	s.feed.Publish(r.registerEvent(storeID, false))
+}
+
+// peakDebt returns the largest write debt of any store.
+func (c *Cluster) peakDebt() int64 {
+	var peak int64
+	for _, s := range c.stores {
+		if s.debt > peak {
+			peak = s.debt
+		}
+	}
+	return peak
+}
+
+// setSnapshotEpochs sets the number of epochs it takes a store to receive the
+// snapshot of each replica added to it. The snapshots a store is receiving
+// are reported in its gossiped capacity until they complete.
+func (c *Cluster) setSnapshotEpochs(epochs int) {
+	c.snapshotEpochs = epochs
+}
+
+// finishSnapshots completes the snapshots due by the current epoch.
+func (c *Cluster) finishSnapshots() {
+	for _, s := range c.stores {
+		s.finishSnapshots(c.epoch)
+	}
+}
+
+// peakSnapshots returns the largest number of snapshots any store is
+// receiving.
+func (c *Cluster) peakSnapshots() int {
+	var peak int
+	for _, s := range c.stores {
+		if len(s.snapshots) > peak {
+			peak = len(s.snapshots)
+		}
+	}
+	return peak
+}
+
+// setGCDelay sets the number of epochs for which a replica removed from a
+// store continues to occupy space on it before being garbage collected.
+func (c *Cluster) setGCDelay(epochs int) {
+	c.gcDelay = epochs
+}
+
+// removeReplica removes the range's replica from the store. Unless the GC
+// delay is zero, the replica's space is only freed once it is garbage
+// collected.
+func (c *Cluster) removeReplica(r *Range, s *Store) {
+	r.removeReplica(s)
+	c.replicasMoved++
+	storeID, _ := s.getIDs()
+	s.feed.Publish(r.removeEvent(storeID))
+	if c.gcDelay > 0 {
+		s.addPendingGC(r.desc.RangeID, r.size, c.epoch+c.gcDelay)
+	}
+}
+
+// replaceReplica moves the range's replica from the source store to the
+// target store, returning whether it did so. The move reserves the
+// replica's bytes on the target, so it is refused if the target, as it
+// stands now rather than as last gossiped, lacks room for the replica. The
+// source's space is freed as for removeReplica.
+func (c *Cluster) replaceReplica(r *Range, target, source *Store) bool {
+	targetID, _ := target.getIDs()
+	if target.getCapacity(0, c.storesUsedBytes()[targetID]).Available < r.size {
+		return false
+	}
+	c.addReplica(r, target)
+	c.removeReplica(r, source)
+	return true
+}
+
+// setDeadAfter sets the number of epochs a store may be down before its
+// replicas are considered dead.
+func (c *Cluster) setDeadAfter(epochs int) {
+	c.deadAfter = epochs
+}
+
+// setPinned pins or unpins the replicas of the range to their stores. Like
+// the replicate queue, the simulation then never removes or rebalances them,
+// but still up-replicates the range and replaces its dead replicas.
+func (c *Cluster) setPinned(rangeID proto.RangeID, pinned bool) {
+	if pinned {
+		c.pinned[rangeID] = struct{}{}
+	} else {
+		delete(c.pinned, rangeID)
+	}
+}
+
+// skipsPinned returns whether the action must be skipped because the range
+// is pinned, warning when a dead replica of a pinned range is removed.
+func (c *Cluster) skipsPinned(rangeID proto.RangeID, action storage.AllocatorAction) bool {
+	if _, ok := c.pinned[rangeID]; !ok {
+		return false
+	}
+	switch action {
+	case storage.AllocatorAdd:
+		return false
+	case storage.AllocatorRemoveDead:
+		fmt.Printf("Warning: range %d is pinned, but has a dead replica; removing it\n", rangeID)
+		return false
+	}
+	return true
+}
+
+// stopNode stops all of the node's stores. Once they have gossiped their
+// last descriptor, they stop gossiping and acting on their replicas, and
+// after deadAfter epochs their replicas are considered dead. The time taken to recover from the failure is tracked.
+func (c *Cluster) stopNode(nodeID proto.NodeID) {
+	n := c.nodes[nodeID]
+	for _, s := range n.stores {
+		s.setDown(true, c.epoch)
+	}
+	// Each store gossips a health of 0 as it stops, so that it isn't chosen
+	// as a target for new replicas while it is down.
+	c.regossipStores(n.getStoreIDs()...)
+	c.recordFailure(fmt.Sprintf("node %d", nodeID), n.getStoreIDs())
+}
+
+// restartNode restarts all of the node's stores.
+func (c *Cluster) restartNode(nodeID proto.NodeID) {
+	n := c.nodes[nodeID]
+	n.start(c.clock.PhysicalNow())
+	for _, s := range n.stores {
+		s.setDown(false, c.epoch)
+		s.start(c.clock.PhysicalNow())
+	}
+}
+
+// drainLeases transfers the leases held by the node's replicas to replicas on
+// other nodes, as a node does before it is shut down so that its ranges
+// aren't left without a leaseholder until its leases expire. Its replicas
+// stay in place until it is decommissioned. The number of leases transferred
+// is returned, along with an error for the first one which couldn't be.
+func (c *Cluster) drainLeases(nodeID proto.NodeID) (int, error) {
+	var rangeIDs proto.RangeIDSlice
+	for rangeID := range c.ranges {
+		rangeIDs = append(rangeIDs, rangeID)
+	}
+	sort.Sort(rangeIDs)
+	var transferred int
+	for _, rangeID := range rangeIDs {
+		r := c.ranges[rangeID]
+		source := r.leaseholder()
+		if s, ok := c.stores[source]; !ok || s.desc.Node.NodeID != nodeID {
+			continue
+		}
+		target, err := r.getTransferLeaseTarget()
+		if err != nil {
+			return transferred, util.Errorf("range %d: %s", rangeID, err)
+		}
+		r.lease = target
+		transferred++
+		c.timeline.record(c.epoch, rangeID, "transfer-lease", source, target)
+	}
+	return transferred, nil
+}
+
+// nodeLeases returns the number of ranges whose lease is held by one of the
+// node's replicas.
+func (c *Cluster) nodeLeases(nodeID proto.NodeID) int {
+	var count int
+	for _, r := range c.ranges {
+		if s, ok := c.stores[r.leaseholder()]; ok && s.desc.Node.NodeID == nodeID {
+			count++
+		}
+	}
+	return count
+}
+
+// nodeReplicas returns the number of voting replicas held by the node's
+// stores.
+func (c *Cluster) nodeReplicas(nodeID proto.NodeID) int {
+	var count int
+	for _, r := range c.ranges {
+		for _, replica := range r.desc.Replicas {
+			if replica.NodeID == nodeID {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// rollingRestart restarts every node in turn, as an operator would: each
+// node is stopped for downtime epochs and restarted, and the cluster runs
+// for another epoch before the next node is stopped.
+func (c *Cluster) rollingRestart(downtime int) {
+	var nodeIDs proto.NodeIDSlice
+	for nodeID := range c.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Sort(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		c.stopNode(nodeID)
+		for i := 0; i < downtime; i++ {
+			c.runEpoch()
+		}
+		c.restartNode(nodeID)
+		c.runEpoch()
+	}
+}
+
+// isDead returns whether the store has been down for long enough that its
+// replicas are considered dead.
+func (c *Cluster) isDead(s *Store) bool {
+	return s.down && c.epoch-s.downSince >= c.deadAfter
+}
+
+// deadReplica returns the store of one of the range's replicas which is
+// considered dead, if any.
+func (c *Cluster) deadReplica(r *Range) (proto.StoreID, bool) {
+	for storeID, replica := range r.replicas {
+		if c.isDead(replica.store) {
+			return storeID, true
+		}
+	}
+	return 0, false
+}
+
+// gcReplicas garbage collects all removed replicas which are due for
+// collection.
+func (c *Cluster) gcReplicas() {
+	for _, s := range c.stores {
+		s.gc(c.epoch)
+	}
+}
+
+// peakFractionUsed returns the highest fraction of capacity used on any store,
+// including space held by replicas awaiting garbage collection.
+func (c *Cluster) peakFractionUsed() float64 {
+	var peak float64
+	for _, desc := range c.getStoreDescs() {
+		if used := desc.Capacity.FractionUsed(); used > peak {
+			peak = used
+		}
+	}
+	return peak
+}
+
+// decommissionStore marks the store as draining. Over the following epochs,
+// every replica on the store is replaced by one on another store and then
+// removed, after which the store can be removed with removeStore.
+func (c *Cluster) decommissionStore(storeID proto.StoreID) {
+	c.stores[storeID].setDraining(true)
+}
+
+// removeStore removes a store from the cluster. It fails if the store still
+// holds any replicas.
+func (c *Cluster) removeStore(storeID proto.StoreID) error {
+	if count := c.storesRangeCounts()[storeID]; count > 0 {
+		return util.Errorf("store %d still holds %d replicas", storeID, count)
+	}
+	s := c.stores[storeID]
+	_, nodeID := s.getIDs()
+	delete(c.nodes[nodeID].stores, storeID)
+	delete(c.stores, storeID)
+	for i, id := range c.storeIDs {
+		if id == storeID {
+			c.storeIDs = append(c.storeIDs[:i], c.storeIDs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
 // addRange adds a new range to the cluster but does not attach it to any
 // store.
 func (c *Cluster) addRange() *Range {
 	rangeID := proto.RangeID(len(c.ranges))
-	newRng := newRange(rangeID, c.allocator)
+	newRng := newRange(rangeID, c.zone, c.allocator)
+	newRng.nonVoterAttrs = c.nonVoterAttrs
 	c.ranges[rangeID] = newRng
 	return newRng
 }
 
+// seedReplicas replaces the replicas of the cluster's ranges with the given
+// initial distribution. Each entry of replicaSets lists the stores holding
+// the replicas of one range; the first entry is applied to the cluster's
+// initial range and a new range is added for each of the others. Replicas
+// are placed directly, without consulting the allocator or charging the
+// stores for writing them, so that the simulation can begin deliberately
+// imbalanced. It must be called before any epoch is run.
+func (c *Cluster) seedReplicas(replicaSets [][]proto.StoreID) {
+	for i, storeIDs := range replicaSets {
+		var r *Range
+		if i == 0 {
+			r = c.ranges[0]
+			for _, s := range r.getStores() {
+				r.removeReplica(s)
+			}
+		} else {
+			r = c.addRange()
+		}
+		for _, storeID := range storeIDs {
+			r.addReplica(c.stores[storeID])
+		}
+	}
+}
+
+// concentratedReplicaSets returns replica sets for rangeCount ranges, each
+// with the given number of replicas, which are all placed on the given
+// stores in round robin order.
+func concentratedReplicaSets(rangeCount, replicas int, storeIDs []proto.StoreID) [][]proto.StoreID {
+	replicaSets := make([][]proto.StoreID, rangeCount)
+	for i := range replicaSets {
+		for j := 0; j < replicas; j++ {
+			replicaSets[i] = append(replicaSets[i], storeIDs[(i+j)%len(storeIDs)])
+		}
+	}
+	return replicaSets
+}
+
+// maxRangeCountDeviation returns the largest difference between the number of
+// replicas on any store and the mean, as a fraction of the mean.
+func (c *Cluster) maxRangeCountDeviation() float64 {
+	storesRangeCounts := c.storesRangeCounts()
+	var total int
+	for _, storeID := range c.storeIDs {
+		total += storesRangeCounts[storeID]
+	}
+	if total == 0 {
+		return 0
+	}
+	mean := float64(total) / float64(len(c.storeIDs))
+	var maxDeviation float64
+	for _, storeID := range c.storeIDs {
+		if deviation := math.Abs(float64(storesRangeCounts[storeID])-mean) / mean; deviation > maxDeviation {
+			maxDeviation = deviation
+		}
+	}
+	return maxDeviation
+}
+
+// setZone replaces the zone config used by every range in the cluster,
+// including any ranges added afterwards, except those in a table with a zone
+// config of its own. This is the simulated equivalent of an operator updating
+// the zone config in the system config; the new zone config will be picked up
+// when the allocator is next consulted for each range during the following
+// epoch.
+func (c *Cluster) setZone(zone config.ZoneConfig) {
+	c.zone = zone
+	c.refreshZones()
+}
+
+// setTableZone sets the zone config of the table with the given ID, which
+// applies to every range within the table's key span. Use splitRangeAt to
+// give the table ranges of its own.
+func (c *Cluster) setTableZone(tableID uint32, zone config.ZoneConfig) {
+	c.tableZones[tableID] = &zone
+	config.ZoneConfigHook = c.tableZoneHook
+	c.refreshZones()
+}
+
+// tableZoneHook looks up the zone config of a table for the system config.
+// Tables without a zone config of their own use the cluster's.
+func (c *Cluster) tableZoneHook(_ *config.SystemConfig, id uint32) (*config.ZoneConfig, error) {
+	if zone, ok := c.tableZones[id]; ok {
+		return zone, nil
+	}
+	return &c.zone, nil
+}
+
+// rangeZone returns the zone config which applies to the range. Ranges within
+// a table with a zone config of its own look it up by their start key, as
+// the replicate queue does; all others use the cluster's zone config.
+func (c *Cluster) rangeZone(r *Range) config.ZoneConfig {
+	if id, ok := config.ObjectIDForKey(r.desc.StartKey); ok {
+		if _, ok := c.tableZones[id]; ok {
+			zone, err := c.sysCfg.GetZoneConfigForKey(r.desc.StartKey)
+			if err == nil {
+				return *zone
+			}
+			fmt.Printf("Error: range %d - %s\n", r.desc.RangeID, err)
+		}
+	}
+	return c.zone
+}
+
+// refreshZones updates the zone config of every range.
+func (c *Cluster) refreshZones() {
+	for _, r := range c.ranges {
+		r.zone = c.rangeZone(r)
+		r.generation++
+	}
+}
+
+// setNonVoters sets the attributes required of each non-voting replica of
+// every range in the cluster, including any ranges added afterwards. Each
+// range is given one non-voter per entry of attrs.
+func (c *Cluster) setNonVoters(attrs []proto.Attributes) {
+	c.nonVoterAttrs = attrs
+	for _, r := range c.ranges {
+		r.nonVoterAttrs = attrs
+		r.generation++
+	}
+}
+
+// addNonVoter adds a non-voting replica of the range to the store, charging
+// the store for writing the replica's data.
+func (c *Cluster) addNonVoter(r *Range, s *Store) {
+	r.addNonVoter(s)
+	s.write(r.size)
+	c.replicasMoved++
+	storeID, _ := s.getIDs()
+	s.feed.Publish(r.registerEvent(storeID, false))
+}
+
+// setAllocator replaces the allocator policy used by every range in the
+// cluster, including any ranges added afterwards.
+func (c *Cluster) setAllocator(allocator allocatorPolicy) {
+	c.allocator = allocator
+	for _, r := range c.ranges {
+		r.allocator = allocator
+	}
+	c.actions.Clear()
+}
+
+// getStoreDescs returns the current descriptors of all stores in the cluster,
+// sorted by store ID.
+func (c *Cluster) getStoreDescs() []proto.StoreDescriptor {
+	storesRangeCounts := c.storesRangeCounts()
+	storesUsedBytes := c.storesUsedBytes()
+	descs := make([]proto.StoreDescriptor, 0, len(c.storeIDs))
+	for _, storeID := range c.storeIDs {
+		descs = append(descs, c.stores[storeID].getDesc(storesRangeCounts[storeID], storesUsedBytes[storeID]))
+	}
+	return descs
+}
+
+// storesRangeCounts returns the number of replicas housed on each store.
+func (c *Cluster) storesRangeCounts() map[proto.StoreID]int {
+	storesRangeCounts := make(map[proto.StoreID]int)
+	for _, r := range c.ranges {
+		for _, storeID := range r.getStoreIDs() {
+			storesRangeCounts[storeID]++
+		}
+	}
+	return storesRangeCounts
+}
+
+// storesUsedBytes returns the number of bytes occupied by the replicas housed
+// on each store.
+func (c *Cluster) storesUsedBytes() map[proto.StoreID]int64 {
+	storesUsedBytes := make(map[proto.StoreID]int64)
+	for _, r := range c.ranges {
+		for _, storeID := range r.getStoreIDs() {
+			storesUsedBytes[storeID] += r.size
+		}
+	}
+	return storesUsedBytes
+}
+
+// setRangeSize sets the number of bytes occupied by each replica of the range.
+func (c *Cluster) setRangeSize(rangeID proto.RangeID, size int64) {
+	c.ranges[rangeID].size = size
+}
+
+// byteConvergenceScore returns the coefficient of variation of the bytes used
+// on each store, that is the standard deviation divided by the mean. A
+// perfectly balanced cluster has a score of 0.
+func (c *Cluster) byteConvergenceScore() float64 {
+	if len(c.storeIDs) == 0 {
+		return 0
+	}
+	storesUsedBytes := c.storesUsedBytes()
+	var total int64
+	for _, storeID := range c.storeIDs {
+		total += storesUsedBytes[storeID]
+	}
+	if total == 0 {
+		return 0
+	}
+	mean := float64(total) / float64(len(c.storeIDs))
+	var variance float64
+	for _, storeID := range c.storeIDs {
+		diff := float64(storesUsedBytes[storeID]) - mean
+		variance += diff * diff
+	}
+	return math.Sqrt(variance/float64(len(c.storeIDs))) / mean
+}
+
+// convergenceScore returns the standard deviation of the number of replicas
+// housed on each store. A perfectly balanced cluster has a score of 0.
+func (c *Cluster) convergenceScore() float64 {
+	if len(c.storeIDs) == 0 {
+		return 0
+	}
+	storesRangeCounts := c.storesRangeCounts()
+	var total int
+	for _, storeID := range c.storeIDs {
+		total += storesRangeCounts[storeID]
+	}
+	mean := float64(total) / float64(len(c.storeIDs))
+	var variance float64
+	for _, storeID := range c.storeIDs {
+		diff := float64(storesRangeCounts[storeID]) - mean
+		variance += diff * diff
+	}
+	return math.Sqrt(variance / float64(len(c.storeIDs)))
+}
+
+// rangeCountHistogram returns the min, max, mean and standard deviation of
+// the number of replicas housed on each store, followed by a histogram of
+// those counts in at most the given number of buckets of equal width. A
+// single overloaded or underloaded store, which an averaged score such as
+// convergenceScore hides, stands out alone in the first or last bucket.
+func (c *Cluster) rangeCountHistogram(buckets int) string {
+	if len(c.storeIDs) == 0 || buckets <= 0 {
+		return ""
+	}
+	storesRangeCounts := c.storesRangeCounts()
+	min := storesRangeCounts[c.storeIDs[0]]
+	max := min
+	var total int
+	for _, storeID := range c.storeIDs {
+		count := storesRangeCounts[storeID]
+		if count < min {
+			min = count
+		}
+		if count > max {
+			max = count
+		}
+		total += count
+	}
+	mean := float64(total) / float64(len(c.storeIDs))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Replica Counts: Min:%d, Max:%d, Mean:%.2f, StdDev:%.2f\n",
+		min, max, mean, c.convergenceScore())
+	width := (max - min + buckets) / buckets
+	hist := make([]int, (max-min)/width+1)
+	for _, storeID := range c.storeIDs {
+		hist[(storesRangeCounts[storeID]-min)/width]++
+	}
+	for i, stores := range hist {
+		low := min + i*width
+		fmt.Fprintf(&buf, "%6d-%-6d %4d %s\n", low, low+width-1, stores, strings.Repeat("#", stores))
+	}
+	return buf.String()
+}
+
+// misreplicatedRanges returns the IDs of all ranges which do not currently
+// have the number of replicas required by their zone config, or are missing
+// any of their non-voting replicas.
+func (c *Cluster) misreplicatedRanges() proto.RangeIDSlice {
+	var rangeIDs proto.RangeIDSlice
+	for rangeID, r := range c.ranges {
+		if len(r.replicas) != len(r.zone.ReplicaAttrs) || len(r.nonVoters) != len(r.nonVoterAttrs) {
+			rangeIDs = append(rangeIDs, rangeID)
+		}
+	}
+	sort.Sort(rangeIDs)
+	return rangeIDs
+}
+
 // splitRangeRandom splits a random range from within the cluster.
 func (c *Cluster) splitRangeRandom() {
 	rangeID := proto.RangeID(c.rand.Int63n(int64(len(c.ranges))))
@@ -132,23 +825,130 @@ func (c *Cluster) splitRangeLast() {
 
 // splitRange "splits" a range. This split creates a new range with new
 // replicas on the same stores as the passed in range. The new range has the
-// same zone config as the original range.
+// same zone config as the original range. No split key is chosen: the new
+// range shares the original's start key but has no end key of its own, so it
+// is never itself split by splitRangeAt.
 func (c *Cluster) splitRange(rangeID proto.RangeID) {
+	c.split(c.ranges[rangeID], nil)
+}
+
+// splitRangeAt splits the range whose key span contains key at key, as a
+// real range is split at a table boundary. The new range, holding the keys
+// from key onwards, takes on the zone config which applies at key.
+func (c *Cluster) splitRangeAt(key proto.Key) error {
+	for _, r := range c.ranges {
+		if r.desc.ContainsKey(key) {
+			if r.desc.StartKey.Equal(key) {
+				return util.Errorf("range %d is already split at %q", r.desc.RangeID, key)
+			}
+			c.split(r, key)
+			return nil
+		}
+	}
+	return util.Errorf("no range contains key %q", key)
+}
+
+// split creates a new range with replicas on the same stores as the
+// original range. If key is set, the original range is split at key;
+// otherwise the new range shares the original's start key.
+func (c *Cluster) split(originalRange *Range, key proto.Key) {
 	newRange := c.addRange()
-	originalRange := c.ranges[rangeID]
 	newRange.splitRange(originalRange)
+	newRange.desc.StartKey = originalRange.desc.StartKey
+	if key != nil {
+		newRange.desc.StartKey = key
+		newRange.desc.EndKey = originalRange.desc.EndKey
+		originalRange.desc.EndKey = key
+		newRange.zone = c.rangeZone(newRange)
+	}
+	for _, storeID := range newRange.getStoreIDs() {
+		c.stores[storeID].feed.Publish(&storage.SplitRangeEvent{
+			StoreID: storeID,
+			Original: storage.UpdateRangeEvent{
+				StoreID: storeID,
+				Desc:    originalRange.getDesc(),
+				Stats:   originalRange.getStats(),
+			},
+			New: *newRange.registerEvent(storeID, false),
+		})
+	}
+}
+
+// setFeed directs the events of every node and store in the cluster,
+// including those added afterwards, to the feed. These are the same events
+// a real cluster publishes, so listeners such as the status monitors can
+// consume them unchanged. Every existing node and store is announced as
+// started, and each store then scans over its replicas, as a real store
+// does on startup.
+func (c *Cluster) setFeed(feed *util.Feed) {
+	c.feed = feed
+	startedAt := c.clock.PhysicalNow()
+
+	var nodeIDs proto.NodeIDSlice
+	for nodeID := range c.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Sort(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		n := c.nodes[nodeID]
+		n.feed = feed
+		n.start(startedAt)
+	}
+
+	var rangeIDs proto.RangeIDSlice
+	for rangeID := range c.ranges {
+		rangeIDs = append(rangeIDs, rangeID)
+	}
+	sort.Sort(rangeIDs)
+	for _, storeID := range c.storeIDs {
+		s := c.stores[storeID]
+		s.feed = feed
+		s.start(startedAt)
+		feed.Publish(&storage.BeginScanRangesEvent{StoreID: storeID})
+		for _, rangeID := range rangeIDs {
+			r := c.ranges[rangeID]
+			for _, id := range r.getStoreIDs() {
+				if id == storeID {
+					feed.Publish(r.registerEvent(storeID, true))
+				}
+			}
+		}
+		feed.Publish(&storage.EndScanRangesEvent{StoreID: storeID})
+	}
 }
 
 // runEpoch steps through a single instance of the simulator. Each epoch
 // performs the following steps:
-// 1) The status of every store is gossiped so the store pool is up to date.
-// 2) Each replica on every range calls the allocator to determine if there are
-//    any actions required.
-// 3) The replica on each range with the highest priority executes it's action.
-// 4) The current status of the cluster is output.
+//  1. The failure events scheduled for the epoch are applied, removed
+//     replicas due for garbage collection free their space, the writes
+//     of the previous epoch are settled against each store's budget and
+//     the snapshots due complete.
+//  2. The status of every store is gossiped so the store pool is up to date.
+//  3. Each replica on every range calls the allocator to determine if there are
+//     any actions required.
+//  4. The replica on each range with the highest priority executes it's action.
+//  5. Each range with all of its voting replicas, but missing a non-voting
+//     replica, adds one.
+//  6. The current status of the cluster is output, along with the actions
+//     taken if --timeline is set and the contents of gossip if --gossip is
+//     set.
 func (c *Cluster) runEpoch() {
 	c.epoch++
 
+	// Stop and restart the stores scheduled to fail or recover.
+	c.applySchedule()
+
+	// Collect removed replicas.
+	c.gcReplicas()
+
+	// Settle the writes of the previous epoch.
+	for _, s := range c.stores {
+		s.settleWrites()
+	}
+
+	// Complete the snapshots due.
+	c.finishSnapshots()
+
 	// Gossip all the store updates.
 	c.gossipStores()
 
@@ -160,35 +960,93 @@ func (c *Cluster) runEpoch() {
 	// Execute the determined operations.
 	c.performActions()
 
+	// Add any missing non-voting replicas.
+	c.placeNonVoters()
+
+	// Check which failures the cluster has recovered from.
+	c.updateRecoveries()
+
 	// Output the update.
 	fmt.Println(c.StringEpoch())
+	if *showTimeline {
+		fmt.Print(c.timeline.epochString(c.epoch))
+	}
+	if *dumpGossip {
+		fmt.Print(c.gossipString())
+	}
 }
 
 // gossipStores gossips all the most recent status for all stores.
 func (c *Cluster) gossipStores() {
-	storesRangeCounts := make(map[proto.StoreID]int)
-	for _, r := range c.ranges {
-		for _, storeID := range r.getStoreIDs() {
-			storesRangeCounts[storeID]++
+	storesRangeCounts := c.storesRangeCounts()
+	storesUsedBytes := c.storesUsedBytes()
+
+	for storeID, store := range c.stores {
+		store.checkOvercommit(storesRangeCounts[storeID], storesUsedBytes[storeID])
+	}
+
+	// Stopped stores don't gossip, and stores with injected gossip failures
+	// may fail to; don't wait for either. The rest of the cluster keeps
+	// using whatever it last heard from them.
+	var gossiping []proto.StoreID
+	for _, storeID := range c.storeIDs {
+		s := c.stores[storeID]
+		if s.down {
+			continue
+		}
+		if s.gossipFailureRate > 0 && c.rand.Float64() < s.gossipFailureRate {
+			c.gossipError(s, util.Errorf("injected gossip failure"))
+			continue
 		}
+		gossiping = append(gossiping, storeID)
 	}
+	c.storeGossiper.GossipWithFunction(gossiping, func() {
+		for _, storeID := range gossiping {
+			s := c.stores[storeID]
+			if err := s.gossipStore(storesRangeCounts[storeID], storesUsedBytes[storeID]); err != nil {
+				c.gossipError(s, err)
+			}
+		}
+	})
+}
 
-	c.storeGossiper.GossipWithFunction(c.storeIDs, func() {
-		for storeID, store := range c.stores {
-			if err := store.gossipStore(storesRangeCounts[storeID]); err != nil {
-				fmt.Printf("Error gossiping store %d: %s\n", storeID, err)
+// regossipStores gossips the descriptors of the given stores outside of the
+// regular once-per-epoch gossip, so that the rest of the cluster sees a
+// change to them before the next epoch.
+func (c *Cluster) regossipStores(storeIDs ...proto.StoreID) {
+	storesRangeCounts := c.storesRangeCounts()
+	storesUsedBytes := c.storesUsedBytes()
+	c.storeGossiper.GossipWithFunction(storeIDs, func() {
+		for _, storeID := range storeIDs {
+			s := c.stores[storeID]
+			if err := s.gossipStore(storesRangeCounts[storeID], storesUsedBytes[storeID]); err != nil {
+				c.gossipError(s, err)
 			}
 		}
 	})
 }
 
+// gossipError records a failure to gossip the store's descriptor.
+func (c *Cluster) gossipError(s *Store, err error) {
+	s.gossipErrors++
+	fmt.Printf("Error gossiping store %d: %s\n", s.desc.StoreID, err)
+}
+
 // prepareActions walks through each replica and determines if any action is
 // required using the allocator.
 func (c *Cluster) prepareActions() {
 	for _, r := range c.ranges {
+		_, hasDead := c.deadReplica(r)
 		for storeID, replica := range r.replicas {
-			replica.action, replica.priority = r.allocator.ComputeAction(r.zone, &r.desc)
-			if replica.action == storage.AllocatorNoop {
+			replica.action, replica.priority = c.computeAction(r)
+			if replica.store.down {
+				// A stopped store doesn't act on its replicas.
+				replica.action, replica.priority, replica.rebalance = storage.AllocatorNoop, 0, false
+			} else if hasDead {
+				// The store pool never considers a simulated store dead, so
+				// replace the replicas of stores down for too long here.
+				replica.action, replica.priority, replica.rebalance = storage.AllocatorRemoveDead, 1, false
+			} else if replica.action == storage.AllocatorNoop {
 				replica.rebalance = r.allocator.ShouldRebalance(storeID)
 				replica.priority = 0
 			} else {
@@ -199,43 +1057,125 @@ func (c *Cluster) prepareActions() {
 	}
 }
 
+// newActionCache returns the replicate queue's action cache with entries
+// reused for up to ttl epochs. The simulation's clock counts epochs as
+// nanoseconds.
+func newActionCache(ttl int) *storage.ActionCache {
+	return storage.NewActionCache(time.Duration(ttl))
+}
+
+// computeAction returns the allocator action for the range through the
+// replicate queue's action cache, reusing the action computed for it in a
+// recent epoch if the range and the store pool are unchanged since. A
+// range's descriptor is modified in place, so its generation is folded into
+// the store pool's; as both only increase, their sum changes whenever
+// either does.
+func (c *Cluster) computeAction(r *Range) (storage.AllocatorAction, float64) {
+	now := proto.Timestamp{WallTime: int64(c.epoch)}
+	generation := c.storePool.Generation() + int64(r.generation)
+	return c.actions.ComputeAction(now, &r.desc, &c.sysCfg, generation,
+		func() (storage.AllocatorAction, float64) {
+			return r.allocator.ComputeAction(r.zone, &r.desc)
+		})
+}
+
 // performActions performs a single action, if required, for each range.
 func (c *Cluster) performActions() {
 	for rangeID, r := range c.ranges {
-		nextAction, rebalance := r.getNextAction()
+		nextAction, rebalance, source := r.getNextAction()
+		if c.skipsPinned(rangeID, nextAction) {
+			continue
+		}
 		switch nextAction {
 		case storage.AllocatorAdd:
 			newStoreID, err := r.getAllocateTarget()
 			if err != nil {
-				fmt.Printf("Error: %s\n", err)
+				fmt.Printf("Error: range %d - %s\n", rangeID, err)
+				c.allocateErrs[rangeID] = err
 				continue
 			}
-			r.addReplica(c.stores[newStoreID])
+			delete(c.allocateErrs, rangeID)
+			newStore, ok := c.stores[newStoreID]
+			if !ok {
+				fmt.Printf("Error: range %d - allocation target store %d does not exist\n", rangeID, newStoreID)
+				continue
+			}
+			c.addReplica(r, newStore)
+			c.timeline.record(c.epoch, rangeID, "add", source, newStoreID)
 		case storage.AllocatorRemoveDead:
-			// TODO(bram): implement this.
-			fmt.Printf("Range %d - Repair\n", rangeID)
+			storeID, ok := c.deadReplica(r)
+			if !ok {
+				continue
+			}
+			c.removeReplica(r, c.stores[storeID])
+			c.timeline.record(c.epoch, rangeID, "remove-dead", source, storeID)
 		case storage.AllocatorRemove:
-			// TODO(bram): implement this.
-			fmt.Printf("Range %d - Remove\n", rangeID)
+			storeID, err := r.getRemoveTarget(source)
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				continue
+			}
+			c.removeReplica(r, c.stores[storeID])
+			c.timeline.record(c.epoch, rangeID, "remove", source, storeID)
 		case storage.AllocatorNoop:
-			if rebalance {
-				// TODO(bram): implement this.
-				fmt.Printf("Range %d - Rebalance\n", rangeID)
+			if rebalance && r.allocator.RebalanceAction() == storage.AllocatorReplace {
+				// Rebalancing by replace moves a replica within the epoch, so
+				// the range is never over-replicated.
+				newStoreID, oldStoreID, ok := r.getReplaceTarget(source)
+				if !ok {
+					continue
+				}
+				newStore, ok := c.stores[newStoreID]
+				if !ok {
+					continue
+				}
+				if c.replaceReplica(r, newStore, c.stores[oldStoreID]) {
+					c.timeline.record(c.epoch, rangeID, "replace", oldStoreID, newStoreID)
+				}
+			} else if rebalance {
+				// Rebalancing adds a replica on the target store, the range
+				// will then be over-replicated and a replica will be removed
+				// during a following epoch.
+				if newStoreID, ok := r.getRebalanceTarget(); ok {
+					if newStore, ok := c.stores[newStoreID]; ok {
+						c.addReplica(r, newStore)
+						c.timeline.record(c.epoch, rangeID, "rebalance", source, newStoreID)
+					}
+				}
 			}
 		}
 	}
 }
 
+// placeNonVoters adds a single non-voting replica to each range which is
+// missing one. Voters take precedence, so ranges which lack any of their
+// voting replicas are skipped until they are up-replicated.
+func (c *Cluster) placeNonVoters() {
+	for rangeID, r := range c.ranges {
+		if len(r.nonVoters) >= len(r.nonVoterAttrs) || len(r.desc.Replicas) < len(r.zone.ReplicaAttrs) {
+			continue
+		}
+		newStoreID, err := r.getNonVoterTarget()
+		if err != nil {
+			fmt.Printf("Error: range %d - non-voter: %s\n", rangeID, err)
+			continue
+		}
+		newStore, ok := c.stores[newStoreID]
+		if !ok {
+			fmt.Printf("Error: range %d - non-voter target store %d does not exist\n", rangeID, newStoreID)
+			continue
+		}
+		c.addNonVoter(r, newStore)
+		c.timeline.record(c.epoch, rangeID, "add-non-voter", 0, newStoreID)
+	}
+}
+
 // String prints out the current status of the cluster.
 func (c *Cluster) String() string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "Cluster Info:\nSeed - %d\tEpoch - %d\n", c.seed, c.epoch)
-	storesRangeCounts := make(map[proto.StoreID]int)
-	for _, r := range c.ranges {
-		for _, storeID := range r.getStoreIDs() {
-			storesRangeCounts[storeID]++
-		}
-	}
+	storesRangeCounts := c.storesRangeCounts()
+	storesUsedBytes := c.storesUsedBytes()
 
 	var nodeIDs proto.NodeIDSlice
 	for nodeID := range c.nodes {
@@ -246,16 +1186,17 @@ func (c *Cluster) String() string {
 	buf.WriteString("Node Info:\n")
 	for _, nodeID := range nodeIDs {
 		n := c.nodes[nodeID]
-		buf.WriteString(n.String())
+		buf.WriteString(n.String(storesRangeCounts, storesUsedBytes))
 		buf.WriteString("\n")
 	}
 
 	buf.WriteString("Store Info:\n")
 	for _, storeID := range c.storeIDs {
 		s := c.stores[storeID]
-		buf.WriteString(s.String(storesRangeCounts[storeID]))
+		buf.WriteString(s.String(storesRangeCounts[storeID], storesUsedBytes[storeID]))
 		buf.WriteString("\n")
 	}
+	buf.WriteString(c.rangeCountHistogram(*histogramBuckets))
 
 	var rangeIDs proto.RangeIDSlice
 	for rangeID := range c.ranges {
@@ -272,6 +1213,43 @@ func (c *Cluster) String() string {
 	return buf.String()
 }
 
+// gossipString returns every node and store descriptor of the cluster which
+// is currently visible in gossip, one per line. The store descriptors are
+// exactly what the store pool, and so the allocator, sees. Nodes and stores
+// which have nothing in gossip are listed as such.
+func (c *Cluster) gossipString() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Gossip at epoch %d:\n", c.epoch)
+
+	var nodeIDs proto.NodeIDSlice
+	for nodeID := range c.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Sort(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		key := gossip.MakeNodeIDKey(nodeID)
+		var desc proto.NodeDescriptor
+		if err := c.gossip.GetInfoProto(key, &desc); err != nil {
+			fmt.Fprintf(&buf, "  %s: not gossiped\n", key)
+			continue
+		}
+		fmt.Fprintf(&buf, "  %s: Address:%s, Attrs:%s\n", key, desc.Address, desc.Attrs.SortedString())
+	}
+
+	for _, storeID := range c.storeIDs {
+		key := gossip.MakeStoreKey(storeID)
+		var desc proto.StoreDescriptor
+		if err := c.gossip.GetInfoProto(key, &desc); err != nil {
+			fmt.Fprintf(&buf, "  %s: not gossiped\n", key)
+			continue
+		}
+		fmt.Fprintf(&buf, "  %s: Node:%d, Attrs:%s, RangeCount:%d, Capacity:%d, Available:%d, FractionUsed:%.2f\n",
+			key, desc.Node.NodeID, desc.CombinedAttrs().SortedString(), desc.Capacity.RangeCount,
+			desc.Capacity.Capacity, desc.Capacity.Available, desc.Capacity.FractionUsed())
+	}
+	return buf.String()
+}
+
 // StringEpochHeader creates the string header for epoch outputs based on all
 // of the current stores.
 func (c *Cluster) StringEpochHeader() string {
@@ -288,18 +1266,14 @@ func (c *Cluster) StringEpoch() string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "%d:\t", c.epoch)
 
-	// TODO(bram): Consider saving this map in the cluster instead of
-	// recalculating it each time.
-	storesRangeCounts := make(map[proto.StoreID]int)
-	for _, r := range c.ranges {
-		for _, storeID := range r.getStoreIDs() {
-			storesRangeCounts[storeID]++
-		}
-	}
+	// TODO(bram): Consider saving these maps in the cluster instead of
+	// recalculating them each time.
+	storesRangeCounts := c.storesRangeCounts()
+	storesUsedBytes := c.storesUsedBytes()
 
 	for _, storeID := range c.storeIDs {
 		store := c.stores[proto.StoreID(storeID)]
-		capacity := store.getCapacity(storesRangeCounts[proto.StoreID(storeID)])
+		capacity := store.getCapacity(storesRangeCounts[proto.StoreID(storeID)], storesUsedBytes[proto.StoreID(storeID)])
 		fmt.Fprintf(&buf, "%.0f%%\t", float64(capacity.Available)/float64(capacity.Capacity)*100)
 	}
 	return buf.String()
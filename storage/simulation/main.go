@@ -18,30 +18,69 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/cockroachdb/cockroach/util/stop"
 )
 
-func main() {
-	stopper := stop.NewStopper()
-	defer stopper.Stop()
+var scenarioName = flag.String("scenario", "rebalance", "Name of the scenario to run.")
+var showTimeline = flag.Bool("timeline", false, "Print every action taken by the replicate queue after each epoch.")
+var storeThroughput = flag.Int64("store-throughput", 0, "Number of bytes each store can absorb per epoch before falling behind; 0 is unlimited.")
+var actionCacheTTL = flag.Int("action-cache-ttl", 0, "Number of epochs an allocator action computed for an unchanged range is reused; 0 disables caching.")
+var dumpGossip = flag.Bool("gossip", false, "Print every node and store descriptor visible in gossip after each epoch.")
+var timeUntilStoreDead = flag.Int("time-until-store-dead", 5, "Number of epochs a store may be down before its replicas are considered dead.")
+var gcDelay = flag.Int("gc-delay", 0, "Number of epochs a removed replica lingers before it is garbage collected.")
+var histogramBuckets = flag.Int("histogram-buckets", 10, "Maximum number of buckets in the histogram of per store replica counts printed with the cluster info; 0 disables it.")
+var specFile = flag.String("spec", "", "File holding a declarative scenario spec to run in place of --scenario; see parseSpec.")
+var scheduleFile = flag.String("schedule", "", "File holding a failure schedule, e.g. \"at epoch 10 kill store 1000\", applied to each cluster of the scenario.")
 
-	c := createCluster(stopper, 5)
+// flagSchedule is the failure schedule read from --schedule.
+var flagSchedule failureSchedule
 
-	fmt.Printf("A simulation of the cluster's rebalancing.\n\n")
-	fmt.Println(c)
+func main() {
+	flag.Parse()
 
-	// Split a random range 100 times.
-	for i := 0; i < 1000; i++ {
-		c.splitRangeRandom()
+	if *scheduleFile != "" {
+		b, err := ioutil.ReadFile(*scheduleFile)
+		if err != nil {
+			fmt.Printf("Unable to read failure schedule: %s\n", err)
+			os.Exit(1)
+		}
+		if flagSchedule, err = parseSchedule(string(b)); err != nil {
+			fmt.Printf("Unable to parse failure schedule %s: %s\n", *scheduleFile, err)
+			os.Exit(1)
+		}
 	}
 
-	fmt.Println(c.StringEpochHeader())
-
-	for i := 0; i < 100; i++ {
-		c.runEpoch()
+	var s scenario
+	if *specFile != "" {
+		b, err := ioutil.ReadFile(*specFile)
+		if err != nil {
+			fmt.Printf("Unable to read scenario spec: %s\n", err)
+			os.Exit(1)
+		}
+		spec, err := parseSpec(b)
+		if err != nil {
+			fmt.Printf("Unable to parse scenario spec %s: %s\n", *specFile, err)
+			os.Exit(1)
+		}
+		s = spec.scenario()
+	} else {
+		var ok bool
+		if s, ok = findScenario(*scenarioName); !ok {
+			fmt.Printf("Unknown scenario %q. Available scenarios:\n%s", *scenarioName, scenarioList())
+			os.Exit(1)
+		}
 	}
 
-	fmt.Println(c)
+	stopper := stop.NewStopper()
+	err := s.run(stopper)
+	stopper.Stop()
+	if err != nil {
+		fmt.Printf("Scenario %q failed: %s\n", s.name, err)
+		os.Exit(1)
+	}
 }
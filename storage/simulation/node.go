@@ -23,6 +23,8 @@ import (
 
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/server/status"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 // Node is a simulated cockroach node.
@@ -30,6 +32,11 @@ type Node struct {
 	desc   proto.NodeDescriptor
 	stores map[proto.StoreID]*Store
 	gossip *gossip.Gossip
+	// feed, if set, receives the same events a real node publishes.
+	feed *util.Feed
+	// storesAdded counts the stores ever added to the node, including any
+	// since removed, so that store IDs are never reused.
+	storesAdded int
 }
 
 // newNode creates a new node with no stores.
@@ -44,6 +51,11 @@ func newNode(nodeID proto.NodeID, gossip *gossip.Gossip) *Node {
 	return node
 }
 
+// start publishes a StartNodeEvent for the node to its feed.
+func (n *Node) start(startedAt int64) {
+	status.NewNodeEventFeed(n.desc.NodeID, n.feed).StartNode(n.desc, startedAt)
+}
+
 // getStoreIDs returns the list of storeIDs from the stores contained on the
 // node.
 func (n *Node) getStoreIDs() []proto.StoreID {
@@ -54,22 +66,49 @@ func (n *Node) getStoreIDs() []proto.StoreID {
 	return storeIDs
 }
 
+// maxStoresPerNode is the number of store IDs reserved for each node. The
+// stores of node n are numbered from n*maxStoresPerNode.
+const maxStoresPerNode = 1000
+
 // getNextStoreID gets the store ID that should be used when adding a new store
-// to the node.
+// to the node. IDs of removed stores are not reused.
 func (n *Node) getNextStoreID() proto.StoreID {
-	return proto.StoreID((int(n.desc.NodeID) * 1000) + len(n.stores))
+	if n.storesAdded >= maxStoresPerNode {
+		panic(fmt.Sprintf("node %d can't hold more than %d stores", n.desc.NodeID, maxStoresPerNode))
+	}
+	return proto.StoreID((int(n.desc.NodeID) * maxStoresPerNode) + n.storesAdded)
 }
 
 // addNewStore creates a new store and adds it to the node.
 func (n *Node) addNewStore() *Store {
 	newStoreID := n.getNextStoreID()
 	newStore := newStore(newStoreID, n.desc, n.gossip)
+	newStore.feed = n.feed
 	n.stores[newStoreID] = newStore
+	n.storesAdded++
 	return newStore
 }
 
+// getCapacity returns the aggregate capacity of all the node's stores, given
+// the number of ranges located in each store and the bytes they occupy. This
+// is the same aggregate the store pool computes from the gossiped store
+// descriptors.
+func (n *Node) getCapacity(storesRangeCounts map[proto.StoreID]int,
+	storesUsedBytes map[proto.StoreID]int64) proto.StoreCapacity {
+	var capacity proto.StoreCapacity
+	for storeID, s := range n.stores {
+		c := s.getCapacity(storesRangeCounts[storeID], storesUsedBytes[storeID])
+		capacity.Capacity += c.Capacity
+		capacity.Available += c.Available
+		capacity.RangeCount += c.RangeCount
+	}
+	return capacity
+}
+
 // String returns the current status of the node for human readable printing.
-func (n *Node) String() string {
+// Like getCapacity, it requires the number of ranges located in each store
+// and the bytes they occupy.
+func (n *Node) String(storesRangeCounts map[proto.StoreID]int, storesUsedBytes map[proto.StoreID]int64) string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "Node %d - Stores:[", n.desc.NodeID)
 	first := true
@@ -81,6 +120,8 @@ func (n *Node) String() string {
 		}
 		buf.WriteString(storeID.String())
 	}
-	buf.WriteString("]")
+	capacity := n.getCapacity(storesRangeCounts, storesUsedBytes)
+	fmt.Fprintf(&buf, "], Capacity:%d, Available:%d, FractionUsed:%.2f",
+		capacity.Capacity, capacity.Available, capacity.FractionUsed())
 	return buf.String()
 }
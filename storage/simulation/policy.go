@@ -0,0 +1,277 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"math/rand"
+
+	"github.com/cockroachdb/cockroach/config"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// allocatorPolicy is used by the simulated replicate queue to determine what
+// action each range requires and to choose the targets for those actions.
+// Swapping out the policy allows alternative allocation strategies to be
+// compared against the production allocator on the same topology.
+type allocatorPolicy interface {
+	// name returns a short human readable name for the policy.
+	name() string
+	// ComputeAction determines the operation needed to repair the range.
+	ComputeAction(zone config.ZoneConfig, desc *proto.RangeDescriptor) (storage.AllocatorAction, float64)
+	// ShouldRebalance returns whether the store should attempt to move one of
+	// its replicas elsewhere.
+	ShouldRebalance(storeID proto.StoreID) bool
+	// AllocateTarget returns the store on which to add a new replica. The
+	// replicas of the range must span at least minNodes distinct nodes.
+	AllocateTarget(required proto.Attributes, existing []proto.Replica, minNodes int) (*proto.StoreDescriptor, error)
+	// RemoveTarget returns the replica which should be removed, preferring
+	// not to remove the leaseholder's.
+	RemoveTarget(existing []proto.Replica, leaseStoreID proto.StoreID) (proto.Replica, error)
+	// RebalanceTarget returns the store to which a replica should be moved, or
+	// nil if there is no suitable target.
+	RebalanceTarget(required proto.Attributes, existing []proto.Replica) *proto.StoreDescriptor
+	// RebalanceAction returns how a rebalance opportunity is taken, either
+	// by adding a replica (AllocatorAdd) or by moving one (AllocatorReplace).
+	RebalanceAction() storage.AllocatorAction
+	// ReplaceTarget returns the store to which a replica of rangeBytes bytes
+	// should be moved along with the replica it replaces, or nil if there is
+	// no suitable target.
+	ReplaceTarget(required proto.Attributes, existing []proto.Replica,
+		rangeBytes int64, leaseStoreID proto.StoreID) (*proto.StoreDescriptor, proto.Replica)
+	// TransferLeaseTarget returns the replica on another node to which the
+	// lease held by the replica on leaseStoreID should be transferred.
+	TransferLeaseTarget(existing []proto.Replica, leaseStoreID proto.StoreID) (proto.Replica, error)
+}
+
+// defaultPolicy is the production allocator.
+type defaultPolicy struct {
+	storage.Allocator
+}
+
+var _ allocatorPolicy = &defaultPolicy{}
+
+// newDefaultPolicy returns an allocatorPolicy backed by the production
+// allocator.
+func newDefaultPolicy(storePool *storage.StorePool, options storage.RebalancingOptions) *defaultPolicy {
+	return &defaultPolicy{storage.MakeAllocator(storePool, options)}
+}
+
+func (p *defaultPolicy) name() string {
+	return "default"
+}
+
+// AllocateTarget calls the production allocator, always relaxing constraints
+// as the replicate queue does.
+func (p *defaultPolicy) AllocateTarget(required proto.Attributes, existing []proto.Replica,
+	minNodes int) (*proto.StoreDescriptor, error) {
+	return p.Allocator.AllocateTarget(required, existing, minNodes, true, nil)
+}
+
+// weightedRandomPolicy picks its targets at random, weighting each candidate
+// store by its free capacity. Deciding which action to take is left to the
+// production allocator.
+type weightedRandomPolicy struct {
+	storage.Allocator
+	rand       *rand.Rand
+	storeDescs func() []proto.StoreDescriptor
+}
+
+var _ allocatorPolicy = &weightedRandomPolicy{}
+
+// newWeightedRandomPolicy returns a policy which places replicas using
+// storeDescs as its view of the cluster.
+func newWeightedRandomPolicy(storePool *storage.StorePool, options storage.RebalancingOptions,
+	rand *rand.Rand, storeDescs func() []proto.StoreDescriptor) *weightedRandomPolicy {
+	return &weightedRandomPolicy{
+		Allocator:  storage.MakeAllocator(storePool, options),
+		rand:       rand,
+		storeDescs: storeDescs,
+	}
+}
+
+func (p *weightedRandomPolicy) name() string {
+	return "weighted-random"
+}
+
+// candidates returns all stores matching the required attributes which are
+// not on a node already holding one of the existing replicas.
+func (p *weightedRandomPolicy) candidates(required proto.Attributes, existing []proto.Replica) []proto.StoreDescriptor {
+	usedNodes := make(map[proto.NodeID]struct{})
+	for _, replica := range existing {
+		usedNodes[replica.NodeID] = struct{}{}
+	}
+	var candidates []proto.StoreDescriptor
+	for _, desc := range p.storeDescs() {
+		if _, ok := usedNodes[desc.Node.NodeID]; ok {
+			continue
+		}
+		if !required.IsSubset(*desc.CombinedAttrs()) {
+			continue
+		}
+		candidates = append(candidates, desc)
+	}
+	return candidates
+}
+
+// pick chooses one of the supplied stores at random, with each store's chance
+// of being picked proportional to its weight. It returns nil if no store has
+// a positive weight.
+func (p *weightedRandomPolicy) pick(descs []proto.StoreDescriptor,
+	weight func(proto.StoreDescriptor) int64) *proto.StoreDescriptor {
+	var total int64
+	for _, desc := range descs {
+		if w := weight(desc); w > 0 {
+			total += w
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := p.rand.Int63n(total)
+	for i, desc := range descs {
+		w := weight(desc)
+		if w <= 0 {
+			continue
+		}
+		if n < w {
+			return &descs[i]
+		}
+		n -= w
+	}
+	return nil
+}
+
+// freeCapacity weights a store by its available bytes.
+func freeCapacity(desc proto.StoreDescriptor) int64 {
+	return desc.Capacity.Available
+}
+
+// AllocateTarget picks a random candidate store weighted by free capacity.
+// Candidates are always on new nodes, so minNodes needs no special handling.
+func (p *weightedRandomPolicy) AllocateTarget(required proto.Attributes, existing []proto.Replica,
+	minNodes int) (*proto.StoreDescriptor, error) {
+	if target := p.pick(p.candidates(required, existing), freeCapacity); target != nil {
+		return target, nil
+	}
+	return nil, util.Errorf("unable to allocate a target store; no candidates available")
+}
+
+// RemoveTarget picks a random replica weighted by the used capacity of its
+// store. The leaseholder's replica is picked only if it is the only one.
+func (p *weightedRandomPolicy) RemoveTarget(existing []proto.Replica, leaseStoreID proto.StoreID) (proto.Replica, error) {
+	if len(existing) == 0 {
+		return proto.Replica{}, util.Errorf("must supply at least one replica to RemoveTarget()")
+	}
+	if len(existing) > 1 {
+		var others []proto.Replica
+		for _, replica := range existing {
+			if replica.StoreID != leaseStoreID {
+				others = append(others, replica)
+			}
+		}
+		existing = others
+	}
+	storeIDs := make(map[proto.StoreID]struct{})
+	for _, replica := range existing {
+		storeIDs[replica.StoreID] = struct{}{}
+	}
+	var descs []proto.StoreDescriptor
+	for _, desc := range p.storeDescs() {
+		if _, ok := storeIDs[desc.StoreID]; ok {
+			descs = append(descs, desc)
+		}
+	}
+	target := p.pick(descs, func(desc proto.StoreDescriptor) int64 {
+		return desc.Capacity.Capacity - desc.Capacity.Available
+	})
+	if target == nil {
+		return existing[p.rand.Intn(len(existing))], nil
+	}
+	for _, replica := range existing {
+		if replica.StoreID == target.StoreID {
+			return replica, nil
+		}
+	}
+	return proto.Replica{}, util.Errorf("store %d does not hold any of the replicas", target.StoreID)
+}
+
+// RebalanceTarget picks a random store, weighted by free capacity, from
+// amongst the candidates holding fewer replicas than the cluster's mean.
+func (p *weightedRandomPolicy) RebalanceTarget(required proto.Attributes, existing []proto.Replica) *proto.StoreDescriptor {
+	descs := p.storeDescs()
+	if len(descs) == 0 {
+		return nil
+	}
+	var total int32
+	for _, desc := range descs {
+		total += desc.Capacity.RangeCount
+	}
+	mean := float64(total) / float64(len(descs))
+	var underfull []proto.StoreDescriptor
+	for _, desc := range p.candidates(required, existing) {
+		if float64(desc.Capacity.RangeCount) < mean {
+			underfull = append(underfull, desc)
+		}
+	}
+	return p.pick(underfull, freeCapacity)
+}
+
+// ReplaceTarget picks a rebalance target with room for the range and
+// replaces a random replica, weighted by the used capacity of its store.
+func (p *weightedRandomPolicy) ReplaceTarget(required proto.Attributes, existing []proto.Replica,
+	rangeBytes int64, leaseStoreID proto.StoreID) (*proto.StoreDescriptor, proto.Replica) {
+	target := p.RebalanceTarget(required, existing)
+	if target == nil || target.Capacity.Available < rangeBytes {
+		return nil, proto.Replica{}
+	}
+	remove, err := p.RemoveTarget(existing, leaseStoreID)
+	if err != nil {
+		return nil, proto.Replica{}
+	}
+	return target, remove
+}
+
+// TransferLeaseTarget picks a random replica on another node than the
+// leaseholder's, weighted by the free capacity of its store.
+func (p *weightedRandomPolicy) TransferLeaseTarget(existing []proto.Replica,
+	leaseStoreID proto.StoreID) (proto.Replica, error) {
+	var leaseNodeID proto.NodeID
+	for _, replica := range existing {
+		if replica.StoreID == leaseStoreID {
+			leaseNodeID = replica.NodeID
+		}
+	}
+	others := make(map[proto.StoreID]proto.Replica)
+	for _, replica := range existing {
+		if replica.NodeID != leaseNodeID {
+			others[replica.StoreID] = replica
+		}
+	}
+	var descs []proto.StoreDescriptor
+	for _, desc := range p.storeDescs() {
+		if _, ok := others[desc.StoreID]; ok {
+			descs = append(descs, desc)
+		}
+	}
+	target := p.pick(descs, freeCapacity)
+	if target == nil {
+		return proto.Replica{}, util.Errorf("unable to transfer the lease from store %d; no replica on another node",
+			leaseStoreID)
+	}
+	return others[target.StoreID], nil
+}
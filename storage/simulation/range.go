@@ -25,6 +25,7 @@ import (
 	"github.com/cockroachdb/cockroach/config"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
 )
 
 // replica holds the results from calling the allocator as to what the range
@@ -42,18 +43,36 @@ type Range struct {
 	zone      config.ZoneConfig
 	desc      proto.RangeDescriptor
 	replicas  map[proto.StoreID]replica
-	allocator storage.Allocator
+	allocator allocatorPolicy
+	size      int64 // bytes occupied by each replica
+	// generation is incremented whenever the range's replicas or zone config
+	// change.
+	generation int
+	// nonVoterAttrs holds the attributes required of each of the range's
+	// non-voting (read-only) replicas. Non-voters receive the range's data
+	// but take no part in quorum. The zone config has no notion of them yet,
+	// so they are modeled only by the simulation.
+	nonVoterAttrs []proto.Attributes
+	// nonVoters holds the stores with non-voting replicas of the range. They
+	// are deliberately kept out of the range descriptor, so the allocator
+	// never counts them as voters.
+	nonVoters map[proto.StoreID]*Store
+	// lease is the store of the replica holding the range's lease, once it
+	// has been transferred there. See leaseholder.
+	lease proto.StoreID
 }
 
-// newRange returns a new range with the given rangeID.
-func newRange(rangeID proto.RangeID, allocator storage.Allocator) *Range {
+// newRange returns a new range with the given rangeID and zone config.
+func newRange(rangeID proto.RangeID, zone config.ZoneConfig, allocator allocatorPolicy) *Range {
 	return &Range{
 		desc: proto.RangeDescriptor{
 			RangeID: rangeID,
 		},
-		zone:      *config.DefaultZoneConfig,
+		zone:      zone,
 		replicas:  make(map[proto.StoreID]replica),
+		nonVoters: make(map[proto.StoreID]*Store),
 		allocator: allocator,
+		size:      bytesPerRange,
 	}
 }
 
@@ -68,18 +87,62 @@ func (r *Range) addReplica(s *Store) {
 	r.replicas[storeID] = replica{
 		store: s,
 	}
+	r.generation++
 }
 
-// getStoreIDs returns the list of all stores where this range has replicas.
+// removeReplica removes the replica on the passed in store from both the range
+// descriptor and the store map.
+func (r *Range) removeReplica(s *Store) {
+	storeID, _ := s.getIDs()
+	for i, replica := range r.desc.Replicas {
+		if replica.StoreID == storeID {
+			r.desc.Replicas = append(r.desc.Replicas[:i], r.desc.Replicas[i+1:]...)
+			break
+		}
+	}
+	delete(r.replicas, storeID)
+	r.generation++
+}
+
+// addNonVoter adds a non-voting replica on the passed in store.
+func (r *Range) addNonVoter(s *Store) {
+	storeID, _ := s.getIDs()
+	r.nonVoters[storeID] = s
+	r.generation++
+}
+
+// quorum returns the number of replicas which must acknowledge a write to
+// the range. Like computeQuorum in the storage package, it is a majority of
+// the voting replicas; non-voters are not counted.
+func (r *Range) quorum() int {
+	return len(r.desc.Replicas)/2 + 1
+}
+
+// spannedNodes returns the number of distinct nodes holding replicas of the
+// range.
+func (r *Range) spannedNodes() int {
+	nodes := make(map[proto.NodeID]struct{})
+	for _, replica := range r.desc.Replicas {
+		nodes[replica.NodeID] = struct{}{}
+	}
+	return len(nodes)
+}
+
+// getStoreIDs returns the list of all stores where this range has replicas,
+// both voting and non-voting.
 func (r *Range) getStoreIDs() []proto.StoreID {
 	var storeIDs []proto.StoreID
 	for storeID := range r.replicas {
 		storeIDs = append(storeIDs, storeID)
 	}
+	for storeID := range r.nonVoters {
+		storeIDs = append(storeIDs, storeID)
+	}
 	return storeIDs
 }
 
-// getStores returns a shallow copy of the internal stores map.
+// getStores returns a shallow copy of the internal stores map. Only stores
+// with voting replicas are included.
 func (r *Range) getStores() map[proto.StoreID]*Store {
 	stores := make(map[proto.StoreID]*Store)
 	for storeID, replica := range r.replicas {
@@ -90,44 +153,189 @@ func (r *Range) getStores() map[proto.StoreID]*Store {
 
 // split range adds a replica to all the stores from the passed in range. This
 // function should only be called on new ranges as it will overwrite all of the
-// replicas in the range.
+// replicas in the range. The new range has the same size as the original.
 func (r *Range) splitRange(originalRange *Range) {
 	stores := originalRange.getStores()
+	r.zone = originalRange.zone
+	r.size = originalRange.size
 	r.desc.Replicas = append([]proto.Replica(nil), originalRange.desc.Replicas...)
 	for storeID, store := range stores {
 		r.replicas[storeID] = replica{
 			store: store,
 		}
 	}
+	r.nonVoterAttrs = originalRange.nonVoterAttrs
+	r.lease = originalRange.lease
+	for storeID, store := range originalRange.nonVoters {
+		r.nonVoters[storeID] = store
+	}
+	r.generation++
+}
+
+// leaseholder returns the store of the replica holding the range's lease.
+// Until the lease is transferred, or if the replica it was transferred to
+// has since been removed, it is held by the first replica in the range
+// descriptor. 0 is returned if the range has no replicas.
+func (r *Range) leaseholder() proto.StoreID {
+	if _, ok := r.replicas[r.lease]; ok {
+		return r.lease
+	}
+	if len(r.desc.Replicas) == 0 {
+		return 0
+	}
+	return r.desc.Replicas[0].StoreID
+}
+
+// getTransferLeaseTarget calls transferLeaseTarget for the range and returns
+// the store to which its lease should be transferred.
+func (r *Range) getTransferLeaseTarget() (proto.StoreID, error) {
+	replica, err := r.allocator.TransferLeaseTarget(r.desc.Replicas, r.leaseholder())
+	if err != nil {
+		return 0, err
+	}
+	return replica.StoreID, nil
 }
 
 // getNextAction returns the action and rebalance from the replica with the
-// highest action priority.
-func (r *Range) getNextAction() (storage.AllocatorAction, bool) {
+// highest action priority, along with the store holding that replica. Of
+// replicas with equal priority, one which wants to rebalance is preferred.
+func (r *Range) getNextAction() (storage.AllocatorAction, bool, proto.StoreID) {
 	var topReplica replica
 	if len(r.replicas) == 0 {
-		return storage.AllocatorNoop, false
+		return storage.AllocatorNoop, false, 0
 	}
 	// TODO(bram): This is random. Might want to make it deterministic for
 	// repeatability.
 	for _, replica := range r.replicas {
-		if replica.priority > topReplica.priority {
+		if topReplica.store == nil || replica.priority > topReplica.priority ||
+			(replica.priority == topReplica.priority && replica.rebalance && !topReplica.rebalance) {
 			topReplica = replica
 		}
 	}
-	return topReplica.action, topReplica.rebalance
+	var source proto.StoreID
+	if topReplica.store != nil {
+		source, _ = topReplica.store.getIDs()
+	}
+	return topReplica.action, topReplica.rebalance, source
 }
 
 // getAllocateTarget calls allocateTarget for the range and returns the top
-// target store.
+// target store. The stores of non-voting replicas are avoided, though their
+// nodes also count toward the zone's MinDistinctNodes.
 func (r *Range) getAllocateTarget() (proto.StoreID, error) {
-	newStore, err := r.allocator.AllocateTarget(r.zone.ReplicaAttrs[0], r.desc.Replicas, true, nil)
+	newStore, err := r.allocator.AllocateTarget(r.zone.ReplicaAttrs[0], r.allReplicas(),
+		int(r.zone.MinDistinctNodes))
 	if err != nil {
 		return 0, err
 	}
 	return newStore.StoreID, nil
 }
 
+// allReplicas returns the voting replicas from the range descriptor followed
+// by the non-voting replicas. Allocation targets are chosen against these so
+// that a store never holds two replicas of the range.
+func (r *Range) allReplicas() []proto.Replica {
+	if len(r.nonVoters) == 0 {
+		return r.desc.Replicas
+	}
+	replicas := append([]proto.Replica(nil), r.desc.Replicas...)
+	for _, s := range r.nonVoters {
+		storeID, nodeID := s.getIDs()
+		replicas = append(replicas, proto.Replica{
+			NodeID:  nodeID,
+			StoreID: storeID,
+		})
+	}
+	return replicas
+}
+
+// getNonVoterTarget calls allocateTarget for the range's next missing
+// non-voting replica and returns the target store.
+func (r *Range) getNonVoterTarget() (proto.StoreID, error) {
+	newStore, err := r.allocator.AllocateTarget(r.nonVoterAttrs[len(r.nonVoters)], r.allReplicas(), 0)
+	if err != nil {
+		return 0, err
+	}
+	return newStore.StoreID, nil
+}
+
+// getRemoveTarget calls removeTarget for the range and returns the store
+// holding the replica which should be removed. leaseStoreID is the store
+// of the replica acting for the range, which like the replica processed by
+// the replicate queue is taken to hold the lease.
+func (r *Range) getRemoveTarget(leaseStoreID proto.StoreID) (proto.StoreID, error) {
+	replica, err := r.allocator.RemoveTarget(r.desc.Replicas, leaseStoreID)
+	if err != nil {
+		return 0, err
+	}
+	return replica.StoreID, nil
+}
+
+// getRebalanceTarget calls rebalanceTarget for the range and returns the
+// target store. If no suitable target was found, false is returned.
+func (r *Range) getRebalanceTarget() (proto.StoreID, bool) {
+	newStore := r.allocator.RebalanceTarget(r.zone.ReplicaAttrs[0], r.allReplicas())
+	if newStore == nil {
+		return 0, false
+	}
+	return newStore.StoreID, true
+}
+
+// getReplaceTarget calls ReplaceTarget for the range and returns the store to
+// which one of its replicas should be moved and the store of the replica
+// being replaced. Targets holding a non-voting replica of the range are
+// skipped, as only voting replicas are moved. As with getRemoveTarget,
+// leaseStoreID is the store of the acting replica.
+func (r *Range) getReplaceTarget(leaseStoreID proto.StoreID) (proto.StoreID, proto.StoreID, bool) {
+	newStore, removeReplica := r.allocator.ReplaceTarget(r.zone.ReplicaAttrs[0], r.desc.Replicas, r.size,
+		leaseStoreID)
+	if newStore == nil {
+		return 0, 0, false
+	}
+	if _, ok := r.nonVoters[newStore.StoreID]; ok {
+		return 0, 0, false
+	}
+	return newStore.StoreID, removeReplica.StoreID, true
+}
+
+// getDesc returns a copy of the range descriptor, which unlike the range's
+// own descriptor is not modified by later replication changes.
+func (r *Range) getDesc() *proto.RangeDescriptor {
+	desc := r.desc
+	desc.Replicas = append([]proto.Replica(nil), r.desc.Replicas...)
+	return &desc
+}
+
+// getStats returns the MVCC stats of each replica of the range. Only the
+// range's size is simulated, so it is reported as live data.
+func (r *Range) getStats() engine.MVCCStats {
+	return engine.MVCCStats{
+		LiveBytes: r.size,
+		ValBytes:  r.size,
+	}
+}
+
+// registerEvent returns the RegisterRangeEvent a store publishes when it
+// gains a replica of the range, or when it scans over its replicas.
+func (r *Range) registerEvent(storeID proto.StoreID, scan bool) *storage.RegisterRangeEvent {
+	return &storage.RegisterRangeEvent{
+		StoreID: storeID,
+		Desc:    r.getDesc(),
+		Stats:   r.getStats(),
+		Scan:    scan,
+	}
+}
+
+// removeEvent returns the RemoveRangeEvent a store publishes when its
+// replica of the range is removed.
+func (r *Range) removeEvent(storeID proto.StoreID) *storage.RemoveRangeEvent {
+	return &storage.RemoveRangeEvent{
+		StoreID: storeID,
+		Desc:    r.getDesc(),
+		Stats:   r.getStats(),
+	}
+}
+
 // String returns a human readable string with details about the range.
 func (r *Range) String() string {
 	var storeIDs proto.StoreIDSlice
@@ -137,7 +345,7 @@ func (r *Range) String() string {
 	sort.Sort(storeIDs)
 
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "Range:%d, Factor:%d, Stores:[", r.desc.RangeID, len(r.zone.ReplicaAttrs))
+	fmt.Fprintf(&buf, "Range:%d, Factor:%d, Size:%d, Stores:[", r.desc.RangeID, len(r.zone.ReplicaAttrs), r.size)
 
 	first := true
 	for _, storeID := range storeIDs {
@@ -149,5 +357,21 @@ func (r *Range) String() string {
 		fmt.Fprintf(&buf, "%d", storeID)
 	}
 	buf.WriteString("]")
+
+	if len(r.nonVoterAttrs) > 0 {
+		var nonVoterIDs proto.StoreIDSlice
+		for storeID := range r.nonVoters {
+			nonVoterIDs = append(nonVoterIDs, storeID)
+		}
+		sort.Sort(nonVoterIDs)
+		buf.WriteString(", NonVoters:[")
+		for i, storeID := range nonVoterIDs {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, "%d", storeID)
+		}
+		fmt.Fprintf(&buf, "], Quorum:%d", r.quorum())
+	}
 	return buf.String()
 }
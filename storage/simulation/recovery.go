@@ -0,0 +1,142 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// recovery tracks the ranges affected by the failure of a store or node
+// until each of them is fully replicated again, as a measure of how quickly
+// the allocator repairs the cluster.
+type recovery struct {
+	failure string // e.g. "node 2"
+	epoch   int    // epoch at which the failure occurred
+	// pending holds the affected ranges which haven't yet recovered.
+	pending map[proto.RangeID]struct{}
+	ranges  int // number of affected ranges
+	// recoveredAt is the epoch by the end of which every affected range
+	// had recovered, or -1 while any is pending.
+	recoveredAt int
+}
+
+// epochs returns the number of epochs it took to recover from the failure,
+// and false if the cluster hasn't recovered yet.
+func (rec *recovery) epochs() (int, bool) {
+	if rec.recoveredAt < 0 {
+		return 0, false
+	}
+	return rec.recoveredAt - rec.epoch, true
+}
+
+// String returns a summary of the recovery.
+func (rec *recovery) String() string {
+	if epochs, ok := rec.epochs(); ok {
+		return fmt.Sprintf("%s failed at epoch %d: %d range(s) recovered in %d epoch(s)",
+			rec.failure, rec.epoch, rec.ranges, epochs)
+	}
+	return fmt.Sprintf("%s failed at epoch %d: %d of %d range(s) not yet recovered",
+		rec.failure, rec.epoch, len(rec.pending), rec.ranges)
+}
+
+// recordFailure starts tracking the recovery from the failure of the given
+// stores, which must already be down. The ranges with a voting replica on
+// any of the stores are affected.
+func (c *Cluster) recordFailure(failure string, storeIDs []proto.StoreID) {
+	failed := make(map[proto.StoreID]struct{})
+	for _, storeID := range storeIDs {
+		failed[storeID] = struct{}{}
+	}
+	rec := &recovery{
+		failure:     failure,
+		epoch:       c.epoch,
+		pending:     make(map[proto.RangeID]struct{}),
+		recoveredAt: -1,
+	}
+	for rangeID, r := range c.ranges {
+		for storeID := range r.replicas {
+			if _, ok := failed[storeID]; ok {
+				rec.pending[rangeID] = struct{}{}
+				break
+			}
+		}
+	}
+	rec.ranges = len(rec.pending)
+	c.recoveries = append(c.recoveries, rec)
+}
+
+// recovered returns whether the range has as many voting replicas on
+// running stores as its zone config requires.
+func (c *Cluster) recovered(r *Range) bool {
+	live := 0
+	for _, replica := range r.replicas {
+		if !replica.store.down {
+			live++
+		}
+	}
+	return live >= len(r.zone.ReplicaAttrs)
+}
+
+// updateRecoveries marks the affected ranges which have recovered by the
+// end of the current epoch, and reports every failure the cluster has
+// fully recovered from. Ranges which no longer exist are no longer
+// awaited.
+func (c *Cluster) updateRecoveries() {
+	for _, rec := range c.recoveries {
+		if rec.recoveredAt >= 0 {
+			continue
+		}
+		for rangeID := range rec.pending {
+			if r, ok := c.ranges[rangeID]; !ok || c.recovered(r) {
+				delete(rec.pending, rangeID)
+			}
+		}
+		if len(rec.pending) == 0 {
+			rec.recoveredAt = c.epoch
+			fmt.Printf("Recovered: %s\n", rec)
+		}
+	}
+}
+
+// maxRecoveryEpochs returns the longest time taken to recover from any
+// failure, and false if the cluster has yet to recover from one.
+func (c *Cluster) maxRecoveryEpochs() (int, bool) {
+	var max int
+	for _, rec := range c.recoveries {
+		epochs, ok := rec.epochs()
+		if !ok {
+			return 0, false
+		}
+		if epochs > max {
+			max = epochs
+		}
+	}
+	return max, true
+}
+
+// recoveryString returns a summary of the recovery from every failure, in
+// the order in which they occurred.
+func (c *Cluster) recoveryString() string {
+	var buf bytes.Buffer
+	buf.WriteString("Recovery Info:\n")
+	for _, rec := range c.recoveries {
+		fmt.Fprintf(&buf, "%s\n", rec)
+	}
+	return buf.String()
+}
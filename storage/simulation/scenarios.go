@@ -0,0 +1,1633 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/config"
+	"github.com/cockroachdb/cockroach/keys"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/server/status"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/stop"
+)
+
+// scenario is a single named run of the simulation. Each scenario creates its
+// own cluster, drives it through a number of epochs and returns an error if
+// the cluster did not end up in the expected state.
+type scenario struct {
+	name        string
+	description string
+	run         func(stopper *stop.Stopper) error
+}
+
+// scenarios lists all the scenarios which can be selected with the --scenario
+// flag.
+var scenarios = []scenario{
+	{
+		name:        "rebalance",
+		description: "splits a single range many times and watches it replicate and rebalance",
+		run:         runRebalanceScenario,
+	},
+	{
+		name:        "zone-factor",
+		description: "increases the zone's replication factor mid-run and waits for up-replication",
+		run:         runZoneFactorScenario,
+	},
+	{
+		name:        "compare-policies",
+		description: "runs the default and weighted random allocator policies on the same topology",
+		run:         runComparePoliciesScenario,
+	},
+	{
+		name:        "unhealthy-store",
+		description: "marks a store unhealthy and verifies new replicas are routed away from it",
+		run:         runUnhealthyStoreScenario,
+	},
+	{
+		name:        "storeless-node",
+		description: "adds a node without any stores and verifies nothing is placed on it until it has one",
+		run:         runStorelessNodeScenario,
+	},
+	{
+		name:        "locality",
+		description: "rebalances onto new nodes in three localities and verifies replicas stay spread across them",
+		run:         runLocalityScenario,
+	},
+	{
+		name:        "decommission",
+		description: "drains the busiest store and removes it once all of its replicas have moved",
+		run:         runDecommissionScenario,
+	},
+	{
+		name:        "gc-delay",
+		description: "compares peak store usage while rebalancing with and without replica GC latency",
+		run:         runGCDelayScenario,
+	},
+	{
+		name:        "range-sizes",
+		description: "rebalances ranges of varied sizes onto new nodes and verifies bytes used are balanced",
+		run:         runRangeSizesScenario,
+	},
+	{
+		name:        "throttling",
+		description: "rebalances onto new nodes with a per store write budget and reports how far stores fall behind",
+		run:         runThrottlingScenario,
+	},
+	{
+		name:        "action-cache",
+		description: "counts allocator computations in a steady-state cluster with and without the action cache",
+		run:         runActionCacheScenario,
+	},
+	{
+		name:        "imbalanced-start",
+		description: "starts with every replica on three of six stores and measures how long the allocator takes to balance them",
+		run:         runImbalancedStartScenario,
+	},
+	{
+		name:        "min-distinct-nodes",
+		description: "requires replicas to span three nodes on a two node cluster, then adds a third node",
+		run:         runMinDistinctNodesScenario,
+	},
+	{
+		name:        "overcommit",
+		description: "over-fills a store and verifies the allocator stops targeting it",
+		run:         runOvercommitScenario,
+	},
+	{
+		name:        "node-capacity",
+		description: "places new ranges while one node is nearly full, with and without node capacity awareness",
+		run:         runNodeCapacityScenario,
+	},
+	{
+		name:        "non-voters",
+		description: "places two non-voting replicas of each range in a remote locality and checks quorum ignores them",
+		run:         runNonVotersScenario,
+	},
+	{
+		name:        "event-feed",
+		description: "publishes node and store events to a feed and rebuilds each store's replica count from them",
+		run:         runEventFeedScenario,
+	},
+	{
+		name:        "replace",
+		description: "rebalances onto a new node by moving replicas without over-committing its capacity",
+		run:         runReplaceScenario,
+	},
+	{
+		name:        "fill-new-store",
+		description: "adds an empty store to a full cluster and checks that it fills smoothly",
+		run:         runFillNewStoreScenario,
+	},
+	{
+		name:        "rolling-restart",
+		description: "restarts every node in turn and measures the churn caused by short and long downtimes",
+		run:         runRollingRestartScenario,
+	},
+	{
+		name:        "stale-gossip",
+		description: "injects gossip failures and verifies the allocator never removes replicas based on missing descriptors",
+		run:         runStaleGossipScenario,
+	},
+	{
+		name:        "table-zones",
+		description: "gives two tables zone configs of their own and verifies each table's ranges follow them",
+		run:         runTableZonesScenario,
+	},
+	{
+		name:        "failure-schedule",
+		description: "kills and revives stores and nodes according to a failure schedule and waits for recovery",
+		run:         runFailureScheduleScenario,
+	},
+	{
+		name:        "pinned-replicas",
+		description: "rebalances onto new nodes with some ranges pinned, then repairs a pinned range whose store dies",
+		run:         runPinnedReplicasScenario,
+	},
+	{
+		name:        "mixed-hardware",
+		description: "balances replicas across nodes with different numbers of stores without placing two replicas of a range on one node",
+		run:         runMixedHardwareScenario,
+	},
+	{
+		name:        "snapshot-load",
+		description: "rebalances onto new nodes with and without a limit on the snapshots each store receives at once",
+		run:         runSnapshotLoadScenario,
+	},
+	{
+		name:        "locality-tiers",
+		description: "places replicas across two regions of two zones each, spreading them across regions first",
+		run:         runLocalityTiersScenario,
+	},
+	{
+		name:        "lease-drain",
+		description: "drains the leases of the node holding the most before shutting it down and checks it keeps its replicas",
+		run:         runLeaseDrainScenario,
+	},
+	{
+		name:        "recovery-time",
+		description: "measures how many epochs it takes to fully replicate the ranges of a failed node and of a briefly stopped store",
+		run:         runRecoveryTimeScenario,
+	},
+}
+
+// findScenario returns the scenario with the given name.
+func findScenario(name string) (scenario, bool) {
+	for _, s := range scenarios {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return scenario{}, false
+}
+
+// scenarioList returns a human readable list of all available scenarios.
+func scenarioList() string {
+	var buf bytes.Buffer
+	for _, s := range scenarios {
+		fmt.Fprintf(&buf, "  %s - %s\n", s.name, s.description)
+	}
+	return buf.String()
+}
+
+// makeZone returns a copy of the default zone config requiring the given
+// number of replicas.
+func makeZone(replicas int) config.ZoneConfig {
+	zone := *config.DefaultZoneConfig
+	zone.ReplicaAttrs = make([]proto.Attributes, replicas)
+	return zone
+}
+
+// runEpochsUntil runs epochs until either done returns true or maxEpochs
+// have been run. It returns whether done was satisfied.
+func (c *Cluster) runEpochsUntil(maxEpochs int, done func() bool) bool {
+	for i := 0; i < maxEpochs; i++ {
+		if done() {
+			return true
+		}
+		c.runEpoch()
+	}
+	return done()
+}
+
+// runRebalanceScenario splits a random range 1000 times and then runs the
+// cluster for 100 epochs.
+func runRebalanceScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 5)
+
+	fmt.Printf("A simulation of the cluster's rebalancing.\n\n")
+	fmt.Println(c)
+
+	// Split a random range 1000 times.
+	for i := 0; i < 1000; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+
+	for i := 0; i < 100; i++ {
+		c.runEpoch()
+	}
+
+	fmt.Println(c)
+	return nil
+}
+
+// runZoneFactorScenario replicates a set of ranges using the default zone
+// config and then raises the replication factor, as an operator would by
+// updating the zone config. All existing ranges are expected to be
+// up-replicated to the new factor.
+func runZoneFactorScenario(stopper *stop.Stopper) error {
+	const newFactor = 5
+	c := createCluster(stopper, 7)
+
+	fmt.Printf("A simulation of a runtime change to the zone's replication factor.\n\n")
+	for i := 0; i < 100; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	allReplicated := func() bool { return len(c.misreplicatedRanges()) == 0 }
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	fmt.Printf("Increasing the replication factor to %d.\n", newFactor)
+	c.setZone(makeZone(newFactor))
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v were not up-replicated to %d replicas", c.misreplicatedRanges(), newFactor)
+	}
+
+	fmt.Println(c)
+	return nil
+}
+
+// runComparePoliciesScenario runs the same workload against both the default
+// allocator and the weighted random policy and reports which policy ended up
+// with the better balanced cluster. Each run starts with five nodes, fills
+// them and then adds two empty nodes that need to be rebalanced onto.
+func runComparePoliciesScenario(stopper *stop.Stopper) error {
+	options := storage.RebalancingOptions{AllowRebalance: true}
+	makePolicies := []func(c *Cluster) allocatorPolicy{
+		func(c *Cluster) allocatorPolicy {
+			return newDefaultPolicy(c.storePool, options)
+		},
+		func(c *Cluster) allocatorPolicy {
+			return newWeightedRandomPolicy(c.storePool, options, rand.New(rand.NewSource(c.seed)), c.getStoreDescs)
+		},
+	}
+
+	var best allocatorPolicy
+	var bestScore float64
+	for _, makePolicy := range makePolicies {
+		c := createCluster(stopper, 5)
+		policy := makePolicy(c)
+		c.setAllocator(policy)
+
+		fmt.Printf("Running with the %s allocator policy.\n", policy.name())
+		for i := 0; i < 200; i++ {
+			c.splitRangeRandom()
+		}
+		fmt.Println(c.StringEpochHeader())
+		c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 })
+
+		c.addNewNodeWithStore()
+		c.addNewNodeWithStore()
+		fmt.Println(c.StringEpochHeader())
+		for i := 0; i < 100; i++ {
+			c.runEpoch()
+		}
+
+		score := c.convergenceScore()
+		fmt.Printf("Policy %s - Convergence score: %.2f, Replicas moved: %d\n", policy.name(), score, c.replicasMoved)
+		fmt.Println(c.rangeCountHistogram(*histogramBuckets))
+		if best == nil || score < bestScore {
+			best, bestScore = policy, score
+		}
+	}
+
+	fmt.Printf("The %s policy converged best with a score of %.2f.\n", best.name(), bestScore)
+	return nil
+}
+
+// runUnhealthyStoreScenario replicates a set of ranges and then marks one
+// store as unhealthy, but not dead, before increasing the replication factor.
+// None of the new replicas may be placed on the unhealthy store, while the
+// replicas already on it must be left in place.
+func runUnhealthyStoreScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 7)
+
+	fmt.Printf("A simulation of allocation around an unhealthy store.\n\n")
+	for i := 0; i < 100; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	allReplicated := func() bool { return len(c.misreplicatedRanges()) == 0 }
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	unhealthyStoreID := c.storeIDs[len(c.storeIDs)-1]
+	before := c.storesRangeCounts()[unhealthyStoreID]
+	fmt.Printf("Marking store %d, holding %d replicas, as unhealthy.\n", unhealthyStoreID, before)
+	c.stores[unhealthyStoreID].setHealth(0)
+	c.setZone(makeZone(len(c.zone.ReplicaAttrs) + 1))
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v were not up-replicated", c.misreplicatedRanges())
+	}
+
+	fmt.Println(c)
+	if after := c.storesRangeCounts()[unhealthyStoreID]; after != before {
+		return util.Errorf("expected unhealthy store %d to keep exactly %d replicas, found %d",
+			unhealthyStoreID, before, after)
+	}
+	return nil
+}
+
+// runStorelessNodeScenario adds a node that has not yet added a store and
+// raises the replication factor beyond the number of available stores. The
+// allocator must not consider the storeless node a valid target, so the
+// ranges must remain under-replicated until a store is added to the node.
+func runStorelessNodeScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 3)
+
+	fmt.Printf("A simulation of allocation with a node that has no stores.\n\n")
+	for i := 0; i < 50; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	allReplicated := func() bool { return len(c.misreplicatedRanges()) == 0 }
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	nodeID := c.addNewNode()
+	fmt.Printf("Added node %d without any stores.\n", nodeID)
+	c.setZone(makeZone(len(c.zone.ReplicaAttrs) + 1))
+	for i := 0; i < 5; i++ {
+		c.runEpoch()
+	}
+	for _, r := range c.ranges {
+		for _, storeID := range r.getStoreIDs() {
+			if _, ok := c.stores[storeID]; !ok {
+				return util.Errorf("range %d has a replica on non-existent store %d", r.desc.RangeID, storeID)
+			}
+		}
+	}
+	if allReplicated() {
+		return util.Errorf("expected ranges to remain under-replicated while node %d has no stores", nodeID)
+	}
+
+	newStore := c.addStore(nodeID)
+	newStoreID, _ := newStore.getIDs()
+	fmt.Printf("Added store %d to node %d.\n", newStoreID, nodeID)
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v were not up-replicated once store %d was added", c.misreplicatedRanges(), newStoreID)
+	}
+
+	fmt.Println(c)
+	if count := c.storesRangeCounts()[newStoreID]; count != len(c.ranges) {
+		return util.Errorf("expected every range to have a replica on store %d, found %d of %d",
+			newStoreID, count, len(c.ranges))
+	}
+	return nil
+}
+
+// runLocalityScenario replicates a set of ranges across three nodes, each in
+// its own locality, and then adds two more nodes to every locality. While
+// rebalancing onto the new nodes, every range must keep a replica in each
+// locality.
+func runLocalityScenario(stopper *stop.Stopper) error {
+	localities := []string{"dc1", "dc2", "dc3"}
+	c := createCluster(stopper, len(localities))
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+	for i, locality := range localities {
+		c.setLocality(proto.NodeID(i), locality)
+	}
+
+	fmt.Printf("A simulation of rebalancing across localities.\n\n")
+	for i := 0; i < 100; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	for _, locality := range localities {
+		for i := 0; i < 2; i++ {
+			c.addNewNodeWithStore()
+			c.setLocality(proto.NodeID(len(c.nodes)-1), locality)
+		}
+	}
+	fmt.Printf("Added two nodes to each locality.\n")
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 100; i++ {
+		c.runEpoch()
+		for rangeID, r := range c.ranges {
+			if spread := c.rangeLocalities(r); len(spread) != len(localities) {
+				return util.Errorf("epoch %d: range %d is spread across localities %v", c.epoch, rangeID, spread)
+			}
+		}
+	}
+
+	fmt.Println(c)
+	fmt.Printf("Convergence score: %.2f\n", c.convergenceScore())
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	return nil
+}
+
+// runDecommissionScenario replicates a set of ranges and then decommissions
+// the store holding the most replicas. Every replica must be moved off the
+// store before it is removed, and no range may ever drop below its
+// replication factor while doing so.
+func runDecommissionScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 5)
+
+	fmt.Printf("A simulation of decommissioning a store.\n\n")
+	for i := 0; i < 100; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	var storeID proto.StoreID
+	maxCount := -1
+	for id, count := range c.storesRangeCounts() {
+		if count > maxCount {
+			storeID, maxCount = id, count
+		}
+	}
+	fmt.Printf("Decommissioning store %d, holding %d replicas.\n", storeID, maxCount)
+	c.decommissionStore(storeID)
+
+	need := len(c.zone.ReplicaAttrs)
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 100 && c.storesRangeCounts()[storeID] > 0; i++ {
+		c.runEpoch()
+		for rangeID, r := range c.ranges {
+			if have := len(r.replicas); have < need {
+				return util.Errorf("epoch %d: range %d dropped to %d replicas while draining", c.epoch, rangeID, have)
+			}
+		}
+	}
+	if err := c.removeStore(storeID); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed store %d.\n", storeID)
+	fmt.Println(c)
+	return nil
+}
+
+// runGCDelayScenario rebalances onto newly added nodes, first with removed
+// replicas freed instantly and then with them lingering for several epochs
+// before being garbage collected, and reports the peak usage of any store in
+// each case. Once rebalancing stops, all removed replicas must be collected.
+func runGCDelayScenario(stopper *stop.Stopper) error {
+	const lingerEpochs = 10
+	for _, delay := range []int{0, lingerEpochs} {
+		c := createCluster(stopper, 5)
+		c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+		c.setGCDelay(delay)
+
+		fmt.Printf("Rebalancing with a GC delay of %d epochs.\n", delay)
+		for i := 0; i < 200; i++ {
+			c.splitRangeRandom()
+		}
+		fmt.Println(c.StringEpochHeader())
+		c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 })
+
+		c.addNewNodeWithStore()
+		c.addNewNodeWithStore()
+		fmt.Println(c.StringEpochHeader())
+		var peak float64
+		for i := 0; i < 50; i++ {
+			c.runEpoch()
+			if used := c.peakFractionUsed(); used > peak {
+				peak = used
+			}
+		}
+
+		// Stop rebalancing and let all removed replicas be collected.
+		c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{}))
+		for i := 0; i <= delay; i++ {
+			c.runEpoch()
+		}
+		for storeID, s := range c.stores {
+			if len(s.pendingGC) > 0 {
+				return util.Errorf("store %d still has %d replicas pending GC", storeID, len(s.pendingGC))
+			}
+		}
+		fmt.Printf("GC delay %d - Peak store usage: %.4f%%\n\n", delay, peak*100)
+	}
+	return nil
+}
+
+// runRangeSizesScenario replicates a set of ranges in which every fourth range
+// is much larger than the others, and then rebalances onto two new nodes with
+// byte balancing enabled. The bytes used on each store must end up balanced,
+// even though the number of replicas on each store may differ.
+func runRangeSizesScenario(stopper *stop.Stopper) error {
+	const maxByteConvergenceScore = 0.2
+	c := createCluster(stopper, 3)
+	c.setAllocator(newDefaultPolicy(c.storePool,
+		storage.RebalancingOptions{AllowRebalance: true, BalanceBytes: true}))
+
+	fmt.Printf("A simulation of rebalancing ranges of varied sizes.\n\n")
+	for i := 0; i < 200; i++ {
+		c.splitRangeRandom()
+	}
+	for rangeID := range c.ranges {
+		if rangeID%4 == 0 {
+			c.setRangeSize(rangeID, 4*bytesPerRange)
+		} else {
+			c.setRangeSize(rangeID, bytesPerRange/4)
+		}
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	c.addNewNodeWithStore()
+	c.addNewNodeWithStore()
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 100; i++ {
+		c.runEpoch()
+	}
+
+	fmt.Println(c)
+	score := c.byteConvergenceScore()
+	fmt.Printf("Convergence score: %.2f\n", c.convergenceScore())
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	fmt.Printf("Byte convergence score: %.2f\n", score)
+	if score > maxByteConvergenceScore {
+		return util.Errorf("bytes used are not balanced; convergence score %.2f exceeds %.2f",
+			score, maxByteConvergenceScore)
+	}
+	return nil
+}
+
+// runThrottlingScenario replicates a set of ranges and then rebalances onto
+// two new nodes while each store can only absorb a few replicas per epoch.
+// Stores receiving replicas faster than that fall behind, which lowers their
+// health as reported to the allocator. The peak write debt shows whether the
+// allocator overloaded any individual store. Once rebalancing stops, every
+// store must catch up.
+func runThrottlingScenario(stopper *stop.Stopper) error {
+	const throughput = 5 * bytesPerRange
+	c := createCluster(stopper, 3)
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+
+	fmt.Printf("A simulation of rebalancing with a write budget of %d bytes per store per epoch.\n\n", throughput)
+	for i := 0; i < 200; i++ {
+		c.splitRangeRandom()
+	}
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	c.setStoreThroughput(throughput)
+	c.addNewNodeWithStore()
+	c.addNewNodeWithStore()
+	fmt.Println(c.StringEpochHeader())
+	var peak int64
+	for i := 0; i < 100; i++ {
+		c.runEpoch()
+		if debt := c.peakDebt(); debt > peak {
+			peak = debt
+		}
+	}
+
+	// Stop rebalancing and let every store catch up.
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{}))
+	if !c.runEpochsUntil(100, func() bool { return c.peakDebt() == 0 }) {
+		return util.Errorf("stores never caught up on their writes; peak debt is still %d", c.peakDebt())
+	}
+
+	fmt.Println(c)
+	fmt.Printf("Convergence score: %.2f\n", c.convergenceScore())
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	fmt.Printf("Peak write debt: %d bytes (%.1f epochs of throughput)\n", peak, float64(peak)/throughput)
+	return nil
+}
+
+// runActionCacheScenario replicates a set of ranges until the cluster reaches
+// a steady state, and then runs the same number of epochs with and without
+// the allocator action cache, reporting how many times the allocator had to
+// compute an action in each case.
+func runActionCacheScenario(stopper *stop.Stopper) error {
+	const epochs = 50
+	c := createCluster(stopper, 5)
+
+	fmt.Printf("A simulation of allocator computations in a steady-state cluster.\n\n")
+	for i := 0; i < 200; i++ {
+		c.splitRangeRandom()
+	}
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never reached the replication factor", c.misreplicatedRanges())
+	}
+
+	var computations [2]int64
+	var evaluations int64
+	for i, ttl := range []int{0, 10} {
+		c.actions = newActionCache(ttl)
+		for j := 0; j < epochs; j++ {
+			c.runEpoch()
+		}
+		evaluations, computations[i] = c.actions.Stats()
+	}
+
+	fmt.Println(c)
+	fmt.Printf("Action evaluations per %d epochs: %d\n", epochs, evaluations)
+	fmt.Printf("Allocator computations without cache: %d\n", computations[0])
+	fmt.Printf("Allocator computations with cache: %d (%.1f%% fewer)\n", computations[1],
+		100*(1-float64(computations[1])/float64(computations[0])))
+	if computations[1] >= computations[0] {
+		return util.Errorf("the action cache did not reduce allocator computations")
+	}
+	return nil
+}
+
+// runImbalancedStartScenario seeds a cluster of six stores with every replica
+// concentrated on the first three, and then runs until the number of replicas
+// on each store is within maxDeviation of the mean. It reports how many
+// epochs and replicate queue actions the allocator needed to correct the
+// imbalance.
+func runImbalancedStartScenario(stopper *stop.Stopper) error {
+	const maxDeviation = 0.1
+	c := createCluster(stopper, 6)
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+	c.seedReplicas(concentratedReplicaSets(300, 3, c.storeIDs[:3]))
+
+	fmt.Printf("A simulation of correcting an imbalanced initial replica distribution.\n\n")
+	fmt.Println(c)
+	fmt.Println(c.StringEpochHeader())
+	balanced := c.runEpochsUntil(500, func() bool { return c.maxRangeCountDeviation() <= maxDeviation })
+
+	fmt.Println(c)
+	fmt.Printf("Epochs: %d\n", c.epoch)
+	fmt.Printf("Convergence score: %.2f\n", c.convergenceScore())
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	if !balanced {
+		return util.Errorf("replicas were not balanced after %d epochs; max deviation from the mean is %.2f",
+			c.epoch, c.maxRangeCountDeviation())
+	}
+	return nil
+}
+
+// runMinDistinctNodesScenario seeds a cluster of two nodes with two stores
+// each, and requires every range to span at least three distinct nodes. It
+// verifies the allocator reports why that can't be satisfied, and that once a
+// third node is added every range is moved to span it.
+func runMinDistinctNodesScenario(stopper *stop.Stopper) error {
+	const minNodes = 3
+	c := createCluster(stopper, 2)
+	c.addStore(0)
+	c.addStore(1)
+	zone := makeZone(3)
+	zone.MinDistinctNodes = minNodes
+	c.setZone(zone)
+	c.seedReplicas(concentratedReplicaSets(50, 3, c.storeIDs))
+
+	fmt.Printf("A simulation of ranges required to span more nodes than the cluster has.\n\n")
+	fmt.Println(c)
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 5; i++ {
+		c.runEpoch()
+	}
+	if len(c.allocateErrs) != len(c.ranges) {
+		return util.Errorf("expected all %d ranges to fail allocation, got %d", len(c.ranges), len(c.allocateErrs))
+	}
+	for rangeID, err := range c.allocateErrs {
+		if !strings.Contains(err.Error(), "distinct nodes") {
+			return util.Errorf("range %d failed allocation for an unexpected reason: %s", rangeID, err)
+		}
+	}
+
+	c.addNewNodeWithStore()
+	spanning := func() bool {
+		for _, r := range c.ranges {
+			if r.spannedNodes() < minNodes || len(r.desc.Replicas) != len(zone.ReplicaAttrs) {
+				return false
+			}
+		}
+		return true
+	}
+	spanned := c.runEpochsUntil(100, spanning)
+
+	fmt.Println(c)
+	fmt.Printf("Epochs: %d\n", c.epoch)
+	if !spanned {
+		return util.Errorf("ranges did not span %d distinct nodes after %d epochs", minNodes, c.epoch)
+	}
+	if len(c.allocateErrs) != 0 {
+		return util.Errorf("%d ranges still failing allocation", len(c.allocateErrs))
+	}
+	return nil
+}
+
+// runOvercommitScenario places a single range larger than a store's capacity
+// on the first of three stores. With the other two stores unhealthy, new
+// ranges must not be placed on the overcommitted store even though it is the
+// only candidate, and once they recover every new range is placed on them.
+func runOvercommitScenario(stopper *stop.Stopper) error {
+	const newRanges = 20
+	c := createCluster(stopper, 3)
+	c.setZone(makeZone(1))
+	fullStoreID := c.storeIDs[0]
+	c.setRangeSize(0, capacityPerStore+bytesPerRange)
+
+	fmt.Printf("A simulation of allocation around an overcommitted store.\n\n")
+	fmt.Println(c.StringEpochHeader())
+	c.runEpoch()
+	if !c.stores[fullStoreID].overcommitted {
+		return util.Errorf("expected store %d to be overcommitted", fullStoreID)
+	}
+
+	for _, storeID := range c.storeIDs[1:] {
+		c.stores[storeID].setHealth(0)
+	}
+	for i := 0; i < newRanges; i++ {
+		c.addRange()
+	}
+	for i := 0; i < 5; i++ {
+		c.runEpoch()
+	}
+	if len(c.allocateErrs) != newRanges {
+		return util.Errorf("expected all %d new ranges to fail allocation, got %d", newRanges, len(c.allocateErrs))
+	}
+
+	for _, storeID := range c.storeIDs[1:] {
+		c.stores[storeID].setHealth(1)
+	}
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v were never placed", c.misreplicatedRanges())
+	}
+
+	fmt.Println(c)
+	if count := c.storesRangeCounts()[fullStoreID]; count != 1 {
+		return util.Errorf("expected overcommitted store %d to hold only its original replica, found %d",
+			fullStoreID, count)
+	}
+	s := c.stores[fullStoreID]
+	storeStr := s.String(c.storesRangeCounts()[fullStoreID], c.storesUsedBytes()[fullStoreID])
+	if !strings.Contains(storeStr, "Overcommitted") {
+		return util.Errorf("expected the overcommit to be shown for store %d: %s", fullStoreID, storeStr)
+	}
+	return nil
+}
+
+// runNodeCapacityScenario builds a cluster in which the first node has three
+// stores, two of which are nearly full, while the third is the least used
+// store in the cluster. New ranges are then placed first by an allocator
+// which only considers store capacity, and then by one which also avoids
+// nodes using more than maxNodeFractionUsed of their capacity in aggregate.
+// Only the former may place replicas on the nearly full node.
+func runNodeCapacityScenario(stopper *stop.Stopper) error {
+	const maxNodeFractionUsed = 0.7
+	const newRanges = 50
+
+	fmt.Printf("A simulation of placing ranges around a nearly full node.\n\n")
+	var placed [2]int
+	for i, maxFraction := range []float64{0, maxNodeFractionUsed} {
+		c := createCluster(stopper, 3)
+		c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{MaxNodeFractionUsed: maxFraction}))
+		c.setZone(makeZone(1))
+		nodeStoreIDs := []proto.StoreID{c.storeIDs[0]}
+		for j := 0; j < 2; j++ {
+			s := c.addStore(0)
+			storeID, _ := s.getIDs()
+			nodeStoreIDs = append(nodeStoreIDs, storeID)
+		}
+		otherStoreIDs := c.nodes[1].getStoreIDs()
+		otherStoreIDs = append(otherStoreIDs, c.nodes[2].getStoreIDs()...)
+
+		// The first node's stores are 99%, 99% and 30% used, and the other
+		// nodes' stores 40% used.
+		replicaSets := [][]proto.StoreID{{nodeStoreIDs[0]}, {nodeStoreIDs[1]}, {nodeStoreIDs[2]}}
+		sizes := []int64{capacityPerStore / 100 * 99, capacityPerStore / 100 * 99, capacityPerStore / 100 * 30}
+		for _, storeID := range otherStoreIDs {
+			replicaSets = append(replicaSets, []proto.StoreID{storeID})
+			sizes = append(sizes, capacityPerStore/100*40)
+		}
+		c.seedReplicas(replicaSets)
+		for rangeID, size := range sizes {
+			c.setRangeSize(proto.RangeID(rangeID), size)
+		}
+		for j := 0; j < newRanges; j++ {
+			c.addRange()
+		}
+
+		fmt.Printf("Running with a maximum node fraction used of %.2f.\n", maxFraction)
+		fmt.Println(c.StringEpochHeader())
+		if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+			return util.Errorf("ranges %v were never placed", c.misreplicatedRanges())
+		}
+		fmt.Println(c)
+		storesRangeCounts := c.storesRangeCounts()
+		for _, storeID := range nodeStoreIDs {
+			placed[i] += storesRangeCounts[storeID] - 1
+		}
+		fmt.Printf("New replicas placed on the nearly full node: %d\n\n", placed[i])
+	}
+
+	if placed[0] == 0 {
+		return util.Errorf("expected replicas to be placed on the nearly full node when only store capacity is considered")
+	}
+	if placed[1] != 0 {
+		return util.Errorf("expected no replicas on the nearly full node, found %d", placed[1])
+	}
+	return nil
+}
+
+// runNonVotersScenario builds a cluster with three nodes in a local locality
+// and two in a remote one. Each range requires three voting replicas in the
+// local locality and two non-voting replicas in the remote one. Every range
+// must end up with exactly that placement, and its quorum must be computed
+// from the three voters alone.
+func runNonVotersScenario(stopper *stop.Stopper) error {
+	const voters, nonVoters = 3, 2
+	local := proto.Attributes{Attrs: []string{"local"}}
+	remote := proto.Attributes{Attrs: []string{"remote"}}
+	c := createCluster(stopper, voters+nonVoters)
+	for i := 0; i < len(c.nodes); i++ {
+		if i < voters {
+			c.setLocality(proto.NodeID(i), "local")
+		} else {
+			c.setLocality(proto.NodeID(i), "remote")
+		}
+	}
+	zone := makeZone(voters)
+	for i := range zone.ReplicaAttrs {
+		zone.ReplicaAttrs[i] = local
+	}
+	c.setZone(zone)
+	c.setNonVoters([]proto.Attributes{remote, remote})
+
+	fmt.Printf("A simulation of non-voting replicas in a remote locality.\n\n")
+	for i := 0; i < 20; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(30, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never received all of their replicas", c.misreplicatedRanges())
+	}
+	// Keep running to verify the allocator doesn't mistake the non-voters
+	// for excess voters and remove them.
+	for i := 0; i < 10; i++ {
+		c.runEpoch()
+	}
+
+	fmt.Println(c)
+	for rangeID, r := range c.ranges {
+		if len(r.desc.Replicas) != voters || len(r.nonVoters) != nonVoters {
+			return util.Errorf("range %d has %d voters and %d non-voters, expected %d and %d",
+				rangeID, len(r.desc.Replicas), len(r.nonVoters), voters, nonVoters)
+		}
+		for _, replica := range r.desc.Replicas {
+			if attrs := c.stores[replica.StoreID].desc.Node.Attrs; !local.IsSubset(attrs) {
+				return util.Errorf("range %d has a voter on store %d in locality %s",
+					rangeID, replica.StoreID, attrs.SortedString())
+			}
+		}
+		for storeID, s := range r.nonVoters {
+			if attrs := s.desc.Node.Attrs; !remote.IsSubset(attrs) {
+				return util.Errorf("range %d has a non-voter on store %d in locality %s",
+					rangeID, storeID, attrs.SortedString())
+			}
+		}
+		if quorum := r.quorum(); quorum != voters/2+1 {
+			return util.Errorf("range %d has a quorum of %d, expected %d", rangeID, quorum, voters/2+1)
+		}
+	}
+	return nil
+}
+
+// runEventFeedScenario subscribes to the events published by the cluster's
+// nodes and stores, and then splits and rebalances ranges while adding a
+// node. The number of replicas on each store, rebuilt from the events alone,
+// must match the simulation's own count.
+func runEventFeedScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 3)
+	feed := util.NewFeed(stopper)
+	var nodesStarted, storesStarted, statuses int
+	storesRangeCounts := map[proto.StoreID]int{}
+	feed.Subscribe(func(event interface{}) {
+		switch e := event.(type) {
+		case *status.StartNodeEvent:
+			nodesStarted++
+		case *storage.StartStoreEvent:
+			storesStarted++
+		case *storage.StoreStatusEvent:
+			statuses++
+		case *storage.RegisterRangeEvent:
+			storesRangeCounts[e.StoreID]++
+		case *storage.SplitRangeEvent:
+			storesRangeCounts[e.StoreID]++
+		case *storage.RemoveRangeEvent:
+			storesRangeCounts[e.StoreID]--
+		}
+	})
+	c.setFeed(feed)
+
+	fmt.Printf("A simulation publishing to an event feed.\n\n")
+	for i := 0; i < 50; i++ {
+		c.splitRangeRandom()
+	}
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 10; i++ {
+		c.runEpoch()
+	}
+	c.addNewNodeWithStore()
+	fmt.Printf("Added a node.\n")
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 20; i++ {
+		c.runEpoch()
+	}
+	feed.Flush()
+
+	fmt.Println(c)
+	fmt.Printf("Events: %d nodes started, %d stores started, %d store statuses\n",
+		nodesStarted, storesStarted, statuses)
+	if nodesStarted != len(c.nodes) || storesStarted != len(c.stores) {
+		return util.Errorf("expected %d nodes and %d stores to start, got %d and %d",
+			len(c.nodes), len(c.stores), nodesStarted, storesStarted)
+	}
+	if statuses == 0 {
+		return util.Errorf("expected store statuses to be published")
+	}
+	counts := c.storesRangeCounts()
+	for _, storeID := range c.storeIDs {
+		if storesRangeCounts[storeID] != counts[storeID] {
+			return util.Errorf("store %d has %d replicas, but its events account for %d",
+				storeID, counts[storeID], storesRangeCounts[storeID])
+		}
+	}
+	return nil
+}
+
+// runReplaceScenario starts six nodes three quarters full and adds an empty
+// node, which every range then sees as a rebalance target in the same epoch.
+// Rebalancing moves replicas, so no range may ever have more replicas than
+// its zone requires, and no store, in particular the new one, may ever be
+// over-committed.
+func runReplaceScenario(stopper *stop.Stopper) error {
+	const rangeCount = 12
+	c := createCluster(stopper, 6)
+	c.setAllocator(newDefaultPolicy(c.storePool,
+		storage.RebalancingOptions{AllowRebalance: true, ReplaceOnRebalance: true}))
+	c.seedReplicas(concentratedReplicaSets(rangeCount, 3, c.storeIDs))
+	for rangeID := range c.ranges {
+		c.setRangeSize(rangeID, capacityPerStore/8)
+	}
+
+	fmt.Printf("A simulation of rebalancing by replace.\n\n")
+	c.addNewNodeWithStore()
+	newStoreID := c.storeIDs[len(c.storeIDs)-1]
+	fmt.Println(c.StringEpochHeader())
+	var peak float64
+	for i := 0; i < 30; i++ {
+		c.runEpoch()
+		if used := c.peakFractionUsed(); used > peak {
+			peak = used
+		}
+		if peak > 1 {
+			return util.Errorf("epoch %d: a store was over-committed, peak usage %.4f%%", c.epoch, peak*100)
+		}
+		for rangeID, r := range c.ranges {
+			if have, need := len(r.replicas), len(r.zone.ReplicaAttrs); have > need {
+				return util.Errorf("epoch %d: range %d has %d replicas, more than the %d required",
+					c.epoch, rangeID, have, need)
+			}
+		}
+	}
+
+	fmt.Println(c)
+	fmt.Printf("Peak store usage: %.4f%%\n", peak*100)
+	if c.storesRangeCounts()[newStoreID] == 0 {
+		return util.Errorf("expected replicas to be moved to new store %d", newStoreID)
+	}
+	return nil
+}
+
+// runFillNewStoreScenario adds an empty store to a cluster whose stores are
+// three quarters full and rebalances onto it, first with the default
+// allocator and then with one weighting targets by free capacity and
+// capping each store's fill per epoch. It reports the largest fraction of
+// the new store's capacity filled in a single epoch; with the cap, this
+// must never exceed maxFillPerEpoch by more than a replica.
+func runFillNewStoreScenario(stopper *stop.Stopper) error {
+	const maxFillPerEpoch = 0.05
+	const rangeCount = 300
+	for _, capped := range []bool{false, true} {
+		c := createCluster(stopper, 5)
+		options := storage.RebalancingOptions{AllowRebalance: true}
+		if capped {
+			options.WeightByFreeCapacity = true
+			options.MaxFillPerPass = maxFillPerEpoch
+		}
+		c.setAllocator(newDefaultPolicy(c.storePool, options))
+		c.seedReplicas(concentratedReplicaSets(rangeCount, 3, c.storeIDs))
+		// Each store holds rangeCount*3/5 replicas.
+		rangeSize := int64(capacityPerStore*3/4) / (rangeCount * 3 / 5)
+		for rangeID := range c.ranges {
+			c.setRangeSize(rangeID, rangeSize)
+		}
+
+		fmt.Printf("Filling a new store, weighted by free capacity: %t.\n", capped)
+		c.addNewNodeWithStore()
+		newStoreID := c.storeIDs[len(c.storeIDs)-1]
+		fmt.Println(c.StringEpochHeader())
+		var peakFill, prevUsed float64
+		for i := 0; i < 50; i++ {
+			c.runEpoch()
+			used := float64(c.storesUsedBytes()[newStoreID]) / capacityPerStore
+			if fill := used - prevUsed; fill > peakFill {
+				peakFill = fill
+			}
+			prevUsed = used
+		}
+
+		fmt.Println(c)
+		fmt.Printf("Weighted: %t - Peak fill of store %d in one epoch: %.4f%%, final usage: %.4f%%\n\n",
+			capped, newStoreID, peakFill*100, prevUsed*100)
+		if prevUsed == 0 {
+			return util.Errorf("expected replicas to be moved to new store %d", newStoreID)
+		}
+		if maxFill := maxFillPerEpoch + float64(rangeSize)/capacityPerStore; capped && peakFill > maxFill {
+			return util.Errorf("store %d filled %.4f%% of its capacity in one epoch, more than the %.4f%% cap",
+				newStoreID, peakFill*100, maxFill*100)
+		}
+	}
+	return nil
+}
+
+// runRollingRestartScenario performs a rolling restart of a balanced
+// cluster, first with each node down for less than deadAfter epochs and
+// then for longer. A node which returns before its replicas are considered
+// dead must cause next to no replicas to be moved, at most maxShortChurn,
+// while one which is down for longer has its replicas replaced.
+func runRollingRestartScenario(stopper *stop.Stopper) error {
+	const deadAfter = 5
+	const maxShortChurn = 5
+	for _, downtime := range []int{deadAfter - 1, deadAfter + 2} {
+		c := createCluster(stopper, 5)
+		c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+		c.setDeadAfter(deadAfter)
+		c.seedReplicas(concentratedReplicaSets(50, 3, c.storeIDs))
+
+		fmt.Printf("Rolling restart with each node down for %d epochs.\n", downtime)
+		fmt.Println(c.StringEpochHeader())
+		for i := 0; i < 5; i++ {
+			c.runEpoch()
+		}
+		before := c.replicasMoved
+		c.rollingRestart(downtime)
+		if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+			return util.Errorf("ranges %v never recovered from the rolling restart", c.misreplicatedRanges())
+		}
+		churn := c.replicasMoved - before
+
+		fmt.Println(c)
+		fmt.Printf("Downtime %d epochs - Replicas moved: %d\n\n", downtime, churn)
+		if downtime < deadAfter && churn > maxShortChurn {
+			return util.Errorf("%d replicas were moved although no node was down for %d epochs, expected at most %d",
+				churn, deadAfter, maxShortChurn)
+		}
+		if downtime >= deadAfter && churn == 0 {
+			return util.Errorf("expected the replicas of nodes down for %d epochs to be replaced", downtime)
+		}
+	}
+	return nil
+}
+
+// runStaleGossipScenario runs a cluster in which some stores intermittently
+// fail to gossip, so that the allocator works with stale descriptors, and in
+// which a newly added store never gossips at all. One range is given an extra
+// replica on the silent store. No range may ever drop below its replication
+// factor, no other replicas may be placed on the silent store, and the
+// over-replicated range must keep all its replicas until the silent store
+// has been gossiped, after which the cluster must settle.
+func runStaleGossipScenario(stopper *stop.Stopper) error {
+	const replicas = 3
+	c := createCluster(stopper, 5)
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+	c.seedReplicas(concentratedReplicaSets(30, replicas, c.storeIDs[:3]))
+	for _, storeID := range c.storeIDs[:2] {
+		c.stores[storeID].setGossipFailureRate(0.5)
+	}
+
+	silent := c.addStore(c.addNewNode())
+	silent.setGossipFailureRate(1)
+	silentID, _ := silent.getIDs()
+	overReplicated := c.ranges[0]
+	c.addReplica(overReplicated, silent)
+
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 10; i++ {
+		c.runEpoch()
+		for rangeID, r := range c.ranges {
+			if len(r.replicas) < replicas {
+				return util.Errorf("range %d dropped to %d replicas", rangeID, len(r.replicas))
+			}
+			if _, ok := r.replicas[silentID]; ok && r != overReplicated {
+				return util.Errorf("range %d was given a replica on store %d, which has never been gossiped",
+					rangeID, silentID)
+			}
+		}
+		if n := len(overReplicated.replicas); n != replicas+1 {
+			return util.Errorf("range %d had a replica removed while store %d was not gossiped; %d replicas remain",
+				overReplicated.desc.RangeID, silentID, n)
+		}
+	}
+
+	silent.setGossipFailureRate(0)
+	if !c.runEpochsUntil(10, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never settled once store %d was gossiped", c.misreplicatedRanges(), silentID)
+	}
+
+	fmt.Println(c)
+	for _, storeID := range c.storeIDs {
+		if errs := c.stores[storeID].gossipErrors; errs > 0 {
+			fmt.Printf("Store %d - Gossip errors: %d\n", storeID, errs)
+		}
+	}
+	return nil
+}
+
+// runTableZonesScenario gives two tables zone configs with different
+// replication factors and splits each table into a few ranges, leaving the
+// rest of the keyspace to the default zone config. Every range must be
+// replicated according to the zone config of the table containing it. The
+// zone config of one table is then changed, which must affect only its own
+// ranges.
+func runTableZonesScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 7)
+	factors := map[uint32]int{
+		keys.MaxReservedDescID + 1: 5,
+		keys.MaxReservedDescID + 3: 1,
+	}
+	for tableID, factor := range factors {
+		c.setTableZone(tableID, makeZone(factor))
+		start := proto.Key(keys.MakeTablePrefix(tableID))
+		for _, key := range []proto.Key{start, append(start[:len(start):len(start)], 'm'), keys.MakeTablePrefix(tableID + 1)} {
+			if err := c.splitRangeAt(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	// checkFactors verifies that every range has the replication factor of
+	// the table containing it, or the default zone config's outside of them.
+	checkFactors := func() error {
+		for rangeID, r := range c.ranges {
+			want := len(config.DefaultZoneConfig.ReplicaAttrs)
+			if tableID, ok := config.ObjectIDForKey(r.desc.StartKey); ok {
+				if factor, ok := factors[tableID]; ok {
+					want = factor
+				}
+			}
+			if have := len(r.desc.Replicas); have != want {
+				return util.Errorf("range %d starting at %q has %d replicas, expected %d",
+					rangeID, r.desc.StartKey, have, want)
+			}
+		}
+		return nil
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	allReplicated := func() bool { return len(c.misreplicatedRanges()) == 0 }
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v never reached their zones' replication factors", c.misreplicatedRanges())
+	}
+	if err := checkFactors(); err != nil {
+		return err
+	}
+
+	tableID := uint32(keys.MaxReservedDescID + 1)
+	factors[tableID] = 3
+	fmt.Printf("Changing the replication factor of table %d to %d.\n", tableID, factors[tableID])
+	c.setTableZone(tableID, makeZone(factors[tableID]))
+	if !c.runEpochsUntil(20, allReplicated) {
+		return util.Errorf("ranges %v never reached their zones' replication factors", c.misreplicatedRanges())
+	}
+	if err := checkFactors(); err != nil {
+		return err
+	}
+
+	fmt.Println(c)
+	return nil
+}
+
+// runFailureScheduleScenario drives a balanced cluster through a failure
+// schedule, as would be written to reproduce an incident: a store is killed
+// for long enough that its replicas are replaced, while a node is killed
+// and revived before its replicas are considered dead. Every range must
+// recover, and the stores must all be running once the schedule is done.
+func runFailureScheduleScenario(stopper *stop.Stopper) error {
+	const deadAfter = 5
+	sched, err := parseSchedule(`
+		at epoch 3 kill store 1000
+		at epoch 6 kill node 2; at epoch 8 revive node 2 # back before deadAfter
+		at epoch 14 revive store 1000
+	`)
+	if err != nil {
+		return err
+	}
+	c := createCluster(stopper, 5)
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+	c.setDeadAfter(deadAfter)
+	c.setSchedule(sched)
+	c.seedReplicas(concentratedReplicaSets(30, 3, c.storeIDs))
+
+	fmt.Println(c.StringEpochHeader())
+	last := sched[len(sched)-1].epoch
+	for c.epoch < last {
+		c.runEpoch()
+	}
+	if len(c.schedule) > 0 {
+		return util.Errorf("failure events %v were never applied", c.schedule)
+	}
+	for _, storeID := range c.storeIDs {
+		if c.stores[storeID].down {
+			return util.Errorf("store %d is still down after the failure schedule", storeID)
+		}
+	}
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never recovered from the failure schedule", c.misreplicatedRanges())
+	}
+
+	fmt.Println(c)
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	return nil
+}
+
+// runPinnedReplicasScenario pins a third of the ranges of a three node
+// cluster and adds three more nodes. The unpinned ranges are rebalanced onto
+// the new nodes, but the pinned ranges must stay put. One of the original
+// nodes is then stopped for good: its replicas of the pinned ranges must
+// still be replaced, with a warning, as pinning them would leave the ranges
+// under-replicated.
+func runPinnedReplicasScenario(stopper *stop.Stopper) error {
+	const deadAfter = 5
+	c := createCluster(stopper, 3)
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+	c.setDeadAfter(deadAfter)
+	c.seedReplicas(concentratedReplicaSets(30, 3, c.storeIDs))
+
+	pinned := make(map[proto.RangeID]string)
+	for rangeID, r := range c.ranges {
+		if rangeID%3 == 0 {
+			c.setPinned(rangeID, true)
+			pinned[rangeID] = r.String()
+		}
+	}
+	for i := 0; i < 3; i++ {
+		c.addNewNodeWithStore()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	for i := 0; i < 30; i++ {
+		c.runEpoch()
+	}
+	for rangeID, before := range pinned {
+		if after := c.ranges[rangeID].String(); after != before {
+			return util.Errorf("pinned range %d moved during rebalancing: %s became %s", rangeID, before, after)
+		}
+	}
+	var moved bool
+	counts := c.storesRangeCounts()
+	for _, storeID := range c.storeIDs[3:] {
+		if counts[storeID] > 0 {
+			moved = true
+		}
+	}
+	if !moved {
+		return util.Errorf("no unpinned range was rebalanced onto the new nodes")
+	}
+
+	// Every range has a replica on node 0, so stopping it leaves each pinned
+	// range with a dead replica to replace.
+	fmt.Println("Stopping node 0, which holds replicas of every pinned range")
+	c.stopNode(0)
+	done := func() bool {
+		for rangeID := range pinned {
+			r := c.ranges[rangeID]
+			if _, ok := c.deadReplica(r); ok || len(r.replicas) != len(r.zone.ReplicaAttrs) {
+				return false
+			}
+		}
+		return true
+	}
+	if !c.runEpochsUntil(deadAfter+20, done) {
+		return util.Errorf("pinned ranges were not repaired after their store died")
+	}
+
+	fmt.Println(c)
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	return nil
+}
+
+// runMixedHardwareScenario builds a cluster whose nodes have between one and
+// four stores, seeds every replica onto the stores of three nodes and
+// rebalances them. The allocator must balance the replica counts of the
+// stores, while never placing two replicas of a range on the same node.
+// Balance is only achievable while no node holds more than a third of the
+// stores, as a node can hold at most one replica of each range.
+func runMixedHardwareScenario(stopper *stop.Stopper) error {
+	const maxDeviation = 0.2
+	storesPerNode := []int{2, 4, 1, 3, 2, 2, 1, 3}
+	c := createClusterWithStores(stopper, storesPerNode)
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+	var totalStores int
+	for _, stores := range storesPerNode {
+		totalStores += stores
+	}
+	if len(c.stores) != totalStores || len(c.storeIDs) != totalStores {
+		return util.Errorf("expected %d stores with unique IDs, got %d", totalStores, len(c.stores))
+	}
+	// Seed one replica of each range on each of the first three nodes.
+	var seedStores []proto.StoreID
+	for nodeID := proto.NodeID(0); nodeID < 3; nodeID++ {
+		seedStores = append(seedStores, c.nodes[nodeID].getStoreIDs()[0])
+	}
+	c.seedReplicas(concentratedReplicaSets(300, 3, seedStores))
+
+	fmt.Printf("A simulation of rebalancing across nodes with different numbers of stores.\n\n")
+	fmt.Println(c)
+	fmt.Println(c.StringEpochHeader())
+	balanced := c.runEpochsUntil(500, func() bool { return c.maxRangeCountDeviation() <= maxDeviation })
+
+	fmt.Println(c)
+	fmt.Printf("Epochs: %d\n", c.epoch)
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	if !balanced {
+		return util.Errorf("replicas were not balanced after %d epochs; max deviation from the mean is %.2f",
+			c.epoch, c.maxRangeCountDeviation())
+	}
+	for rangeID, r := range c.ranges {
+		if nodes := r.spannedNodes(); nodes != len(r.desc.Replicas) {
+			return util.Errorf("range %d has %d replicas on only %d nodes", rangeID, len(r.desc.Replicas), nodes)
+		}
+	}
+	return nil
+}
+
+// runSnapshotLoadScenario rebalances the replicas of a three node cluster
+// onto three new nodes, with each snapshot taking several epochs to
+// receive. It is run first without and then with a limit on the snapshots
+// a store may receive at once, verifying that the limit is never exceeded
+// and that the snapshot load is spread across the new stores.
+func runSnapshotLoadScenario(stopper *stop.Stopper) error {
+	const snapshotEpochs = 3
+	const maxSnapshots = 2
+	run := func(maxIncomingSnapshots int) (int, *Cluster) {
+		c := createCluster(stopper, 3)
+		c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{
+			AllowRebalance:       true,
+			MaxIncomingSnapshots: maxIncomingSnapshots,
+		}))
+		c.setSnapshotEpochs(snapshotEpochs)
+		c.seedReplicas(concentratedReplicaSets(200, 3, c.storeIDs))
+		for i := 0; i < 3; i++ {
+			c.addNewNodeWithStore()
+		}
+		fmt.Println(c.StringEpochHeader())
+		var peak int
+		for i := 0; i < 50; i++ {
+			c.runEpoch()
+			if snapshots := c.peakSnapshots(); snapshots > peak {
+				peak = snapshots
+			}
+		}
+		fmt.Println(c)
+		return peak, c
+	}
+
+	fmt.Printf("A simulation of rebalancing with snapshots taking %d epochs, without a limit.\n\n", snapshotEpochs)
+	unlimitedPeak, _ := run(0)
+	fmt.Printf("A simulation of rebalancing with snapshots taking %d epochs, limited to %d per store.\n\n",
+		snapshotEpochs, maxSnapshots)
+	limitedPeak, c := run(maxSnapshots)
+
+	fmt.Printf("Peak snapshots received by a store at once: %d without a limit, %d with a limit of %d\n",
+		unlimitedPeak, limitedPeak, maxSnapshots)
+	if limitedPeak > maxSnapshots {
+		return util.Errorf("a store received %d snapshots at once, above the limit of %d", limitedPeak, maxSnapshots)
+	}
+	counts := c.storesRangeCounts()
+	for _, storeID := range c.storeIDs[3:] {
+		if counts[storeID] == 0 {
+			return util.Errorf("no replicas were rebalanced onto store %d with the snapshot limit", storeID)
+		}
+	}
+	return nil
+}
+
+// runLocalityTiersScenario replicates a set of ranges across two regions of
+// two zones each, with two nodes in every zone, and then lets them
+// rebalance. Every range must spread its replicas across both regions
+// before placing two in the same region, and two replicas in the same
+// region must be in distinct zones, at every epoch.
+func runLocalityTiersScenario(stopper *stop.Stopper) error {
+	regions := []string{"us", "eu"}
+	zones := []string{"a", "b"}
+	const nodesPerZone = 2
+	c := createCluster(stopper, len(regions)*len(zones)*nodesPerZone)
+	c.setAllocator(newDefaultPolicy(c.storePool, storage.RebalancingOptions{AllowRebalance: true}))
+	for i := 0; i < len(c.nodes); i++ {
+		region := regions[i/(len(zones)*nodesPerZone)]
+		zone := zones[i/nodesPerZone%len(zones)]
+		c.setLocality(proto.NodeID(i), "region="+region, "zone="+region+"-"+zone)
+	}
+
+	fmt.Printf("A simulation of replica placement across regions and zones.\n\n")
+	for i := 0; i < 100; i++ {
+		c.splitRangeRandom()
+	}
+
+	// checkSpread verifies that the replicas of every range are spread
+	// across as many regions, and then zones, as there are replicas.
+	checkSpread := func() error {
+		for rangeID, r := range c.ranges {
+			for tiers, localities := range []int{len(regions), len(regions) * len(zones)} {
+				want := len(r.desc.Replicas)
+				if want > localities {
+					want = localities
+				}
+				if spread := c.rangeTierSpread(r, tiers+1); spread != want {
+					return util.Errorf("epoch %d: range %d has %d replicas in %d localities of %d tiers, expected %d: %v",
+						c.epoch, rangeID, len(r.desc.Replicas), spread, tiers+1, want, c.rangeLocalities(r))
+				}
+			}
+		}
+		return nil
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	replicated := false
+	for i := 0; i < 60; i++ {
+		c.runEpoch()
+		if err := checkSpread(); err != nil {
+			return err
+		}
+		replicated = replicated || len(c.misreplicatedRanges()) == 0
+	}
+	if !replicated {
+		return util.Errorf("ranges %v never reached the replication factor", c.misreplicatedRanges())
+	}
+
+	fmt.Println(c)
+	fmt.Printf("Convergence score: %.2f\n", c.convergenceScore())
+	fmt.Printf("Replicas moved: %d\n", c.replicasMoved)
+	return nil
+}
+
+// runLeaseDrainScenario transfers away the leases of the node holding the
+// most of them before shutting it down, as is done ahead of a restart. Once
+// drained, the node must hold no leases but all of its replicas, and none of
+// the cluster's ranges may be left with their leaseholder on the stopped
+// node.
+func runLeaseDrainScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 5)
+
+	fmt.Printf("A simulation of draining a node's leases before shutting it down.\n\n")
+	for i := 0; i < 100; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	var nodeID proto.NodeID
+	maxLeases := -1
+	for id := range c.nodes {
+		if leases := c.nodeLeases(id); leases > maxLeases {
+			nodeID, maxLeases = id, leases
+		}
+	}
+	replicas := c.nodeReplicas(nodeID)
+	fmt.Printf("Draining node %d, holding %d leases and %d replicas.\n", nodeID, maxLeases, replicas)
+	transferred, err := c.drainLeases(nodeID)
+	if err != nil {
+		return err
+	}
+	if transferred != maxLeases {
+		return util.Errorf("transferred %d of node %d's %d leases", transferred, nodeID, maxLeases)
+	}
+	if leases := c.nodeLeases(nodeID); leases != 0 {
+		return util.Errorf("node %d still holds %d leases after draining", nodeID, leases)
+	}
+	if have := c.nodeReplicas(nodeID); have != replicas {
+		return util.Errorf("node %d holds %d replicas after draining its leases, expected %d", nodeID, have, replicas)
+	}
+
+	fmt.Printf("Stopping node %d.\n", nodeID)
+	c.stopNode(nodeID)
+	c.runEpoch()
+	if leases := c.nodeLeases(nodeID); leases != 0 {
+		return util.Errorf("stopped node %d holds %d leases", nodeID, leases)
+	}
+	c.restartNode(nodeID)
+	c.runEpoch()
+
+	fmt.Println(c)
+	return nil
+}
+
+// runRecoveryTimeScenario kills a node for good and, once its ranges have
+// been repaired, stops a store for fewer epochs than it takes for its
+// replicas to be considered dead. The number of epochs taken to recover from
+// each failure is reported. The ranges of the stopped store must recover as
+// soon as it is revived.
+func runRecoveryTimeScenario(stopper *stop.Stopper) error {
+	c := createCluster(stopper, 6)
+
+	fmt.Printf("A simulation of the time taken to recover from failures.\n\n")
+	for i := 0; i < 100; i++ {
+		c.splitRangeRandom()
+	}
+
+	fmt.Println(c.StringEpochHeader())
+	if !c.runEpochsUntil(20, func() bool { return len(c.misreplicatedRanges()) == 0 }) {
+		return util.Errorf("ranges %v never reached the initial replication factor", c.misreplicatedRanges())
+	}
+
+	const outage = 2
+	if c.deadAfter <= outage {
+		return util.Errorf("stores must be down for more than %d epochs before their replicas are dead, got %d",
+			outage, c.deadAfter)
+	}
+	var storeID proto.StoreID
+	maxCount := -1
+	for id, count := range c.storesRangeCounts() {
+		if s := c.stores[id]; s.desc.Node.NodeID != 2 && count > maxCount {
+			storeID, maxCount = id, count
+		}
+	}
+	sched, err := parseSchedule(fmt.Sprintf("at epoch %d kill node 2", c.epoch+1))
+	if err != nil {
+		return err
+	}
+	c.setSchedule(sched)
+	if !c.runEpochsUntil(100, func() bool {
+		_, ok := c.maxRecoveryEpochs()
+		return ok && len(c.recoveries) > 0
+	}) {
+		return util.Errorf("the cluster never recovered:\n%s", c.recoveryString())
+	}
+
+	sched, err = parseSchedule(fmt.Sprintf("at epoch %d kill store %d; at epoch %d revive store %d",
+		c.epoch+1, storeID, c.epoch+1+outage, storeID))
+	if err != nil {
+		return err
+	}
+	c.setSchedule(sched)
+	if !c.runEpochsUntil(100, func() bool {
+		_, ok := c.maxRecoveryEpochs()
+		return ok && len(c.recoveries) > 1
+	}) {
+		return util.Errorf("the cluster never recovered:\n%s", c.recoveryString())
+	}
+
+	fmt.Println(c)
+	fmt.Print(c.recoveryString())
+	if epochs, _ := c.recoveries[1].epochs(); epochs > outage {
+		return util.Errorf("store %d was down for %d epochs, but its ranges took %d epochs to recover",
+			storeID, outage, epochs)
+	}
+	return nil
+}
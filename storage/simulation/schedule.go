@@ -0,0 +1,159 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// failureEvent stops or restarts a single store, or all of the stores of a
+// node, at the start of a given epoch.
+type failureEvent struct {
+	epoch int
+	kill  bool  // kill if set, otherwise revive
+	node  bool  // id is a node ID if set, otherwise a store ID
+	id    int64 // store or node ID
+	seq   int   // position of the event in its schedule
+}
+
+// String returns the event in the notation accepted by parseSchedule.
+func (e failureEvent) String() string {
+	action, target := "revive", "store"
+	if e.kill {
+		action = "kill"
+	}
+	if e.node {
+		target = "node"
+	}
+	return fmt.Sprintf("at epoch %d %s %s %d", e.epoch, action, target, e.id)
+}
+
+// failureSchedule is a list of failure events, sorted by epoch. Events
+// scheduled for the same epoch keep the order in which they were listed.
+type failureSchedule []failureEvent
+
+func (s failureSchedule) Len() int      { return len(s) }
+func (s failureSchedule) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s failureSchedule) Less(i, j int) bool {
+	if s[i].epoch != s[j].epoch {
+		return s[i].epoch < s[j].epoch
+	}
+	return s[i].seq < s[j].seq
+}
+
+var failureEventRE = regexp.MustCompile(`^at epoch ([0-9]+) (kill|revive) (store|node) ([0-9]+)$`)
+
+// parseSchedule parses a failure schedule, such as one reproducing the
+// sequence of failures of an incident. Events are separated by semicolons
+// or newlines, and each has the form "at epoch <n> (kill|revive)
+// (store|node) <id>", e.g. "at epoch 10 kill store 5000; at epoch 15 kill
+// node 9; at epoch 40 revive store 5000". Anything following a "#" on a
+// line is a comment. Events need not be listed in order of epoch.
+func parseSchedule(schedule string) (failureSchedule, error) {
+	var sched failureSchedule
+	for _, line := range strings.Split(schedule, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, elem := range strings.Split(line, ";") {
+			elem = strings.Join(strings.Fields(elem), " ")
+			if len(elem) == 0 {
+				continue
+			}
+			match := failureEventRE.FindStringSubmatch(elem)
+			if match == nil {
+				return nil, util.Errorf("failed to parse failure event %q", elem)
+			}
+			epoch, err := strconv.Atoi(match[1])
+			if err != nil {
+				return nil, util.Errorf("invalid epoch in failure event %q: %s", elem, err)
+			}
+			id, err := strconv.ParseInt(match[4], 10, 32)
+			if err != nil {
+				return nil, util.Errorf("invalid %s ID in failure event %q: %s", match[3], elem, err)
+			}
+			sched = append(sched, failureEvent{
+				epoch: epoch,
+				kill:  match[2] == "kill",
+				node:  match[3] == "node",
+				id:    id,
+				seq:   len(sched),
+			})
+		}
+	}
+	sort.Sort(sched)
+	return sched, nil
+}
+
+// setSchedule sets the failure schedule to be applied as the cluster runs.
+// Events scheduled for epochs which have already run are never applied.
+func (c *Cluster) setSchedule(sched failureSchedule) {
+	c.schedule = sched
+}
+
+// applySchedule applies the failure events scheduled for the current epoch.
+// Events naming stores or nodes which don't exist are reported and skipped,
+// as a scenario may add them after the schedule is set.
+func (c *Cluster) applySchedule() {
+	for len(c.schedule) > 0 && c.schedule[0].epoch <= c.epoch {
+		e := c.schedule[0]
+		c.schedule = c.schedule[1:]
+		if e.epoch < c.epoch {
+			continue
+		}
+		if err := c.applyFailure(e); err != nil {
+			fmt.Printf("Skipping failure event %q: %s\n", e, err)
+			continue
+		}
+		fmt.Printf("Applied failure event %q\n", e)
+	}
+}
+
+// applyFailure stops or restarts the store or node named by the event.
+func (c *Cluster) applyFailure(e failureEvent) error {
+	if e.node {
+		nodeID := proto.NodeID(e.id)
+		if _, ok := c.nodes[nodeID]; !ok {
+			return util.Errorf("no node %d", nodeID)
+		}
+		if e.kill {
+			c.stopNode(nodeID)
+		} else {
+			c.restartNode(nodeID)
+		}
+		return nil
+	}
+	storeID := proto.StoreID(e.id)
+	s, ok := c.stores[storeID]
+	if !ok {
+		return util.Errorf("no store %d", storeID)
+	}
+	if e.kill {
+		s.setDown(true, c.epoch)
+		c.recordFailure(fmt.Sprintf("store %d", storeID), []proto.StoreID{storeID})
+	} else {
+		s.setDown(false, c.epoch)
+		s.start(c.clock.PhysicalNow())
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	yaml "gopkg.in/yaml.v1"
+
+	"github.com/cockroachdb/cockroach/config"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/stop"
+)
+
+// scenarioSpec is a scenario described declaratively, so that a library of
+// reproducible scenarios can be kept as files rather than code. See
+// parseSpec for the format.
+type scenarioSpec struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+	// Nodes lists the nodes the cluster starts with.
+	Nodes []nodeSpec `yaml:"nodes"`
+	// Splits is the number of times a random range is split before the
+	// first epoch.
+	Splits int `yaml:"splits,omitempty"`
+	// Zone, if set, replaces the default zone config of every range.
+	Zone *config.ZoneConfig `yaml:"zone,omitempty"`
+	// Policy is the name of the allocator policy, either "default" or
+	// "weighted-random". The default policy is used if unset.
+	Policy    string `yaml:"policy,omitempty"`
+	Rebalance bool   `yaml:"rebalance,omitempty"`
+	// Schedule is a failure schedule in the notation of parseSchedule. If
+	// set, it replaces the one given with --schedule.
+	Schedule string `yaml:"schedule,omitempty"`
+	// Growth lists nodes joining the cluster while it runs.
+	Growth []growthSpec `yaml:"growth,omitempty"`
+	// Epochs is the number of epochs the cluster runs for.
+	Epochs int `yaml:"epochs"`
+	// Assert holds the conditions the cluster must meet once it has run.
+	Assert assertSpec `yaml:"assert,omitempty"`
+}
+
+// nodeSpec describes a single node.
+type nodeSpec struct {
+	// Stores is the number of stores of the node, one if unset.
+	Stores int `yaml:"stores,omitempty"`
+	// Locality lists the node's locality tiers, see setLocality.
+	Locality []string `yaml:"locality,flow,omitempty"`
+}
+
+// growthSpec lists nodes added to the cluster at the start of an epoch.
+type growthSpec struct {
+	Epoch int        `yaml:"epoch"`
+	Nodes []nodeSpec `yaml:"nodes"`
+}
+
+// assertSpec holds the conditions checked once a scenarioSpec has run.
+// Thresholds which are unset aren't checked.
+type assertSpec struct {
+	// Replicated requires every range to be at its replication factor.
+	Replicated             bool     `yaml:"replicated,omitempty"`
+	MaxConvergenceScore    *float64 `yaml:"max_convergence_score,omitempty"`
+	MaxRangeCountDeviation *float64 `yaml:"max_range_count_deviation,omitempty"`
+	MaxReplicasMoved       *int     `yaml:"max_replicas_moved,omitempty"`
+	// MaxRecoveryEpochs bounds the epochs taken to fully replicate the
+	// ranges affected by each failure. A failure not yet recovered from
+	// fails the assertion.
+	MaxRecoveryEpochs *int `yaml:"max_recovery_epochs,omitempty"`
+}
+
+// parseSpec parses a scenario spec from YAML. For example:
+//
+//   name: grow-under-failure
+//   nodes:
+//     - {stores: 2, locality: [region=us]}
+//     - {locality: [region=eu]}
+//     - {locality: [region=ap]}
+//   splits: 100
+//   policy: default
+//   rebalance: true
+//   schedule: at epoch 20 kill node 1; at epoch 30 revive node 1
+//   growth:
+//     - epoch: 40
+//       nodes: [{locality: [region=eu]}]
+//   epochs: 100
+//   assert:
+//     replicated: true
+//     max_convergence_score: 0.5
+//     max_recovery_epochs: 30
+//
+// The zone config, if given, has the same format as for "cockroach zone
+// set".
+func parseSpec(b []byte) (*scenarioSpec, error) {
+	spec := &scenarioSpec{}
+	if err := yaml.Unmarshal(b, spec); err != nil {
+		return nil, err
+	}
+	if len(spec.Name) == 0 {
+		return nil, util.Errorf("scenario spec has no name")
+	}
+	if len(spec.Nodes) == 0 {
+		return nil, util.Errorf("scenario %q has no nodes", spec.Name)
+	}
+	if spec.Epochs <= 0 {
+		return nil, util.Errorf("scenario %q must run for at least one epoch, got %d", spec.Name, spec.Epochs)
+	}
+	switch spec.Policy {
+	case "", "default", "weighted-random":
+	default:
+		return nil, util.Errorf("scenario %q has unknown allocator policy %q", spec.Name, spec.Policy)
+	}
+	if spec.Zone != nil {
+		if err := spec.Zone.Validate(); err != nil {
+			return nil, util.Errorf("scenario %q has an invalid zone config: %s", spec.Name, err)
+		}
+	}
+	if _, err := parseSchedule(spec.Schedule); err != nil {
+		return nil, util.Errorf("scenario %q: %s", spec.Name, err)
+	}
+	nodes := append([]nodeSpec(nil), spec.Nodes...)
+	for _, g := range spec.Growth {
+		if g.Epoch <= 0 || g.Epoch > spec.Epochs {
+			return nil, util.Errorf("scenario %q adds nodes at epoch %d, outside of [1, %d]",
+				spec.Name, g.Epoch, spec.Epochs)
+		}
+		nodes = append(nodes, g.Nodes...)
+	}
+	for i, n := range nodes {
+		if n.Stores < 0 {
+			return nil, util.Errorf("scenario %q: node %d has %d stores", spec.Name, i, n.Stores)
+		}
+	}
+	return spec, nil
+}
+
+// scenario returns the scenario which runs the spec.
+func (spec *scenarioSpec) scenario() scenario {
+	return scenario{
+		name:        spec.Name,
+		description: spec.Description,
+		run:         spec.run,
+	}
+}
+
+// addNode adds a node described by n to the cluster.
+func (spec *scenarioSpec) addNode(c *Cluster, n nodeSpec) {
+	nodeID := c.addNewNode()
+	spec.setupNode(c, nodeID, n)
+}
+
+// setupNode adds the stores and locality described by n to the node, which
+// may already have a store.
+func (spec *scenarioSpec) setupNode(c *Cluster, nodeID proto.NodeID, n nodeSpec) {
+	stores := n.Stores
+	if stores == 0 {
+		stores = 1
+	}
+	for len(c.nodes[nodeID].stores) < stores {
+		c.addStore(nodeID)
+	}
+	if len(n.Locality) > 0 {
+		c.setLocality(nodeID, n.Locality...)
+	}
+}
+
+// run builds the spec's cluster, runs it and checks the assertions, returning
+// an error listing those which failed.
+func (spec *scenarioSpec) run(stopper *stop.Stopper) error {
+	c := createCluster(stopper, len(spec.Nodes))
+	for i, n := range spec.Nodes {
+		spec.setupNode(c, proto.NodeID(i), n)
+	}
+	options := storage.RebalancingOptions{AllowRebalance: spec.Rebalance}
+	if spec.Policy == "weighted-random" {
+		c.setAllocator(newWeightedRandomPolicy(c.storePool, options, rand.New(rand.NewSource(c.seed)), c.getStoreDescs))
+	} else {
+		c.setAllocator(newDefaultPolicy(c.storePool, options))
+	}
+	if spec.Zone != nil {
+		c.setZone(*spec.Zone)
+	}
+	if len(spec.Schedule) > 0 {
+		sched, err := parseSchedule(spec.Schedule)
+		if err != nil {
+			return err
+		}
+		c.setSchedule(sched)
+	}
+
+	if len(spec.Description) > 0 {
+		fmt.Printf("%s\n\n", spec.Description)
+	}
+	for i := 0; i < spec.Splits; i++ {
+		c.splitRangeRandom()
+	}
+	fmt.Println(c.StringEpochHeader())
+	for c.epoch < spec.Epochs {
+		for _, g := range spec.Growth {
+			if g.Epoch == c.epoch+1 {
+				for _, n := range g.Nodes {
+					spec.addNode(c, n)
+				}
+				fmt.Printf("Added %d node(s) at epoch %d.\n", len(g.Nodes), g.Epoch)
+			}
+		}
+		c.runEpoch()
+	}
+	fmt.Println(c)
+
+	var failed []string
+	check := func(ok bool, format string, args ...interface{}) {
+		status := "PASS"
+		if !ok {
+			status = "FAIL"
+			failed = append(failed, fmt.Sprintf(format, args...))
+		}
+		fmt.Printf("%s: %s\n", status, fmt.Sprintf(format, args...))
+	}
+	a := spec.Assert
+	if a.Replicated {
+		misreplicated := c.misreplicatedRanges()
+		check(len(misreplicated) == 0, "%d misreplicated range(s) %v", len(misreplicated), misreplicated)
+	}
+	if a.MaxConvergenceScore != nil {
+		score := c.convergenceScore()
+		check(score <= *a.MaxConvergenceScore, "convergence score %.2f <= %.2f", score, *a.MaxConvergenceScore)
+	}
+	if a.MaxRangeCountDeviation != nil {
+		deviation := c.maxRangeCountDeviation()
+		check(deviation <= *a.MaxRangeCountDeviation, "range count deviation %.2f <= %.2f",
+			deviation, *a.MaxRangeCountDeviation)
+	}
+	if a.MaxReplicasMoved != nil {
+		check(c.replicasMoved <= *a.MaxReplicasMoved, "replicas moved %d <= %d", c.replicasMoved, *a.MaxReplicasMoved)
+	}
+	if a.MaxRecoveryEpochs != nil {
+		epochs, ok := c.maxRecoveryEpochs()
+		check(ok && epochs <= *a.MaxRecoveryEpochs, "recovered from every failure within %d <= %d epochs",
+			epochs, *a.MaxRecoveryEpochs)
+	}
+	if len(c.recoveries) > 0 {
+		fmt.Print(c.recoveryString())
+	}
+	if len(failed) > 0 {
+		return util.Errorf("%d assertion(s) failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -22,6 +22,8 @@ import (
 
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
 )
 
 const (
@@ -34,8 +36,43 @@ const (
 // Store is a simulated cockroach store. To access the replicas in a store, use
 // the ranges directly instead.
 type Store struct {
-	desc   proto.StoreDescriptor
-	gossip *gossip.Gossip
+	desc     proto.StoreDescriptor
+	gossip   *gossip.Gossip
+	health   float64
+	draining bool
+	// pendingGC holds the replicas which have been removed from the store
+	// but not yet garbage collected. They continue to occupy space.
+	pendingGC []pendingGC
+	// throughput is the number of bytes the store can absorb each epoch, or
+	// 0 if writes are unlimited. Bytes written beyond the budget accumulate
+	// as debt, which the store catches up on in later epochs.
+	throughput int64
+	written    int64 // bytes written during the current epoch
+	debt       int64
+	// down is set while the store's node is stopped, since the epoch
+	// downSince. A down store neither gossips nor acts on its replicas.
+	down      bool
+	downSince int
+	// gossipFailureRate is the probability that gossiping the store's
+	// descriptor fails in any given epoch, leaving the rest of the cluster
+	// with a stale view of the store. gossipErrors counts the failures.
+	gossipFailureRate float64
+	gossipErrors      int
+	// overcommitted is set while the replicas on the store occupy more than
+	// its capacity.
+	overcommitted bool
+	// snapshots holds the epoch at which each snapshot the store is
+	// receiving completes.
+	snapshots []int
+	// feed, if set, receives the same events a real store publishes.
+	feed *util.Feed
+}
+
+// pendingGC is a removed replica awaiting garbage collection.
+type pendingGC struct {
+	rangeID proto.RangeID
+	bytes   int64
+	gcEpoch int // the epoch at which the replica is collected
 }
 
 // newStore returns a new store with using the passed in ID and node
@@ -47,7 +84,122 @@ func newStore(storeID proto.StoreID, nodeDesc proto.NodeDescriptor, gossip *goss
 			Node:    nodeDesc,
 		},
 		gossip: gossip,
+		health: 1,
+	}
+}
+
+// start publishes a StartStoreEvent for the store to its feed.
+func (s *Store) start(startedAt int64) {
+	s.feed.Publish(&storage.StartStoreEvent{
+		StoreID:   s.desc.StoreID,
+		StartedAt: startedAt,
+	})
+}
+
+// setHealth sets the synthetic health score of the store, ranging from 0
+// (completely unhealthy) to 1 (fully healthy). It is gossiped in the store's
+// descriptor.
+func (s *Store) setHealth(health float64) {
+	s.health = health
+}
+
+// setDraining marks the store as being decommissioned. It is gossiped in the
+// store's descriptor.
+func (s *Store) setDraining(draining bool) {
+	s.draining = draining
+}
+
+// setDown marks the store as stopped, as of the given epoch, or as running
+// again.
+func (s *Store) setDown(down bool, epoch int) {
+	s.down = down
+	s.downSince = epoch
+}
+
+// setGossipFailureRate sets the probability that the store fails to gossip
+// its descriptor in any given epoch. A rate of 1 prevents the store from
+// ever gossiping.
+func (s *Store) setGossipFailureRate(rate float64) {
+	s.gossipFailureRate = rate
+}
+
+// write records that a replica of the given size was written to the store.
+func (s *Store) write(bytes int64) {
+	s.written += bytes
+}
+
+// settleWrites ends the current epoch's writes. Bytes written beyond the
+// store's throughput budget are added to its debt, and any unused budget pays
+// the debt down.
+func (s *Store) settleWrites() {
+	if s.throughput > 0 {
+		s.debt += s.written - s.throughput
+		if s.debt < 0 {
+			s.debt = 0
+		}
+	}
+	s.written = 0
+}
+
+// effectiveHealth returns the store's health score, reduced in proportion to
+// how far it has fallen behind on its writes. A store with a debt equal to
+// its per epoch throughput has half its synthetic health.
+func (s *Store) effectiveHealth() float64 {
+	if s.down {
+		return 0
 	}
+	if s.throughput == 0 || s.debt == 0 {
+		return s.health
+	}
+	return s.health * float64(s.throughput) / float64(s.throughput+s.debt)
+}
+
+// startSnapshot records that the store began receiving a snapshot, which
+// completes at doneEpoch.
+func (s *Store) startSnapshot(doneEpoch int) {
+	s.snapshots = append(s.snapshots, doneEpoch)
+}
+
+// finishSnapshots completes the snapshots due by the given epoch.
+func (s *Store) finishSnapshots(epoch int) {
+	var pending []int
+	for _, doneEpoch := range s.snapshots {
+		if doneEpoch > epoch {
+			pending = append(pending, doneEpoch)
+		}
+	}
+	s.snapshots = pending
+}
+
+// addPendingGC records that the replica of the given range, occupying the
+// given number of bytes, was removed from the store and will be garbage
+// collected at gcEpoch.
+func (s *Store) addPendingGC(rangeID proto.RangeID, bytes int64, gcEpoch int) {
+	s.pendingGC = append(s.pendingGC, pendingGC{rangeID: rangeID, bytes: bytes, gcEpoch: gcEpoch})
+}
+
+// pendingGCBytes returns the number of bytes held by replicas awaiting
+// garbage collection.
+func (s *Store) pendingGCBytes() int64 {
+	var bytes int64
+	for _, p := range s.pendingGC {
+		bytes += p.bytes
+	}
+	return bytes
+}
+
+// gc frees the space of all removed replicas due for collection by the given
+// epoch and returns the number collected.
+func (s *Store) gc(epoch int) int {
+	var remaining []pendingGC
+	for _, p := range s.pendingGC {
+		if p.gcEpoch > epoch {
+			remaining = append(remaining, p)
+		}
+	}
+	collected := len(s.pendingGC) - len(remaining)
+	s.pendingGC = remaining
+	return collected
 }
 
 // getIDs returns the store's ID and its node's IDs.
@@ -55,40 +207,74 @@ func (s *Store) getIDs() (proto.StoreID, proto.NodeID) {
 	return s.desc.StoreID, s.desc.Node.NodeID
 }
 
-// getDesc returns the store descriptor. The rangeCount is required to
-// determine the current capacity.
-func (s *Store) getDesc(rangeCount int) proto.StoreDescriptor {
+// getDesc returns the store descriptor. The rangeCount and usedBytes are
+// required to determine the current capacity. A store which has fallen behind
+// on its writes reports a reduced health.
+func (s *Store) getDesc(rangeCount int, usedBytes int64) proto.StoreDescriptor {
 	desc := s.desc
-	desc.Capacity = s.getCapacity(rangeCount)
+	desc.Capacity = s.getCapacity(rangeCount, usedBytes)
+	health := s.effectiveHealth()
+	desc.Health = &health
+	desc.Draining = s.draining
 	return desc
 }
 
-// getCapacity returns the store capacity based on the numbers of ranges
-// located in the store.
-// TODO(bram): Change this to take the actual ranges for real counts.
-func (s *Store) getCapacity(rangeCount int) proto.StoreCapacity {
+// getCapacity returns the store capacity based on the number of ranges
+// located in the store and the bytes they occupy. Replicas awaiting garbage
+// collection still count against the available capacity.
+func (s *Store) getCapacity(rangeCount int, usedBytes int64) proto.StoreCapacity {
 	return proto.StoreCapacity{
 		Capacity:   capacityPerStore,
-		Available:  capacityPerStore - int64(rangeCount)*bytesPerRange,
+		Available:  capacityPerStore - usedBytes - s.pendingGCBytes(),
 		RangeCount: int32(rangeCount),
+		// Like a real store's uninitialized replicas, the replicas still
+		// receiving their snapshots are reported as incoming.
+		IncomingSnapshots: int32(len(s.snapshots)),
+	}
+}
+
+// checkOvercommit records whether the replicas on the store occupy more than
+// its capacity, logging each time the store becomes overcommitted. The
+// allocator treats an overcommitted store as full.
+func (s *Store) checkOvercommit(rangeCount int, usedBytes int64) {
+	available := s.getCapacity(rangeCount, usedBytes).Available
+	if available < 0 && !s.overcommitted {
+		fmt.Printf("Store %d is overcommitted by %d bytes\n", s.desc.StoreID, -available)
 	}
+	s.overcommitted = available < 0
 }
 
 // String returns the current status of the store in human readable format.
 // Like the getDesc and getCapacity, it requires the number of ranges currently
-// housed in the store.
-func (s *Store) String(rangeCount int) string {
-	desc := s.getDesc(rangeCount)
-	return fmt.Sprintf("Store %d - Node:%d, Replicas:%d, AvailableReplicas:%d, Capacity:%d, Available:%d",
+// housed in the store and the bytes they occupy.
+func (s *Store) String(rangeCount int, usedBytes int64) string {
+	desc := s.getDesc(rangeCount, usedBytes)
+	str := fmt.Sprintf("Store %d - Node:%d, Replicas:%d, AvailableReplicas:%d, Capacity:%d, Available:%d, PendingGC:%d, Health:%.2f, Draining:%t, Debt:%d",
 		desc.StoreID, desc.Node.NodeID, desc.Capacity.RangeCount, desc.Capacity.Available/bytesPerRange,
-		desc.Capacity.Capacity, desc.Capacity.Available)
+		desc.Capacity.Capacity, desc.Capacity.Available, len(s.pendingGC), s.effectiveHealth(), s.draining, s.debt)
+	if desc.Capacity.Available < 0 {
+		str += fmt.Sprintf(", Overcommitted:%d", -desc.Capacity.Available)
+	}
+	if s.down {
+		str += fmt.Sprintf(", DownSince:%d", s.downSince)
+	}
+	if s.gossipErrors > 0 {
+		str += fmt.Sprintf(", GossipErrors:%d", s.gossipErrors)
+	}
+	return str
 }
 
 // GossipStore broadcasts the store on the gossip network.
-func (s *Store) gossipStore(rangeCount int) error {
-	desc := s.getDesc(rangeCount)
+func (s *Store) gossipStore(rangeCount int, usedBytes int64) error {
+	desc := s.getDesc(rangeCount, usedBytes)
 	// Unique gossip key per store.
 	gossipKey := gossip.MakeStoreKey(desc.StoreID)
 	// Gossip store descriptor.
-	return s.gossip.AddInfoProto(gossipKey, &desc, 0)
+	if err := s.gossip.AddInfoProto(gossipKey, &desc, 0); err != nil {
+		return err
+	}
+	// Like a real store, periodically publish the descriptor, which carries
+	// the store's current capacity.
+	s.feed.Publish(&storage.StoreStatusEvent{Desc: &desc})
+	return nil
 }
@@ -0,0 +1,76 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// timelineEvent is a single action taken by the simulated replicate queue.
+type timelineEvent struct {
+	epoch   int
+	rangeID proto.RangeID
+	action  string
+	source  proto.StoreID // store whose replica took the action
+	target  proto.StoreID // store a replica was added to or removed from
+}
+
+// String returns the event in human readable format.
+func (e timelineEvent) String() string {
+	return fmt.Sprintf("%d:\tRange:%d, Action:%s, Source:%d, Target:%d",
+		e.epoch, e.rangeID, e.action, e.source, e.target)
+}
+
+// timeline is a chronological log of every action taken by the simulated
+// replicate queue. It explains how the cluster reached its current state.
+type timeline struct {
+	events []timelineEvent
+}
+
+// record appends an event to the timeline.
+func (tl *timeline) record(epoch int, rangeID proto.RangeID, action string, source, target proto.StoreID) {
+	tl.events = append(tl.events, timelineEvent{
+		epoch:   epoch,
+		rangeID: rangeID,
+		action:  action,
+		source:  source,
+		target:  target,
+	})
+}
+
+// epochString returns the events recorded during the given epoch, one per
+// line.
+func (tl *timeline) epochString(epoch int) string {
+	var buf bytes.Buffer
+	for _, e := range tl.events {
+		if e.epoch == epoch {
+			fmt.Fprintf(&buf, "%s\n", e)
+		}
+	}
+	return buf.String()
+}
+
+// String returns every recorded event, one per line.
+func (tl *timeline) String() string {
+	var buf bytes.Buffer
+	for _, e := range tl.events {
+		fmt.Fprintf(&buf, "%s\n", e)
+	}
+	return buf.String()
+}
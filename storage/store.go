@@ -290,6 +290,7 @@ type Store struct {
 	replicas          map[proto.RangeID]*Replica // Map of replicas by Range ID
 	replicasByKey     *btree.BTree               // btree keyed by ranges end keys.
 	uninitReplicas    map[proto.RangeID]*Replica // Map of uninitialized replicas by Range ID
+	draining          bool                       // Set while the store is being decommissioned
 }
 
 var _ multiraft.Storage = &Store{}
@@ -688,6 +689,17 @@ func (s *Store) GossipStore() {
 	}
 }
 
+// SetDraining marks the store as being decommissioned, or clears the mark,
+// and gossips the change. While the store is draining, the allocator never
+// chooses it as a target for new replicas and moves its replicas to other
+// stores.
+func (s *Store) SetDraining(draining bool) {
+	s.mu.Lock()
+	s.draining = draining
+	s.mu.Unlock()
+	s.GossipStore()
+}
+
 // DisableRangeGCQueue disables or enables the range GC queue.
 // Exposed only for testing.
 func (s *Store) DisableRangeGCQueue(disabled bool) {
@@ -895,6 +907,36 @@ func (s *Store) splitQueue() *splitQueue { return s._splitQueue }
 // rangeGCQueue accessor.
 func (s *Store) rangeGCQueue() *rangeGCQueue { return s._rangeGCQueue }
 
+// QueueBacklog returns the total number of replicas waiting to be
+// processed across all of the store's queues.
+func (s *Store) QueueBacklog() int {
+	return s.gcQueue.Length() + s._splitQueue.Length() + s.verifyQueue.Length() +
+		s.replicateQueue.Length() + s._rangeGCQueue.Length()
+}
+
+// ReplicateQueueRejections returns the number of replicas the store's
+// replicate queue has dropped because it was full. A growing count means
+// repair work is arriving faster than the queue can process it.
+func (s *Store) ReplicateQueueRejections() int64 {
+	return s.replicateQueue.Rejections()
+}
+
+// ReplicateQueueStats returns the number of replicas processed by the
+// store's replicate queue and the time spent processing them, which shows
+// whether slow allocator decisions or replication changes are holding up
+// repair work.
+func (s *Store) ReplicateQueueStats() ReplicateQueueStats {
+	return s.replicateQueue.stats.snapshot()
+}
+
+// SetRangePinned pins or unpins the replicas of the range to their current
+// stores. The replicate queue doesn't remove or rebalance the replicas of a
+// pinned range, though it still adds replicas to it and replaces its dead
+// replicas, logging a warning when it does so.
+func (s *Store) SetRangePinned(rangeID proto.RangeID, pinned bool) {
+	s.replicateQueue.pins.set(rangeID, pinned)
+}
+
 // Stopper accessor.
 func (s *Store) Stopper() *stop.Stopper { return s.stopper }
 
@@ -1148,12 +1190,19 @@ func (s *Store) Descriptor() (*proto.StoreDescriptor, error) {
 		return nil, err
 	}
 	capacity.RangeCount = int32(s.ReplicaCount())
+	// Uninitialized replicas are those still awaiting their initial
+	// snapshot.
+	s.mu.RLock()
+	capacity.IncomingSnapshots = int32(len(s.uninitReplicas))
+	draining := s.draining
+	s.mu.RUnlock()
 	// Initialize the store descriptor.
 	return &proto.StoreDescriptor{
 		StoreID:  s.Ident.StoreID,
 		Attrs:    s.Attrs(),
 		Node:     *s.nodeDesc,
 		Capacity: capacity,
+		Draining: draining,
 	}, nil
 }
 
@@ -142,9 +142,15 @@ type StorePool struct {
 
 	// Each storeDetail is contained in both a map and a priorityQueue; pointers
 	// are used so that data can be kept in sync.
-	mu     sync.RWMutex // Protects stores and queue.
+	mu     sync.RWMutex // Protects stores, queue, reserved and generation.
 	stores map[proto.StoreID]*storeDetail
 	queue  storePoolPQ
+	// reserved holds the bytes allocated to each store since its descriptor
+	// was last gossiped, which its gossiped capacity doesn't yet reflect.
+	reserved map[proto.StoreID]int64
+	// generation is incremented whenever a store becomes dead or alive, or
+	// starts or stops draining.
+	generation int64
 }
 
 // NewStorePool creates a StorePool and registers the store updating callback
@@ -153,6 +159,7 @@ func NewStorePool(g *gossip.Gossip, timeUntilStoreDead time.Duration, stopper *s
 	sp := &StorePool{
 		timeUntilStoreDead: timeUntilStoreDead,
 		stores:             make(map[proto.StoreID]*storeDetail),
+		reserved:           make(map[proto.StoreID]int64),
 	}
 	heap.Init(&sp.queue)
 
@@ -181,6 +188,10 @@ func (sp *StorePool) storeGossipUpdate(_ string, content []byte) {
 		detail = &storeDetail{index: -1}
 		sp.stores[storeDesc.StoreID] = detail
 	}
+	if detail.dead || detail.desc.Draining != storeDesc.Draining {
+		sp.generation++
+	}
+	delete(sp.reserved, storeDesc.StoreID)
 	detail.markAlive(time.Now(), storeDesc, true)
 	sp.queue.enqueue(detail)
 }
@@ -203,6 +214,7 @@ func (sp *StorePool) start(stopper *stop.Stopper) {
 				if now.After(deadAsOf) {
 					deadDetail := sp.queue.dequeue()
 					deadDetail.markDead(now)
+					sp.generation++
 					// The next store might be dead as well, set the timeout to
 					// 0 to process it immediately.
 					timeout = 0
@@ -261,6 +273,80 @@ func (sp *StorePool) getStoreDescriptor(storeID proto.StoreID) *proto.StoreDescr
 	return &desc
 }
 
+// storeHealth returns the health score last gossiped by the given store,
+// ranging from 0 (completely unhealthy) to 1 (fully healthy). A store with a
+// health score below minStoreHealth is still considered live, but will not
+// be chosen as a target for new replicas. Stores are considered fully
+// healthy until they gossip a score.
+func (sp *StorePool) storeHealth(storeID proto.StoreID) float64 {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	detail, ok := sp.stores[storeID]
+	if !ok || detail.desc.Health == nil {
+		return 1
+	}
+	return *detail.desc.Health
+}
+
+// Generation returns a counter which changes whenever any store becomes dead
+// or alive, or starts or stops draining. An allocator action computed for a
+// range remains valid while the generation and the range's inputs are
+// unchanged.
+func (sp *StorePool) Generation() int64 {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.generation
+}
+
+// reserve records that bytes were allocated to the given store. The
+// reservation lasts until the store's descriptor is next gossiped.
+func (sp *StorePool) reserve(storeID proto.StoreID, bytes int64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.reserved[storeID] += bytes
+}
+
+// release returns bytes reserved on the given store for a target which was
+// discarded.
+func (sp *StorePool) release(storeID proto.StoreID, bytes int64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.reserved[storeID] -= bytes; sp.reserved[storeID] <= 0 {
+		delete(sp.reserved, storeID)
+	}
+}
+
+// reservedBytes returns the bytes allocated to the given store since its
+// descriptor was last gossiped.
+func (sp *StorePool) reservedBytes(storeID proto.StoreID) int64 {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.reserved[storeID]
+}
+
+// isDraining returns whether the given store last gossiped that it is
+// draining. A draining store is being decommissioned: it is never chosen as a
+// target for new replicas, and each of its replicas is replaced by one on
+// another store before being removed.
+func (sp *StorePool) isDraining(storeID proto.StoreID) bool {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	detail, ok := sp.stores[storeID]
+	return ok && detail.desc.Draining
+}
+
+// drainingReplicas returns any replicas from the supplied slice that are
+// located on draining stores.
+func (sp *StorePool) drainingReplicas(repls []proto.Replica) []proto.Replica {
+	var drainingReplicas []proto.Replica
+	for _, repl := range repls {
+		if sp.isDraining(repl.StoreID) {
+			drainingReplicas = append(drainingReplicas, repl)
+		}
+	}
+	return drainingReplicas
+}
+
 // findDeadReplicas returns any replicas from the supplied slice that are
 // located on dead stores.
 func (sp *StorePool) deadReplicas(repls []proto.Replica) []proto.Replica {
@@ -273,6 +359,53 @@ func (sp *StorePool) deadReplicas(repls []proto.Replica) []proto.Replica {
 	return deadReplicas
 }
 
+// StoreLiveness is the store pool's view of a single store's liveness.
+type StoreLiveness struct {
+	Dead bool
+	// LastGossiped is when the store's descriptor was last received via
+	// gossip, or the zero time if it never has been. A store is considered
+	// dead once it hasn't been gossiped for timeUntilStoreDead.
+	LastGossiped time.Time
+}
+
+// StoreLiveness returns the current live/dead classification of every store
+// known to the pool, keyed by store ID. It is the same classification which
+// determines the replicas reported as dead to the allocator.
+func (sp *StorePool) StoreLiveness() map[proto.StoreID]StoreLiveness {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	statuses := make(map[proto.StoreID]StoreLiveness, len(sp.stores))
+	for storeID, detail := range sp.stores {
+		status := StoreLiveness{Dead: detail.dead}
+		if detail.gossiped {
+			status.LastGossiped = detail.lastUpdatedTime
+		}
+		statuses[storeID] = status
+	}
+	return statuses
+}
+
+// nodeCapacities returns the aggregate capacity of the live stores on each
+// node, computed from their gossiped store descriptors.
+func (sp *StorePool) nodeCapacities() map[proto.NodeID]proto.StoreCapacity {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	capacities := map[proto.NodeID]proto.StoreCapacity{}
+	for _, detail := range sp.stores {
+		if detail.dead {
+			continue
+		}
+		c := capacities[detail.desc.Node.NodeID]
+		c.Capacity += detail.desc.Capacity.Capacity
+		c.Available += detail.desc.Capacity.Available
+		c.RangeCount += detail.desc.Capacity.RangeCount
+		capacities[detail.desc.Node.NodeID] = c
+	}
+	return capacities
+}
+
 // stat provides a running sample size and mean.
 type stat struct {
 	n, mean float64
@@ -285,11 +418,11 @@ func (s *stat) update(x float64) {
 	s.mean += (x - s.mean) / s.n
 }
 
-// StoreList holds a list of store descriptors and associated count and used
-// stats for those stores.
+// StoreList holds a list of store descriptors and associated count, used
+// and used bytes stats for those stores.
 type StoreList struct {
-	stores      []*proto.StoreDescriptor
-	count, used stat
+	stores                 []*proto.StoreDescriptor
+	count, used, usedBytes stat
 }
 
 // add includes the store descriptor to the list of stores and updates
@@ -298,6 +431,22 @@ func (sl *StoreList) add(s *proto.StoreDescriptor) {
 	sl.stores = append(sl.stores, s)
 	sl.count.update(float64(s.Capacity.RangeCount))
 	sl.used.update(s.Capacity.FractionUsed())
+	sl.usedBytes.update(usedBytes(s))
+}
+
+// meanRangeBytes returns an estimate of the average size of a replica on the
+// stores in the list. This is the granularity at which rebalancing can move
+// bytes between stores.
+func (sl *StoreList) meanRangeBytes() float64 {
+	if sl.count.mean == 0 {
+		return 0
+	}
+	return sl.usedBytes.mean / sl.count.mean
+}
+
+// usedBytes returns the number of bytes used on the store.
+func usedBytes(s *proto.StoreDescriptor) float64 {
+	return float64(s.Capacity.Capacity - s.Capacity.Available)
 }
 
 // GetStoreList returns a storeList that contains all active stores that
@@ -295,6 +295,51 @@ func TestStorePoolGetStoreDetails(t *testing.T) {
 	}
 }
 
+// TestStorePoolStoreLiveness verifies that StoreLiveness reports when each
+// store was last gossiped, and that a store which times out is reported as
+// dead until it is gossiped again.
+func TestStorePoolStoreLiveness(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	stopper, g, sp := createTestStorePool(TestTimeUntilStoreDead)
+	defer stopper.Stop()
+	sg := gossiputil.NewStoreGossiper(g)
+
+	if statuses := sp.StoreLiveness(); len(statuses) != 0 {
+		t.Fatalf("expected no stores before gossip, got %+v", statuses)
+	}
+
+	before := time.Now()
+	sg.GossipStores(uniqueStore, t)
+	status, ok := sp.StoreLiveness()[2]
+	if !ok {
+		t.Fatalf("store 2 isn't in the pool's statuses")
+	}
+	if status.LastGossiped.Before(before) {
+		t.Errorf("expected store 2 to have been gossiped after %s, got %s", before, status.LastGossiped)
+	}
+	lastGossiped := status.LastGossiped
+
+	waitUntilDead(t, sp, 2)
+	if status := sp.StoreLiveness()[2]; !status.Dead {
+		t.Errorf("expected store 2 to be dead, got %+v", status)
+	} else if !status.LastGossiped.Equal(lastGossiped) {
+		t.Errorf("expected store 2 to have last been gossiped at %s, got %s", lastGossiped, status.LastGossiped)
+	}
+
+	sg.GossipStores(uniqueStore, t)
+	if status := sp.StoreLiveness()[2]; status.Dead {
+		t.Errorf("expected store 2 to be alive after gossip, got %+v", status)
+	} else if !status.LastGossiped.After(lastGossiped) {
+		t.Errorf("expected store 2 to have been gossiped after %s, got %s", lastGossiped, status.LastGossiped)
+	}
+
+	// A store which is only known through a replica has never been gossiped.
+	sp.getStoreDetail(3)
+	if status := sp.StoreLiveness()[3]; !status.LastGossiped.IsZero() {
+		t.Errorf("expected store 3 to never have been gossiped, got %+v", status)
+	}
+}
+
 func TestStorePoolFindDeadReplicas(t *testing.T) {
 	defer leaktest.AfterTest(t)
 	stopper, g, sp := createTestStorePool(TestTimeUntilStoreDead)